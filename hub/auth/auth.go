@@ -0,0 +1,184 @@
+/*
+Package auth authenticates the connections to the hub. A client sends its credentials in the Authorization header of the websocket upgrade, either as a shared-secret HMAC token:
+
+	Authorization: HMAC <id>:<unix time>:<signature>
+
+or as a signed JWT:
+
+	Authorization: Bearer <jwt>
+
+or with a client certificate the hub verifies during the TLS handshake, and the hub's Authenticator turns them into the Identity of the connection.
+*/
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//Authentication methods
+const (
+	MethodNone = "none"
+	MethodHMAC = "hmac"
+	MethodJWT  = "jwt"
+	MethodTLS  = "tls"
+)
+
+//Error types
+const (
+	//NoCredentials is the type of the error when the request doesn't have the credentials an authenticator looks for
+	NoCredentials = "no-credentials"
+
+	//Unauthorized is the type of the error when the credentials are wrong
+	Unauthorized = "unauthorized"
+)
+
+//Authorization schemes
+const (
+	SchemeHMAC   = "HMAC"
+	SchemeBearer = "Bearer"
+)
+
+//Identity is who a connection authenticated as
+type Identity struct {
+	Subject string `json:"subject,omitempty"`
+	Method  string `json:"method"`
+}
+
+func (i Identity) String() string {
+	if len(i.Subject) == 0 {
+		return i.Method
+	}
+	return fmt.Sprintf("%v (%v)", i.Subject, i.Method)
+}
+
+//Authenticator checks the credentials on a request to connect as connType
+type Authenticator interface {
+	Authenticate(req *http.Request, connType string) (Identity, *nerr.E)
+}
+
+//None lets every request through, it's what the hub uses when authentication isn't configured. Requests with a verified client certificate still get its identity
+type None struct{}
+
+//Authenticate .
+func (None) Authenticate(req *http.Request, connType string) (Identity, *nerr.E) {
+	if id, err := (TLS{}).Authenticate(req, connType); err == nil {
+		return id, nil
+	}
+	return Identity{Method: MethodNone}, nil
+}
+
+//Any lets a request through if any of its authenticators do
+type Any []Authenticator
+
+//Authenticate returns the identity from the first authenticator that accepts the request. If none do, it returns the error from the one that understood the credentials
+func (a Any) Authenticate(req *http.Request, connType string) (Identity, *nerr.E) {
+	toReturn := nerr.Create("no credentials", NoCredentials)
+	for i := range a {
+		id, err := a[i].Authenticate(req, connType)
+		if err == nil {
+			return id, nil
+		}
+
+		if err.Type != NoCredentials {
+			toReturn = err
+		}
+	}
+	return Identity{}, toReturn
+}
+
+//FromEnv builds the hub's authenticator from HUB_AUTH, a comma separated list of the methods to accept (hmac, jwt, tls), and the settings for each:
+//	HUB_AUTH_HMAC_SECRETS   comma separated shared secrets, more than one lets the secret be rotated
+//	HUB_AUTH_HMAC_MAX_AGE   how old a token may be, defaults to DefaultMaxAge
+//	HUB_AUTH_JWT_SECRETS    comma separated secrets for HS256/384/512 tokens
+//	HUB_AUTH_JWT_KEYS       comma separated PEM files with the public keys for RS and ES tokens
+//	HUB_AUTH_JWT_ISSUER     the iss tokens must have, if set
+//	HUB_AUTH_JWT_AUDIENCE   the aud tokens must have, if set
+//tls has no settings of its own, it needs client certificate verification turned on (see certs.FromEnv).
+//Without HUB_AUTH every connection is let through
+func FromEnv() (Authenticator, *nerr.E) {
+	methods := split(os.Getenv("HUB_AUTH"))
+	if len(methods) == 0 {
+		return None{}, nil
+	}
+
+	toReturn := Any{}
+	for _, m := range methods {
+		switch strings.ToLower(m) {
+		case MethodNone:
+			return None{}, nil
+
+		case MethodHMAC:
+			h := &HMAC{
+				MaxAge: DefaultMaxAge,
+			}
+			for _, s := range split(os.Getenv("HUB_AUTH_HMAC_SECRETS")) {
+				h.Secrets = append(h.Secrets, []byte(s))
+			}
+			if v := os.Getenv("HUB_AUTH_HMAC_MAX_AGE"); len(v) > 0 {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					return nil, nerr.Create(fmt.Sprintf("invalid HUB_AUTH_HMAC_MAX_AGE %v", v), "invalid")
+				}
+				h.MaxAge = d
+			}
+			if len(h.Secrets) == 0 {
+				return nil, nerr.Create("HUB_AUTH_HMAC_SECRETS must be set to use hmac authentication", "invalid")
+			}
+			toReturn = append(toReturn, h)
+
+		case MethodJWT:
+			j := &JWT{
+				Issuer:   os.Getenv("HUB_AUTH_JWT_ISSUER"),
+				Audience: os.Getenv("HUB_AUTH_JWT_AUDIENCE"),
+				Leeway:   DefaultLeeway,
+			}
+			for _, s := range split(os.Getenv("HUB_AUTH_JWT_SECRETS")) {
+				j.Secrets = append(j.Secrets, []byte(s))
+			}
+			for _, path := range split(os.Getenv("HUB_AUTH_JWT_KEYS")) {
+				keys, err := LoadPublicKeys(path)
+				if err != nil {
+					return nil, err
+				}
+				j.Keys = append(j.Keys, keys...)
+			}
+			if len(j.Secrets) == 0 && len(j.Keys) == 0 {
+				return nil, nerr.Create("HUB_AUTH_JWT_SECRETS or HUB_AUTH_JWT_KEYS must be set to use jwt authentication", "invalid")
+			}
+			toReturn = append(toReturn, j)
+
+		case MethodTLS:
+			toReturn = append(toReturn, TLS{})
+
+		default:
+			return nil, nerr.Create(fmt.Sprintf("unknown authentication method %v", m), "invalid")
+		}
+	}
+
+	return toReturn, nil
+}
+
+//authorization returns the credentials in the request's Authorization header for the scheme, and false if it's using a different scheme
+func authorization(req *http.Request, scheme string) (string, bool) {
+	v := req.Header.Get("Authorization")
+	if len(v) <= len(scheme) || !strings.EqualFold(v[:len(scheme)], scheme) || v[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(v[len(scheme)+1:]), true
+}
+
+func split(v string) []string {
+	toReturn := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			toReturn = append(toReturn, s)
+		}
+	}
+	return toReturn
+}
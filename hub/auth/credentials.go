@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//Credentials are what a client sends the hub to connect
+type Credentials interface {
+	//Authorization returns the value of the Authorization header for connecting as connType
+	Authorization(connType string) (string, *nerr.E)
+}
+
+//Token is a JWT (or any other bearer token) the client sends as is
+type Token string
+
+//Authorization .
+func (t Token) Authorization(string) (string, *nerr.E) {
+	return SchemeBearer + " " + string(t), nil
+}
+
+//HMACCredentials sign a new HMAC token each time the client connects
+type HMACCredentials struct {
+	ID     string
+	Secret []byte
+}
+
+//Authorization .
+func (c HMACCredentials) Authorization(connType string) (string, *nerr.E) {
+	if len(c.ID) == 0 {
+		return "", nerr.Create("no ID to sign an HMAC token for", "invalid")
+	}
+	return SchemeHMAC + " " + NewHMACToken(c.Secret, c.ID, connType, time.Now()), nil
+}
+
+//CredentialsFromEnv returns the credentials in HUB_AUTH_TOKEN, or the HMAC credentials for HUB_AUTH_ID (or defaultID, or the hostname) and HUB_AUTH_SECRET. Returns nil if neither are set
+func CredentialsFromEnv(defaultID string) Credentials {
+	if v := os.Getenv("HUB_AUTH_TOKEN"); len(v) > 0 {
+		return Token(v)
+	}
+
+	secret := os.Getenv("HUB_AUTH_SECRET")
+	if len(secret) == 0 {
+		return nil
+	}
+
+	id := os.Getenv("HUB_AUTH_ID")
+	if len(id) == 0 {
+		id = defaultID
+	}
+	if len(id) == 0 {
+		id, _ = os.Hostname()
+	}
+
+	return HMACCredentials{
+		ID:     id,
+		Secret: []byte(secret),
+	}
+}
+
+//SetCredentials sets the Authorization header for connecting as connType. Nil credentials leave the header alone
+func SetCredentials(h http.Header, c Credentials, connType string) *nerr.E {
+	if c == nil {
+		return nil
+	}
+
+	v, err := c.Authorization(connType)
+	if err != nil {
+		return err
+	}
+
+	h.Set("Authorization", v)
+	return nil
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//DefaultMaxAge is how old an HMAC token may be before the hub turns it away
+const DefaultMaxAge = 5 * time.Minute
+
+//HMAC authenticates the HMAC tokens signed with one of the shared secrets.
+//A token is <id>:<unix time>:<signature>, where the signature is the base64url encoded HMAC-SHA256 of <id>:<connection type>:<unix time>, so a token only works for the connection type it was made for.
+//The unix time may have a fraction of a second. With a MaxAge, each token is only accepted once
+type HMAC struct {
+	Secrets [][]byte
+	MaxAge  time.Duration
+
+	//seen is when each token that's been accepted stops being valid, so it can't be replayed until then
+	lock   sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+//Authenticate .
+func (h *HMAC) Authenticate(req *http.Request, connType string) (Identity, *nerr.E) {
+	token, ok := authorization(req, SchemeHMAC)
+	if !ok {
+		return Identity{}, nerr.Create("no HMAC token", NoCredentials)
+	}
+
+	//the ID may have a ':' in it, the time and signature can't
+	last := strings.LastIndex(token, ":")
+	if last <= 0 {
+		return Identity{}, nerr.Create("malformed HMAC token", Unauthorized)
+	}
+	mid := strings.LastIndex(token[:last], ":")
+	if mid <= 0 {
+		return Identity{}, nerr.Create("malformed HMAC token", Unauthorized)
+	}
+	id, ts, sig := token[:mid], token[mid+1:last], token[last+1:]
+
+	signed, err := parseHMACTime(ts)
+	if err != nil {
+		return Identity{}, nerr.Create("malformed HMAC token", Unauthorized)
+	}
+
+	now := time.Now()
+	age := now.Sub(signed)
+	if age < 0 {
+		age = -age
+	}
+	if h.MaxAge > 0 && age > h.MaxAge {
+		return Identity{}, nerr.Create(fmt.Sprintf("HMAC token for %v is %v old", id, age.Round(time.Second)), Unauthorized)
+	}
+
+	given, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return Identity{}, nerr.Create("malformed HMAC token", Unauthorized)
+	}
+
+	for i := range h.Secrets {
+		if hmac.Equal(given, signHMAC(h.Secrets[i], id, connType, ts)) {
+			if !h.first(token, signed, now) {
+				return Identity{}, nerr.Create(fmt.Sprintf("HMAC token for %v has already been used", id), Unauthorized)
+			}
+			return Identity{Subject: id, Method: MethodHMAC}, nil
+		}
+	}
+
+	return Identity{}, nerr.Create(fmt.Sprintf("invalid HMAC token for %v", id), Unauthorized)
+}
+
+//first records that the token signed at signed was accepted, and returns false if it already has been. Tokens are forgotten once they're too old to be accepted anyway
+func (h *HMAC) first(token string, signed, now time.Time) bool {
+	if h.MaxAge <= 0 {
+		return true
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.seen == nil {
+		h.seen = make(map[string]time.Time)
+	}
+	if now.Sub(h.pruned) > time.Second {
+		for k, until := range h.seen {
+			if now.After(until) {
+				delete(h.seen, k)
+			}
+		}
+		h.pruned = now
+	}
+
+	if _, ok := h.seen[token]; ok {
+		return false
+	}
+	h.seen[token] = signed.Add(h.MaxAge)
+	return true
+}
+
+//NewHMACToken returns a token for the ID to connect as connType, signed with the secret. The time is down to the microsecond, so the tokens made for a client one after the other are different
+func NewHMACToken(secret []byte, id, connType string, t time.Time) string {
+	ts := fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+	return fmt.Sprintf("%v:%v:%v", id, ts, base64.RawURLEncoding.EncodeToString(signHMAC(secret, id, connType, ts)))
+}
+
+//parseHMACTime reads a token's unix time, which may have a fraction of a second
+func parseHMACTime(ts string) (time.Time, error) {
+	sec, frac := ts, ""
+	if i := strings.Index(ts, "."); i >= 0 {
+		sec, frac = ts[:i], ts[i+1:]
+	}
+
+	unix, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if len(frac) > 0 {
+		if len(frac) > 9 {
+			return time.Time{}, fmt.Errorf("too many digits in %v", ts)
+		}
+		nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil || strings.HasPrefix(frac, "-") || strings.HasPrefix(frac, "+") {
+			return time.Time{}, fmt.Errorf("invalid fraction in %v", ts)
+		}
+	}
+	return time.Unix(unix, nsec), nil
+}
+
+//signHMAC signs the token's ID, connection type and time, as the time appears in the token
+func signHMAC(secret []byte, id, connType, ts string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%v:%v:%v", id, connType, ts)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//authenticate authenticates a request to connect as connType with the Authorization header, and returns the identity and the type of the error
+func authenticate(a Authenticator, authorization, connType string) (Identity, string) {
+	req := httptest.NewRequest("GET", "/connect/"+connType, nil)
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	id, err := a.Authenticate(req, connType)
+	if err != nil {
+		return id, err.Type
+	}
+	return id, ""
+}
+
+func TestHMAC(t *testing.T) {
+	secret := []byte("the-secret")
+	now := time.Now()
+
+	//a token from a client that only sends whole seconds
+	unix := fmt.Sprint(now.Unix())
+	seconds := fmt.Sprintf("ITB-1101-CP1:%v:%v", unix, base64.RawURLEncoding.EncodeToString(signHMAC(secret, "ITB-1101-CP1", "messenger", unix)))
+
+	tests := []struct {
+		name          string
+		authorization string
+		connType      string
+		err           string
+	}{
+		{"a valid token", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now), "messenger", ""},
+		{"an ID with a colon", "HMAC " + NewHMACToken(secret, "host:7100", "messenger", now), "messenger", ""},
+		{"a token in whole seconds", "HMAC " + seconds, "messenger", ""},
+		{"the rotated secret", "HMAC " + NewHMACToken([]byte("the-old-secret"), "ITB-1101-CP1", "messenger", now), "messenger", ""},
+		{"the scheme in lower case", "hmac " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now.Add(time.Millisecond)), "messenger", ""},
+		{"the wrong secret", "HMAC " + NewHMACToken([]byte("another-secret"), "ITB-1101-CP1", "messenger", now), "messenger", Unauthorized},
+		{"another connection type", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now), "hub", Unauthorized},
+		{"a changed ID", "HMAC ITB-1101-CP2" + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now)[len("ITB-1101-CP1"):], "messenger", Unauthorized},
+		{"a changed time", "HMAC " + seconds[:len("ITB-1101-CP1:")] + fmt.Sprint(now.Unix()+1) + seconds[len("ITB-1101-CP1:")+len(unix):], "messenger", Unauthorized},
+		{"a changed signature", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now) + "A", "messenger", Unauthorized},
+		{"a token that's too old", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now.Add(-6*time.Minute)), "messenger", Unauthorized},
+		{"a token from a clock that's ahead", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now.Add(2*time.Minute)), "messenger", ""},
+		{"a token from a clock that's too far ahead", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now.Add(6*time.Minute)), "messenger", Unauthorized},
+		{"a token from a clock that's behind", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", now.Add(-2*time.Minute)), "messenger", ""},
+		{"no Authorization header", "", "messenger", NoCredentials},
+		{"a bearer token", "Bearer abc", "messenger", NoCredentials},
+		{"no token", "HMAC ", "messenger", Unauthorized},
+		{"only an ID", "HMAC ITB-1101-CP1", "messenger", Unauthorized},
+		{"no ID", "HMAC :" + unix + ":abc", "messenger", Unauthorized},
+		{"a time that isn't a number", "HMAC ITB-1101-CP1:yesterday:abc", "messenger", Unauthorized},
+		{"a fraction that isn't a number", "HMAC ITB-1101-CP1:" + unix + ".-5:abc", "messenger", Unauthorized},
+		{"a signature that isn't base64", "HMAC ITB-1101-CP1:" + unix + ":!!!", "messenger", Unauthorized},
+	}
+
+	h := &HMAC{
+		Secrets: [][]byte{secret, []byte("the-old-secret")},
+		MaxAge:  DefaultMaxAge,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(h, tt.authorization, tt.connType)
+			if err != tt.err {
+				t.Fatalf("got error %q, want %q", err, tt.err)
+			}
+			if len(err) == 0 && (id.Method != MethodHMAC || len(id.Subject) == 0) {
+				t.Fatalf("got identity %+v", id)
+			}
+		})
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+	secret := []byte("the-secret")
+	h := &HMAC{
+		Secrets: [][]byte{secret},
+		MaxAge:  DefaultMaxAge,
+	}
+
+	token := "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", time.Now())
+	if _, err := authenticate(h, token, "messenger"); len(err) > 0 {
+		t.Fatalf("the token was turned away the first time: %v", err)
+	}
+	if _, err := authenticate(h, token, "messenger"); err != Unauthorized {
+		t.Fatalf("got error %q when the token was used again, want %q", err, Unauthorized)
+	}
+
+	//tokens made one after the other are all different
+	creds := HMACCredentials{ID: "ITB-1101-CP1", Secret: secret}
+	for i := 0; i < 100; i++ {
+		v, nerr := creds.Authorization("messenger")
+		if nerr != nil {
+			t.Fatalf("couldn't make a token: %v", nerr.Error())
+		}
+		if _, err := authenticate(h, v, "messenger"); len(err) > 0 {
+			t.Fatalf("token %v was turned away: %v", i, err)
+		}
+	}
+
+	//once a token is too old to be accepted anyway, it's forgotten
+	h.lock.Lock()
+	for k := range h.seen {
+		h.seen[k] = time.Now().Add(-time.Second)
+	}
+	h.pruned = time.Time{}
+	h.lock.Unlock()
+
+	if h.first("another", time.Now(), time.Now()); len(h.seen) != 1 {
+		t.Fatalf("%v tokens are remembered, want 1", len(h.seen))
+	}
+
+	//without a max age every token is accepted, and nothing is remembered
+	h = &HMAC{Secrets: [][]byte{secret}}
+	for i := 0; i < 2; i++ {
+		if _, err := authenticate(h, token, "messenger"); len(err) > 0 {
+			t.Fatalf("the token was turned away without a max age: %v", err)
+		}
+	}
+	if len(h.seen) != 0 {
+		t.Fatalf("%v tokens are remembered without a max age", len(h.seen))
+	}
+}
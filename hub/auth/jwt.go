@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//DefaultLeeway is how far the hub's clock may be off from the token issuer's when checking exp and nbf
+const DefaultLeeway = 30 * time.Second
+
+//JWT authenticates signed JSON web tokens. HS256/384/512 tokens are checked against Secrets, and RS and ES tokens against Keys; unsigned tokens are never accepted.
+//The identity is the token's sub. A token with a types claim (a list of connection types) may only be used to connect as one of them
+type JWT struct {
+	Secrets [][]byte
+	Keys    []crypto.PublicKey
+
+	//Issuer and Audience are the iss and aud a token must have, if they're set
+	Issuer   string
+	Audience string
+
+	Leeway time.Duration
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt float64         `json:"exp"`
+	NotBefore float64         `json:"nbf"`
+	Types     []string        `json:"types"`
+}
+
+//Authenticate .
+func (j *JWT) Authenticate(req *http.Request, connType string) (Identity, *nerr.E) {
+	token, ok := authorization(req, SchemeBearer)
+	if !ok {
+		return Identity{}, nerr.Create("no bearer token", NoCredentials)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, nerr.Create("malformed jwt", Unauthorized)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, nerr.Create("malformed jwt signature", Unauthorized)
+	}
+
+	if err := j.verify(header.Alg, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return Identity{}, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, err
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt > 0 && now.After(unixTime(claims.ExpiresAt).Add(j.Leeway)) {
+		return Identity{}, nerr.Create(fmt.Sprintf("jwt for %v has expired", claims.Subject), Unauthorized)
+	}
+	if claims.NotBefore > 0 && now.Add(j.Leeway).Before(unixTime(claims.NotBefore)) {
+		return Identity{}, nerr.Create(fmt.Sprintf("jwt for %v isn't valid yet", claims.Subject), Unauthorized)
+	}
+	if len(j.Issuer) > 0 && claims.Issuer != j.Issuer {
+		return Identity{}, nerr.Create(fmt.Sprintf("jwt for %v has the wrong issuer %q", claims.Subject, claims.Issuer), Unauthorized)
+	}
+	if len(j.Audience) > 0 && !hasAudience(claims.Audience, j.Audience) {
+		return Identity{}, nerr.Create(fmt.Sprintf("jwt for %v isn't for audience %q", claims.Subject, j.Audience), Unauthorized)
+	}
+	if len(claims.Types) > 0 && !contains(claims.Types, connType) {
+		return Identity{}, nerr.Create(fmt.Sprintf("jwt for %v doesn't allow connecting as a %v", claims.Subject, connType), Unauthorized)
+	}
+
+	return Identity{Subject: claims.Subject, Method: MethodJWT}, nil
+}
+
+//verify checks the signature with each of the secrets or keys for the algorithm
+func (j *JWT) verify(alg string, signed, sig []byte) *nerr.E {
+	//"none" and anything else that isn't HS, RS, or ES with a hash size is turned away
+	if len(alg) != 5 {
+		return nerr.Create(fmt.Sprintf("unsupported jwt algorithm %q", alg), Unauthorized)
+	}
+
+	var newHash func() hash.Hash
+	var h crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		newHash, h = sha256.New, crypto.SHA256
+	case "384":
+		newHash, h = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, h = sha512.New, crypto.SHA512
+	default:
+		return nerr.Create(fmt.Sprintf("unsupported jwt algorithm %q", alg), Unauthorized)
+	}
+
+	switch alg[:len(alg)-3] {
+	case "HS":
+		for i := range j.Secrets {
+			mac := hmac.New(newHash, j.Secrets[i])
+			mac.Write(signed)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return nil
+			}
+		}
+
+	case "RS", "ES":
+		d := newHash()
+		d.Write(signed)
+		digest := d.Sum(nil)
+
+		for i := range j.Keys {
+			switch key := j.Keys[i].(type) {
+			case *rsa.PublicKey:
+				if alg[0] == 'R' && rsa.VerifyPKCS1v15(key, h, digest, sig) == nil {
+					return nil
+				}
+			case *ecdsa.PublicKey:
+				//the signature is r and s, each the size of the curve
+				size := (key.Curve.Params().BitSize + 7) / 8
+				if alg[0] == 'E' && len(sig) == 2*size {
+					r := new(big.Int).SetBytes(sig[:size])
+					s := new(big.Int).SetBytes(sig[size:])
+					if ecdsa.Verify(key, digest, r, s) {
+						return nil
+					}
+				}
+			}
+		}
+
+	default:
+		return nerr.Create(fmt.Sprintf("unsupported jwt algorithm %q", alg), Unauthorized)
+	}
+
+	return nerr.Create("invalid jwt signature", Unauthorized)
+}
+
+//LoadPublicKeys reads the public keys (PKIX or PKCS1 public keys, or certificates) in a PEM file
+func LoadPublicKeys(path string) ([]crypto.PublicKey, *nerr.E) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't read jwt keys from %v", path)
+	}
+
+	toReturn := []crypto.PublicKey{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, nerr.Translate(err).Addf("couldn't parse a jwt key in %v", path)
+		}
+
+		toReturn = append(toReturn, key)
+	}
+
+	if len(toReturn) == 0 {
+		return nil, nerr.Create(fmt.Sprintf("no public keys in %v", path), "invalid")
+	}
+	return toReturn, nil
+}
+
+func decodeSegment(seg string, v interface{}) *nerr.E {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return nerr.Create("malformed jwt", Unauthorized)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nerr.Create("malformed jwt", Unauthorized)
+	}
+	return nil
+}
+
+func unixTime(v float64) time.Time {
+	return time.Unix(int64(v), 0)
+}
+
+//hasAudience returns true if aud, which may be a string or a list of them, has the audience
+func hasAudience(aud json.RawMessage, audience string) bool {
+	var one string
+	if err := json.Unmarshal(aud, &one); err == nil {
+		return one == audience
+	}
+
+	var many []string
+	if err := json.Unmarshal(aud, &many); err == nil {
+		return contains(many, audience)
+	}
+	return false
+}
+
+func contains(v []string, s string) bool {
+	for i := range v {
+		if v[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newJWT signs the claims with the key for the algorithm: a []byte for HS, and an *rsa.PrivateKey or *ecdsa.PrivateKey for RS and ES.
+//The algorithm in the header is alg, which doesn't have to be the one the token is signed with
+func newJWT(t *testing.T, alg string, signWith string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("couldn't marshal the header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("couldn't marshal the claims: %v", err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var newHash func() hash.Hash
+	var h crypto.Hash
+	switch signWith[2:] {
+	case "256":
+		newHash, h = sha256.New, crypto.SHA256
+	case "384":
+		newHash, h = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, h = sha512.New, crypto.SHA512
+	}
+
+	var sig []byte
+	switch k := key.(type) {
+	case nil:
+	case []byte:
+		mac := hmac.New(newHash, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		d := newHash()
+		d.Write([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, h, d.Sum(nil))
+	case *ecdsa.PrivateKey:
+		d := newHash()
+		d.Write([]byte(signed))
+		r, s, serr := ecdsa.Sign(rand.Reader, k, d.Sum(nil))
+		err = serr
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatalf("couldn't sign the token: %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("the-secret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate an rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate an ecdsa key: %v", err)
+	}
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate an ecdsa key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate an ecdsa key: %v", err)
+	}
+
+	//the rsa public key as the hub would have it in a PEM file, which an attacker knows
+	rsaDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("couldn't marshal the rsa key: %v", err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaDER})
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "ITB-1101-CP1",
+			"iss": "av-auth",
+			"aud": "event-hub",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	valid := claims(nil)
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"HS256", newJWT(t, "HS256", "HS256", secret, valid), ""},
+		{"HS384", newJWT(t, "HS384", "HS384", secret, valid), ""},
+		{"HS512", newJWT(t, "HS512", "HS512", secret, valid), ""},
+		{"the rotated secret", newJWT(t, "HS256", "HS256", []byte("the-old-secret"), valid), ""},
+		{"RS256", newJWT(t, "RS256", "RS256", rsaKey, valid), ""},
+		{"RS512", newJWT(t, "RS512", "RS512", rsaKey, valid), ""},
+		{"ES256", newJWT(t, "ES256", "ES256", ecKey, valid), ""},
+		{"ES384", newJWT(t, "ES384", "ES384", ec384Key, valid), ""},
+		{"an audience list", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"aud": []string{"another-service", "event-hub"}})), ""},
+		{"the connection type", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"types": []string{"messenger", "repeater"}})), ""},
+		{"just expired, within the leeway", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), ""},
+		{"not valid for a few seconds, within the leeway", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(10 * time.Second).Unix()})), ""},
+		{"no exp or nbf", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"exp": nil, "nbf": nil})), ""},
+
+		{"alg none", newJWT(t, "none", "HS256", nil, valid), Unauthorized},
+		{"alg None", newJWT(t, "None", "HS256", nil, valid), Unauthorized},
+		{"alg none with a signature", newJWT(t, "none", "HS256", secret, valid), Unauthorized},
+		{"no alg", newJWT(t, "", "HS256", secret, valid), Unauthorized},
+		{"an unknown alg", newJWT(t, "PS256", "RS256", rsaKey, valid), Unauthorized},
+		{"HS256 signed with the rsa public key", newJWT(t, "HS256", "HS256", rsaPEM, valid), Unauthorized},
+		{"HS256 signed with the rsa public key's DER", newJWT(t, "HS256", "HS256", rsaDER, valid), Unauthorized},
+		{"an rsa signature as ES256", newJWT(t, "ES256", "RS256", rsaKey, valid), Unauthorized},
+		{"an ecdsa signature as RS256", newJWT(t, "RS256", "ES256", ecKey, valid), Unauthorized},
+		{"an HS256 signature as HS512", newJWT(t, "HS512", "HS256", secret, valid), Unauthorized},
+		{"the wrong secret", newJWT(t, "HS256", "HS256", []byte("another-secret"), valid), Unauthorized},
+		{"a key the hub doesn't have", newJWT(t, "ES256", "ES256", otherKey, valid), Unauthorized},
+		{"expired", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), Unauthorized},
+		{"not valid yet", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), Unauthorized},
+		{"the wrong issuer", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"iss": "someone-else"})), Unauthorized},
+		{"no issuer", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"iss": nil})), Unauthorized},
+		{"the wrong audience", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"aud": "another-service"})), Unauthorized},
+		{"an audience list without the hub", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"aud": []string{"another-service"}})), Unauthorized},
+		{"no audience", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"aud": nil})), Unauthorized},
+		{"another connection type", newJWT(t, "HS256", "HS256", secret, claims(map[string]interface{}{"types": []string{"hub"}})), Unauthorized},
+		{"two segments", "abc.def", Unauthorized},
+		{"four segments", newJWT(t, "HS256", "HS256", secret, valid) + ".abc", Unauthorized},
+		{"a header that isn't base64", "!!!." + strings.SplitN(newJWT(t, "HS256", "HS256", secret, valid), ".", 2)[1], Unauthorized},
+		{"a header that isn't json", base64.RawURLEncoding.EncodeToString([]byte("HS256")) + "." + strings.SplitN(newJWT(t, "HS256", "HS256", secret, valid), ".", 2)[1], Unauthorized},
+		{"a signature that isn't base64", newJWT(t, "HS256", "HS256", secret, valid) + "!", Unauthorized},
+		{"a changed payload", func() string {
+			parts := strings.Split(newJWT(t, "HS256", "HS256", secret, valid), ".")
+			other := strings.Split(newJWT(t, "HS256", "HS256", []byte("another-secret"), claims(map[string]interface{}{"sub": "admin"})), ".")
+			return parts[0] + "." + other[1] + "." + parts[2]
+		}(), Unauthorized},
+		{"claims that aren't json", func() string {
+			//signed correctly, so it's the claims that are turned away
+			signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte("not json"))
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(signed))
+			return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}(), Unauthorized},
+	}
+
+	j := &JWT{
+		Secrets:  [][]byte{secret, []byte("the-old-secret")},
+		Keys:     []crypto.PublicKey{&rsaKey.PublicKey, &ecKey.PublicKey, &ec384Key.PublicKey},
+		Issuer:   "av-auth",
+		Audience: "event-hub",
+		Leeway:   DefaultLeeway,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(j, "Bearer "+tt.token, "messenger")
+			if err != tt.err {
+				t.Fatalf("got error %q, want %q", err, tt.err)
+			}
+			if len(err) == 0 && (id.Method != MethodJWT || id.Subject != "ITB-1101-CP1") {
+				t.Fatalf("got identity %+v", id)
+			}
+		})
+	}
+
+	if _, err := authenticate(j, "", "messenger"); err != NoCredentials {
+		t.Fatalf("got error %q without a token, want %q", err, NoCredentials)
+	}
+	if _, err := authenticate(j, "HMAC abc", "messenger"); err != NoCredentials {
+		t.Fatalf("got error %q with an HMAC token, want %q", err, NoCredentials)
+	}
+}
+
+//TestJWTKeysOnly checks a hub with only public keys doesn't accept HS tokens signed with them
+func TestJWTKeysOnly(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate an rsa key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("couldn't marshal the rsa key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatalf("couldn't write the keys: %v", err)
+	}
+
+	keys, nerr := LoadPublicKeys(path)
+	if nerr != nil {
+		t.Fatalf("couldn't load the keys: %v", nerr.Error())
+	}
+	j := &JWT{Keys: keys}
+
+	claims := map[string]interface{}{"sub": "ITB-1101-CP1"}
+	if _, err := authenticate(j, "Bearer "+newJWT(t, "RS256", "RS256", rsaKey, claims), "messenger"); len(err) > 0 {
+		t.Fatalf("an RS256 token was turned away: %v", err)
+	}
+	for _, secret := range [][]byte{pemBytes, der, nil} {
+		if _, err := authenticate(j, "Bearer "+newJWT(t, "HS256", "HS256", secret, claims), "messenger"); err != Unauthorized {
+			t.Fatalf("got error %q for an HS256 token signed with the public key, want %q", err, Unauthorized)
+		}
+	}
+}
+
+func TestAny(t *testing.T) {
+	secret := []byte("the-secret")
+	a := Any{
+		&HMAC{Secrets: [][]byte{secret}, MaxAge: DefaultMaxAge},
+		&JWT{Secrets: [][]byte{secret}},
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		err           string
+	}{
+		{"an HMAC token", "HMAC " + NewHMACToken(secret, "ITB-1101-CP1", "messenger", time.Now()), MethodHMAC, ""},
+		{"a jwt", "Bearer " + newJWT(t, "HS256", "HS256", secret, map[string]interface{}{"sub": "ITB-1101-CP1"}), MethodJWT, ""},
+		{"a bad jwt", "Bearer " + newJWT(t, "none", "HS256", nil, map[string]interface{}{"sub": "ITB-1101-CP1"}), "", Unauthorized},
+		{"no credentials", "", "", NoCredentials},
+		{"an unknown scheme", "Basic abc", "", NoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(a, tt.authorization, "messenger")
+			if err != tt.err || id.Method != tt.method {
+				t.Fatalf("got %+v and error %q, want method %q and error %q", id, err, tt.method, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//TLS authenticates the client certificate the hub verified during the TLS handshake (see the certs package for turning verification on).
+//The identity is the certificate's common name, or its first DNS name if it doesn't have one
+type TLS struct{}
+
+//Authenticate .
+func (TLS) Authenticate(req *http.Request, connType string) (Identity, *nerr.E) {
+	subject, ok := PeerSubject(req)
+	if !ok {
+		return Identity{}, nerr.Create("no verified client certificate", NoCredentials)
+	}
+	return Identity{Subject: subject, Method: MethodTLS}, nil
+}
+
+//PeerSubject returns the subject of the verified client certificate on the request, and false if it doesn't have one
+func PeerSubject(req *http.Request) (string, bool) {
+	return ConnectionSubject(req.TLS)
+}
+
+//ConnectionSubject returns the subject of the other end's verified certificate on the TLS connection, and false if it doesn't have one
+func ConnectionSubject(cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	cert := cs.VerifiedChains[0][0]
+	switch {
+	case len(cert.Subject.CommonName) > 0:
+		return cert.Subject.CommonName, true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	}
+	return cert.Subject.String(), true
+}
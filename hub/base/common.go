@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/byuoitav/central-event-system/hub/filter"
 	"github.com/byuoitav/common/log"
 	"github.com/byuoitav/common/nerr"
 	"github.com/byuoitav/common/v2/events"
@@ -20,8 +23,9 @@ const (
 
 //EventWrapper is the wrapper class to handle an event and its tag to avoid unmarshaling overheads.
 type EventWrapper struct {
-	Room  string
-	Event []byte
+	Room   string
+	Event  []byte
+	Header Header
 }
 
 //HubEventWrapper is just an event wrapper plus a source to help with routing within the axle.
@@ -41,38 +45,97 @@ type RegistrationChange struct {
 
 //SubscriptionChange is used to transmit room subscription changes from the messengers to the hub
 type SubscriptionChange struct {
-	Rooms  []string `json:"rooms"`
-	Create bool     `json:"create"` //if False means to deregister, true means add the registration
+	Rooms    []string `json:"rooms"`
+	Create   bool     `json:"create"`             //if False means to deregister, true means add the registration
+	Filter   string   `json:"filter,omitempty"`   //Filter limits the events sent for these rooms to those that match it, see the filter package for the syntax
+	Snapshot bool     `json:"snapshot,omitempty"` //Snapshot asks the hub to send the last known value of each device and key in the rooms before any new events
+	Replay   *Replay  `json:"replay,omitempty"`   //Replay asks the hub to send the events for the rooms from its event log
+
+	//RequestID asks the hub to answer the change with a ControlReply, and Control is set to ControlQuery to ask for the subscriptions instead of changing them. See control.go
+	RequestID string `json:"request-id,omitempty"`
+	Control   string `json:"control,omitempty"`
+}
+
+//Replay picks where a replay from the hub's event log starts. Only the events after both From and Since are replayed
+type Replay struct {
+	From  uint64    `json:"from"`
+	Since time.Time `json:"since,omitempty"`
 }
 
 //Registration contains information needed to maintain a registration. Both ID and Channel are necessary when submitting a regristation change for a new registration. Only ID is necessary during a deregistration request.
 type Registration struct {
 	ID      string            `json:"id,omitempty"` //ID is used to identify a specific channel during de-registration events
 	Channel chan EventWrapper `json:"-"`
+	PeerID  string            `json:"-"` //PeerID is the hub ID of the other end of a hub connection, if it's known
+	Peer    *Hello            `json:"-"` //Peer is the hello from the other end of a hub connection, if it sent one
+	Addr    string            `json:"-"` //Addr is the host a repeater connected from
+
+	//Outbound is set on the hub connections this hub dialed
+	Outbound bool `json:"-"`
+
+	//Identity is who the connection authenticated as, if the hub checks
+	Identity string `json:"-"`
+
+	//PriorityChannel gets the high priority events, if it's set. The connection should drain it before Channel
+	PriorityChannel chan EventWrapper `json:"-"`
+
+	//ContentFilter is the compiled SubscriptionChange.Filter, only events that match it are sent to the registration
+	ContentFilter *filter.Filter `json:"-"`
+
+	//Interest is the rooms the hub on the other end of a hub connection wants, see interest.go. nil sends it everything
+	Interest *InterestSet `json:"-"`
+}
+
+//ChannelFor returns the channel the event should be sent down
+func (r Registration) ChannelFor(e EventWrapper) chan EventWrapper {
+	if r.PriorityChannel != nil && e.Header.HighPriority() {
+		return r.PriorityChannel
+	}
+	return r.Channel
+}
+
+//malformedFrames counts the messages ParseMessage couldn't parse
+var malformedFrames uint64
+
+//MalformedFrames returns the number of messages ParseMessage has failed to parse
+func MalformedFrames() uint64 {
+	return atomic.LoadUint64(&malformedFrames)
 }
 
 /*
 ParseMessage will take a byte array in format of:
 roomID\n
 JSONEvent
-and parse it out
+and parse it out. Versioned frames (see PrepareFrame) are detected and parsed as well.
 */
 func ParseMessage(b []byte) (EventWrapper, *nerr.E) {
+	if bytes.HasPrefix(b, frameMagic) {
+		m, err := parseFrame(b)
+		if err != nil {
+			log.L.Errorf("Invalid frame: %v", err.Error())
+			atomic.AddUint64(&malformedFrames, 1)
+		}
+		return m, err
+	}
 
 	//parse out room name
 	index := bytes.IndexByte(b, '\n')
 	if index == -1 {
 		log.L.Errorf("Invalid message format: %v", b)
+		atomic.AddUint64(&malformedFrames, 1)
 		return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid format %s", b), "invalid-format")
 	}
 
 	return EventWrapper{
 		Room:  string(b[:index]),
 		Event: b[index:],
+		Header: Header{
+			Version: LegacyFrameVersion,
+		},
 	}, nil
 }
 
-//PrepareMessage will take an eventWrapper and return it in the format listed above
+//PrepareMessage will take an eventWrapper and return it in the legacy format listed above. The header is not included.
 func PrepareMessage(message EventWrapper) []byte {
 	return append([]byte(message.Room+"\n"), message.Event...)
 }
@@ -85,10 +148,16 @@ func WrapEvent(e events.Event) EventWrapper {
 		log.L.Errorf("Couldn't marshal event %v", err.Error())
 		return EventWrapper{}
 	}
-	return EventWrapper{
+	toReturn := EventWrapper{
 		Room:  e.AffectedRoom.RoomID,
 		Event: b,
+		Header: Header{
+			Timestamp: e.Timestamp,
+		},
 	}
+	toReturn.Header.Stamp()
+
+	return toReturn
 }
 
 //UnwrapEvent .
@@ -0,0 +1,59 @@
+package base
+
+import (
+	"fmt"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//ControlHeader is sent by the hub during the websocket upgrade, so a messenger knows it will answer subscription changes that have a request ID
+const ControlHeader = "X-Event-Control"
+
+//ControlVersion is the value of ControlHeader sent by hubs that answer subscription changes
+const ControlVersion = "1"
+
+//Control message types
+const (
+	//ControlQuery asks the hub for the messenger's subscriptions, instead of changing them
+	ControlQuery = "query"
+
+	//ControlAck and ControlNack answer a subscription change or query. A change is nacked if any of its rooms couldn't be subscribed to
+	ControlAck  = "ack"
+	ControlNack = "nack"
+)
+
+//Subscription is a room (or pattern) a messenger is subscribed to, and the filter on it
+type Subscription struct {
+	Room   string `json:"room"`
+	Filter string `json:"filter,omitempty"`
+}
+
+//ControlReply is the hub's answer to a subscription change or query that had a RequestID. Changes without a RequestID aren't answered, so messengers that don't know about replies keep working
+type ControlReply struct {
+	RequestID string `json:"request-id"`
+	Control   string `json:"control"`
+
+	//Error is why the change was nacked, if it wasn't for the rooms in Rejected
+	Error string `json:"error,omitempty"`
+
+	//Rejected holds the rooms that weren't subscribed to, and why
+	Rejected map[string]string `json:"rejected,omitempty"`
+
+	//Subscriptions is the answer to a query
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+
+	//SnapshotTruncated is how many cached events the hub left out of the snapshot the change asked for, because they weren't taken in time. The change is still acked
+	SnapshotTruncated int `json:"snapshot-truncated,omitempty"`
+}
+
+//Err returns the reason the change was nacked, or nil if it was acked
+func (r ControlReply) Err() *nerr.E {
+	if r.Control == ControlAck {
+		return nil
+	}
+
+	if len(r.Error) > 0 {
+		return nerr.Create(r.Error, ControlNack)
+	}
+	return nerr.Create(fmt.Sprintf("the hub rejected the subscriptions %v", r.Rejected), ControlNack)
+}
@@ -0,0 +1,288 @@
+package base
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/nerr"
+)
+
+//Frame versions understood by the hub
+const (
+	//LegacyFrameVersion is the original ROOMID\nJSONEvent format
+	LegacyFrameVersion = 0
+
+	//FrameVersion is the newest frame version this package can read and write
+	FrameVersion = 1
+
+	//FrameVersionHeader is sent during the websocket upgrade so each side knows what the other can read
+	FrameVersionHeader = "X-Event-Frame-Version"
+
+	//HubIDHeader is sent during the websocket upgrade by hubs, so each side knows which hub is on the other end
+	HubIDHeader = "X-Event-Hub-Id"
+
+	//ContentTypeJSON is the Content-Type of a frame whose body is a JSON encoded event
+	ContentTypeJSON = "application/json"
+)
+
+//Standard header keys of a versioned frame
+const (
+	HeaderRoom        = "Room"
+	HeaderID          = "Message-Id"
+	HeaderTimestamp   = "Timestamp"
+	HeaderHops        = "Hops"
+	HeaderContentType = "Content-Type"
+
+	//HeaderVisited lists the IDs of the hubs an event has been routed through
+	HeaderVisited = "Visited-Hubs"
+
+	//HeaderSnapshot is set on the cached events sent to a new subscription, to tell them apart from live events
+	HeaderSnapshot = "Snapshot"
+
+	//HeaderOffset is set on events replayed from the event log, to the event's offset in the log
+	HeaderOffset = "Offset"
+
+	//HeaderPriority is set to PriorityHigh on events that should skip ahead of the rest
+	HeaderPriority = "Priority"
+)
+
+//PriorityHigh is the value of HeaderPriority for high priority events. Any other value (or none) is normal priority
+const PriorityHigh = "high"
+
+//frameMagic starts every versioned frame. Room IDs never contain a '/', so it can't be confused with a legacy frame.
+var frameMagic = []byte("CES/")
+
+//Header is the metadata that travels with an event.
+type Header struct {
+	//Version is the frame version the event was read in, LegacyFrameVersion for legacy frames
+	Version     int       `json:"version"`
+	ID          string    `json:"id,omitempty"`
+	Timestamp   time.Time `json:"timestamp,omitempty"`
+	Hops        int       `json:"hops"`
+	ContentType string    `json:"content-type,omitempty"`
+
+	//Extensions holds any header that isn't one of the standard ones, so that unknown headers survive a trip through the hub
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+//Get returns the value of an extension header
+func (h Header) Get(key string) string {
+	return h.Extensions[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+//Set sets the value of an extension header. The extensions are copied first, since copies of an EventWrapper share them.
+func (h *Header) Set(key, value string) {
+	ext := make(map[string]string, len(h.Extensions)+1)
+	for k, v := range h.Extensions {
+		ext[k] = v
+	}
+	ext[textproto.CanonicalMIMEHeaderKey(key)] = value
+	h.Extensions = ext
+}
+
+//Visited returns the IDs of the hubs the event has been routed through, in order
+func (h Header) Visited() []string {
+	v := h.Get(HeaderVisited)
+	if len(v) == 0 {
+		return []string{}
+	}
+	return strings.Split(v, ",")
+}
+
+//HasVisited returns true if the event has already been routed through the hub
+func (h Header) HasVisited(hubID string) bool {
+	for _, id := range h.Visited() {
+		if id == hubID {
+			return true
+		}
+	}
+	return false
+}
+
+//Visit adds the hub to the list of hubs the event has been routed through
+func (h *Header) Visit(hubID string) {
+	h.Set(HeaderVisited, strings.Join(append(h.Visited(), hubID), ","))
+}
+
+//NewMessageID returns a random ID for a message
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+//HighPriority returns true if the event should skip ahead of normal priority events
+func (h Header) HighPriority() bool {
+	return strings.EqualFold(h.Get(HeaderPriority), PriorityHigh)
+}
+
+//Stamp fills in the ID, timestamp and content type of a header if they aren't already set
+func (h *Header) Stamp() {
+	if len(h.ID) == 0 {
+		h.ID = NewMessageID()
+	}
+	if h.Timestamp.IsZero() {
+		h.Timestamp = time.Now()
+	}
+	if len(h.ContentType) == 0 {
+		h.ContentType = ContentTypeJSON
+	}
+}
+
+/*
+parseFrame will take a byte array in the format of:
+CES/1\n
+Room: roomID\n
+Header: value\n
+\n
+JSONEvent
+and parse it out
+*/
+func parseFrame(b []byte) (EventWrapper, *nerr.E) {
+	index := bytes.IndexByte(b, '\n')
+	if index == -1 {
+		return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid frame %s", b), "invalid-format")
+	}
+
+	version, err := strconv.Atoi(string(b[len(frameMagic):index]))
+	if err != nil || version < 1 {
+		return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid frame version %s", b[:index]), "invalid-format")
+	}
+
+	toReturn := EventWrapper{
+		Header: Header{
+			Version: version,
+		},
+	}
+
+	b = b[index+1:]
+	for {
+		index = bytes.IndexByte(b, '\n')
+		if index == -1 {
+			return EventWrapper{}, nerr.Create("Frame header isn't terminated", "invalid-format")
+		}
+
+		line := string(b[:index])
+		b = b[index+1:]
+		if len(line) == 0 {
+			break
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid frame header %s", line), "invalid-format")
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(split[0]))
+		value := strings.TrimSpace(split[1])
+
+		switch key {
+		case HeaderRoom:
+			toReturn.Room = value
+		case HeaderID:
+			toReturn.Header.ID = value
+		case HeaderTimestamp:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid frame timestamp %s", value), "invalid-format")
+			}
+			toReturn.Header.Timestamp = t
+		case HeaderHops:
+			hops, err := strconv.Atoi(value)
+			if err != nil {
+				return EventWrapper{}, nerr.Create(fmt.Sprintf("Invalid frame hop count %s", value), "invalid-format")
+			}
+			toReturn.Header.Hops = hops
+		case HeaderContentType:
+			toReturn.Header.ContentType = value
+		default:
+			if toReturn.Header.Extensions == nil {
+				toReturn.Header.Extensions = make(map[string]string)
+			}
+			toReturn.Header.Extensions[key] = value
+		}
+	}
+
+	toReturn.Event = b
+	return toReturn, nil
+}
+
+//PrepareFrame will take an eventWrapper and return it in the versioned frame format
+func PrepareFrame(message EventWrapper) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(message.Event) + 256)
+
+	fmt.Fprintf(&buf, "%s%d\n", frameMagic, FrameVersion)
+	writeHeader(&buf, HeaderRoom, message.Room)
+	writeHeader(&buf, HeaderID, message.Header.ID)
+	if !message.Header.Timestamp.IsZero() {
+		writeHeader(&buf, HeaderTimestamp, message.Header.Timestamp.Format(time.RFC3339Nano))
+	}
+	writeHeader(&buf, HeaderHops, strconv.Itoa(message.Header.Hops))
+	writeHeader(&buf, HeaderContentType, message.Header.ContentType)
+
+	//keep the extensions in a stable order
+	keys := make([]string, 0, len(message.Header.Extensions))
+	for k := range message.Header.Extensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		writeHeader(&buf, k, message.Header.Extensions[k])
+	}
+
+	buf.WriteByte('\n')
+	buf.Write(message.Event)
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	if len(value) == 0 {
+		return
+	}
+
+	//a newline in a value would end the header early
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	buf.WriteString(key)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+//EncodeMessage returns the message in the given frame version, falling back to the legacy format for peers that don't understand frames
+func EncodeMessage(message EventWrapper, version int) []byte {
+	if version >= FrameVersion {
+		return PrepareFrame(message)
+	}
+	return PrepareMessage(message)
+}
+
+//FrameVersionHeaders returns the headers to send during a websocket upgrade to advertise the frame version we speak
+func FrameVersionHeaders() http.Header {
+	h := http.Header{}
+	h.Set(FrameVersionHeader, strconv.Itoa(FrameVersion))
+	return h
+}
+
+//NegotiateFrameVersion returns the frame version to write to a peer, based on the headers it sent during the websocket upgrade. Peers that don't send the header only speak the legacy format.
+func NegotiateFrameVersion(h http.Header) int {
+	v, err := strconv.Atoi(h.Get(FrameVersionHeader))
+	if err != nil || v < LegacyFrameVersion {
+		return LegacyFrameVersion
+	}
+	if v > FrameVersion {
+		return FrameVersion
+	}
+	return v
+}
@@ -0,0 +1,176 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFrame(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	tests := []struct {
+		name    string
+		frame   string
+		want    EventWrapper
+		wantErr bool
+	}{
+		{
+			name:  "standard headers",
+			frame: "CES/1\nRoom: ITB-1101\nMessage-Id: abc\nTimestamp: 2020-01-02T03:04:05.000000006Z\nHops: 2\nContent-Type: application/json\n\n{\"key\":\"power\"}",
+			want: EventWrapper{
+				Room:  "ITB-1101",
+				Event: []byte(`{"key":"power"}`),
+				Header: Header{
+					Version:     1,
+					ID:          "abc",
+					Timestamp:   ts,
+					Hops:        2,
+					ContentType: ContentTypeJSON,
+				},
+			},
+		},
+		{
+			name:  "extensions are kept, keys are canonicalized and values trimmed",
+			frame: "CES/1\nroom:ITB-1101\nvisited-hubs:  a,b \n\n{}",
+			want: EventWrapper{
+				Room:  "ITB-1101",
+				Event: []byte(`{}`),
+				Header: Header{
+					Version:    1,
+					Extensions: map[string]string{HeaderVisited: "a,b"},
+				},
+			},
+		},
+		{
+			name:  "a newer version is read",
+			frame: "CES/2\nRoom: ITB-1101\n\n{}",
+			want: EventWrapper{
+				Room:   "ITB-1101",
+				Event:  []byte(`{}`),
+				Header: Header{Version: 2},
+			},
+		},
+		{
+			name:  "empty body",
+			frame: "CES/1\nRoom: ITB-1101\n\n",
+			want: EventWrapper{
+				Room:   "ITB-1101",
+				Event:  []byte{},
+				Header: Header{Version: 1},
+			},
+		},
+		{name: "no newline", frame: "CES/1", wantErr: true},
+		{name: "version isn't a number", frame: "CES/x\n\n{}", wantErr: true},
+		{name: "version zero", frame: "CES/0\n\n{}", wantErr: true},
+		{name: "header isn't terminated", frame: "CES/1\nRoom: ITB-1101\n", wantErr: true},
+		{name: "header without a colon", frame: "CES/1\nRoom ITB-1101\n\n{}", wantErr: true},
+		{name: "invalid timestamp", frame: "CES/1\nTimestamp: yesterday\n\n{}", wantErr: true},
+		{name: "invalid hops", frame: "CES/1\nHops: two\n\n{}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFrame([]byte(tt.frame))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		room    string
+		event   string
+		version int
+		wantErr bool
+	}{
+		{name: "legacy", message: "ITB-1101\n{}", room: "ITB-1101", event: "\n{}", version: LegacyFrameVersion},
+		{name: "frame", message: "CES/1\nRoom: ITB-1101\n\n{}", room: "ITB-1101", event: "{}", version: 1},
+		{name: "legacy without a newline", message: "ITB-1101", wantErr: true},
+		{name: "invalid frame", message: "CES/1\nRoom: ITB-1101", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMessage([]byte(tt.message))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err.Error())
+			}
+			if got.Room != tt.room || string(got.Event) != tt.event || got.Header.Version != tt.version {
+				t.Fatalf("got room %q, event %q, version %v", got.Room, got.Event, got.Header.Version)
+			}
+		})
+	}
+}
+
+func TestPrepareFrameRoundTrip(t *testing.T) {
+	want := EventWrapper{
+		Room:  "ITB-1101",
+		Event: []byte(`{"key":"power","value":"on"}`),
+		Header: Header{
+			Version:     FrameVersion,
+			ID:          "abc",
+			Timestamp:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Hops:        1,
+			ContentType: ContentTypeJSON,
+			Extensions: map[string]string{
+				HeaderVisited:  "hub-1",
+				HeaderPriority: "a value\nwith a newline",
+			},
+		},
+	}
+
+	got, err := ParseMessage(PrepareFrame(want))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err.Error())
+	}
+
+	//newlines in values are replaced, so they can't end the header
+	want.Header.Extensions[HeaderPriority] = "a value with a newline"
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNegotiateFrameVersion(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", LegacyFrameVersion},
+		{"x", LegacyFrameVersion},
+		{"-1", LegacyFrameVersion},
+		{"0", LegacyFrameVersion},
+		{"1", 1},
+		{"99", FrameVersion},
+	}
+
+	for _, tt := range tests {
+		h := FrameVersionHeaders()
+		h.Set(FrameVersionHeader, tt.header)
+		if got := NegotiateFrameVersion(h); got != tt.want {
+			t.Errorf("NegotiateFrameVersion(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package base
+
+import (
+	"net/http"
+	"strings"
+)
+
+//Hello headers, HubIDHeader carries the ID
+const (
+	//HubVersionHeader is the version of the hub
+	HubVersionHeader = "X-Event-Hub-Version"
+
+	//HubCapabilitiesHeader is a comma separated list of the hub's capabilities
+	HubCapabilitiesHeader = "X-Event-Hub-Capabilities"
+
+	//HubRefusedHeader is set on the answer to a hello that's turned away, with why: self or duplicate
+	HubRefusedHeader = "X-Event-Hub-Refused"
+)
+
+//Hub capabilities
+const (
+	//CapabilityInterest means the hub sends and applies interest messages, see interest.go
+	CapabilityInterest = "interest"
+
+	//CapabilitySingleLink means the hub keeps only one connection to each hub, and closes or turns away the others
+	CapabilitySingleLink = "single-link"
+)
+
+//Capabilities are the capabilities of this version of the hub
+var Capabilities = []string{CapabilityInterest, CapabilitySingleLink}
+
+//Hello is who a hub is, and what it can do. Hubs exchange it in the headers of the websocket upgrade on /connect/hub, see HelloFromHeaders
+type Hello struct {
+	ID           string   `json:"id"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+//SetHeaders sets the hello on the headers
+func (h Hello) SetHeaders(header http.Header) {
+	header.Set(HubIDHeader, h.ID)
+	if len(h.Version) > 0 {
+		header.Set(HubVersionHeader, h.Version)
+	}
+	if len(h.Capabilities) > 0 {
+		header.Set(HubCapabilitiesHeader, strings.Join(h.Capabilities, ","))
+	}
+}
+
+//HelloFromHeaders reads the hello the other hub sent. The ID is empty if it didn't send one
+func HelloFromHeaders(header http.Header) Hello {
+	h := Hello{
+		ID:      header.Get(HubIDHeader),
+		Version: header.Get(HubVersionHeader),
+	}
+
+	for _, c := range strings.Split(header.Get(HubCapabilitiesHeader), ",") {
+		if c = strings.TrimSpace(c); len(c) > 0 {
+			h.Capabilities = append(h.Capabilities, c)
+		}
+	}
+	return h
+}
+
+//Has returns true if the hub has the capability
+func (h Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package base
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+//InterestHeader is sent by both sides of a hub connection's websocket upgrade by hubs that understand interest messages. Hubs that don't send it are never sent interest messages
+const InterestHeader = "X-Event-Interest"
+
+//InterestVersion is the value of InterestHeader
+const InterestVersion = "1"
+
+//ControlInterest is the control type of an interest message
+const ControlInterest = "interest"
+
+//Interest is a change to the rooms a hub wants events for, sent to the hub on the other end of a connection as a text message. The first one has Reset set.
+//A hub only forwards an event to another hub if the other hub's interest covers the event's room
+type Interest struct {
+	Control string `json:"control"`
+
+	//Reset means Add is the whole interest, replacing what was there before
+	Reset  bool     `json:"reset,omitempty"`
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+//InterestSet is the interest of the hub on the other end of a connection. It's safe to use from multiple goroutines.
+//Until the first interest message is applied it matches every room, and so does a nil set
+type InterestSet struct {
+	lock     sync.RWMutex
+	known    bool
+	rooms    map[string]bool
+	patterns map[string]bool //keyed on the pattern without the trailing '*'
+}
+
+//NewInterestSet returns a set that matches every room until an interest message is applied to it
+func NewInterestSet() *InterestSet {
+	return &InterestSet{
+		rooms:    make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+//Apply applies an interest message to the set
+func (s *InterestSet) Apply(i Interest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if i.Reset {
+		s.rooms = make(map[string]bool)
+		s.patterns = make(map[string]bool)
+	}
+	s.known = true
+
+	for _, room := range i.Add {
+		if room != "*" && strings.HasSuffix(room, "*") {
+			s.patterns[strings.TrimSuffix(room, "*")] = true
+			continue
+		}
+		s.rooms[room] = true
+	}
+
+	for _, room := range i.Remove {
+		if room != "*" && strings.HasSuffix(room, "*") {
+			delete(s.patterns, strings.TrimSuffix(room, "*"))
+			continue
+		}
+		delete(s.rooms, room)
+	}
+}
+
+//Matches returns true if the hub wants the events for the room. Patterns match the same way they do for messengers
+func (s *InterestSet) Matches(room string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.known || s.rooms["*"] || s.rooms[room] {
+		return true
+	}
+
+	for prefix := range s.patterns {
+		if strings.HasPrefix(room, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//Rooms returns the rooms and patterns in the set, sorted, and false if the hub hasn't sent its interest
+func (s *InterestSet) Rooms() ([]string, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.known {
+		return nil, false
+	}
+
+	toReturn := make([]string, 0, len(s.rooms)+len(s.patterns))
+	for room := range s.rooms {
+		toReturn = append(toReturn, room)
+	}
+	for prefix := range s.patterns {
+		toReturn = append(toReturn, prefix+"*")
+	}
+	sort.Strings(toReturn)
+	return toReturn, true
+}
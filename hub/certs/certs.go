@@ -0,0 +1,338 @@
+/*
+Package certs loads the TLS certificate and CA bundle the hub, repeater, and messengers use for wss:// connections, and reloads them when the files change so a renewed certificate is picked up without a restart.
+The certificate is served by the hub and the repeater, and sent as the client certificate when they (or a messenger) connect to another one. The CA bundle verifies the other end: the server when connecting, and the client certificate when the server asks for one.
+*/
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//DefaultReloadInterval is how often the files are checked for changes
+const DefaultReloadInterval = 1 * time.Minute
+
+//Client certificate verification, see ParseClientAuth
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+//Store holds the certificate and the CA bundle loaded from PEM files. Use New or FromEnv to build one
+type Store struct {
+	CertFile string
+	KeyFile  string
+	CAFiles  []string
+
+	//ClientAuth is how the server checks client certificates
+	ClientAuth tls.ClientAuthType
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+	loaded   time.Time
+	lastErr  string
+}
+
+//Status is the state of the store, for the status endpoint
+type Status struct {
+	Subject    string    `json:"subject,omitempty"`
+	NotAfter   time.Time `json:"not-after,omitempty"`
+	CAFiles    []string  `json:"ca-files,omitempty"`
+	ClientAuth string    `json:"client-auth"`
+	Loaded     time.Time `json:"loaded"`
+	LastError  string    `json:"last-error,omitempty"`
+}
+
+var (
+	envStore *Store
+	envErr   *nerr.E
+	envOnce  sync.Once
+)
+
+//New loads the certificate and key (both or neither must be set) and the CA bundles
+func New(certFile, keyFile string, caFiles []string) (*Store, *nerr.E) {
+	if (len(certFile) == 0) != (len(keyFile) == 0) {
+		return nil, nerr.Create("both the certificate and the key must be set", "invalid")
+	}
+
+	s := &Store{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFiles:  caFiles,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//FromEnv builds the store from the environment, and starts watching the files:
+//	HUB_TLS_CERT             the PEM certificate (with any intermediates) to serve and to send as the client certificate
+//	HUB_TLS_KEY              its PEM private key
+//	HUB_TLS_CA               comma separated PEM CA bundles to verify the other end with, the system roots are used if it isn't set
+//	HUB_TLS_CLIENT_AUTH      none (default), request (verify a client certificate if one is sent), or require
+//	HUB_TLS_RELOAD_INTERVAL  how often to check the files for changes, defaults to DefaultReloadInterval
+//Returns nil if none of the files are set. The store is built once, every call returns the same one
+func FromEnv() (*Store, *nerr.E) {
+	envOnce.Do(func() {
+		certFile := os.Getenv("HUB_TLS_CERT")
+		keyFile := os.Getenv("HUB_TLS_KEY")
+		caFiles := split(os.Getenv("HUB_TLS_CA"))
+		if len(certFile) == 0 && len(keyFile) == 0 && len(caFiles) == 0 {
+			return
+		}
+
+		clientAuth, err := ParseClientAuth(os.Getenv("HUB_TLS_CLIENT_AUTH"))
+		if err != nil {
+			envErr = err
+			return
+		}
+		if clientAuth != tls.NoClientCert && len(caFiles) == 0 {
+			envErr = nerr.Create("HUB_TLS_CA must be set to verify client certificates", "invalid")
+			return
+		}
+
+		interval := DefaultReloadInterval
+		if v := os.Getenv("HUB_TLS_RELOAD_INTERVAL"); len(v) > 0 {
+			d, perr := time.ParseDuration(v)
+			if perr != nil || d <= 0 {
+				envErr = nerr.Create(fmt.Sprintf("invalid HUB_TLS_RELOAD_INTERVAL %v", v), "invalid")
+				return
+			}
+			interval = d
+		}
+
+		envStore, envErr = New(certFile, keyFile, caFiles)
+		if envErr != nil {
+			return
+		}
+
+		envStore.ClientAuth = clientAuth
+		go envStore.Watch(interval)
+	})
+
+	return envStore, envErr
+}
+
+//ParseClientAuth parses none, request, or require. Empty is none
+func ParseClientAuth(v string) (tls.ClientAuthType, *nerr.E) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, nerr.Create(fmt.Sprintf("invalid client certificate verification %v", v), "invalid")
+}
+
+//Watch reloads the files when they change, checking every interval. It doesn't return
+func (s *Store) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Reload(); err != nil {
+			log.L.Warnf("Couldn't reload the TLS certificates, still using the old ones: %v", err.Error())
+		}
+	}
+}
+
+//Reload loads the files again if any of them have changed since they were loaded. If they can't be loaded, the old ones are kept
+func (s *Store) Reload() *nerr.E {
+	if !s.changed() {
+		return nil
+	}
+
+	if err := s.load(); err != nil {
+		s.lock.Lock()
+		s.lastErr = err.Error()
+		s.lock.Unlock()
+		return err
+	}
+
+	log.L.Infof("Reloaded the TLS certificates")
+	return nil
+}
+
+//ServerConfig returns the tls config for serving the certificate. The certificate and CA bundle in use are looked up on each handshake
+func (s *Store) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			if s.cert == nil {
+				return nil, fmt.Errorf("no certificate to serve")
+			}
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				ClientAuth:   s.ClientAuth,
+				ClientCAs:    s.pool,
+				//websockets can't be upgraded over http/2
+				NextProtos: []string{"http/1.1"},
+			}, nil
+		},
+	}
+}
+
+//ClientConfig returns the tls config for connecting to a server with the certificates loaded right now. Build a new one for each connection so reloads are picked up
+func (s *Store) ClientConfig() *tls.Config {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cert := s.cert
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    s.pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				//send no certificate
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+}
+
+//CanServe returns true if the store has a certificate to serve
+func (s *Store) CanServe() bool {
+	return s != nil && len(s.CertFile) > 0
+}
+
+//Scheme returns the websocket scheme to connect to a peer with the same configuration: wss:// if the store has a certificate to serve, ws:// if it doesn't
+func (s *Store) Scheme() string {
+	if !s.CanServe() {
+		return "ws://"
+	}
+	return "wss://"
+}
+
+//GetStatus returns the status of the store
+func (s *Store) GetStatus() Status {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	toReturn := Status{
+		CAFiles:   s.CAFiles,
+		Loaded:    s.loaded,
+		LastError: s.lastErr,
+	}
+
+	switch s.ClientAuth {
+	case tls.VerifyClientCertIfGiven:
+		toReturn.ClientAuth = ClientAuthRequest
+	case tls.RequireAndVerifyClientCert:
+		toReturn.ClientAuth = ClientAuthRequire
+	default:
+		toReturn.ClientAuth = ClientAuthNone
+	}
+
+	if s.cert != nil && s.cert.Leaf != nil {
+		toReturn.Subject = s.cert.Leaf.Subject.String()
+		toReturn.NotAfter = s.cert.Leaf.NotAfter
+	}
+	return toReturn
+}
+
+//load reads all of the files, and swaps them in if they're all valid
+func (s *Store) load() *nerr.E {
+	modTimes := s.stat()
+
+	var cert *tls.Certificate
+	if len(s.CertFile) > 0 {
+		c, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nerr.Translate(err).Addf("couldn't load the certificate %v", s.CertFile)
+		}
+
+		c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return nerr.Translate(err).Addf("couldn't parse the certificate %v", s.CertFile)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if len(s.CAFiles) > 0 {
+		pool = x509.NewCertPool()
+		for _, path := range s.CAFiles {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nerr.Translate(err).Addf("couldn't read the CA bundle %v", path)
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nerr.Create(fmt.Sprintf("no certificates in the CA bundle %v", path), "invalid")
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cert = cert
+	s.pool = pool
+	s.modTimes = modTimes
+	s.loaded = time.Now()
+	s.lastErr = ""
+	return nil
+}
+
+//changed returns true if any of the files have a different modification time than when they were loaded
+func (s *Store) changed() bool {
+	modTimes := s.stat()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for path, t := range modTimes {
+		if !t.Equal(s.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+//stat returns the modification time of each of the files. Missing files have the zero time
+func (s *Store) stat() map[string]time.Time {
+	toReturn := make(map[string]time.Time)
+	for _, path := range append([]string{s.CertFile, s.KeyFile}, s.CAFiles...) {
+		if len(path) == 0 {
+			continue
+		}
+
+		var t time.Time
+		if info, err := os.Stat(path); err == nil {
+			t = info.ModTime()
+		}
+		toReturn[path] = t
+	}
+	return toReturn
+}
+
+func split(v string) []string {
+	toReturn := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			toReturn = append(toReturn, s)
+		}
+	}
+	return toReturn
+}
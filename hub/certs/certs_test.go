@@ -0,0 +1,277 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testCA is a certificate authority that issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string //the CA's PEM certificate
+}
+
+var serial int64
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate a key: %v", err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path, kind string, b []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: b}), 0600); err != nil {
+		t.Fatalf("couldn't write %v: %v", path, err)
+	}
+}
+
+func newCA(t *testing.T, dir, name string) *testCA {
+	serial++
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create the CA %v: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("couldn't parse the CA %v: %v", name, err)
+	}
+
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, name+"-ca.pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+//issue writes a certificate for 127.0.0.1 signed by the CA, that can be used by a server or a client. Returns the certificate and key files
+func (ca *testCA) issue(t *testing.T, dir, name string) (string, string) {
+	serial++
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("couldn't issue %v: %v", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("couldn't marshal the key for %v: %v", name, err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+//serve accepts tls connections with the store's server config, and writes ok on each one that completes the handshake. Returns the address it's listening on
+func serve(t *testing.T, s *Store) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.ServerConfig())
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+//connect returns nil if a connection with the store's client config is accepted by the server at addr
+func connect(addr string, s *Store) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, s.ClientConfig())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//with tls 1.3 the client only finds out the server rejected its certificate once it reads
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2)
+	_, err = conn.Read(b)
+	return err
+}
+
+func newStore(t *testing.T, certFile, keyFile string, caFiles ...string) *Store {
+	s, err := New(certFile, keyFile, caFiles)
+	if err != nil {
+		t.Fatalf("couldn't build the store: %v", err.Error())
+	}
+	return s
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, dir, "hubs")
+	other := newCA(t, dir, "other")
+
+	serverCert, serverKey := ca.issue(t, dir, "server")
+	server := newStore(t, serverCert, serverKey, ca.file)
+	server.ClientAuth = tls.RequireAndVerifyClientCert
+	addr := serve(t, server)
+
+	clientCert, clientKey := ca.issue(t, dir, "client")
+	otherCert, otherKey := other.issue(t, dir, "other-client")
+
+	tests := []struct {
+		name   string
+		client *Store
+		accept bool
+	}{
+		{"a client certificate from the CA", newStore(t, clientCert, clientKey, ca.file), true},
+		{"no client certificate", newStore(t, "", "", ca.file), false},
+		{"a client certificate from another CA", newStore(t, otherCert, otherKey, ca.file), false},
+		{"a client that doesn't trust the server's CA", newStore(t, clientCert, clientKey, other.file), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := connect(addr, tt.client)
+			if tt.accept && err != nil {
+				t.Fatalf("the connection was rejected: %v", err)
+			}
+			if !tt.accept && err == nil {
+				t.Fatalf("the connection was accepted")
+			}
+		})
+	}
+}
+
+func TestRequestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, dir, "hubs")
+	other := newCA(t, dir, "other")
+
+	serverCert, serverKey := ca.issue(t, dir, "server")
+	server := newStore(t, serverCert, serverKey, ca.file)
+	server.ClientAuth = tls.VerifyClientCertIfGiven
+	addr := serve(t, server)
+
+	if err := connect(addr, newStore(t, "", "", ca.file)); err != nil {
+		t.Fatalf("a client without a certificate was rejected: %v", err)
+	}
+
+	otherCert, otherKey := other.issue(t, dir, "other-client")
+	if err := connect(addr, newStore(t, otherCert, otherKey, ca.file)); err == nil {
+		t.Fatalf("a client certificate from another CA was accepted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newCA(t, dir, "old")
+	nextCA := newCA(t, dir, "new")
+
+	//the server's certificate is issued by the old CA, and the client only trusts the new one
+	certFile, keyFile := oldCA.issue(t, dir, "server")
+	server := newStore(t, certFile, keyFile)
+	addr := serve(t, server)
+
+	client := newStore(t, "", "", nextCA.file)
+	if err := connect(addr, client); err == nil {
+		t.Fatalf("the client trusted a certificate from the wrong CA")
+	}
+
+	//nothing changed, so nothing is reloaded
+	loaded := server.GetStatus().Loaded
+	if err := server.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err.Error())
+	}
+	if !server.GetStatus().Loaded.Equal(loaded) {
+		t.Fatalf("the files were reloaded without changing")
+	}
+
+	//a broken certificate is ignored, and the old one is kept
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("couldn't write the certificate: %v", err)
+	}
+	touch(t, certFile, time.Now().Add(time.Minute))
+	if err := server.Reload(); err == nil {
+		t.Fatalf("a broken certificate was loaded")
+	}
+	if status := server.GetStatus(); status.Subject != "CN=server" {
+		t.Fatalf("got status %+v after a failed reload, want the old certificate", status)
+	}
+	if err := connect(addr, newStore(t, "", "", oldCA.file)); err != nil {
+		t.Fatalf("the old certificate isn't served after a failed reload: %v", err)
+	}
+
+	//the renewed certificate is picked up by the connections after the reload
+	renewedCert, renewedKey := nextCA.issue(t, dir, "renewed")
+	rename(t, renewedCert, certFile)
+	rename(t, renewedKey, keyFile)
+	touch(t, certFile, time.Now().Add(2*time.Minute))
+	touch(t, keyFile, time.Now().Add(2*time.Minute))
+
+	if err := server.Reload(); err != nil {
+		t.Fatalf("couldn't reload: %v", err.Error())
+	}
+	if status := server.GetStatus(); len(status.LastError) > 0 || status.Subject != "CN=renewed" {
+		t.Fatalf("got status %+v after reloading, want the renewed certificate", status)
+	}
+	if err := connect(addr, client); err != nil {
+		t.Fatalf("the renewed certificate wasn't served: %v", err)
+	}
+}
+
+//touch sets the file's modification time, so a change is noticed even if it happens within the file system's timestamp resolution
+func touch(t *testing.T, path string, mtime time.Time) {
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("couldn't touch %v: %v", path, err)
+	}
+}
+
+func rename(t *testing.T, from, to string) {
+	if err := os.Rename(from, to); err != nil {
+		t.Fatalf("couldn't move %v to %v: %v", from, to, err)
+	}
+}
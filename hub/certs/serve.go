@@ -0,0 +1,16 @@
+package certs
+
+import (
+	"github.com/labstack/echo"
+)
+
+//Start starts the router on address, serving https (and wss) with the store's certificate if it has one, and plain http if it doesn't
+func Start(router *echo.Echo, address string, s *Store) error {
+	if !s.CanServe() {
+		return router.Start(address)
+	}
+
+	router.TLSServer.Addr = address
+	router.TLSServer.TLSConfig = s.ServerConfig()
+	return router.StartServer(router.TLSServer)
+}
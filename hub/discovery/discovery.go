@@ -0,0 +1,380 @@
+/*
+Package discovery finds the other hubs on the local network without the database. Each hub multicasts an announcement with its ID, room, port and scheme every interval, and listens for the other hubs' announcements.
+A hub's address is the source address of its announcements, with the port and scheme it announced. A hub that misses a few announcements in a row is forgotten. Announcements aren't authenticated, so anything on the network can announce a hub; use TLS or authentication on the hub connections if that matters.
+*/
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Defaults for the options
+const (
+	DefaultGroup     = "239.255.71.0:7199"
+	DefaultInterval  = 5 * time.Second
+	DefaultMaxMissed = 3
+)
+
+//service is set on every announcement, so anything else sent to the group is ignored
+const service = "central-event-system/hub"
+
+//maxAnnouncementSize is the largest announcement that's read
+const maxAnnouncementSize = 2048
+
+//Announcement is what a hub multicasts
+type Announcement struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+	Room    string `json:"room"`
+	Port    int    `json:"port"`
+
+	//Scheme is ws or wss
+	Scheme string `json:"scheme"`
+}
+
+//Hub is a hub that's been heard from
+type Hub struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"last-seen"`
+}
+
+//Options configure discovery
+type Options struct {
+	//Group is the multicast group and port the announcements are sent to
+	Group string
+
+	//Interface is the name of the network interface to announce and listen on. Empty uses the system default
+	Interface string
+
+	//Interval is how often the hub announces itself
+	Interval time.Duration
+
+	//MaxMissed is how many intervals can go by without hearing from a hub before it's forgotten
+	MaxMissed int
+}
+
+//Status is the state of discovery, for the status endpoint
+type Status struct {
+	Group     string `json:"group"`
+	Interface string `json:"interface,omitempty"`
+	Interval  string `json:"interval"`
+	MaxMissed int    `json:"max-missed"`
+	Hubs      []Hub  `json:"hubs"`
+	Announced uint64 `json:"announced"`
+	Received  uint64 `json:"received"`
+	Ignored   uint64 `json:"ignored"`
+	LastError string `json:"last-error,omitempty"`
+}
+
+//Discoverer announces a hub, and keeps track of the other hubs it hears. Use New to build one
+type Discoverer struct {
+	self      Announcement
+	group     *net.UDPAddr
+	ifi       *net.Interface
+	interval  time.Duration
+	maxMissed int
+
+	//the counters are accessed atomically
+	announced uint64
+	received  uint64
+	ignored   uint64
+
+	lock    sync.Mutex
+	hubs    map[string]Hub
+	lastErr string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+//OptionsFromEnv returns the options from the environment:
+//	HUB_DISCOVERY_GROUP      the multicast group and port, defaults to DefaultGroup
+//	HUB_DISCOVERY_INTERFACE  the network interface to use, defaults to the system's choice
+//	HUB_DISCOVERY_INTERVAL   how often to announce, defaults to DefaultInterval
+//	HUB_DISCOVERY_MAX_MISSED how many announcements a hub can miss before it's forgotten, defaults to DefaultMaxMissed
+func OptionsFromEnv() (Options, *nerr.E) {
+	o := Options{
+		Group:     DefaultGroup,
+		Interface: os.Getenv("HUB_DISCOVERY_INTERFACE"),
+		Interval:  DefaultInterval,
+		MaxMissed: DefaultMaxMissed,
+	}
+
+	if v := os.Getenv("HUB_DISCOVERY_GROUP"); len(v) > 0 {
+		o.Group = v
+	}
+
+	if v := os.Getenv("HUB_DISCOVERY_INTERVAL"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return o, nerr.Create(fmt.Sprintf("invalid HUB_DISCOVERY_INTERVAL %v", v), "invalid")
+		}
+		o.Interval = d
+	}
+
+	if v := os.Getenv("HUB_DISCOVERY_MAX_MISSED"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return o, nerr.Create(fmt.Sprintf("invalid HUB_DISCOVERY_MAX_MISSED %v", v), "invalid")
+		}
+		o.MaxMissed = n
+	}
+
+	return o, nil
+}
+
+//New builds a discoverer that announces self. Announcing and listening doesn't start until Run is called
+func New(o Options, self Announcement) (*Discoverer, *nerr.E) {
+	if len(o.Group) == 0 {
+		o.Group = DefaultGroup
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.MaxMissed <= 0 {
+		o.MaxMissed = DefaultMaxMissed
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", o.Group)
+	if err != nil {
+		return nil, nerr.Translate(err).Addf("invalid discovery group %v", o.Group)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, nerr.Create(fmt.Sprintf("invalid discovery group %v: it isn't a multicast address", o.Group), "invalid")
+	}
+
+	d := &Discoverer{
+		self:      self,
+		group:     group,
+		interval:  o.Interval,
+		maxMissed: o.MaxMissed,
+		hubs:      make(map[string]Hub),
+		stop:      make(chan struct{}),
+	}
+	d.self.Service = service
+
+	if len(o.Interface) > 0 {
+		d.ifi, err = net.InterfaceByName(o.Interface)
+		if err != nil {
+			return nil, nerr.Translate(err).Addf("invalid discovery interface %v", o.Interface)
+		}
+	}
+
+	return d, nil
+}
+
+//Run announces the hub every interval, and listens for the other hubs. found is called with each hub the first time it's heard from, and each time its address changes.
+//lost is called with each hub that hasn't been heard from for MaxMissed intervals, which is then forgotten until it's heard from again. found and lost are only called from Run's goroutine.
+//It returns nil once the discoverer is stopped, or an error if it can't listen for announcements
+func (d *Discoverer) Run(found, lost func(Hub)) *nerr.E {
+	conn, err := net.ListenMulticastUDP("udp4", d.ifi, d.group)
+	if err != nil {
+		return nerr.Translate(err).Addf("couldn't listen for hubs on %v", d.group)
+	}
+	defer conn.Close()
+
+	log.L.Infof("Discovering hubs on %v, announcing %v in %v every %v", d.group, d.self.ID, d.self.Room, d.interval)
+	go d.announce()
+
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		//wake up at least every interval to forget the hubs that have gone quiet
+		for _, h := range d.expire(time.Now()) {
+			log.L.Infof("Haven't heard from hub %v at %v since %v, forgetting it", h.ID, h.Address, h.LastSeen.Format(time.RFC3339))
+			lost(h)
+		}
+
+		select {
+		case <-d.stop:
+			return nil
+		default:
+		}
+
+		conn.SetReadDeadline(time.Now().Add(d.interval))
+		n, src, err := conn.ReadFromUDP(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			log.L.Warnf("Couldn't read a hub announcement: %v", err.Error())
+			d.setError(err)
+			time.Sleep(d.interval)
+			continue
+		}
+
+		a, ok := parse(buf[:n])
+		if !ok {
+			atomic.AddUint64(&d.ignored, 1)
+			continue
+		}
+		if a.ID == d.self.ID {
+			//our own, looped back
+			continue
+		}
+		atomic.AddUint64(&d.received, 1)
+
+		hub := Hub{
+			ID:       a.ID,
+			Room:     a.Room,
+			Address:  a.Scheme + "://" + net.JoinHostPort(src.IP.String(), strconv.Itoa(a.Port)),
+			LastSeen: time.Now(),
+		}
+
+		if d.heard(hub) {
+			log.L.Infof("Discovered hub %v in %v at %v", hub.ID, hub.Room, hub.Address)
+			found(hub)
+		}
+	}
+}
+
+//Stop stops announcing the hub and listening for the others, Run returns within an interval
+func (d *Discoverer) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+//GetStatus returns the state of discovery
+func (d *Discoverer) GetStatus() Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	toReturn := Status{
+		Group:     d.group.String(),
+		Interval:  d.interval.String(),
+		MaxMissed: d.maxMissed,
+		Hubs:      make([]Hub, 0, len(d.hubs)),
+		Announced: atomic.LoadUint64(&d.announced),
+		Received:  atomic.LoadUint64(&d.received),
+		Ignored:   atomic.LoadUint64(&d.ignored),
+		LastError: d.lastErr,
+	}
+	if d.ifi != nil {
+		toReturn.Interface = d.ifi.Name
+	}
+
+	for _, h := range d.hubs {
+		toReturn.Hubs = append(toReturn.Hubs, h)
+	}
+	sort.Slice(toReturn.Hubs, func(i, j int) bool {
+		return toReturn.Hubs[i].ID < toReturn.Hubs[j].ID
+	})
+	return toReturn
+}
+
+//announce sends the announcement now, and then every interval, until the discoverer is stopped
+func (d *Discoverer) announce() {
+	b, err := json.Marshal(d.self)
+	if err != nil {
+		log.L.Errorf("Couldn't marshal the hub announcement: %v", err.Error())
+		return
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.send(b); err != nil {
+			log.L.Warnf("Couldn't announce the hub on %v: %v", d.group, err.Error())
+			d.setError(err)
+		} else {
+			atomic.AddUint64(&d.announced, 1)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+//send multicasts the announcement. The socket is bound to the interface's address if there is one, which makes it the interface the announcement goes out on
+func (d *Discoverer) send(b []byte) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: d.localIP()})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteToUDP(b, d.group)
+	return err
+}
+
+//localIP returns the interface's first IPv4 address, or nil if there's no interface or it doesn't have one
+func (d *Discoverer) localIP() net.IP {
+	if d.ifi == nil {
+		return nil
+	}
+
+	addrs, err := d.ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+//parse reads an announcement. Returns false if it isn't a valid one
+func parse(b []byte) (Announcement, bool) {
+	var a Announcement
+	if err := json.Unmarshal(b, &a); err != nil {
+		return a, false
+	}
+
+	a.Scheme = strings.ToLower(a.Scheme)
+	if a.Service != service || len(a.ID) == 0 || a.Port <= 0 || a.Port > 65535 || (a.Scheme != "ws" && a.Scheme != "wss") {
+		return a, false
+	}
+	return a, true
+}
+
+//heard records that the hub was heard from. Returns true if it's new, or its address changed
+func (d *Discoverer) heard(h Hub) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	prev, ok := d.hubs[h.ID]
+	d.hubs[h.ID] = h
+	return !ok || prev.Address != h.Address
+}
+
+//expire forgets the hubs that haven't been heard from for MaxMissed intervals, and returns them
+func (d *Discoverer) expire(now time.Time) []Hub {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	toReturn := []Hub{}
+	for id, h := range d.hubs {
+		if now.Sub(h.LastSeen) > time.Duration(d.maxMissed)*d.interval {
+			delete(d.hubs, id)
+			toReturn = append(toReturn, h)
+		}
+	}
+	return toReturn
+}
+
+func (d *Discoverer) setError(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.lastErr = err.Error()
+}
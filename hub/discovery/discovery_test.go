@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const testInterval = 50 * time.Millisecond
+
+//loopback returns the loopback interface, and skips the test if it can't carry multicast
+func loopback(t *testing.T) string {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("couldn't list the interfaces: %v", err)
+	}
+
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+
+	t.Skip("there's no loopback interface")
+	return ""
+}
+
+//start runs a discoverer announcing id, and returns the channels its found and lost hubs are sent on
+func start(t *testing.T, group, ifi, id string, port int) (*Discoverer, chan Hub, chan Hub) {
+	d, err := New(Options{Group: group, Interface: ifi, Interval: testInterval, MaxMissed: 3}, Announcement{
+		ID:     id,
+		Room:   "ITB-1101",
+		Port:   port,
+		Scheme: "ws",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create the discoverer for %v: %v", id, err.Error())
+	}
+
+	found := make(chan Hub, 10)
+	lost := make(chan Hub, 10)
+	failed := make(chan error, 1)
+	go func() {
+		if err := d.Run(func(h Hub) { found <- h }, func(h Hub) { lost <- h }); err != nil {
+			failed <- err
+		}
+	}()
+	t.Cleanup(d.Stop)
+
+	select {
+	case err := <-failed:
+		t.Skipf("couldn't listen for hubs on %v: %v", ifi, err)
+	case <-time.After(testInterval):
+	}
+	return d, found, lost
+}
+
+//wait returns the next hub sent on c, or false if there isn't one within the timeout
+func wait(c chan Hub, timeout time.Duration) (Hub, bool) {
+	select {
+	case h := <-c:
+		return h, true
+	case <-time.After(timeout):
+		return Hub{}, false
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	ifi := loopback(t)
+	group := fmt.Sprintf("239.255.71.%d:%d", 1+os.Getpid()%250, 20000+os.Getpid()%10000)
+
+	a, foundByA, lostByA := start(t, group, ifi, "ITB-1101-CP1", 7100)
+	b, foundByB, _ := start(t, group, ifi, "ITB-1101-CP2", 7200)
+
+	h, ok := wait(foundByA, 20*testInterval)
+	if !ok {
+		if a.GetStatus().Received == 0 {
+			t.Skipf("no announcements were received on %v, it may not carry multicast", ifi)
+		}
+		t.Fatalf("CP1 didn't find CP2")
+	}
+	if h.ID != "ITB-1101-CP2" || h.Room != "ITB-1101" || h.Address != "ws://127.0.0.1:7200" {
+		t.Fatalf("CP1 found %+v, want CP2 at ws://127.0.0.1:7200", h)
+	}
+
+	h, ok = wait(foundByB, 20*testInterval)
+	if !ok || h.ID != "ITB-1101-CP1" || h.Address != "ws://127.0.0.1:7100" {
+		t.Fatalf("CP2 found %+v, want CP1 at ws://127.0.0.1:7100", h)
+	}
+
+	//hearing from a hub again at the same address doesn't find it again
+	if h, ok := wait(foundByA, 5*testInterval); ok {
+		t.Fatalf("CP1 found %+v again", h)
+	}
+
+	//once CP2 stops announcing, CP1 forgets it after it misses a few announcements
+	b.Stop()
+	h, ok = wait(lostByA, 20*testInterval)
+	if !ok || h.ID != "ITB-1101-CP2" {
+		t.Fatalf("CP1 lost %+v, want CP2", h)
+	}
+	if hubs := a.GetStatus().Hubs; len(hubs) != 0 {
+		t.Fatalf("CP1 still knows about %+v", hubs)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	d, err := New(Options{Interval: time.Second, MaxMissed: 3}, Announcement{ID: "ITB-1101-CP1"})
+	if err != nil {
+		t.Fatalf("couldn't create the discoverer: %v", err.Error())
+	}
+
+	now := time.Now()
+	if !d.heard(Hub{ID: "ITB-1101-CP2", Address: "ws://10.0.0.2:7100", LastSeen: now}) {
+		t.Fatalf("a new hub wasn't found")
+	}
+	if d.heard(Hub{ID: "ITB-1101-CP2", Address: "ws://10.0.0.2:7100", LastSeen: now}) {
+		t.Fatalf("a hub at the same address was found again")
+	}
+	if !d.heard(Hub{ID: "ITB-1101-CP2", Address: "ws://10.0.0.3:7100", LastSeen: now}) {
+		t.Fatalf("a hub at a new address wasn't found")
+	}
+
+	if lost := d.expire(now.Add(3 * time.Second)); len(lost) != 0 {
+		t.Fatalf("lost %+v after 3 intervals, want nothing", lost)
+	}
+
+	lost := d.expire(now.Add(4 * time.Second))
+	if len(lost) != 1 || lost[0].ID != "ITB-1101-CP2" {
+		t.Fatalf("lost %+v after 4 intervals, want CP2", lost)
+	}
+
+	//a hub that comes back is found again
+	if !d.heard(Hub{ID: "ITB-1101-CP2", Address: "ws://10.0.0.3:7100", LastSeen: now.Add(5 * time.Second)}) {
+		t.Fatalf("a hub that came back wasn't found")
+	}
+}
@@ -0,0 +1,544 @@
+/*
+Package eventlog is an append-only log of the events routed by the hub.
+
+Every event appended to the log gets the next offset, which only ever goes up, even across restarts. The log is split into segment files named after the first offset they hold;
+once a segment is full (or old enough) a new one is started, and the oldest segments are deleted once they're past the retention time, or once the log is over its size limit.
+Each segment is a file of json records, one per line, so they can also be read with the usual tools.
+
+Events are usually added with Submit, which queues them for the log's writer instead of writing them itself, so the router is never held up by the disk. The writer appends whatever has been queued since its last write in one batch.
+*/
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Defaults for the event log
+const (
+	DefaultSegmentSize = 64 * 1024 * 1024
+	DefaultSegmentAge  = time.Hour
+	DefaultRetention   = 7 * 24 * time.Hour
+	DefaultMaxSize     = 1024 * 1024 * 1024
+	DefaultQueueSize   = 10000
+)
+
+//segmentExt is the extension of the segment files
+const segmentExt = ".log"
+
+//syncInterval is how often the active segment is synced to disk, and the retention is checked
+const syncInterval = time.Second
+
+//maxBatch is the most queued events the writer appends at once
+const maxBatch = 1000
+
+//segmentFile is the active segment's file, an *os.File
+type segmentFile interface {
+	Write(b []byte) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+//Options configure an event log
+type Options struct {
+	//Dir is the directory the segments are kept in. An empty Dir turns the log off
+	Dir string
+
+	//SegmentSize is the size a segment may grow to before a new one is started, and SegmentAge is how long a segment is written to before a new one is started
+	SegmentSize int64
+	SegmentAge  time.Duration
+
+	//Retention is how long a segment is kept after it was last written to, and MaxSize is the most the segments may take up. The active segment is never deleted. 0 means no limit
+	Retention time.Duration
+	MaxSize   int64
+
+	//QueueSize is the most events that can be waiting for the writer. Events submitted while the queue is full are dropped
+	QueueSize int
+}
+
+//DefaultOptions returns the options the log is opened with when nothing is configured
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize: DefaultSegmentSize,
+		SegmentAge:  DefaultSegmentAge,
+		Retention:   DefaultRetention,
+		MaxSize:     DefaultMaxSize,
+		QueueSize:   DefaultQueueSize,
+	}
+}
+
+//Record is an event as it's kept in the log
+type Record struct {
+	Offset   uint64      `json:"offset"`
+	Time     time.Time   `json:"time"`
+	Source   string      `json:"source"`
+	SourceID string      `json:"source-id"`
+	Room     string      `json:"room"`
+	Header   base.Header `json:"header"`
+
+	//Event is the event, if it's json. Anything else is kept in Data
+	Event json.RawMessage `json:"event,omitempty"`
+	Data  []byte          `json:"data,omitempty"`
+}
+
+//EventWrapper returns the event in the record, with the Offset header set to the record's offset
+func (r Record) EventWrapper() base.EventWrapper {
+	e := base.EventWrapper{
+		Room:   r.Room,
+		Event:  []byte(r.Event),
+		Header: r.Header,
+	}
+	if len(r.Data) > 0 {
+		e.Event = r.Data
+	}
+
+	e.Header.Set(base.HeaderOffset, fmt.Sprintf("%v", r.Offset))
+	return e
+}
+
+//Status represents the state of the log
+type Status struct {
+	Dir         string `json:"dir"`
+	Segments    int    `json:"segments"`
+	Size        int64  `json:"size"`
+	FirstOffset uint64 `json:"first-offset"`
+	NextOffset  uint64 `json:"next-offset"`
+	Appended    uint64 `json:"appended"`
+	Errors      uint64 `json:"errors"`
+	Queued      int    `json:"queued"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+//Log is an append-only event log. It's safe to append to and replay from a log concurrently
+type Log struct {
+	opts Options
+
+	lock     sync.Mutex
+	segments []*segment
+	active   segmentFile
+	started  time.Time //when the active segment was started
+	next     uint64
+	closed   bool
+
+	appended uint64
+	errors   uint64
+	dropped  uint64
+
+	//queue holds the submitted events until the writer appends them, and written is closed once the writer has appended everything left in the queue after the log is closed
+	queue   chan base.HubEventWrapper
+	written chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+//Open opens the log in the options' directory, creating it if it doesn't exist. Zero sizes and ages are replaced with their defaults
+func Open(o Options) (*Log, *nerr.E) {
+	if len(o.Dir) == 0 {
+		return nil, nerr.Create("no directory given for the event log", "invalid")
+	}
+
+	d := DefaultOptions()
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = d.SegmentSize
+	}
+	if o.SegmentAge <= 0 {
+		o.SegmentAge = d.SegmentAge
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = d.QueueSize
+	}
+
+	if err := os.MkdirAll(o.Dir, 0755); err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't create event log directory %v", o.Dir)
+	}
+
+	segments, err := listSegments(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		opts:     o,
+		segments: segments,
+		queue:    make(chan base.HubEventWrapper, o.QueueSize),
+		written:  make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.startSegment(); err != nil {
+			return nil, err
+		}
+	} else {
+		last := l.segments[len(l.segments)-1]
+		next, started, err := last.recover()
+		if err != nil {
+			return nil, err
+		}
+
+		f, ferr := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if ferr != nil {
+			return nil, nerr.Translate(ferr).Addf("couldn't open segment %v", last.path)
+		}
+
+		l.active = f
+		l.next = next
+		l.started = started
+	}
+
+	log.L.Infof("Opened event log in %v with %v segments, next offset is %v", o.Dir, len(l.segments), l.next)
+
+	go l.maintain()
+	go l.write()
+	return l, nil
+}
+
+//Submit queues the event to be appended by the log's writer, without waiting for it to be written. Returns false if the event was dropped because the queue is full, or the log is closed
+func (l *Log) Submit(e base.HubEventWrapper) bool {
+	select {
+	case <-l.stop:
+		return false
+	default:
+	}
+
+	select {
+	case l.queue <- e:
+		return true
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		return false
+	}
+}
+
+//Append adds the event to the log right away, ahead of anything still queued, and returns its offset
+func (l *Log) Append(e base.HubEventWrapper) (uint64, *nerr.E) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	offset := l.next
+	if err := l.appendEvents([]base.HubEventWrapper{e}); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+//write is the log's writer. It appends the queued events in batches until the log is closed, and then appends whatever is left in the queue
+func (l *Log) write() {
+	defer close(l.written)
+
+	batch := make([]base.HubEventWrapper, 0, maxBatch)
+	for {
+		select {
+		case e := <-l.queue:
+			batch = append(batch[:0], e)
+		case <-l.stop:
+			l.drain(batch[:0])
+			return
+		}
+
+		//everything else that's already waiting goes in the same batch
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case e := <-l.queue:
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+
+		l.appendBatch(batch)
+	}
+}
+
+//drain appends the events left in the queue once the log is closing
+func (l *Log) drain(batch []base.HubEventWrapper) {
+	for {
+		select {
+		case e := <-l.queue:
+			batch = append(batch, e)
+			if len(batch) < maxBatch {
+				continue
+			}
+		default:
+		}
+
+		if len(batch) == 0 {
+			return
+		}
+		l.appendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+func (l *Log) appendBatch(batch []base.HubEventWrapper) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.appendEvents(batch); err != nil {
+		log.L.Warnf("Couldn't add %v events to the event log: %v", len(batch), err.Error())
+	}
+}
+
+//appendEvents adds the events to the log, with one write for each segment they go in. The events that can't be appended are counted as errors. Must be called with the lock held
+func (l *Log) appendEvents(events []base.HubEventWrapper) *nerr.E {
+	if l.closed {
+		atomic.AddUint64(&l.errors, uint64(len(events)))
+		return nerr.Create("the event log is closed", "closed")
+	}
+
+	//buf holds the records that haven't been written to the active segment yet, starting at offset first
+	var buf []byte
+	first := l.next
+	pending := 0
+
+	flush := func() *nerr.E {
+		if len(buf) == 0 {
+			return nil
+		}
+
+		cur := l.segments[len(l.segments)-1]
+		n, err := l.active.Write(buf)
+		cur.modTime = time.Now()
+		if err != nil {
+			//the records weren't written, so their offsets are given out again
+			l.next = first
+			l.discard(cur, n)
+			return nerr.Translate(err).Addf("couldn't write %v events to %v", pending, cur.path)
+		}
+		cur.size += int64(n)
+
+		atomic.AddUint64(&l.appended, uint64(pending))
+		buf = buf[:0]
+		first = l.next
+		pending = 0
+		return nil
+	}
+
+	for i, e := range events {
+		//the last roll couldn't start a new segment
+		if l.active == nil {
+			if err := l.startSegment(); err != nil {
+				atomic.AddUint64(&l.errors, uint64(len(events)-i))
+				return err
+			}
+		}
+
+		now := time.Now()
+		rec := Record{
+			Offset:   l.next,
+			Time:     now,
+			Source:   e.Source,
+			SourceID: e.SourceID,
+			Room:     e.Room,
+			Header:   e.Header,
+		}
+		if json.Valid(e.Event) {
+			rec.Event = e.Event
+		} else {
+			rec.Data = e.Event
+		}
+
+		b, err := json.Marshal(rec)
+		if err != nil {
+			atomic.AddUint64(&l.errors, 1)
+			log.L.Warnf("Couldn't encode event %v for the event log: %v", e.Header.ID, err.Error())
+			continue
+		}
+		b = append(b, '\n')
+
+		size := l.segments[len(l.segments)-1].size + int64(len(buf))
+		if size > 0 && (size+int64(len(b)) > l.opts.SegmentSize || now.Sub(l.started) > l.opts.SegmentAge) {
+			if err := flush(); err != nil {
+				atomic.AddUint64(&l.errors, uint64(pending+len(events)-i))
+				return err
+			}
+			if err := l.roll(); err != nil {
+				atomic.AddUint64(&l.errors, uint64(len(events)-i))
+				return err
+			}
+		}
+
+		buf = append(buf, b...)
+		pending++
+		l.next++
+	}
+
+	if err := flush(); err != nil {
+		atomic.AddUint64(&l.errors, uint64(pending))
+		return err
+	}
+	return nil
+}
+
+//discard gets rid of the n bytes a failed write left at the end of the active segment, which would stop the segment from being read past them.
+//They're cut off, or if that fails, the segment is left behind with them at its end and a new one is started. Must be called with the lock held
+func (l *Log) discard(cur *segment, n int) {
+	if n == 0 {
+		return
+	}
+
+	err := l.active.Truncate(cur.size)
+	if err == nil {
+		return
+	}
+
+	log.L.Warnf("Couldn't cut a partial write off of %v, starting a new segment: %v", cur.path, err.Error())
+	if cur.base == l.next {
+		//there's nothing else in it, so the new segment replaces it
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	if err := l.roll(); err != nil {
+		log.L.Warnf("Couldn't start a new event log segment: %v", err.Error())
+	}
+}
+
+//Close appends the events still in the queue, then syncs and closes the log. Nothing can be appended to it afterwards
+func (l *Log) Close() *nerr.E {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	<-l.written
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	if l.active == nil {
+		return nil
+	}
+
+	l.active.Sync()
+	err := l.active.Close()
+	l.active = nil
+	if err != nil {
+		return nerr.Translate(err).Addf("couldn't close the event log")
+	}
+	return nil
+}
+
+//GetStatus returns the state of the log
+func (l *Log) GetStatus() Status {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	toReturn := Status{
+		Dir:        l.opts.Dir,
+		Segments:   len(l.segments),
+		NextOffset: l.next,
+		Appended:   atomic.LoadUint64(&l.appended),
+		Errors:     atomic.LoadUint64(&l.errors),
+		Queued:     len(l.queue),
+		Dropped:    atomic.LoadUint64(&l.dropped),
+	}
+	if len(l.segments) > 0 {
+		toReturn.FirstOffset = l.segments[0].base
+	}
+	for _, s := range l.segments {
+		toReturn.Size += s.size
+	}
+	return toReturn
+}
+
+//maintain syncs the active segment, starts a new one once it's too old, and deletes the segments past the retention
+func (l *Log) maintain() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.lock.Lock()
+			if l.active != nil {
+				if err := l.active.Sync(); err != nil {
+					log.L.Warnf("Couldn't sync the event log: %v", err.Error())
+				}
+
+				if l.segments[len(l.segments)-1].size > 0 && time.Since(l.started) > l.opts.SegmentAge {
+					if err := l.roll(); err != nil {
+						log.L.Warnf("Couldn't start a new event log segment: %v", err.Error())
+					}
+				}
+
+				l.enforceRetention()
+			}
+			l.lock.Unlock()
+
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+//roll closes the active segment and starts a new one. Must be called with the lock held
+func (l *Log) roll() *nerr.E {
+	l.active.Sync()
+	if err := l.active.Close(); err != nil {
+		log.L.Warnf("Couldn't close event log segment: %v", err.Error())
+	}
+	l.active = nil
+
+	if err := l.startSegment(); err != nil {
+		return err
+	}
+
+	l.enforceRetention()
+	return nil
+}
+
+//startSegment creates a new segment starting at the next offset, and makes it the active one. Must be called with the lock held
+func (l *Log) startSegment() *nerr.E {
+	path := filepath.Join(l.opts.Dir, segmentName(l.next))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nerr.Translate(err).Addf("couldn't create segment %v", path)
+	}
+
+	l.active = f
+	l.started = time.Now()
+	l.segments = append(l.segments, &segment{
+		base:    l.next,
+		path:    path,
+		modTime: l.started,
+	})
+
+	log.L.Debugf("Started event log segment %v", path)
+	return nil
+}
+
+//enforceRetention deletes the oldest segments until the log is within its size and time limits. Must be called with the lock held
+func (l *Log) enforceRetention() {
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		tooBig := l.opts.MaxSize > 0 && total > l.opts.MaxSize
+		tooOld := l.opts.Retention > 0 && time.Since(oldest.modTime) > l.opts.Retention
+		if !tooBig && !tooOld {
+			return
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.L.Warnf("Couldn't delete event log segment %v: %v", oldest.path, err.Error())
+			return
+		}
+
+		log.L.Infof("Deleted event log segment %v", oldest.path)
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+}
@@ -0,0 +1,209 @@
+package eventlog
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+func testEvent(i int) base.HubEventWrapper {
+	return base.HubEventWrapper{
+		EventWrapper: base.EventWrapper{
+			Room:  fmt.Sprintf("ITB-%04d", i),
+			Event: []byte(fmt.Sprintf(`{"key":"power","value":"%v"}`, i)),
+		},
+		Source:   base.Messenger,
+		SourceID: "producer",
+	}
+}
+
+//TestSubmit submits enough events to roll the segments in the middle of a batch, and checks they're all there, in order, once the log is opened again
+func TestSubmit(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.SegmentSize = 1024
+
+	l, err := Open(o)
+	if err != nil {
+		t.Fatalf("couldn't open the log: %v", err.Error())
+	}
+
+	const count = 200
+	for i := 0; i < count; i++ {
+		if !l.Submit(testEvent(i)) {
+			t.Fatalf("event %v was dropped", i)
+		}
+	}
+
+	//closing appends everything that's still queued
+	if err := l.Close(); err != nil {
+		t.Fatalf("couldn't close the log: %v", err.Error())
+	}
+	if l.Submit(testEvent(count)) {
+		t.Fatalf("an event was submitted to a closed log")
+	}
+
+	status := l.GetStatus()
+	if status.Appended != count || status.Errors != 0 || status.Dropped != 0 {
+		t.Fatalf("got status %+v, want %v appended", status, count)
+	}
+	if status.Segments < 2 {
+		t.Fatalf("the log only has %v segments, it should have rolled", status.Segments)
+	}
+
+	l, err = Open(o)
+	if err != nil {
+		t.Fatalf("couldn't open the log again: %v", err.Error())
+	}
+	defer l.Close()
+
+	next := uint64(0)
+	err = l.Replay(Query{}, func(r Record) bool {
+		if r.Offset != next || r.Room != testEvent(int(next)).Room {
+			t.Fatalf("got record %v for %v, want %v for %v", r.Offset, r.Room, next, testEvent(int(next)).Room)
+		}
+		next++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("couldn't replay the log: %v", err.Error())
+	}
+	if next != count {
+		t.Fatalf("replayed %v records, want %v", next, count)
+	}
+
+	if offset, err := l.Append(testEvent(count)); err != nil || offset != count {
+		t.Fatalf("Append returned offset %v (%v), want %v", offset, err, count)
+	}
+}
+
+func TestSubmitDropsWhenFull(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.QueueSize = 1
+
+	l, err := Open(o)
+	if err != nil {
+		t.Fatalf("couldn't open the log: %v", err.Error())
+	}
+	defer l.Close()
+
+	//hold the lock so the writer can't take anything off the queue
+	l.lock.Lock()
+	submitted := 0
+	for i := 0; i < 10; i++ {
+		if l.Submit(testEvent(i)) {
+			submitted++
+		}
+	}
+	l.lock.Unlock()
+
+	//the writer may have taken one event before it blocked on the lock
+	if submitted < 1 || submitted > 2 {
+		t.Fatalf("submitted %v events to a queue of 1", submitted)
+	}
+	if dropped := l.GetStatus().Dropped; dropped != uint64(10-submitted) {
+		t.Fatalf("dropped %v events, want %v", dropped, 10-submitted)
+	}
+}
+
+//failingFile writes half of what it's given and fails, the next time it's written to
+type failingFile struct {
+	segmentFile
+	fail         bool
+	failTruncate bool
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	if !f.fail {
+		return f.segmentFile.Write(b)
+	}
+
+	f.fail = false
+	n, _ := f.segmentFile.Write(b[:len(b)/2])
+	return n, fmt.Errorf("disk full")
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return fmt.Errorf("read-only file system")
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+//TestPartialWrite fails a write halfway through, and checks the events appended after it are still there once the log is opened again
+func TestPartialWrite(t *testing.T) {
+	for _, failTruncate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("truncate fails=%v", failTruncate), func(t *testing.T) {
+			o := DefaultOptions()
+			o.Dir = t.TempDir()
+
+			l, err := Open(o)
+			if err != nil {
+				t.Fatalf("couldn't open the log: %v", err.Error())
+			}
+
+			if _, err := l.Append(testEvent(0)); err != nil {
+				t.Fatalf("couldn't append: %v", err.Error())
+			}
+
+			l.lock.Lock()
+			l.active = &failingFile{segmentFile: l.active, fail: true, failTruncate: failTruncate}
+			l.lock.Unlock()
+
+			if _, err := l.Append(testEvent(1)); err == nil {
+				t.Fatalf("the failed write was appended")
+			}
+
+			//the offset of the failed write is given out again
+			for i := 2; i < 4; i++ {
+				if offset, err := l.Append(testEvent(i)); err != nil || offset != uint64(i-1) {
+					t.Fatalf("Append returned offset %v (%v), want %v", offset, err, i-1)
+				}
+			}
+
+			wantSegments := 1
+			if failTruncate {
+				wantSegments = 2
+			}
+			if status := l.GetStatus(); status.Segments != wantSegments || status.NextOffset != 3 {
+				t.Fatalf("got status %+v, want %v segments and next offset 3", status, wantSegments)
+			}
+
+			replay := func(l *Log) []string {
+				rooms := []string{}
+				err := l.Replay(Query{}, func(r Record) bool {
+					if r.Offset != uint64(len(rooms)) {
+						t.Fatalf("got offset %v, want %v", r.Offset, len(rooms))
+					}
+					rooms = append(rooms, r.Room)
+					return true
+				})
+				if err != nil {
+					t.Fatalf("couldn't replay the log: %v", err.Error())
+				}
+				return rooms
+			}
+
+			want := fmt.Sprint([]string{testEvent(0).Room, testEvent(2).Room, testEvent(3).Room})
+			if got := fmt.Sprint(replay(l)); got != want {
+				t.Fatalf("replayed %v, want %v", got, want)
+			}
+			l.Close()
+
+			l, err = Open(o)
+			if err != nil {
+				t.Fatalf("couldn't open the log again: %v", err.Error())
+			}
+			defer l.Close()
+
+			if got := fmt.Sprint(replay(l)); got != want {
+				t.Fatalf("replayed %v after opening the log again, want %v", got, want)
+			}
+			if next := l.GetStatus().NextOffset; next != 3 {
+				t.Fatalf("the next offset is %v after opening the log again, want 3", next)
+			}
+		})
+	}
+}
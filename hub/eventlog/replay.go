@@ -0,0 +1,118 @@
+package eventlog
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Query picks the records to replay
+type Query struct {
+	//From is the first offset to replay
+	From uint64
+
+	//Since skips the records appended before it
+	Since time.Time
+
+	//Room is the room to replay, or a pattern ending in '*'. Empty or "*" replays every room
+	Room string
+}
+
+//Matches returns true if the record matches the query
+func (q Query) Matches(r Record) bool {
+	if r.Offset < q.From {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+
+	switch {
+	case len(q.Room) == 0 || q.Room == "*":
+		return true
+	case strings.HasSuffix(q.Room, "*"):
+		return strings.HasPrefix(r.Room, strings.TrimSuffix(q.Room, "*"))
+	default:
+		return q.Room == r.Room
+	}
+}
+
+//Replay calls fn with each record that matches the query, oldest first, until fn returns false.
+//Only the records in the log when Replay is called are replayed, so a replay always ends even if events keep being appended.
+func (l *Log) Replay(q Query, fn func(Record) bool) *nerr.E {
+	l.lock.Lock()
+	end := l.next
+	segments := make([]segment, len(l.segments))
+	for i := range l.segments {
+		segments[i] = *l.segments[i]
+	}
+	l.lock.Unlock()
+
+	//skip to the segment holding the first offset
+	start := 0
+	for i := range segments {
+		if segments[i].base <= q.From {
+			start = i
+		}
+	}
+
+	for i := start; i < len(segments); i++ {
+		s := segments[i]
+
+		//a segment that was last written to before Since can't have anything newer in it
+		if !q.Since.IsZero() && s.modTime.Before(q.Since) {
+			continue
+		}
+
+		done, err := s.replay(q, end, fn)
+		if err != nil && i < len(segments)-1 {
+			//a write that failed partway through can leave a bad record at the end of a segment, and the log goes on in the next one
+			log.L.Warnf("Skipping the rest of event log segment %v: %v", s.path, err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+//replay replays the part of the segment that was written when the replay started. Returns true if fn asked to stop, or the end offset was reached
+func (s segment) replay(q Query, end uint64, fn func(Record) bool) (bool, *nerr.E) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		//it was deleted by the retention since the replay started
+		return false, nil
+	}
+	if err != nil {
+		return false, nerr.Translate(err).Addf("couldn't open segment %v", s.path)
+	}
+	defer f.Close()
+
+	done := false
+	err = readRecords(io.LimitReader(f, s.size), func(rec Record, _ int64) bool {
+		if rec.Offset >= end {
+			done = true
+			return false
+		}
+
+		if q.Matches(rec) && !fn(rec) {
+			done = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return false, nerr.Translate(err).Addf("couldn't read segment %v", s.path)
+	}
+
+	return done, nil
+}
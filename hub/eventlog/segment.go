@@ -0,0 +1,127 @@
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//segment is one file of the log. Only the last segment is ever written to
+type segment struct {
+	base    uint64 //the first offset in the segment
+	path    string
+	size    int64
+	modTime time.Time //when the segment was last written to
+}
+
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%020d%v", base, segmentExt)
+}
+
+//listSegments returns the segments in the directory, oldest first
+func listSegments(dir string) ([]*segment, *nerr.E) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't read event log directory %v", dir)
+	}
+
+	toReturn := []*segment{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+
+		base, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			log.L.Warnf("Ignoring unknown file %v in the event log directory", f.Name())
+			continue
+		}
+
+		toReturn = append(toReturn, &segment{
+			base:    base,
+			path:    filepath.Join(dir, f.Name()),
+			size:    f.Size(),
+			modTime: f.ModTime(),
+		})
+	}
+
+	sort.Slice(toReturn, func(i, j int) bool {
+		return toReturn[i].base < toReturn[j].base
+	})
+	return toReturn, nil
+}
+
+//recover reads the segment to find the next offset and the time of its first record. Anything after the last complete record (e.g. from a crash halfway through a write) is cut off
+func (s *segment) recover() (uint64, time.Time, *nerr.E) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, time.Time{}, nerr.Translate(err).Addf("couldn't open segment %v", s.path)
+	}
+	defer f.Close()
+
+	next := s.base
+	started := time.Now()
+
+	var good int64
+	err = readRecords(f, func(rec Record, end int64) bool {
+		if good == 0 {
+			started = rec.Time
+		}
+
+		next = rec.Offset + 1
+		good = end
+		return true
+	})
+	if err != nil {
+		log.L.Warnf("Segment %v ends with a bad record, cutting it off at %v bytes: %v", s.path, good, err.Error())
+	}
+
+	if good < s.size {
+		if err := os.Truncate(s.path, good); err != nil {
+			return 0, time.Time{}, nerr.Translate(err).Addf("couldn't truncate segment %v", s.path)
+		}
+		s.size = good
+	}
+
+	return next, started, nil
+}
+
+//readRecords calls fn with each record in r, and the position just past it, until fn returns false. A partial or invalid record stops the read with an error
+func readRecords(r io.Reader, fn func(rec Record, end int64) bool) error {
+	reader := bufio.NewReader(r)
+
+	var pos int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return fmt.Errorf("partial record at %v", pos)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("invalid record at %v: %v", pos, err)
+		}
+
+		pos += int64(len(line))
+		if !fn(rec, pos) {
+			return nil
+		}
+	}
+}
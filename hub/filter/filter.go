@@ -0,0 +1,349 @@
+/*
+Package filter compiles the content filters messengers attach to their subscriptions, so the hub only sends them the events they care about.
+
+A filter is a set of comparisons on the fields of an event, joined with && and ||, negated with !, and grouped with parentheses:
+
+	key == "power" && (value == "on" || value == "standby")
+	system =~ "^ITB-1101-CP[0-9]+$" && !(tags == "heartbeat")
+
+The fields are key, value, device, room, building, user, system (the generating system), and tags.
+The operators are == and != for exact matches, and =~ and !~ for regular expressions. Comparing tags checks each of the event's tags; == and =~ match if any tag matches, != and !~ match if none do.
+Values may be quoted, or left bare if they don't contain spaces or operators.
+*/
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/byuoitav/common/nerr"
+	"github.com/byuoitav/common/v2/events"
+)
+
+//Filter is a compiled filter expression
+type Filter struct {
+	expr string
+	root node
+}
+
+//Compile parses the expression into a filter
+func Compile(expr string) (*Filter, *nerr.E) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err.Addf("invalid filter %q", expr)
+	}
+
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err.Addf("invalid filter %q", expr)
+	}
+
+	if !p.done() {
+		return nil, nerr.Create(fmt.Sprintf("invalid filter %q: unexpected %q", expr, p.peek().val), "invalid-filter")
+	}
+
+	return &Filter{
+		expr: expr,
+		root: root,
+	}, nil
+}
+
+//Match returns true if the event passes the filter. A nil filter matches everything
+func (f *Filter) Match(e events.Event) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.eval(e)
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+type node interface {
+	eval(events.Event) bool
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(e events.Event) bool {
+	return n.left.eval(e) && n.right.eval(e)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(e events.Event) bool {
+	return n.left.eval(e) || n.right.eval(e)
+}
+
+type notNode struct {
+	child node
+}
+
+func (n notNode) eval(e events.Event) bool {
+	return !n.child.eval(e)
+}
+
+type compareNode struct {
+	field  string
+	negate bool
+	value  string
+	re     *regexp.Regexp
+}
+
+func (n compareNode) eval(e events.Event) bool {
+	if n.field == "tags" {
+		for _, t := range e.EventTags {
+			if n.matches(t) {
+				return !n.negate
+			}
+		}
+		return n.negate
+	}
+
+	return n.matches(fieldValue(n.field, e)) != n.negate
+}
+
+func (n compareNode) matches(v string) bool {
+	if n.re != nil {
+		return n.re.MatchString(v)
+	}
+	return v == n.value
+}
+
+var fields = map[string]string{
+	"key":               "key",
+	"value":             "value",
+	"device":            "device",
+	"room":              "room",
+	"building":          "building",
+	"user":              "user",
+	"system":            "system",
+	"generating-system": "system",
+	"tags":              "tags",
+	"tag":               "tags",
+}
+
+func fieldValue(field string, e events.Event) string {
+	switch field {
+	case "key":
+		return e.Key
+	case "value":
+		return e.Value
+	case "device":
+		return e.TargetDevice.DeviceID
+	case "room":
+		return e.AffectedRoom.RoomID
+	case "building":
+		return e.AffectedRoom.BuildingID
+	case "user":
+		return e.User
+	case "system":
+		return e.GeneratingSystem
+	}
+	return ""
+}
+
+const (
+	tokWord = iota
+	tokString
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+	tokOpen
+	tokClose
+)
+
+type token struct {
+	kind int
+	val  string
+}
+
+func tokenize(expr string) ([]token, *nerr.E) {
+	toks := []token{}
+	r := []rune(expr)
+
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{tokOpen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokClose, ")"})
+			i++
+		case strings.HasPrefix(string(r[i:]), "&&"):
+			toks = append(toks, token{tokAnd, "&&"})
+			i += 2
+		case strings.HasPrefix(string(r[i:]), "||"):
+			toks = append(toks, token{tokOr, "||"})
+			i += 2
+		case strings.HasPrefix(string(r[i:]), "=="), strings.HasPrefix(string(r[i:]), "!="),
+			strings.HasPrefix(string(r[i:]), "=~"), strings.HasPrefix(string(r[i:]), "!~"):
+			toks = append(toks, token{tokOp, string(r[i : i+2])})
+			i += 2
+		case c == '!':
+			toks = append(toks, token{tokNot, "!"})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(r) && r[i] != '"'; i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				sb.WriteRune(r[i])
+			}
+			if i >= len(r) {
+				return nil, nerr.Create("unterminated string", "invalid-filter")
+			}
+			toks = append(toks, token{tokString, sb.String()})
+			i++
+		default:
+			start := i
+			for i < len(r) && !unicode.IsSpace(r[i]) && !strings.ContainsRune(`()!=&|"`, r[i]) {
+				i++
+			}
+			if start == i {
+				return nil, nerr.Create(fmt.Sprintf("unexpected %q", c), "invalid-filter")
+			}
+			toks = append(toks, token{tokWord, string(r[start:i])})
+		}
+	}
+
+	return toks, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1, val: "end of filter"}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) parseOr() (node, *nerr.E) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, *nerr.E) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, *nerr.E) {
+	switch p.peek().kind {
+	case tokNot:
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+
+	case tokOpen:
+		p.next()
+		child, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokClose {
+			return nil, nerr.Create("missing ')'", "invalid-filter")
+		}
+		return child, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, *nerr.E) {
+	f := p.next()
+	if f.kind != tokWord {
+		return nil, nerr.Create(fmt.Sprintf("expected a field, got %q", f.val), "invalid-filter")
+	}
+
+	field, ok := fields[strings.ToLower(f.val)]
+	if !ok {
+		return nil, nerr.Create(fmt.Sprintf("unknown field %q", f.val), "invalid-filter")
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, nerr.Create(fmt.Sprintf("expected an operator after %v, got %q", f.val, op.val), "invalid-filter")
+	}
+
+	v := p.next()
+	if v.kind != tokWord && v.kind != tokString {
+		return nil, nerr.Create(fmt.Sprintf("expected a value after %v %v, got %q", f.val, op.val, v.val), "invalid-filter")
+	}
+
+	toReturn := compareNode{
+		field:  field,
+		negate: op.val[0] == '!',
+		value:  v.val,
+	}
+
+	if op.val[1] == '~' {
+		re, err := regexp.Compile(v.val)
+		if err != nil {
+			return nil, nerr.Translate(err).Addf("invalid regular expression %q", v.val)
+		}
+		toReturn.re = re
+	}
+
+	return toReturn, nil
+}
@@ -0,0 +1,100 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/byuoitav/common/v2/events"
+)
+
+var testEvent = events.Event{
+	GeneratingSystem: "ITB-1101-CP1",
+	EventTags:        []string{"core-state", "heartbeat"},
+	TargetDevice:     events.BasicDeviceInfo{DeviceID: "ITB-1101-D1"},
+	AffectedRoom:     events.BasicRoomInfo{BuildingID: "ITB", RoomID: "ITB-1101"},
+	Key:              "power",
+	Value:            "on",
+	User:             "someone",
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`key == "power"`, true},
+		{`key == power`, true},
+		{`key != power`, false},
+		{`KEY == power`, true},
+		{`value == "standby"`, false},
+		{`device == ITB-1101-D1`, true},
+		{`room == ITB-1101`, true},
+		{`building == JFSB`, false},
+		{`user == someone`, true},
+		{`system == ITB-1101-CP1`, true},
+		{`generating-system == ITB-1101-CP1`, true},
+		{`system =~ "^ITB-1101-CP[0-9]+$"`, true},
+		{`system !~ "^ITB-1101-CP[0-9]+$"`, false},
+		{`tags == heartbeat`, true},
+		{`tag == heartbeat`, true},
+		{`tags != heartbeat`, false},
+		{`tags != alert`, true},
+		{`tags =~ "^core"`, true},
+		{`tags !~ "^core"`, false},
+		{`key == power && value == on`, true},
+		{`key == power && value == off`, false},
+		{`key == input || value == on`, true},
+		{`key == input || value == off`, false},
+		{`!(key == input)`, true},
+		{`!key == power`, false},
+		{`key == power && (value == "on" || value == "standby")`, true},
+		{`key == input || key == power && value == off`, false},
+		{`(key == input || key == power) && !(tags == heartbeat)`, false},
+		{`value == "with \"quotes\""`, false},
+	}
+
+	for _, tt := range tests {
+		f, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%v) failed: %v", tt.expr, err.Error())
+			continue
+		}
+
+		if got := f.Match(testEvent); got != tt.want {
+			t.Errorf("%v matched %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`key`,
+		`key ==`,
+		`key power`,
+		`color == red`,
+		`key == "power`,
+		`(key == power`,
+		`key == power)`,
+		`key == power &&`,
+		`key == power value == on`,
+		`key =~ "["`,
+		`== power`,
+		`key == &&`,
+	}
+
+	for _, expr := range tests {
+		if f, err := Compile(expr); err == nil {
+			t.Errorf("Compile(%v) = %v, expected an error", expr, f)
+		}
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	if !f.Match(testEvent) {
+		t.Errorf("a nil filter should match everything")
+	}
+	if f.String() != "" {
+		t.Errorf("a nil filter should print as an empty string")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -10,11 +11,12 @@ import (
 	"sync"
 	"time"
 
-	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/discovery"
 	"github.com/byuoitav/central-event-system/hub/hubconn"
 	"github.com/byuoitav/central-event-system/hub/nexus"
 	"github.com/byuoitav/common/db"
 	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
 	"github.com/byuoitav/common/v2/events"
 	"github.com/labstack/echo"
 )
@@ -22,34 +24,51 @@ import (
 // TODO put port into a const
 var dev sync.Once
 
-//CreateInterconnection . fyi this will NOT work :)
-func CreateInterconnection(context echo.Context, n *nexus.Nexus) error {
-	hubaddr := context.Param("address")
-	err := hubconn.OpenConnection(hubaddr+":7100", "/connect/hub", base.Hub, n, false)
+//processorRegex matches the processor number at the end of a hub's name, e.g. the 2 in ITB-1101-CP2
+var processorRegex = regexp.MustCompile(`[a-zA-z]+(\d+)$`)
+
+//processorNumber returns the processor number at the end of a hub's name, and false if it doesn't end in one
+func processorNumber(name string) (int, bool) {
+	matches := processorRegex.FindAllStringSubmatch(name, -1)
+	if len(matches) != 1 {
+		return 0, false
+	}
+
+	num, err := strconv.Atoi(matches[0][1])
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+//CreateInterconnection adds a link to the hub at address with the default retry policy, like POST /links. The address may leave out the scheme and port, or be escaped if it has them. It's kept for the hubs and scripts that used it before POST /links
+func CreateInterconnection(context echo.Context, n *nexus.Nexus, conf *hubconn.Config) error {
+	hubaddr, uerr := url.PathUnescape(context.Param("address"))
+	if uerr != nil {
+		return context.String(http.StatusBadRequest, "invalid address")
+	}
+	_, _, err := hubconn.AddLink(hubaddr, "", hubconn.LinkSourceAPI, hubconn.DefaultRetryPolicy, n, conf)
 	if err != nil {
-		return context.String(http.StatusInternalServerError, fmt.Sprintf("Couldn't establish hub connction: %v", err.Error()))
+		return context.String(http.StatusBadRequest, fmt.Sprintf("Couldn't establish hub connction: %v", err.Error()))
 	}
 
 	return context.String(http.StatusOK, "ok")
 }
 
-// GetHubAddresses returns a list of hubs this hub should try to connect to.
-func GetHubAddresses() []string {
+// GetHubAddresses returns a list of hubs this hub should try to connect to, using scheme (ws:// or wss://).
+func GetHubAddresses(scheme string) []string {
 	log.L.Infof("Getting list of hubs I should connect to")
 	addresses := []string{}
 
 	id := os.Getenv("SYSTEM_ID")
 	roomID := events.GenerateBasicDeviceInfo(id).RoomID
 
-	regexStr := `[a-zA-z]+(\d+)$`
-	re := regexp.MustCompile(regexStr)
-	matches := re.FindAllStringSubmatch(id, -1)
-	if len(matches) != 1 {
+	myNum, ok := processorNumber(id)
+	if !ok {
 		log.L.Infof("Event router limited to only Control Processors.")
 		return nil
 	}
 
-	myNum, _ := strconv.Atoi(matches[0][1])
 	log.L.Debugf("My processor number: %v", myNum)
 
 	for {
@@ -72,7 +91,7 @@ func GetHubAddresses() []string {
 					log.L.Infof("Development device. Adding all hubs in room")
 				})
 
-				addresses = append(addresses, "ws://"+device.Address+":7100")
+				addresses = append(addresses, scheme+device.Address+":7100")
 				continue
 			}
 
@@ -82,22 +101,13 @@ func GetHubAddresses() []string {
 			}
 
 			log.L.Debugf("Considering device: %v", device.ID)
-			matches = re.FindAllStringSubmatch(device.Name, -1)
-			if len(matches) != 1 {
-				continue
-			}
-
-			num, err := strconv.Atoi(matches[0][1])
-			if err != nil {
-				continue
-			}
-
-			if num < myNum {
+			num, ok := processorNumber(device.Name)
+			if !ok || num < myNum {
 				continue
 			}
 
 			log.L.Debugf("Adding hub %v to address list.", device.Address)
-			addresses = append(addresses, "ws://"+device.Address+":7100")
+			addresses = append(addresses, scheme+device.Address+":7100")
 		}
 
 		break
@@ -106,3 +116,196 @@ func GetHubAddresses() []string {
 	log.L.Infof("Done. Found %v routers", len(addresses))
 	return addresses
 }
+
+//discoveryModes reads how a room hub finds the other hubs in its room from HUB_DISCOVERY, a comma separated list of db (the database, the default) and multicast (see DiscoverHubs)
+func discoveryModes() (fromDB, multicast bool) {
+	v := os.Getenv("HUB_DISCOVERY")
+	if len(v) == 0 {
+		return true, false
+	}
+
+	for _, mode := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(mode)) {
+		case "db":
+			fromDB = true
+		case "multicast":
+			multicast = true
+		case "":
+		default:
+			log.L.Fatalf("Invalid HUB_DISCOVERY %v: the modes are db and multicast", v)
+		}
+	}
+	return fromDB, multicast
+}
+
+//DiscoverHubs announces this hub to the other hubs on the local network, and adds a link to each hub in its room that this hub should dial, with the same processor number rule as GetHubAddresses.
+//port and scheme (ws:// or wss://) are where the other hubs can reach this one. Returns nil if this hub isn't a control processor
+func DiscoverHubs(o discovery.Options, port int, scheme string, n *nexus.Nexus, conf *hubconn.Config) (*discovery.Discoverer, *nerr.E) {
+	id := n.ID()
+	roomID := events.GenerateBasicDeviceInfo(id).RoomID
+
+	myNum, ok := processorNumber(id)
+	if !ok {
+		log.L.Infof("Event router limited to only Control Processors.")
+		return nil, nil
+	}
+
+	d, err := discovery.New(o, discovery.Announcement{
+		ID:     id,
+		Room:   roomID,
+		Port:   port,
+		Scheme: strings.TrimSuffix(scheme, "://"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	links := &discoveredLinks{
+		n:      n,
+		conf:   conf,
+		linked: make(map[string]string),
+		moving: make(map[string]string),
+	}
+
+	inRoom := func(h discovery.Hub) bool {
+		if h.Room != roomID {
+			log.L.Debugf("Ignoring hub %v, it's in %v", h.ID, h.Room)
+			return false
+		}
+
+		if len(os.Getenv("DEV_HUB")) == 0 {
+			num, ok := processorNumber(h.ID)
+			if !ok || num < myNum {
+				log.L.Debugf("Not connecting to hub %v, it connects to this one", h.ID)
+				return false
+			}
+		}
+		return true
+	}
+
+	go func() {
+		err := d.Run(func(h discovery.Hub) {
+			if inRoom(h) {
+				links.found(h)
+			}
+		}, links.lost)
+
+		if err != nil {
+			log.L.Errorf("Stopped discovering hubs: %v", err.Error())
+		}
+	}()
+
+	return d, nil
+}
+
+//discoveredLinks are the links to the hubs found by DiscoverHubs
+type discoveredLinks struct {
+	n    *nexus.Nexus
+	conf *hubconn.Config
+
+	lock sync.Mutex
+	//linked is the address each hub is linked at
+	linked map[string]string
+	//moving is the address a hub was last heard from, while it's not yet known to be the same hub as the one at its linked address
+	moving map[string]string
+}
+
+//found links to a hub the first time it's heard from. If it shows up at another address, the link there is added next to the old one, and the old one is only removed once the new one reaches the same hub
+func (dl *discoveredLinks) found(h discovery.Hub) {
+	dl.lock.Lock()
+	prev, ok := dl.linked[h.ID]
+	if ok {
+		if prev == h.Address {
+			//it's back where it's linked, so any move in progress is abandoned
+			delete(dl.moving, h.ID)
+		} else {
+			dl.moving[h.ID] = h.Address
+		}
+	}
+	dl.lock.Unlock()
+
+	log.L.Infof("Opening hub interconnection with %v at %v", h.ID, h.Address)
+	if _, _, err := hubconn.AddLink(h.Address, h.ID, hubconn.LinkSourceDiscovery, hubconn.DefaultRetryPolicy, dl.n, dl.conf); err != nil {
+		log.L.Warnf("Couldn't add a link to %v: %v", h.ID, err.Error())
+		return
+	}
+
+	switch {
+	case !ok:
+		dl.lock.Lock()
+		dl.linked[h.ID] = h.Address
+		dl.lock.Unlock()
+	case prev != h.Address:
+		go dl.confirm(h, prev)
+	}
+}
+
+//confirm waits for the link to a hub's new address to connect, and moves the hub there if the peer's hello ID is the hub's. Otherwise the new link is removed and the old one is kept
+func (dl *discoveredLinks) confirm(h discovery.Hub, prev string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		dl.lock.Lock()
+		if dl.moving[h.ID] != h.Address {
+			//the hub moved again, came back, or was lost
+			if dl.linked[h.ID] != h.Address {
+				dl.remove(h.Address)
+			}
+			dl.lock.Unlock()
+			return
+		}
+
+		l, ok := hubconn.GetLink(h.Address, dl.conf)
+		switch {
+		case !ok:
+			//the link was removed from somewhere else
+			delete(dl.moving, h.ID)
+		case l.State == hubconn.LinkConnected && l.PeerID == h.ID:
+			log.L.Infof("Hub %v moved from %v to %v", h.ID, prev, h.Address)
+			dl.remove(prev)
+			dl.linked[h.ID] = h.Address
+			delete(dl.moving, h.ID)
+		case l.State == hubconn.LinkConnected:
+			log.L.Warnf("Hub %v was announced at %v, but %v answered there. Keeping the link at %v", h.ID, h.Address, l.PeerID, prev)
+			dl.remove(h.Address)
+			delete(dl.moving, h.ID)
+		case l.State == hubconn.LinkFailed:
+			log.L.Warnf("Couldn't move hub %v to %v: %v. Keeping the link at %v", h.ID, h.Address, l.LastError, prev)
+			dl.remove(h.Address)
+			delete(dl.moving, h.ID)
+		default:
+			dl.lock.Unlock()
+			continue
+		}
+
+		dl.lock.Unlock()
+		return
+	}
+}
+
+//lost removes the links to a hub that stopped announcing itself
+func (dl *discoveredLinks) lost(h discovery.Hub) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if addr, ok := dl.linked[h.ID]; ok {
+		log.L.Infof("Removing the link to hub %v at %v, it stopped announcing itself", h.ID, addr)
+		dl.remove(addr)
+	}
+	if addr, ok := dl.moving[h.ID]; ok {
+		dl.remove(addr)
+	}
+
+	delete(dl.linked, h.ID)
+	delete(dl.moving, h.ID)
+}
+
+//remove removes the link to addr if discovery added it, links added from the database or through the api are left alone
+func (dl *discoveredLinks) remove(addr string) {
+	if l, ok := hubconn.GetLink(addr, dl.conf); ok && l.Source == hubconn.LinkSourceDiscovery {
+		if _, err := hubconn.RemoveLink(addr, dl.conf); err != nil {
+			log.L.Warnf("Couldn't remove the link to %v: %v", addr, err.Error())
+		}
+	}
+}
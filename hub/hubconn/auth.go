@@ -0,0 +1,46 @@
+package hubconn
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/byuoitav/central-event-system/hub/auth"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Authenticate checks the credentials on a request to connect as connType, and counts the requests that are turned away
+func (c *Config) Authenticate(req *http.Request, connType string) (auth.Identity, *nerr.E) {
+	id, err := c.authenticator.Authenticate(req, connType)
+	if err != nil {
+		log.L.Warnf("Turning away %v from %v: %v", connType, req.RemoteAddr, err.Error())
+
+		ConnectionsLock.Lock()
+		if counts, ok := connectionCounts[connType]; ok {
+			counts.Rejected++
+		}
+		ConnectionsLock.Unlock()
+		return id, err
+	}
+
+	return id, nil
+}
+
+//setCredentials sets the hub's credentials on the headers for connecting to another hub as connType
+func (c *Config) setCredentials(h http.Header, connType string) *nerr.E {
+	return auth.SetCredentials(h, c.credentials, connType)
+}
+
+//tlsConfig returns the tls config for connecting to another hub, or nil to use the default
+func (c *Config) tlsConfig() *tls.Config {
+	if c.certStore == nil {
+		return nil
+	}
+	return c.certStore.ClientConfig()
+}
+
+//unauthorized turns the request away
+func unauthorized(resp http.ResponseWriter) {
+	resp.Header().Set("WWW-Authenticate", auth.SchemeBearer+", "+auth.SchemeHMAC)
+	http.Error(resp, "unauthorized", http.StatusUnauthorized)
+}
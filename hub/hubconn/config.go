@@ -0,0 +1,56 @@
+package hubconn
+
+import (
+	"github.com/byuoitav/central-event-system/hub/auth"
+	"github.com/byuoitav/central-event-system/hub/certs"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Options configure the hub's connections
+type Options struct {
+	//Limits are the limits for each connection type, see LimitsFromEnv. A type without limits isn't limited
+	Limits map[string]Limits
+
+	//Authenticator checks the connections to the hub. Defaults to letting everyone in
+	Authenticator auth.Authenticator
+
+	//Credentials are sent when the hub connects to another hub. nil sends none
+	Credentials auth.Credentials
+
+	//Certificates are used to connect to other hubs over wss://. nil uses the system roots and sends no client certificate
+	Certificates *certs.Store
+
+	//Version is sent to other hubs in the hello
+	Version string
+}
+
+//Config is how the hub's connections are authenticated and limited. It's built once with NewConfig, and passed to CreateConnection and AddLink along with the nexus
+type Config struct {
+	authenticator auth.Authenticator
+	credentials   auth.Credentials
+	certStore     *certs.Store
+	version       string
+
+	//limits are the limits for each connection type, along with how often they've been hit
+	limits map[string]*typeLimits
+}
+
+//NewConfig validates the options and builds a config from them. The zero Options let everyone in and don't limit anything
+func NewConfig(o Options) (*Config, *nerr.E) {
+	limits, err := newTypeLimits(o.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Authenticator == nil {
+		o.Authenticator = auth.None{}
+	}
+
+	return &Config{
+		authenticator: o.Authenticator,
+		credentials:   o.Credentials,
+		certStore:     o.Certificates,
+		version:       o.Version,
+		limits:        limits,
+	}, nil
+}
@@ -1,12 +1,18 @@
 package hubconn
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/byuoitav/central-event-system/hub/auth"
 	"github.com/byuoitav/central-event-system/hub/base"
 	"github.com/byuoitav/central-event-system/hub/nexus"
 	"github.com/byuoitav/common/log"
@@ -30,57 +36,174 @@ const (
 	PingPeriod = (PongWait * 5) / 10
 )
 
-//Connections is the map of all active connections - used mostly for monitoring
+//GoingAwayReason is the reason sent in the close frame when the hub shuts down
+const GoingAwayReason = "going away, reconnect elsewhere"
+
+//Connections is the map of all active connections - used mostly for monitoring. Hold ConnectionsLock to use it
 var (
-	Connections map[string]*connection
-	upgrader    = websocket.Upgrader{
+	Connections     map[string]*connection
+	ConnectionsLock sync.RWMutex
+	upgrader        = websocket.Upgrader{
 		ReadBufferSize:  2048,
 		WriteBufferSize: 2048,
 	}
+
+	connectionCounts map[string]*ConnectionCount
 )
 
 func init() {
 	Connections = map[string]*connection{}
+	connectionCounts = map[string]*ConnectionCount{
+		base.Messenger: {},
+		base.Repeater:  {},
+		base.Hub:       {},
+	}
+}
+
+//ConnectionCount represents the websocket connections of a single type
+type ConnectionCount struct {
+	Active      int    `json:"active"`
+	Connects    uint64 `json:"connects"`
+	Disconnects uint64 `json:"disconnects"`
+	Rejected    uint64 `json:"rejected"` //connections turned away by authentication
+	Refused     uint64 `json:"refused"`  //hub connections turned away for being to this hub, or to a hub there's already a connection to
+}
+
+//GetConnectionCounts returns the connection counts for each connection type
+func GetConnectionCounts() map[string]ConnectionCount {
+	ConnectionsLock.RLock()
+	defer ConnectionsLock.RUnlock()
+
+	toReturn := make(map[string]ConnectionCount, len(connectionCounts))
+	for k, v := range connectionCounts {
+		toReturn[k] = *v
+	}
+	return toReturn
+}
+
+//track adds the connection to Connections
+func (h *connection) track() {
+	ConnectionsLock.Lock()
+	defer ConnectionsLock.Unlock()
+
+	Connections[h.ID] = h
+	if c, ok := connectionCounts[h.Type]; ok {
+		c.Active++
+		c.Connects++
+	}
+}
+
+//untrack removes the connection from Connections
+func (h *connection) untrack() {
+	ConnectionsLock.Lock()
+	defer ConnectionsLock.Unlock()
+
+	if Connections[h.ID] != h {
+		return
+	}
+
+	delete(Connections, h.ID)
+	h.unclaim()
+	if c, ok := connectionCounts[h.Type]; ok {
+		c.Active--
+		c.Disconnects++
+	}
 }
 
 //connection represents a connection from the Hub to either a Hub, Spoke, Ingester, or Dispatcher
 type connection struct {
-	Type  string
-	ID    string
-	Rooms []string
-
-	WriteChannel chan base.EventWrapper
-	ReadChannel  chan base.EventWrapper
-	exitChan     chan bool
-	retry        bool // will try to reconnect if set to true
-	addr         string
-	path         string
-	connType     string
+	Type   string
+	ID     string
+	PeerID string //the ID of the hub on the other end, only set for hub connections
+	Rooms  []string
+
+	//Peer is the hello from the hub on the other end, and outbound is set if this hub dialed it
+	Peer     base.Hello
+	outbound bool
+
+	//Identity is who the peer authenticated as
+	Identity auth.Identity
+
+	WriteChannel    chan base.EventWrapper
+	PriorityChannel chan base.EventWrapper //high priority events, they're written before anything in WriteChannel
+	ReadChannel     chan base.EventWrapper
+	ControlChannel  chan base.ControlReply //answers to the messenger's subscription changes
+	exitChan        chan bool
+	retry           bool // will try to reconnect if set to true
+	policy          RetryPolicy
+	ctx             context.Context //the connection is closed, and not retried, once ctx is done. nil for the connections to the hub
+	link            *link           //the link the connection was opened for, if it was
+	addr            string
+	path            string
+	connType        string
+
+	//closing is set once the hub has sent the peer a close frame, so the connection isn't retried
+	closing int32
+
+	//limiter enforces the rate limits on the messages from the peer
+	limiter *limiter
+
+	//interest is the rooms the hub on the other end wants, and watcher collects the changes to ours if it wants to be sent them. Only set for hub connections
+	interest     *base.InterestSet
+	sendInterest bool
+	watcher      *nexus.InterestWatcher
+
+	//frameVersion is the frame version we write to the peer. It's accessed atomically since the read pump will upgrade it if the peer sends a newer frame
+	frameVersion int32
 
 	conn  *websocket.Conn
 	nexus *nexus.Nexus
+	conf  *Config
 }
 
 //CreateConnection promotes a regular http connection to a websocket, starts the read/write pumps, and registers it with the nexus
-func CreateConnection(resp http.ResponseWriter, req *http.Request, connType string, nexus *nexus.Nexus) error {
-	conn, err := upgrader.Upgrade(resp, req, nil)
+func CreateConnection(resp http.ResponseWriter, req *http.Request, connType string, nexus *nexus.Nexus, conf *Config) error {
+	identity, aerr := conf.Authenticate(req, connType)
+	if aerr != nil {
+		unauthorized(resp)
+		return aerr
+	}
+
+	if connType == base.Hub && !conf.refuse(resp, req, nexus) {
+		return nerr.Create("refused the hub connection", "refused")
+	}
+
+	conn, err := upgrader.Upgrade(resp, req, conf.upgradeHeaders(nexus))
 	if err != nil {
 		log.L.Errorf("Couldn't upgrade	Connection to a websocket: %v", err.Error())
 		return err
 	}
 	hubConn := &connection{
-		Type:         connType,
-		ID:           req.RemoteAddr + connType,
-		WriteChannel: make(chan base.EventWrapper, 1000),
-		ReadChannel:  make(chan base.EventWrapper, 5000),
-		exitChan:     make(chan bool, 2),
+		Type:            connType,
+		ID:              req.RemoteAddr + connType,
+		WriteChannel:    make(chan base.EventWrapper, 1000),
+		PriorityChannel: make(chan base.EventWrapper, 1000),
+		ReadChannel:     make(chan base.EventWrapper, 5000),
+		ControlChannel:  make(chan base.ControlReply, 100),
+		exitChan:        make(chan bool, 2),
+		limiter:         conf.newLimiter(connType),
+		frameVersion:    int32(base.NegotiateFrameVersion(req.Header)),
+		addr:            req.RemoteAddr,
+		Identity:        identity,
 
 		conn:  conn,
 		nexus: nexus,
+		conf:  conf,
+	}
+	if connType == base.Hub {
+		hubConn.Peer = base.HelloFromHeaders(req.Header)
+		hubConn.PeerID = hubConn.Peer.ID
+	}
+	hubConn.setInterest(req.Header)
+	log.L.Infof("[%v] connected as %v", hubConn.ID, identity)
+
+	//the other hub is told why in the close frame, there's no response to write
+	if err := hubConn.claimPeer(); err != nil {
+		return nil
 	}
 
 	//we need to register ourselves
-	nexus.RegisterConnection([]string{}, hubConn.WriteChannel, hubConn.ID, connType)
+	hubConn.register()
 
 	go hubConn.startReadPump()
 	hubConn.startWritePump()
@@ -88,21 +211,57 @@ func CreateConnection(resp http.ResponseWriter, req *http.Request, connType stri
 
 }
 
+//RetryPolicy is how long OpenConnectionWithRetry waits between attempts. The wait starts at Initial, and grows by half every 5 failed attempts up to Max
+type RetryPolicy struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+//DefaultRetryPolicy starts by waiting for 2 seconds, and waits at most 120 seconds between retries
+var DefaultRetryPolicy = RetryPolicy{
+	Initial: 2 * time.Second,
+	Max:     120 * time.Second,
+}
+
 //OpenConnectionWithRetry reaches out to another central event system and establishes a websocket with it, and then registers it with the nexus
 //Do not include protocol with addr,  path will have all leading and trailing `/` characters removed
-func OpenConnectionWithRetry(addr string, path string, connType string, nexus *nexus.Nexus) error {
+func OpenConnectionWithRetry(addr string, path string, connType string, nexus *nexus.Nexus, conf *Config) error {
+	return OpenConnectionWithRetryContext(context.Background(), addr, path, connType, nexus, conf, DefaultRetryPolicy)
+}
+
+//OpenConnectionWithRetryContext is OpenConnectionWithRetry with a retry policy. It gives up (returning ctx's error) once ctx is done, and the connection it opens is closed, and not retried, when ctx is done
+func OpenConnectionWithRetryContext(ctx context.Context, addr string, path string, connType string, nexus *nexus.Nexus, conf *Config, policy RetryPolicy) error {
+	return retryConnection(ctx, addr, path, connType, nexus, conf, policy, nil)
+}
+
+//retryConnection opens the connection like OpenConnectionWithRetryContext, keeping the link's status up to date if it's set
+func retryConnection(ctx context.Context, addr string, path string, connType string, nexus *nexus.Nexus, conf *Config, policy RetryPolicy, lnk *link) error {
 	log.L.Infof("attempting to open connection with %v %v.", connType, addr)
-	MaxBackoff := 120 * time.Second //Wait at most 60 seconds between retrys
-	curBackoff := 2 * time.Second   //Start by waiting for 2 seconds
+	MaxBackoff := policy.Max
+	curBackoff := policy.Initial
 	t := 0
 	l := 5
 
-	err := OpenConnection(addr, path, connType, nexus, true)
+	err := openConnection(ctx, addr, path, connType, nexus, conf, true, policy, lnk)
 
 	for err != nil {
+		//a hub at the address will always be this one, only a duplicate link might go through later
+		if isSelfLink(err) {
+			log.L.Warnf("%v %v is this hub, not retrying the connection", connType, addr)
+			lnk.stopped(err)
+			return err
+		}
+
+		lnk.failed(err)
 		log.L.Infof("connection to %v %v failed. Will retry in %s. ", connType, addr, curBackoff.String())
-		time.Sleep(curBackoff)
-		err = OpenConnection(addr, path, connType, nexus, true)
+		select {
+		case <-ctx.Done():
+			log.L.Infof("no longer trying to connect to %v %v", connType, addr)
+			return ctx.Err()
+		case <-time.After(curBackoff):
+		}
+
+		err = openConnection(ctx, addr, path, connType, nexus, conf, true, policy, lnk)
 		if err != nil {
 			if t >= l {
 				t = 0
@@ -123,36 +282,79 @@ func OpenConnectionWithRetry(addr string, path string, connType string, nexus *n
 
 //OpenConnection reaches out to another central event system and establishes a websocket with it, and then registers it with the nexus
 //Do not include protocol with addr,  path will have all leading and trailing `/` characters removed
-func OpenConnection(addr string, path string, connType string, nexus *nexus.Nexus, retry bool) error {
+func OpenConnection(addr string, path string, connType string, nexus *nexus.Nexus, conf *Config, retry bool) error {
+	return openConnection(context.Background(), addr, path, connType, nexus, conf, retry, DefaultRetryPolicy, nil)
+}
+
+func openConnection(ctx context.Context, addr string, path string, connType string, nexus *nexus.Nexus, conf *Config, retry bool, policy RetryPolicy, l *link) error {
 	// open connection to the router
 	dialer := &websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  conf.tlsConfig(),
 	}
 
 	path = strings.Trim(path, "/")
 
-	conn, _, err := dialer.Dial(fmt.Sprintf("%s/%s", addr, path), nil)
+	headers := conf.upgradeHeaders(nexus)
+	if err := conf.setCredentials(headers, connType); err != nil {
+		return err.Addf("couldn't set the credentials for %v", addr)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, fmt.Sprintf("%s/%s", addr, path), headers)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			return refusedError(addr, resp)
+		}
+		if resp != nil {
+			return nerr.Create(fmt.Sprintf("failed opening websocket with %v: %s (%v)", addr, err, resp.Status), "connection-error")
+		}
 		return nerr.Create(fmt.Sprintf("failed opening websocket with %v: %s", addr, err), "connection-error")
 	}
 
 	hubConn := &connection{
-		Type:         connType,
-		ID:           conn.RemoteAddr().String() + connType,
-		WriteChannel: make(chan base.EventWrapper, 1000),
-		ReadChannel:  make(chan base.EventWrapper, 5000),
-		exitChan:     make(chan bool, 2),
-		retry:        retry,
-		addr:         addr,
-		path:         path,
-		connType:     connType,
+		Type:            connType,
+		ID:              conn.RemoteAddr().String() + connType,
+		WriteChannel:    make(chan base.EventWrapper, 1000),
+		PriorityChannel: make(chan base.EventWrapper, 1000),
+		ReadChannel:     make(chan base.EventWrapper, 5000),
+		ControlChannel:  make(chan base.ControlReply, 100),
+		exitChan:        make(chan bool, 2),
+		limiter:         conf.newLimiter(connType),
+		retry:           retry,
+		policy:          policy,
+		ctx:             ctx,
+		link:            l,
+		addr:            addr,
+		path:            path,
+		connType:        connType,
+		outbound:        true,
+		frameVersion:    int32(base.NegotiateFrameVersion(resp.Header)),
 
 		conn:  conn,
 		nexus: nexus,
+		conf:  conf,
+	}
+	if connType == base.Hub {
+		hubConn.Peer = base.HelloFromHeaders(resp.Header)
+		hubConn.PeerID = hubConn.Peer.ID
+	}
+	hubConn.setInterest(resp.Header)
+
+	//over wss:// the other hub is who its certificate says it is
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		if subject, ok := auth.ConnectionSubject(&state); ok {
+			hubConn.Identity = auth.Identity{Subject: subject, Method: auth.MethodTLS}
+		}
+	}
+
+	if err := hubConn.claimPeer(); err != nil {
+		return err
 	}
 
 	//we need to register ourselves
-	nexus.RegisterConnection([]string{}, hubConn.WriteChannel, hubConn.ID, connType)
+	hubConn.register()
+	l.connected(hubConn)
 
 	go hubConn.startReadPump()
 	go hubConn.startWritePump()
@@ -160,10 +362,110 @@ func OpenConnection(addr string, path string, connType string, nexus *nexus.Nexu
 
 }
 
+//CloseAll sends every connection a close frame with the reason, and waits up to timeout for the peers to close them before closing the rest
+func CloseAll(reason string, timeout time.Duration) {
+	ConnectionsLock.RLock()
+	conns := make([]*connection, 0, len(Connections))
+	for _, h := range Connections {
+		conns = append(conns, h)
+	}
+	ConnectionsLock.RUnlock()
+
+	log.L.Infof("Closing %v connections: %v", len(conns), reason)
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	for _, h := range conns {
+		atomic.StoreInt32(&h.closing, 1)
+		if err := h.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteWait)); err != nil {
+			log.L.Warnf("Couldn't send close frame to %v: %v", h.ID, err.Error())
+		}
+	}
+
+	//the read pumps remove the connections once the peers close them
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ConnectionsLock.RLock()
+		left := len(Connections)
+		ConnectionsLock.RUnlock()
+
+		if left == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ConnectionsLock.RLock()
+	defer ConnectionsLock.RUnlock()
+	for _, h := range Connections {
+		log.L.Warnf("%v didn't close its connection, closing it", h.ID)
+		atomic.StoreInt32(&h.closing, 1)
+		h.conn.Close()
+	}
+}
+
+//upgradeHeaders are the headers sent by both sides of the websocket upgrade
+func (c *Config) upgradeHeaders(n *nexus.Nexus) http.Header {
+	h := base.FrameVersionHeaders()
+	c.localHello(n).SetHeaders(h)
+	h.Set(base.ControlHeader, base.ControlVersion)
+	h.Set(base.InterestHeader, base.InterestVersion)
+	return h
+}
+
+//registration returns the connection's registration with the nexus
+func (h *connection) registration() base.Registration {
+	r := base.Registration{
+		ID:              h.ID,
+		Channel:         h.WriteChannel,
+		PriorityChannel: h.PriorityChannel,
+		PeerID:          h.PeerID,
+		Outbound:        h.outbound,
+		Identity:        h.Identity.Subject,
+		Interest:        h.interest,
+	}
+
+	if h.Type == base.Hub && len(h.PeerID) > 0 {
+		peer := h.Peer
+		r.Peer = &peer
+	}
+
+	//repeaters are known by the host they connect from, so they get the same rooms back when they reconnect
+	if h.Type == base.Repeater {
+		host, _, err := net.SplitHostPort(h.addr)
+		if err != nil {
+			host = h.addr
+		}
+		r.Addr = host
+	}
+
+	return r
+}
+
+func (h *connection) register() {
+	h.track()
+
+	if h.sendInterest {
+		h.watcher = h.nexus.WatchInterest()
+	}
+
+	log.L.Debugf("Registring connection %v of type %v", h.ID, h.Type)
+	h.nexus.SubmitRegistrationChange(base.RegistrationChange{
+		Type:         h.Type,
+		Registration: h.registration(),
+		SubscriptionChange: base.SubscriptionChange{
+			Create: true,
+			Rooms:  []string{},
+		},
+	})
+}
+
 func (h *connection) startReadPump() {
 
 	defer func() {
 		log.L.Infof(color.HiBlueString("[%v] read pump closing", h.ID))
+		h.untrack()
+		if h.watcher != nil {
+			h.nexus.UnwatchInterest(h.watcher)
+		}
 		h.nexus.DeregisterConnection(h.Rooms, h.Type, h.ID)
 		h.exitChan <- true
 		h.conn.Close()
@@ -176,7 +478,7 @@ func (h *connection) startReadPump() {
 		return nil
 	})
 
-	//Spokes are the only ones that will send subscription messages, dispatchers and hubs won't
+	//Spokes are the only ones that will send subscription messages, dispatchers won't, and hubs only send their interest
 	for {
 		messageType, b, err := h.conn.ReadMessage()
 		if err != nil {
@@ -198,12 +500,22 @@ func (h *connection) startReadPump() {
 
 			//else we submit the subscription chagne
 			change.Type = h.Type
-			change.ID = h.ID
-			change.Channel = h.WriteChannel
+			change.Registration = h.registration()
 
-			h.nexus.SubmitRegistrationChange(change)
+			if !h.handleControl(change) {
+				return
+			}
+		} else if h.Type == base.Hub && messageType == websocket.TextMessage && h.handleInterest(b) {
+			continue
 		} else {
-			h.ingestMessage(b)
+			ok, disconnect := h.limiter.allowEvent()
+			if disconnect {
+				h.closeForLimit()
+				return
+			}
+			if ok {
+				h.ingestMessage(b)
+			}
 		}
 	}
 }
@@ -216,32 +528,70 @@ func (h *connection) startWritePump() {
 		log.L.Infof("Write pump for %v closing...", h.ID)
 		ticker.Stop()
 		h.conn.Close()
-		if h.retry {
+		if h.retry && atomic.LoadInt32(&h.closing) == 0 && h.ctx.Err() == nil {
 			log.L.Infof("Connection %v is set for retry, will attempt to re-establish connection", h.ID)
-			go OpenConnectionWithRetry(h.addr, h.path, h.connType, h.nexus)
+			h.link.disconnected()
+			go retryConnection(h.ctx, h.addr, h.path, h.connType, h.nexus, h.conf, h.policy, h.link)
 		}
 	}()
 
+	var done <-chan struct{}
+	if h.ctx != nil {
+		done = h.ctx.Done()
+	}
+
+	var interest <-chan struct{}
+	if h.watcher != nil {
+		interest = h.watcher.Ready
+	}
+
 	for {
+		//high priority events always go out first
 		select {
+		case message := <-h.PriorityChannel:
+			if err := h.write(message); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case message := <-h.PriorityChannel:
+			if err := h.write(message); err != nil {
+				return
+			}
+
 		case message, ok := <-h.WriteChannel:
-			h.conn.SetWriteDeadline(time.Now().Add(WriteWait))
 			if !ok {
 				// The hub closed the channel.
 				h.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(WriteWait))
 				return
 			}
 
-			//write
-			err := h.conn.WriteMessage(websocket.BinaryMessage, base.PrepareMessage(message))
-			if err != nil {
-				log.L.Errorf("%v Error %v", h.ID, err.Error())
+			if err := h.write(message); err != nil {
+				return
+			}
+		case reply := <-h.ControlChannel:
+			if err := h.writeControl(reply); err != nil {
+				return
+			}
+
+		case <-interest:
+			if err := h.writeInterest(); err != nil {
 				return
 			}
+
 		case <-h.exitChan:
 			h.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(WriteWait))
 			return
 
+		case <-done:
+			log.L.Infof("Closing connection %v, it's no longer wanted", h.ID)
+			atomic.StoreInt32(&h.closing, 1)
+			h.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(WriteWait))
+			return
+
 		case <-ticker.C:
 			h.conn.SetWriteDeadline(time.Now().Add(WriteWait))
 			log.L.Infof("[%v] Sending ping.", h.ID)
@@ -253,10 +603,21 @@ func (h *connection) startWritePump() {
 	}
 }
 
+//write writes an event to the peer in the frame version it understands
+func (h *connection) write(message base.EventWrapper) error {
+	h.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	err := h.conn.WriteMessage(websocket.BinaryMessage, base.EncodeMessage(message, h.getFrameVersion()))
+	if err != nil {
+		log.L.Errorf("%v Error %v", h.ID, err.Error())
+	}
+	return err
+}
+
 /*
 Ingest message assumes an event in the format of:
 RoomID\n
 JSONEvent
+or a versioned frame
 */
 func (h *connection) ingestMessage(b []byte) {
 	m, err := base.ParseMessage(b)
@@ -264,9 +625,19 @@ func (h *connection) ingestMessage(b []byte) {
 		log.L.Warnf("Received badly formed event %s: %v", b, err.Error())
 		return
 	}
+
+	//if the peer is sending frames it can read them too
+	if m.Header.Version > h.getFrameVersion() {
+		log.L.Infof("[%v] peer speaks frame version %v", h.ID, m.Header.Version)
+		atomic.StoreInt32(&h.frameVersion, int32(m.Header.Version))
+	}
 	h.nexus.Submit(
 		m,
 		h.Type,
 		h.ID,
 	)
 }
+
+func (h *connection) getFrameVersion() int {
+	return int(atomic.LoadInt32(&h.frameVersion))
+}
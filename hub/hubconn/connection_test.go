@@ -0,0 +1,153 @@
+package hubconn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/gorilla/websocket"
+)
+
+//TestShutdown goes through what the hub does on SIGTERM: the nexus is drained, so a repeater gets every event it was sent, and then CloseAll closes the connection with a going away close frame
+func TestShutdown(t *testing.T) {
+	o := nexus.DefaultOptions()
+	o.Shards = 2
+	o.DedupWindow = 0
+	n, nerr := nexus.New(o)
+	if nerr != nil {
+		t.Fatalf("couldn't build the nexus: %v", nerr.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	conf, nerr := NewConfig(Options{})
+	if nerr != nil {
+		t.Fatalf("couldn't build the config: %v", nerr.Error())
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CreateConnection(w, r, base.Repeater, n, conf)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+srv.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.GetStatus().Repeaters) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the repeater didn't register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const count = 200
+	for i := 0; i < count; i++ {
+		if err := n.Submit(base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`)}, base.Messenger, "producer"); err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+	}
+
+	if !n.Drain(5 * time.Second) {
+		t.Fatalf("the nexus didn't drain")
+	}
+
+	//every event has been written by the time it's drained, so the close frame comes after all of them
+	closed := make(chan error, 1)
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; ; i++ {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if i != count {
+					t.Errorf("got %v events before the connection closed, want %v", i, count)
+				}
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	CloseAll(GoingAwayReason, time.Second)
+	if waited := time.Since(start); waited >= time.Second {
+		t.Fatalf("CloseAll waited %v, the repeater answered the close frame right away", waited)
+	}
+
+	err = <-closed
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) || err.(*websocket.CloseError).Text != GoingAwayReason {
+		t.Fatalf("the connection closed with %v, want a going away close frame", err)
+	}
+
+	ConnectionsLock.RLock()
+	left := len(Connections)
+	ConnectionsLock.RUnlock()
+	if left != 0 {
+		t.Fatalf("%v connections are left", left)
+	}
+}
+
+//TestWritePumpPriority queues a flood of normal events and then a high priority one before the write pump starts, and checks the high priority one is written first
+func TestWritePumpPriority(t *testing.T) {
+	const count = 100
+	exit := make(chan bool, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("couldn't upgrade: %v", err)
+			return
+		}
+
+		h := &connection{
+			ID:              "priority-test",
+			WriteChannel:    make(chan base.EventWrapper, count),
+			PriorityChannel: make(chan base.EventWrapper, 1),
+			ControlChannel:  make(chan base.ControlReply, 1),
+			exitChan:        exit,
+			frameVersion:    base.FrameVersion,
+			conn:            conn,
+		}
+		for i := 0; i < count; i++ {
+			h.WriteChannel <- base.EventWrapper{Room: fmt.Sprintf("ITB-%v", i), Event: []byte(`{"key":"heartbeat"}`)}
+		}
+		alarm := base.EventWrapper{Room: "ITB-1101", Event: []byte(`{"key":"fire-alarm"}`)}
+		alarm.Header.Set(base.HeaderPriority, base.PriorityHigh)
+		h.PriorityChannel <- alarm
+
+		h.startWritePump()
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+srv.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i <= count; i++ {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("couldn't read event %v: %v", i, err)
+		}
+		e, nerr := base.ParseMessage(b)
+		if nerr != nil {
+			t.Fatalf("couldn't parse event %v: %v", i, nerr.Error())
+		}
+
+		switch {
+		case i == 0 && !e.Header.HighPriority():
+			t.Fatalf("the first event was %v, want the high priority one", e.Room)
+		case i > 0 && e.Room != fmt.Sprintf("ITB-%v", i-1):
+			t.Fatalf("event %v was %v, want the normal events in order after the high priority one", i, e.Room)
+		}
+	}
+	exit <- true
+}
@@ -0,0 +1,105 @@
+package hubconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/gorilla/websocket"
+)
+
+//ControlTimeout is how long the hub waits for a subscription change to be applied before it nacks it
+const ControlTimeout = 10 * time.Second
+
+//handleControl applies a subscription change (or query) from a messenger, and answers it if it has a request ID. Returns false if the connection should be closed
+func (h *connection) handleControl(change base.RegistrationChange) bool {
+	requested := change.Rooms
+
+	ok, disconnect := h.limiter.allowSubscriptionChange(&change)
+	if disconnect {
+		h.closeForLimit()
+		return false
+	}
+
+	//messengers that don't send request IDs don't get answers, and don't wait on the nexus
+	if len(change.RequestID) == 0 {
+		if ok && change.Control != base.ControlQuery {
+			h.nexus.SubmitRegistrationChange(change)
+		}
+		return true
+	}
+
+	reply := base.ControlReply{
+		RequestID: change.RequestID,
+		Control:   base.ControlAck,
+		Rejected:  make(map[string]string),
+	}
+
+	//rooms trimmed by the subscription limit
+	kept := make(map[string]bool, len(change.Rooms))
+	for _, room := range change.Rooms {
+		kept[room] = true
+	}
+	for _, room := range requested {
+		if !kept[room] {
+			reply.Rejected[room] = fmt.Sprintf("over the limit of %v subscriptions", h.limiter.limits.MaxSubscriptions)
+		}
+	}
+
+	switch {
+	case !ok && (len(change.Rooms) > 0 || change.Control == base.ControlQuery):
+		//dropped by the rate limit, rather than trimmed
+		reply.Error = RateLimitedReason
+
+	case change.Control == base.ControlQuery:
+		subs, err := h.nexus.Subscriptions(h.ID, ControlTimeout)
+		if err != nil {
+			reply.Error = err.Error()
+			break
+		}
+		reply.Subscriptions = subs
+
+	case ok:
+		report, err := h.nexus.SubmitRegistrationChangeAndReport(change, ControlTimeout)
+		if err != nil {
+			reply.Error = err.Error()
+			break
+		}
+
+		for room, reason := range report.Rejected {
+			reply.Rejected[room] = reason
+		}
+		h.limiter.forget(report.Rejected)
+		reply.SnapshotTruncated = report.SnapshotTruncated
+	}
+
+	if len(reply.Error) > 0 || len(reply.Rejected) > 0 {
+		reply.Control = base.ControlNack
+		log.L.Infof("[%v] nacking request %v: %v", h.ID, reply.RequestID, reply.Err().Error())
+	}
+
+	select {
+	case h.ControlChannel <- reply:
+	default:
+		log.L.Warnf("[%v] control buffer is full, dropping the reply to request %v", h.ID, reply.RequestID)
+	}
+	return true
+}
+
+//writeControl writes a control reply to the peer
+func (h *connection) writeControl(reply base.ControlReply) error {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		log.L.Errorf("Couldn't marshal control reply: %v", err.Error())
+		return nil
+	}
+
+	h.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	err = h.conn.WriteMessage(websocket.TextMessage, b)
+	if err != nil {
+		log.L.Errorf("%v Error %v", h.ID, err.Error())
+	}
+	return err
+}
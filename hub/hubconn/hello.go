@@ -0,0 +1,173 @@
+package hubconn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+	"github.com/gorilla/websocket"
+)
+
+//Reasons a hub connection is refused
+const (
+	SelfLinkReason      = "a hub can't connect to itself"
+	DuplicateLinkReason = "there's already a connection between these hubs"
+)
+
+//Why a hub connection is refused, sent in base.HubRefusedHeader and used as the type of checkPeer's errors
+const (
+	refusedSelf      = "self"
+	refusedDuplicate = "duplicate"
+)
+
+//refusedReasons are the reasons sent in the body of a refusal, for people reading it
+var refusedReasons = map[string]string{
+	refusedSelf:      SelfLinkReason,
+	refusedDuplicate: DuplicateLinkReason,
+}
+
+//hubPeers is the connection to each hub, keyed on the hub's ID. Hold ConnectionsLock to use it
+var hubPeers = map[string]*connection{}
+
+//localHello is the hello this hub sends
+func (c *Config) localHello(n *nexus.Nexus) base.Hello {
+	return base.Hello{
+		ID:           n.ID(),
+		Version:      c.version,
+		Capabilities: base.Capabilities,
+	}
+}
+
+//checkPeer decides whether a connection to the hub that sent the hello may be opened. A hub can't connect to itself, and there's only one connection between two hubs:
+//if they've both dialed each other, the connection dialed by the hub with the lower ID is kept, which both hubs agree on. Otherwise the connection that was there first is kept.
+//Returns the connection that has to be closed to make room for the new one, if there is one. Hold ConnectionsLock to call it
+func checkPeer(localID string, peer base.Hello, outbound bool) (*connection, *nerr.E) {
+	if len(peer.ID) == 0 {
+		//an older hub, there's nothing to check
+		return nil, nil
+	}
+
+	if peer.ID == localID {
+		return nil, nerr.Create(SelfLinkReason, refusedSelf)
+	}
+
+	cur, ok := hubPeers[peer.ID]
+	if !ok {
+		return nil, nil
+	}
+
+	if cur.outbound == outbound {
+		return nil, nerr.Create(DuplicateLinkReason, refusedDuplicate)
+	}
+
+	//one was dialed by us and the other by the peer, keep the one dialed by the lower ID
+	dialer, other := peer.ID, localID
+	if outbound {
+		dialer, other = localID, peer.ID
+	}
+	if dialer < other {
+		return cur, nil
+	}
+	return nil, nerr.Create(DuplicateLinkReason, refusedDuplicate)
+}
+
+//claim makes the connection the connection to its peer hub, if checkPeer allows it. Returns the connection it replaced, which has to be closed
+func (h *connection) claim() (*connection, *nerr.E) {
+	if h.Type != base.Hub || len(h.PeerID) == 0 {
+		return nil, nil
+	}
+
+	ConnectionsLock.Lock()
+	defer ConnectionsLock.Unlock()
+
+	replaced, err := checkPeer(h.nexus.ID(), h.Peer, h.outbound)
+	if err != nil {
+		if c, ok := connectionCounts[h.Type]; ok {
+			c.Refused++
+		}
+		return nil, err
+	}
+
+	hubPeers[h.PeerID] = h
+	return replaced, nil
+}
+
+//claimPeer claims the connection to its peer hub (see claim), closing the connection it replaces. If the connection can't be claimed it's closed, and the error is returned
+func (h *connection) claimPeer() *nerr.E {
+	replaced, err := h.claim()
+	if err != nil {
+		log.L.Infof("[%v] refusing the connection to hub %v: %v", h.ID, h.PeerID, err.Error())
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, refusedReasons[err.Type])
+		h.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteWait))
+		h.conn.Close()
+		return err
+	}
+
+	if replaced != nil {
+		replaced.closeDuplicate()
+	}
+	return nil
+}
+
+//unclaim removes the connection as the connection to its peer hub. Hold ConnectionsLock to call it
+func (h *connection) unclaim() {
+	if len(h.PeerID) > 0 && hubPeers[h.PeerID] == h {
+		delete(hubPeers, h.PeerID)
+	}
+}
+
+//refuse turns away a request to connect from the hub that sent the hello before it's upgraded, if checkPeer wouldn't allow it. Returns false if it was turned away
+func (c *Config) refuse(resp http.ResponseWriter, req *http.Request, n *nexus.Nexus) bool {
+	peer := base.HelloFromHeaders(req.Header)
+
+	ConnectionsLock.Lock()
+	_, err := checkPeer(n.ID(), peer, false)
+	if err != nil {
+		connectionCounts[base.Hub].Refused++
+	}
+	ConnectionsLock.Unlock()
+
+	if err == nil {
+		return true
+	}
+
+	log.L.Infof("Refusing the connection from hub %v at %v: %v", peer.ID, req.RemoteAddr, err.Error())
+	c.localHello(n).SetHeaders(resp.Header())
+	resp.Header().Set(base.HubRefusedHeader, err.Type)
+	http.Error(resp, refusedReasons[err.Type], http.StatusConflict)
+	return false
+}
+
+//refusedError describes a failed dial to a hub that refused the connection
+func refusedError(addr string, resp *http.Response) *nerr.E {
+	b, _ := ioutil.ReadAll(resp.Body)
+	reason := strings.TrimSpace(string(b))
+	peer := base.HelloFromHeaders(resp.Header)
+
+	//the type is the same as checkPeer's, so the caller can tell a link to ourselves from a duplicate
+	errType := "refused"
+	if t := resp.Header.Get(base.HubRefusedHeader); len(refusedReasons[t]) > 0 {
+		errType = t
+	}
+
+	return nerr.Create(fmt.Sprintf("hub %v at %v refused the connection: %s", peer.ID, addr, reason), errType)
+}
+
+//isSelfLink returns true if the connection was refused because it's to this hub, which won't ever change
+func isSelfLink(err error) bool {
+	e, ok := err.(*nerr.E)
+	return ok && e != nil && e.Type == refusedSelf
+}
+
+//closeDuplicate closes the connection because it's been replaced by another one to the same hub. An outbound connection is retried, so it comes back if the other one goes away
+func (h *connection) closeDuplicate() {
+	log.L.Infof("[%v] closing the connection to hub %v, there's another one to it", h.ID, h.PeerID)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, DuplicateLinkReason)
+	h.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteWait))
+}
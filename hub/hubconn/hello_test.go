@@ -0,0 +1,131 @@
+package hubconn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+)
+
+func TestRefusedError(t *testing.T) {
+	tests := []struct {
+		refused string
+		reason  string
+		want    string
+		self    bool
+	}{
+		{"self", SelfLinkReason, "self", true},
+		{"duplicate", DuplicateLinkReason, "duplicate", false},
+		{"self", "anything", "self", true},
+		{"", SelfLinkReason, "refused", false},
+		{"unknown", "something else", "refused", false},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{
+			Header: http.Header{},
+			Body:   ioutil.NopCloser(strings.NewReader(tt.reason + "\n")),
+		}
+		if len(tt.refused) > 0 {
+			resp.Header.Set(base.HubRefusedHeader, tt.refused)
+		}
+
+		err := refusedError("ws://hub:7100", resp)
+		if err.Type != tt.want || isSelfLink(err) != tt.self {
+			t.Errorf("refused with %q (%q): got type %v, want %v", tt.refused, tt.reason, err.Type, tt.want)
+		}
+	}
+}
+
+//TestRefuse checks the refusal a hub sends is understood by the hub that dialed it
+func TestRefuse(t *testing.T) {
+	o := nexus.DefaultOptions()
+	o.ID = "refusing-hub"
+	o.Shards = 1
+	n, nerr := nexus.New(o)
+	if nerr != nil {
+		t.Fatalf("couldn't build the nexus: %v", nerr.Error())
+	}
+
+	conf, nerr := NewConfig(Options{})
+	if nerr != nil {
+		t.Fatalf("couldn't build the config: %v", nerr.Error())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/connect/hub", nil)
+	base.Hello{ID: "refusing-hub"}.SetHeaders(req.Header)
+	rec := httptest.NewRecorder()
+	if conf.refuse(rec, req, n) {
+		t.Fatalf("a hello with the hub's own ID was let in")
+	}
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusConflict)
+	}
+	if err := refusedError("ws://hub:7100", resp); !isSelfLink(err) {
+		t.Fatalf("got %v (%v), want a self link", err.Type, err.Error())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/connect/hub", nil)
+	base.Hello{ID: "another-hub"}.SetHeaders(req.Header)
+	if !conf.refuse(httptest.NewRecorder(), req, n) {
+		t.Fatalf("another hub was refused")
+	}
+}
+
+//TestSelfLinkIsNotRetried links a hub to its own address, and checks the link fails instead of retrying
+func TestSelfLinkIsNotRetried(t *testing.T) {
+	o := nexus.DefaultOptions()
+	o.ID = "self-link-hub"
+	o.Shards = 1
+	n, nerr := nexus.New(o)
+	if nerr != nil {
+		t.Fatalf("couldn't build the nexus: %v", nerr.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	conf, nerr := NewConfig(Options{})
+	if nerr != nil {
+		t.Fatalf("couldn't build the config: %v", nerr.Error())
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CreateConnection(w, r, base.Hub, n, conf)
+	}))
+	defer srv.Close()
+
+	addr := "ws://" + srv.Listener.Addr().String()
+	policy := RetryPolicy{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}
+	if _, _, err := AddLink(addr, "", LinkSourceAPI, policy, n, conf); err != nil {
+		t.Fatalf("couldn't add the link: %v", err.Error())
+	}
+	defer RemoveLink(addr, conf)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l, ok := GetLink(addr, conf)
+		if !ok {
+			t.Fatalf("the link is gone")
+		}
+		if l.State == LinkFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the link is %v after %v attempts, it should have failed", l.State, l.Attempts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//it would have been retried a few times by now if it were going to be
+	time.Sleep(100 * time.Millisecond)
+	if l, _ := GetLink(addr, conf); l.State != LinkFailed || l.Attempts != 1 {
+		t.Fatalf("the link is %v after %v attempts, want failed after 1", l.State, l.Attempts)
+	}
+}
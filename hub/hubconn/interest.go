@@ -0,0 +1,54 @@
+package hubconn
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/gorilla/websocket"
+)
+
+//setInterest sets up the interest messages on a hub connection: the peer's interest starts out matching everything, and ours is only sent if the peer's upgrade headers say it understands it
+func (h *connection) setInterest(header http.Header) {
+	if h.Type != base.Hub {
+		return
+	}
+
+	h.interest = base.NewInterestSet()
+	h.sendInterest = header.Get(base.InterestHeader) == base.InterestVersion || h.Peer.Has(base.CapabilityInterest)
+}
+
+//handleInterest applies an interest message from the other hub. Returns false if the message isn't one, so it can be handled as an event
+func (h *connection) handleInterest(b []byte) bool {
+	var i base.Interest
+	if err := json.Unmarshal(b, &i); err != nil || i.Control != base.ControlInterest {
+		return false
+	}
+
+	log.L.Debugf("[%v] hub %v wants rooms %v, not %v (reset: %v)", h.ID, h.PeerID, i.Add, i.Remove, i.Reset)
+	h.interest.Apply(i)
+	return true
+}
+
+//writeInterest writes the changes to our interest since it was last written, if there are any
+func (h *connection) writeInterest() error {
+	i, ok := h.watcher.Next()
+	if !ok {
+		return nil
+	}
+
+	b, err := json.Marshal(i)
+	if err != nil {
+		log.L.Errorf("Couldn't marshal interest: %v", err.Error())
+		return nil
+	}
+
+	h.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	err = h.conn.WriteMessage(websocket.TextMessage, b)
+	if err != nil {
+		log.L.Errorf("%v Error %v", h.ID, err.Error())
+	}
+	return err
+}
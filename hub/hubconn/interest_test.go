@@ -0,0 +1,166 @@
+package hubconn
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/gorilla/websocket"
+)
+
+//TestHandleInterest checks interest messages are applied, and anything else is left to be handled as an event
+func TestHandleInterest(t *testing.T) {
+	header := http.Header{}
+	header.Set(base.InterestHeader, base.InterestVersion)
+
+	h := &connection{Type: base.Hub, ID: "interest-test"}
+	h.setInterest(header)
+	if !h.sendInterest {
+		t.Fatalf("the connection won't send its interest to a hub that sent %v", base.InterestHeader)
+	}
+	if !h.interest.Matches("ITB-1101") {
+		t.Fatalf("the peer's interest doesn't match everything before it's sent")
+	}
+
+	for _, b := range []string{
+		`{"room": "ITB-1101", "event": {}}`,
+		`{"control": "ack"}`,
+		`not json`,
+	} {
+		if h.handleInterest([]byte(b)) {
+			t.Fatalf("%v was handled as an interest message", b)
+		}
+	}
+
+	tests := []struct {
+		msg   string
+		rooms []string
+	}{
+		{`{"control": "interest", "reset": true, "add": ["ITB-1101", "JFSB-*"]}`, []string{"ITB-1101", "JFSB-*"}},
+		{`{"control": "interest", "add": ["ITB-1102"], "remove": ["JFSB-*"]}`, []string{"ITB-1101", "ITB-1102"}},
+		{`{"control": "interest", "reset": true, "add": ["*"]}`, []string{"*"}},
+		{`{"control": "interest", "reset": true}`, []string{}},
+	}
+	for _, tt := range tests {
+		if !h.handleInterest([]byte(tt.msg)) {
+			t.Fatalf("%v wasn't handled as an interest message", tt.msg)
+		}
+		if rooms, _ := h.interest.Rooms(); !reflect.DeepEqual(rooms, tt.rooms) {
+			t.Fatalf("after %v the peer wants %v, want %v", tt.msg, rooms, tt.rooms)
+		}
+	}
+
+	//a hub that doesn't understand interest messages isn't sent any
+	h = &connection{Type: base.Hub, ID: "legacy-test"}
+	h.setInterest(http.Header{})
+	if h.sendInterest {
+		t.Fatalf("the connection will send its interest to a hub that didn't ask for it")
+	}
+}
+
+//TestInterestOverConnection connects as a hub, and checks the connection is sent the nexus' interest and its changes, and only forwards the events the hub asks for
+func TestInterestOverConnection(t *testing.T) {
+	o := nexus.DefaultOptions()
+	o.ID = "hub-a"
+	o.Shards = 1
+	o.DedupWindow = 0
+	n, nerr := nexus.New(o)
+	if nerr != nil {
+		t.Fatalf("couldn't build the nexus: %v", nerr.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	conf, nerr := NewConfig(Options{})
+	if nerr != nil {
+		t.Fatalf("couldn't build the config: %v", nerr.Error())
+	}
+
+	register := func(id string, rooms ...string) {
+		_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+			Type:               base.Messenger,
+			SubscriptionChange: base.SubscriptionChange{Create: true, Rooms: rooms},
+			Registration:       base.Registration{ID: id, Channel: make(chan base.EventWrapper, 10)},
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't register %v: %v", id, err.Error())
+		}
+	}
+	register("panel-1", "ITB-1101")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CreateConnection(w, r, base.Hub, n, conf)
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	base.Hello{ID: "hub-b"}.SetHeaders(header)
+	header.Set(base.InterestHeader, base.InterestVersion)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+srv.Listener.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	if resp.Header.Get(base.InterestHeader) != base.InterestVersion {
+		t.Fatalf("the hub didn't say it understands interest messages")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readInterest := func(want base.Interest) {
+		var got base.Interest
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatalf("couldn't read the interest: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got interest %+v, want %+v", got, want)
+		}
+	}
+	readInterest(base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"ITB-1101"}})
+
+	//the changes after the first message only have the rooms that changed
+	register("panel-2", "ITB-1101", "ITB-1103")
+	readInterest(base.Interest{Control: base.ControlInterest, Add: []string{"ITB-1103"}})
+
+	b, _ := json.Marshal(base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"ITB-1102"}})
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		t.Fatalf("couldn't send the interest: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := n.GetStatus()
+		if len(status.Hubs) == 1 && reflect.DeepEqual(status.Hubs[0].Interest, []string{"ITB-1102"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the hub's interest wasn't applied: %+v", status.Hubs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, room := range []string{"ITB-1101", "ITB-1102"} {
+		if _, err := n.SubmitAndWait(base.EventWrapper{Room: room, Event: []byte(`{}`)}, base.Messenger, "producer", 5*time.Second); err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("couldn't read the event: %v", err)
+	}
+	e, nerr := base.ParseMessage(msg)
+	if nerr != nil {
+		t.Fatalf("couldn't parse the event: %v", nerr.Error())
+	}
+	if e.Room != "ITB-1102" {
+		t.Fatalf("got an event for %v, want the one for the room the hub asked for", e.Room)
+	}
+	if skipped := n.GetStatus().Interest.Skipped; skipped != 1 {
+		t.Fatalf("%v events were skipped, want 1", skipped)
+	}
+}
@@ -0,0 +1,373 @@
+package hubconn
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+	"github.com/gorilla/websocket"
+)
+
+//Rate limit actions, what happens to a message that goes over a limit
+const (
+	//LimitDrop drops the message
+	LimitDrop = "drop"
+
+	//LimitDelay stops reading from the connection until the message is under the limit
+	LimitDelay = "delay"
+
+	//LimitDisconnect drops the message and closes the connection
+	LimitDisconnect = "disconnect"
+)
+
+//RateLimitedReason is the reason sent in the close frame when a connection is closed for going over a limit
+const RateLimitedReason = "rate limit exceeded"
+
+//Limit is a token bucket, which allows Rate messages a second on average, in bursts of up to Burst. A Rate of 0 means no limit
+type Limit struct {
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+	Action string  `json:"action"`
+}
+
+//ParseLimit parses a limit in the form rate[:burst][:action], e.g. 100, 100:500, or 100:500:delay. The burst defaults to the rate, and the action to drop
+func ParseLimit(s string) (Limit, *nerr.E) {
+	split := strings.Split(strings.TrimSpace(s), ":")
+	l := Limit{Action: LimitDrop}
+
+	rate, err := strconv.ParseFloat(split[0], 64)
+	if err != nil || rate < 0 {
+		return l, nerr.Create(fmt.Sprintf("invalid rate %v", split[0]), "invalid")
+	}
+	l.Rate = rate
+	l.Burst = int(math.Ceil(rate))
+
+	if len(split) > 1 && len(split[1]) > 0 {
+		burst, err := strconv.Atoi(split[1])
+		if err != nil || burst < 1 {
+			return l, nerr.Create(fmt.Sprintf("invalid burst %v", split[1]), "invalid")
+		}
+		l.Burst = burst
+	}
+
+	if len(split) > 2 {
+		l.Action = split[2]
+	}
+
+	if len(split) > 3 {
+		return l, nerr.Create(fmt.Sprintf("invalid limit %v, expected rate[:burst][:action]", s), "invalid")
+	}
+
+	return l, l.validate()
+}
+
+func (l Limit) validate() *nerr.E {
+	switch l.Action {
+	case LimitDrop, LimitDelay, LimitDisconnect:
+		return nil
+	default:
+		return nerr.Create(fmt.Sprintf("unknown limit action %v", l.Action), "invalid")
+	}
+}
+
+//Limits are the limits on the connections of one type. Events and Subscriptions apply to each connection, TotalEvents is shared by all of them
+type Limits struct {
+	Events        Limit `json:"events"`
+	TotalEvents   Limit `json:"total-events"`
+	Subscriptions Limit `json:"subscriptions"`
+
+	//MaxSubscriptions is the most rooms (or patterns) a messenger may be subscribed to at once, and MaxSubscriptionsAction is what happens to the rooms past it (drop or disconnect). 0 means no limit
+	MaxSubscriptions       int    `json:"max-subscriptions"`
+	MaxSubscriptionsAction string `json:"max-subscriptions-action,omitempty"`
+}
+
+//LimitCounters count the messages that went over a limit, by what was done about them
+type LimitCounters struct {
+	Dropped     uint64 `json:"dropped"`
+	Delayed     uint64 `json:"delayed"`
+	Disconnects uint64 `json:"disconnects"`
+}
+
+//LimitStatus represents the limits on a connection type, and how often they've been hit
+type LimitStatus struct {
+	Limits
+
+	Events           LimitCounters `json:"events-limited"`
+	TotalEvents      LimitCounters `json:"total-events-limited"`
+	Subscriptions    LimitCounters `json:"subscriptions-limited"`
+	MaxSubscriptions LimitCounters `json:"max-subscriptions-limited"`
+}
+
+//typeLimits are the limits for a connection type, along with the bucket shared by its connections
+type typeLimits struct {
+	Limits
+	total *tokenBucket
+
+	events           LimitCounters
+	totalEvents      LimitCounters
+	subscriptions    LimitCounters
+	maxSubscriptions LimitCounters
+}
+
+//LimitsFromEnv reads the limits for each connection type from the HUB_LIMIT_<TYPE>_EVENTS, _TOTAL_EVENTS, _SUBSCRIPTIONS, and _MAX_SUBSCRIPTIONS environment variables
+func LimitsFromEnv() (map[string]Limits, *nerr.E) {
+	toReturn := make(map[string]Limits)
+	for _, t := range []string{base.Messenger, base.Repeater, base.Hub} {
+		var l Limits
+		prefix := "HUB_LIMIT_" + strings.ToUpper(t)
+
+		for name, limit := range map[string]*Limit{
+			"_EVENTS":        &l.Events,
+			"_TOTAL_EVENTS":  &l.TotalEvents,
+			"_SUBSCRIPTIONS": &l.Subscriptions,
+		} {
+			v := os.Getenv(prefix + name)
+			if len(v) == 0 {
+				continue
+			}
+
+			var err *nerr.E
+			if *limit, err = ParseLimit(v); err != nil {
+				return nil, err.Addf("invalid %v", prefix+name)
+			}
+		}
+
+		//max subscriptions are in the form count[:action]
+		if v := os.Getenv(prefix + "_MAX_SUBSCRIPTIONS"); len(v) > 0 {
+			split := strings.SplitN(v, ":", 2)
+			max, err := strconv.Atoi(split[0])
+			if err != nil || max < 0 {
+				return nil, nerr.Create(fmt.Sprintf("invalid %v_MAX_SUBSCRIPTIONS %v", prefix, v), "invalid")
+			}
+
+			l.MaxSubscriptions = max
+			if len(split) > 1 {
+				l.MaxSubscriptionsAction = split[1]
+			}
+		}
+
+		toReturn[t] = l
+	}
+
+	return toReturn, nil
+}
+
+//newTypeLimits validates the limits for each connection type and fills in their defaults
+func newTypeLimits(l map[string]Limits) (map[string]*typeLimits, *nerr.E) {
+	next := make(map[string]*typeLimits, 3)
+	for _, t := range []string{base.Messenger, base.Repeater, base.Hub} {
+		cur := l[t]
+		for _, limit := range []*Limit{&cur.Events, &cur.TotalEvents, &cur.Subscriptions} {
+			if len(limit.Action) == 0 {
+				limit.Action = LimitDrop
+			}
+			if limit.Burst < 1 {
+				limit.Burst = int(math.Ceil(limit.Rate))
+			}
+			if err := limit.validate(); err != nil {
+				return nil, err.Addf("invalid limit for %v", t)
+			}
+		}
+
+		switch cur.MaxSubscriptionsAction {
+		case "":
+			cur.MaxSubscriptionsAction = LimitDrop
+		case LimitDrop, LimitDisconnect:
+		default:
+			return nil, nerr.Create(fmt.Sprintf("invalid max subscriptions action %v for %v, it must be %v or %v", cur.MaxSubscriptionsAction, t, LimitDrop, LimitDisconnect), "invalid")
+		}
+
+		next[t] = &typeLimits{
+			Limits: cur,
+			total:  newTokenBucket(cur.TotalEvents),
+		}
+		log.L.Infof("Limits for %v connections: %+v", t, cur)
+	}
+
+	return next, nil
+}
+
+//GetLimitStatus returns the limits for each connection type, and how often they've been hit
+func (c *Config) GetLimitStatus() map[string]LimitStatus {
+	load := func(c *LimitCounters) LimitCounters {
+		return LimitCounters{
+			Dropped:     atomic.LoadUint64(&c.Dropped),
+			Delayed:     atomic.LoadUint64(&c.Delayed),
+			Disconnects: atomic.LoadUint64(&c.Disconnects),
+		}
+	}
+
+	toReturn := make(map[string]LimitStatus, len(c.limits))
+	for t, l := range c.limits {
+		toReturn[t] = LimitStatus{
+			Limits:           l.Limits,
+			Events:           load(&l.events),
+			TotalEvents:      load(&l.totalEvents),
+			Subscriptions:    load(&l.subscriptions),
+			MaxSubscriptions: load(&l.maxSubscriptions),
+		}
+	}
+	return toReturn
+}
+
+//tokenBucket is a token bucket rate limiter. A nil bucket has no limit
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l Limit) *tokenBucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{
+		rate:   l.Rate,
+		burst:  float64(l.Burst),
+		tokens: float64(l.Burst),
+		last:   time.Now(),
+	}
+}
+
+//take takes a token from the bucket, and returns 0 if there was one. Otherwise it returns how long until there is one, and if reserve is set the token is taken from that future
+func (b *tokenBucket) take(reserve bool) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if reserve {
+		b.tokens--
+	}
+	return wait
+}
+
+//limiter enforces the limits on a single connection. Only the connection's read pump uses it
+type limiter struct {
+	limits *typeLimits
+
+	events        *tokenBucket
+	subscriptions *tokenBucket
+
+	//subscribed is the rooms the messenger is subscribed to
+	subscribed map[string]bool
+}
+
+func (c *Config) newLimiter(connType string) *limiter {
+	l, ok := c.limits[connType]
+	if !ok {
+		l = &typeLimits{}
+	}
+
+	return &limiter{
+		limits:        l,
+		events:        newTokenBucket(l.Events),
+		subscriptions: newTokenBucket(l.Subscriptions),
+		subscribed:    make(map[string]bool),
+	}
+}
+
+//check takes a token from the bucket, and applies the limit's action if it's empty. Returns false if the message should be dropped, and true for disconnect if the connection should be closed
+func check(l Limit, counters *LimitCounters, b *tokenBucket) (ok bool, disconnect bool) {
+	wait := b.take(l.Action == LimitDelay)
+	if wait == 0 {
+		return true, false
+	}
+
+	switch l.Action {
+	case LimitDelay:
+		atomic.AddUint64(&counters.Delayed, 1)
+		time.Sleep(wait)
+		return true, false
+	case LimitDisconnect:
+		atomic.AddUint64(&counters.Disconnects, 1)
+		return false, true
+	default:
+		atomic.AddUint64(&counters.Dropped, 1)
+		return false, false
+	}
+}
+
+//allowEvent checks an event from the connection against its own limit, and then the limit shared by its type
+func (l *limiter) allowEvent() (bool, bool) {
+	if ok, disconnect := check(l.limits.Events, &l.limits.events, l.events); !ok {
+		return false, disconnect
+	}
+	return check(l.limits.TotalEvents, &l.limits.totalEvents, l.limits.total)
+}
+
+//allowSubscriptionChange checks a subscription change from the connection against the subscription limits, and trims the rooms past the max subscriptions.
+//Returns false if the change should be dropped, and true for disconnect if the connection should be closed
+func (l *limiter) allowSubscriptionChange(change *base.RegistrationChange) (bool, bool) {
+	if ok, disconnect := check(l.limits.Subscriptions, &l.limits.subscriptions, l.subscriptions); !ok {
+		return false, disconnect
+	}
+
+	if !change.Create {
+		for _, room := range change.Rooms {
+			delete(l.subscribed, room)
+		}
+		return true, false
+	}
+
+	max := l.limits.MaxSubscriptions
+	rooms := []string{}
+	for _, room := range change.Rooms {
+		if !l.subscribed[room] && max > 0 && len(l.subscribed) >= max {
+			if l.limits.MaxSubscriptionsAction == LimitDisconnect {
+				atomic.AddUint64(&l.limits.maxSubscriptions.Disconnects, 1)
+				return false, true
+			}
+
+			atomic.AddUint64(&l.limits.maxSubscriptions.Dropped, 1)
+			continue
+		}
+
+		l.subscribed[room] = true
+		rooms = append(rooms, room)
+	}
+
+	if len(rooms) < len(change.Rooms) {
+		log.L.Warnf("Messenger %v is at its limit of %v subscriptions, not subscribing it to %v rooms", change.ID, max, len(change.Rooms)-len(rooms))
+	}
+
+	change.Rooms = rooms
+	return len(rooms) > 0, false
+}
+
+//forget removes the rooms the nexus didn't subscribe the messenger to from its subscriptions
+func (l *limiter) forget(rooms map[string]string) {
+	for room := range rooms {
+		delete(l.subscribed, room)
+	}
+}
+
+//closeForLimit closes the connection for going over a limit
+func (h *connection) closeForLimit() {
+	log.L.Warnf("[%v] went over its limits, disconnecting it", h.ID)
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, RateLimitedReason)
+	h.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteWait))
+}
@@ -0,0 +1,54 @@
+package hubconn
+
+import (
+	"testing"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//TestLimitCounters checks each limit counts the events that went over it, and not the others
+func TestLimitCounters(t *testing.T) {
+	tests := []struct {
+		name        string
+		limits      Limits
+		events      uint64
+		totalEvents uint64
+	}{
+		{
+			name:   "per connection",
+			limits: Limits{Events: Limit{Rate: 1, Burst: 2}},
+			events: 8,
+		},
+		{
+			name:        "total",
+			limits:      Limits{TotalEvents: Limit{Rate: 1, Burst: 3}},
+			totalEvents: 7,
+		},
+		{
+			name:   "per connection is checked first",
+			limits: Limits{Events: Limit{Rate: 1, Burst: 2}, TotalEvents: Limit{Rate: 1, Burst: 2}},
+			events: 8,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := NewConfig(Options{
+				Limits: map[string]Limits{base.Messenger: tt.limits},
+			})
+			if err != nil {
+				t.Fatalf("couldn't build the config: %v", err.Error())
+			}
+
+			l := conf.newLimiter(base.Messenger)
+			for i := 0; i < 10; i++ {
+				l.allowEvent()
+			}
+
+			status := conf.GetLimitStatus()[base.Messenger]
+			if status.Events.Dropped != tt.events || status.TotalEvents.Dropped != tt.totalEvents {
+				t.Fatalf("dropped %v events and %v total events, want %v and %v", status.Events.Dropped, status.TotalEvents.Dropped, tt.events, tt.totalEvents)
+			}
+		})
+	}
+}
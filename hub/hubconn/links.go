@@ -0,0 +1,271 @@
+package hubconn
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Link states
+const (
+	LinkConnecting = "connecting"
+	LinkConnected  = "connected"
+	LinkRetrying   = "retrying"
+	LinkFailed     = "failed"
+)
+
+//Link sources, where a link was added from
+const (
+	LinkSourceAPI  = "api"
+	LinkSourceFile = "file"
+	LinkSourceRoom = "room"
+
+	LinkSourceDiscovery = "discovery"
+)
+
+//LinkStatus is the state of a link to another hub
+type LinkStatus struct {
+	Address string `json:"address"`
+	Name    string `json:"name,omitempty"`
+	Source  string `json:"source"`
+	State   string `json:"state"`
+
+	//ConnectionID and PeerID are set while the link is connected
+	ConnectionID string     `json:"connection-id,omitempty"`
+	PeerID       string     `json:"peer-id,omitempty"`
+	ConnectedAt  *time.Time `json:"connected-at,omitempty"`
+	Uptime       string     `json:"uptime,omitempty"`
+
+	//Attempts is the number of failed attempts to connect since the link was last connected
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last-error,omitempty"`
+	LastErrorTime *time.Time `json:"last-error-time,omitempty"`
+
+	Retry struct {
+		Initial string `json:"initial"`
+		Max     string `json:"max"`
+	} `json:"retry"`
+}
+
+//link is an outbound hub connection that's kept open, and retried, until it's removed. Hold lock to use its status
+type link struct {
+	status LinkStatus
+	policy RetryPolicy
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+//links is the registry of links, keyed on address. Hold linksLock to use it
+var (
+	links     = map[string]*link{}
+	linksLock sync.Mutex
+)
+
+//LinkAddress returns the address a link to addr is known by: addr gets ws:// (or wss:// if conf has a certificate to serve) if it doesn't have a scheme, and port 7100 if it doesn't have a port
+func LinkAddress(addr string, conf *Config) (string, *nerr.E) {
+	addr = strings.TrimRight(strings.TrimSpace(addr), "/")
+	if len(addr) == 0 {
+		return "", nerr.Create("no address", "invalid")
+	}
+
+	if !strings.Contains(addr, "://") {
+		addr = conf.certStore.Scheme() + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", nerr.Translate(err).Addf("invalid address %v", addr)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", nerr.Createf("invalid", "invalid address %v: the scheme must be ws or wss", addr)
+	}
+	if len(u.Hostname()) == 0 || (len(u.Path) > 0 && u.Path != "/") {
+		return "", nerr.Createf("invalid", "invalid address %v: it must be just a host and port", addr)
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = "7100"
+	}
+	return u.Scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
+
+//AddLink starts keeping a connection to the hub at addr, retrying it with the policy. Adding a link to an address that already has one doesn't add another: the existing link's status is returned, with false
+func AddLink(addr, name, source string, policy RetryPolicy, n *nexus.Nexus, conf *Config) (LinkStatus, bool, *nerr.E) {
+	addr, err := LinkAddress(addr, conf)
+	if err != nil {
+		return LinkStatus{}, false, err
+	}
+	if policy.Initial <= 0 {
+		policy.Initial = DefaultRetryPolicy.Initial
+	}
+	if policy.Max < policy.Initial {
+		policy.Max = policy.Initial
+	}
+
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	if l, ok := links[addr]; ok {
+		return l.getStatus(), false, nil
+	}
+
+	l := &link{
+		policy: policy,
+	}
+	l.status.Address = addr
+	l.status.Name = name
+	l.status.Source = source
+	l.status.State = LinkConnecting
+	l.status.Retry.Initial = policy.Initial.String()
+	l.status.Retry.Max = policy.Max.String()
+
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	links[addr] = l
+
+	log.L.Infof("Adding a link to hub %v from %v", addr, source)
+	go retryConnection(ctx, addr, "/connect/hub", base.Hub, n, conf, policy, l)
+
+	return l.getStatus(), true, nil
+}
+
+//RemoveLink stops retrying the link to addr, and closes its connection. Returns false if there's no link to addr
+func RemoveLink(addr string, conf *Config) (bool, *nerr.E) {
+	addr, err := LinkAddress(addr, conf)
+	if err != nil {
+		return false, err
+	}
+
+	linksLock.Lock()
+	l, ok := links[addr]
+	delete(links, addr)
+	linksLock.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	log.L.Infof("Removing the link to hub %v", addr)
+	l.cancel()
+	return true, nil
+}
+
+//GetLink returns the status of the link to addr, and false if there isn't one
+func GetLink(addr string, conf *Config) (LinkStatus, bool) {
+	addr, err := LinkAddress(addr, conf)
+	if err != nil {
+		return LinkStatus{}, false
+	}
+
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	l, ok := links[addr]
+	if !ok {
+		return LinkStatus{}, false
+	}
+	return l.getStatus(), true
+}
+
+//GetLinks returns the status of each link, sorted by address
+func GetLinks() []LinkStatus {
+	linksLock.Lock()
+	toReturn := make([]LinkStatus, 0, len(links))
+	for _, l := range links {
+		toReturn = append(toReturn, l.getStatus())
+	}
+	linksLock.Unlock()
+
+	sort.Slice(toReturn, func(i, j int) bool {
+		return toReturn[i].Address < toReturn[j].Address
+	})
+	return toReturn
+}
+
+//getStatus returns a copy of the link's status, with the uptime filled in
+func (l *link) getStatus() LinkStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	toReturn := l.status
+	if toReturn.ConnectedAt != nil {
+		toReturn.Uptime = time.Since(*toReturn.ConnectedAt).Round(time.Second).String()
+	}
+	return toReturn
+}
+
+//The rest of the methods are safe to call on a nil link, so connections that aren't links don't need to check
+
+//failed records a failed attempt to connect
+func (l *link) failed(err error) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.status.State = LinkRetrying
+	l.status.Attempts++
+	l.status.LastError = err.Error()
+	now := time.Now()
+	l.status.LastErrorTime = &now
+}
+
+//stopped records that the link won't be retried, because of the error
+func (l *link) stopped(err error) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.status.State = LinkFailed
+	l.status.Attempts++
+	l.status.LastError = err.Error()
+	now := time.Now()
+	l.status.LastErrorTime = &now
+}
+
+//connected records that the link is connected with the connection
+func (l *link) connected(h *connection) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.status.State = LinkConnected
+	l.status.ConnectionID = h.ID
+	l.status.PeerID = h.PeerID
+	now := time.Now()
+	l.status.ConnectedAt = &now
+	l.status.Attempts = 0
+}
+
+//disconnected records that the link's connection closed, and that it's going to be retried
+func (l *link) disconnected() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.status.State = LinkConnecting
+	l.status.ConnectionID = ""
+	l.status.PeerID = ""
+	l.status.ConnectedAt = nil
+}
@@ -0,0 +1,39 @@
+package hubconn
+
+import "testing"
+
+func TestLinkAddress(t *testing.T) {
+	conf, err := NewConfig(Options{})
+	if err != nil {
+		t.Fatalf("couldn't build the config: %v", err.Error())
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hub-1", "ws://hub-1:7100"},
+		{"hub-1:7200", "ws://hub-1:7200"},
+		{" HUB-1.Example.com ", "ws://hub-1.example.com:7100"},
+		{"ws://hub-1/", "ws://hub-1:7100"},
+		{"wss://hub-1:443", "wss://hub-1:443"},
+		{"10.0.0.1", "ws://10.0.0.1:7100"},
+		{"[::1]:7200", "ws://[::1]:7200"},
+		{"", ""},
+		{"http://hub-1", ""},
+		{"ws://hub-1/connect/hub", ""},
+		{"ws://:7100", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := LinkAddress(tt.in, conf)
+		switch {
+		case len(tt.want) == 0 && err == nil:
+			t.Errorf("%q: got %q, want an error", tt.in, got)
+		case len(tt.want) > 0 && err != nil:
+			t.Errorf("%q: got error %v, want %q", tt.in, err.Error(), tt.want)
+		case got != tt.want:
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/byuoitav/common/log"
+	"github.com/labstack/echo"
+)
+
+// RequireHub turns away the requests that don't have the credentials a hub needs to connect to /connect/hub
+func RequireHub(conf *hubconn.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if _, nerr := conf.Authenticate(ctx.Request(), base.Hub); nerr != nil {
+				return unauthorized(ctx)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// GetLinks returns the status of each of the hub's links to other hubs
+func GetLinks() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, hubconn.GetLinks())
+	}
+}
+
+// AddLink adds a link to the hub in the body, which is a peer like the ones in the peer file. It returns 201 and the link's status if the link was added,
+// and 200 and the existing link's status if there's already a link to the address
+func AddLink(n *nexus.Nexus, conf *hubconn.Config) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var p Peer
+		if err := ctx.Bind(&p); err != nil {
+			return ctx.String(http.StatusBadRequest, "invalid link: "+err.Error())
+		}
+
+		policy, nerr := p.policy()
+		if nerr != nil {
+			return ctx.String(http.StatusBadRequest, nerr.Error())
+		}
+
+		status, added, nerr := hubconn.AddLink(p.Address, p.Name, hubconn.LinkSourceAPI, policy, n, conf)
+		if nerr != nil {
+			return ctx.String(http.StatusBadRequest, nerr.Error())
+		}
+
+		if !added {
+			return ctx.JSON(http.StatusOK, status)
+		}
+
+		log.L.Infof("%v added a link to %v", ctx.Request().RemoteAddr, status.Address)
+		return ctx.JSON(http.StatusCreated, status)
+	}
+}
+
+// RemoveLink removes the link to the hub at the address in the path, closing its connection. An address with a scheme has to be escaped, e.g. /links/wss%3A%2F%2Fhub%3A7100.
+// It returns 204 if the link was removed, and 404 if there wasn't one
+func RemoveLink(conf *hubconn.Config) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		addr, err := url.PathUnescape(ctx.Param("address"))
+		if err != nil || len(addr) == 0 {
+			return ctx.String(http.StatusBadRequest, "invalid address")
+		}
+
+		removed, nerr := hubconn.RemoveLink(addr, conf)
+		switch {
+		case nerr != nil:
+			return ctx.String(http.StatusBadRequest, nerr.Error())
+		case !removed:
+			return ctx.String(http.StatusNotFound, "no link to "+addr)
+		}
+
+		log.L.Infof("%v removed the link to %v", ctx.Request().RemoteAddr, addr)
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
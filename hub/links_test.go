@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/auth"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/labstack/echo"
+)
+
+var linkSecret = []byte("the-secret")
+
+//linkRouter returns a router with the /links endpoints, for a hub that lets in the hubs with linkSecret
+func linkRouter(t *testing.T) *echo.Echo {
+	n, err := nexus.New(nexus.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	conf, err := hubconn.NewConfig(hubconn.Options{
+		Authenticator: &auth.HMAC{Secrets: [][]byte{linkSecret}},
+	})
+	if err != nil {
+		t.Fatalf("couldn't build the config: %v", err.Error())
+	}
+	t.Cleanup(func() {
+		for _, l := range hubconn.GetLinks() {
+			hubconn.RemoveLink(l.Address, conf)
+		}
+	})
+
+	router := echo.New()
+	requireHub := RequireHub(conf)
+	router.GET("/links", GetLinks())
+	router.POST("/links", AddLink(n, conf), requireHub)
+	router.DELETE("/links/:address", RemoveLink(conf), requireHub)
+	return router
+}
+
+//linkRequest sends the request to the router, with a hub's credentials if connType is set
+func linkRequest(router *echo.Echo, method, path, body, connType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if len(connType) > 0 {
+		req.Header.Set("Authorization", "HMAC "+auth.NewHMACToken(linkSecret, "hub-2", connType, time.Now()))
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLinks(t *testing.T) {
+	router := linkRouter(t)
+
+	//nobody listens on these, so the links keep retrying
+	rec := linkRequest(router, http.MethodPost, "/links", `{"name": "one", "address": "127.0.0.1:1", "retry": {"initial": "1s"}}`, "hub")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %v adding a link: %s", rec.Code, rec.Body)
+	}
+	var status hubconn.LinkStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("couldn't parse the link: %v", err)
+	}
+	if status.Address != "ws://127.0.0.1:1" || status.Name != "one" || status.Source != hubconn.LinkSourceAPI || status.Retry.Initial != "1s" {
+		t.Fatalf("got link %+v", status)
+	}
+
+	//adding the same address again, in another form, returns the existing link
+	rec = linkRequest(router, http.MethodPost, "/links", `{"name": "again", "address": "ws://127.0.0.1:1/"}`, "hub")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %v adding the link again, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.Name != "one" {
+		t.Fatalf("got link %+v, want the existing one", status)
+	}
+
+	rec = linkRequest(router, http.MethodPost, "/links", `{"address": "127.0.0.1:2"}`, "hub")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %v adding a link: %s", rec.Code, rec.Body)
+	}
+
+	rec = linkRequest(router, http.MethodGet, "/links", "", "")
+	var links []hubconn.LinkStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &links); err != nil {
+		t.Fatalf("couldn't parse the links: %v", err)
+	}
+	if rec.Code != http.StatusOK || len(links) != 2 || links[0].Address != "ws://127.0.0.1:1" || links[1].Address != "ws://127.0.0.1:2" {
+		t.Fatalf("got %v and links %+v", rec.Code, links)
+	}
+
+	//a link is removed by its address, escaped if it has a scheme
+	rec = linkRequest(router, http.MethodDelete, "/links/"+url.PathEscape("ws://127.0.0.1:1"), "", "hub")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %v removing a link: %s", rec.Code, rec.Body)
+	}
+	rec = linkRequest(router, http.MethodDelete, "/links/127.0.0.1:2", "", "hub")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %v removing a link without a scheme: %s", rec.Code, rec.Body)
+	}
+	rec = linkRequest(router, http.MethodDelete, "/links/127.0.0.1:2", "", "hub")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got %v removing a link that's gone, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	if links := hubconn.GetLinks(); len(links) != 0 {
+		t.Fatalf("%v links are left", len(links))
+	}
+}
+
+func TestAddLinkInvalid(t *testing.T) {
+	router := linkRouter(t)
+
+	for _, body := range []string{
+		`{"address": `,
+		`{"name": "no-address"}`,
+		`{"address": "http://hub-1"}`,
+		`{"address": "hub-1", "retry": {"initial": "soon"}}`,
+	} {
+		if rec := linkRequest(router, http.MethodPost, "/links", body, "hub"); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %v, want %v", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if links := hubconn.GetLinks(); len(links) != 0 {
+		t.Fatalf("%v links were added", len(links))
+	}
+}
+
+//TestRequireHub checks that changing the links needs a hub's credentials, while anyone can list them
+func TestRequireHub(t *testing.T) {
+	router := linkRouter(t)
+	if rec := linkRequest(router, http.MethodPost, "/links", `{"address": "127.0.0.1:1"}`, "hub"); rec.Code != http.StatusCreated {
+		t.Fatalf("got %v adding a link: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		connType string
+		want     int
+	}{
+		{http.MethodPost, "/links", `{"address": "127.0.0.1:2"}`, "", http.StatusUnauthorized},
+		{http.MethodPost, "/links", `{"address": "127.0.0.1:2"}`, "messenger", http.StatusUnauthorized},
+		{http.MethodDelete, "/links/127.0.0.1:1", "", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/links/127.0.0.1:1", "", "messenger", http.StatusUnauthorized},
+		{http.MethodGet, "/links", "", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := linkRequest(router, tt.method, tt.path, tt.body, tt.connType)
+		if rec.Code != tt.want {
+			t.Errorf("%v %v as %q: got %v, want %v", tt.method, tt.path, tt.connType, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && len(rec.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%v %v as %q: no WWW-Authenticate header", tt.method, tt.path, tt.connType)
+		}
+	}
+
+	if links := hubconn.GetLinks(); len(links) != 1 || links[0].Address != "ws://127.0.0.1:1" {
+		t.Fatalf("got links %+v, want them unchanged", links)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Package metrics exposes the state of the hub in the prometheus format.
+
+The collector reads the counters the nexus, the hub connections, and the frame parser keep for the status when it's scraped. The only counting done on the routing path is an atomic increment per event in Submit,
+and per registration change in dispatchRegistration.
+
+Registrations are labeled with their peer rather than their ID, which changes every time a connection reconnects: a hub is known by its hub ID, a repeater by its host, and a messenger by the identity it authenticated as.
+The registrations with the same peer are summed, so unauthenticated messengers are all counted under an empty peer.
+*/
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ces_hub"
+
+var (
+	eventsReceived = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "events_received_total"),
+		"Events submitted to the nexus, by the type of connection they came from.",
+		[]string{"source"}, nil)
+
+	eventsDelivered = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "events_delivered_total"),
+		"Events put in a registration's buffer.",
+		[]string{"type", "peer"}, nil)
+
+	eventsDropped = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "events_dropped_total"),
+		"Events dropped because a registration's buffer was full, by the overflow action that dropped them.",
+		[]string{"type", "peer", "reason"}, nil)
+
+	slowConsumerDisconnects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "slow_consumer_disconnects_total"),
+		"Registrations disconnected because their buffer was full.",
+		[]string{"type", "peer"}, nil)
+
+	registrations = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "registrations_total"),
+		"Registrations and subscription changes received by the nexus.",
+		[]string{"type"}, nil)
+
+	deregistrations = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "deregistrations_total"),
+		"Deregistrations and unsubscriptions received by the nexus.",
+		[]string{"type"}, nil)
+
+	duplicateEvents = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "duplicate_events_total"),
+		"Events dropped by the de-duplication cache.",
+		nil, nil)
+
+	loopedEvents = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "looped_events_total"),
+		"Events dropped or not forwarded to keep them from looping between hubs.",
+		[]string{"reason"}, nil)
+
+	malformedFrames = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "malformed_frames_total"),
+		"Messages that couldn't be parsed.",
+		nil, nil)
+
+	websocketConnects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "websocket_connects_total"),
+		"Websocket connections opened, by connection type.",
+		[]string{"type"}, nil)
+
+	websocketRejected = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "websocket_rejected_total"),
+		"Websocket connections turned away by authentication, by connection type.",
+		[]string{"type"}, nil)
+
+	websocketDisconnects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "websocket_disconnects_total"),
+		"Websocket connections closed, by connection type.",
+		[]string{"type"}, nil)
+
+	websocketConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "websocket_connections"),
+		"Open websocket connections, by connection type.",
+		[]string{"type"}, nil)
+
+	rateLimited = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "rate_limited_total"),
+		"Messages from connections that went over a limit, by connection type, limit, and the action taken.",
+		[]string{"type", "limit", "action"}, nil)
+
+	bufferLength = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "buffer_length"),
+		"Events waiting in a buffer.",
+		[]string{"buffer", "id"}, nil)
+
+	bufferCapacity = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "buffer_capacity"),
+		"The size of a buffer.",
+		[]string{"buffer", "id"}, nil)
+)
+
+//Collector collects the metrics of a nexus and the hub's connections
+type Collector struct {
+	nexus *nexus.Nexus
+	conf  *hubconn.Config
+}
+
+//NewCollector returns a collector for the nexus, and the connections set up with conf
+func NewCollector(n *nexus.Nexus, conf *hubconn.Config) *Collector {
+	return &Collector{
+		nexus: n,
+		conf:  conf,
+	}
+}
+
+//Handler returns an http handler serving the metrics of the nexus, along with the go runtime and process metrics
+func Handler(n *nexus.Nexus, conf *hubconn.Config) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		NewCollector(n, conf),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+//Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		eventsReceived, eventsDelivered, eventsDropped, slowConsumerDisconnects,
+		registrations, deregistrations, duplicateEvents, loopedEvents, malformedFrames,
+		websocketConnects, websocketDisconnects, websocketRejected, websocketConnections, rateLimited,
+		bufferLength, bufferCapacity,
+	} {
+		ch <- d
+	}
+}
+
+//Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.nexus.GetStatus()
+
+	for t, v := range s.EventsReceived {
+		ch <- prometheus.MustNewConstMetric(eventsReceived, prometheus.CounterValue, float64(v), t)
+	}
+	for t, v := range s.Registrations {
+		ch <- prometheus.MustNewConstMetric(registrations, prometheus.CounterValue, float64(v), t)
+	}
+	for t, v := range s.Deregistrations {
+		ch <- prometheus.MustNewConstMetric(deregistrations, prometheus.CounterValue, float64(v), t)
+	}
+
+	ch <- prometheus.MustNewConstMetric(duplicateEvents, prometheus.CounterValue, float64(s.Dedup.Hits))
+	ch <- prometheus.MustNewConstMetric(loopedEvents, prometheus.CounterValue, float64(s.Loops.Returned), "returned")
+	ch <- prometheus.MustNewConstMetric(loopedEvents, prometheus.CounterValue, float64(s.Loops.Prevented), "prevented")
+	ch <- prometheus.MustNewConstMetric(loopedEvents, prometheus.CounterValue, float64(s.Loops.TTLExceeded), "ttl-exceeded")
+	ch <- prometheus.MustNewConstMetric(malformedFrames, prometheus.CounterValue, float64(base.MalformedFrames()))
+
+	for t, v := range hubconn.GetConnectionCounts() {
+		ch <- prometheus.MustNewConstMetric(websocketConnects, prometheus.CounterValue, float64(v.Connects), t)
+		ch <- prometheus.MustNewConstMetric(websocketDisconnects, prometheus.CounterValue, float64(v.Disconnects), t)
+		ch <- prometheus.MustNewConstMetric(websocketRejected, prometheus.CounterValue, float64(v.Rejected), t)
+		ch <- prometheus.MustNewConstMetric(websocketConnections, prometheus.GaugeValue, float64(v.Active), t)
+	}
+
+	for t, v := range c.conf.GetLimitStatus() {
+		limited(ch, t, "events", v.Events)
+		limited(ch, t, "total-events", v.TotalEvents)
+		limited(ch, t, "subscriptions", v.Subscriptions)
+		limited(ch, t, "max-subscriptions", v.MaxSubscriptions)
+	}
+
+	buffer(ch, s.Registration, "registration", "")
+	buffer(ch, s.Distribution, "distribution", "")
+	for _, shard := range s.Shards {
+		buffer(ch, shard.Registration, "shard-registration", strconv.Itoa(shard.Index))
+		buffer(ch, shard.Distribution, "shard-distribution", strconv.Itoa(shard.Index))
+	}
+
+	//a messenger shows up once for each of its rooms
+	messengers := make(map[string]nexus.RegStatus)
+	for _, v := range s.MessengerMappings {
+		for i := range v {
+			messengers[v[i].ID] = v[i]
+		}
+	}
+
+	peers := make(map[peerKey]*peerTotals)
+	for _, r := range messengers {
+		addRegistration(peers, base.Messenger, r.Identity, r)
+	}
+	for _, r := range s.Repeaters {
+		addRegistration(peers, base.Repeater, r.Addr, r)
+	}
+	for _, r := range s.Hubs {
+		addRegistration(peers, base.Hub, r.PeerID, r)
+	}
+
+	for k, t := range peers {
+		buffer(ch, t.buffer, k.connType, k.peer)
+		ch <- prometheus.MustNewConstMetric(eventsDelivered, prometheus.CounterValue, float64(t.delivery.Delivered), k.connType, k.peer)
+		ch <- prometheus.MustNewConstMetric(eventsDropped, prometheus.CounterValue, float64(t.delivery.DroppedNewest), k.connType, k.peer, nexus.DropNewest)
+		ch <- prometheus.MustNewConstMetric(eventsDropped, prometheus.CounterValue, float64(t.delivery.DroppedOldest), k.connType, k.peer, nexus.DropOldest)
+		ch <- prometheus.MustNewConstMetric(eventsDropped, prometheus.CounterValue, float64(t.delivery.TimedOut), k.connType, k.peer, "timeout")
+		ch <- prometheus.MustNewConstMetric(slowConsumerDisconnects, prometheus.CounterValue, float64(t.delivery.Disconnects), k.connType, k.peer)
+	}
+}
+
+//peerKey is the labels of a registration's metrics
+type peerKey struct {
+	connType string
+	peer     string
+}
+
+//peerTotals sums the buffers and delivery counters of the registrations with the same peer
+type peerTotals struct {
+	buffer   nexus.RegStatus
+	delivery nexus.DeliveryStatus
+}
+
+func addRegistration(peers map[peerKey]*peerTotals, connType, peer string, r nexus.RegStatus) {
+	k := peerKey{connType: connType, peer: peer}
+	t, ok := peers[k]
+	if !ok {
+		t = &peerTotals{}
+		peers[k] = t
+	}
+
+	t.buffer.BufferUtil += r.BufferUtil
+	t.buffer.BufferCap += r.BufferCap
+	if r.Delivery == nil {
+		return
+	}
+
+	t.delivery.Delivered += r.Delivery.Delivered
+	t.delivery.DroppedNewest += r.Delivery.DroppedNewest
+	t.delivery.DroppedOldest += r.Delivery.DroppedOldest
+	t.delivery.TimedOut += r.Delivery.TimedOut
+	t.delivery.Disconnects += r.Delivery.Disconnects
+}
+
+func limited(ch chan<- prometheus.Metric, connType, limit string, c hubconn.LimitCounters) {
+	ch <- prometheus.MustNewConstMetric(rateLimited, prometheus.CounterValue, float64(c.Dropped), connType, limit, hubconn.LimitDrop)
+	ch <- prometheus.MustNewConstMetric(rateLimited, prometheus.CounterValue, float64(c.Delayed), connType, limit, hubconn.LimitDelay)
+	ch <- prometheus.MustNewConstMetric(rateLimited, prometheus.CounterValue, float64(c.Disconnects), connType, limit, hubconn.LimitDisconnect)
+}
+
+func buffer(ch chan<- prometheus.Metric, r nexus.RegStatus, name, id string) {
+	ch <- prometheus.MustNewConstMetric(bufferLength, prometheus.GaugeValue, float64(r.BufferUtil), name, id)
+	ch <- prometheus.MustNewConstMetric(bufferCapacity, prometheus.GaugeValue, float64(r.BufferCap), name, id)
+}
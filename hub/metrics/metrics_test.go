@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+//TestHandler scrapes the endpoint, and checks it has the metrics in the readme with their labels
+func TestHandler(t *testing.T) {
+	o := nexus.DefaultOptions()
+	o.ID = "hub-a"
+	o.Shards = 2
+	n, err := nexus.New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	conf, err := hubconn.NewConfig(hubconn.Options{})
+	if err != nil {
+		t.Fatalf("couldn't build the config: %v", err.Error())
+	}
+
+	for _, r := range []base.RegistrationChange{
+		{Type: base.Messenger, Registration: base.Registration{ID: "1", Identity: "panel-user"}, SubscriptionChange: base.SubscriptionChange{Rooms: []string{"ITB-1101"}}},
+		{Type: base.Messenger, Registration: base.Registration{ID: "2", Identity: "panel-user"}, SubscriptionChange: base.SubscriptionChange{Rooms: []string{"ITB-1102"}}},
+		{Type: base.Repeater, Registration: base.Registration{ID: "3", Addr: "10.0.0.1"}},
+		{Type: base.Hub, Registration: base.Registration{ID: "4", PeerID: "hub-b"}},
+	} {
+		r.Create = true
+		r.Channel = make(chan base.EventWrapper, 10)
+		if _, err := n.SubmitRegistrationChangeAndWait(r, 5*time.Second); err != nil {
+			t.Fatalf("couldn't register %v: %v", r.ID, err.Error())
+		}
+	}
+	if _, err := n.SubmitAndWait(base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`)}, base.Repeater, "3", 5*time.Second); err != nil {
+		t.Fatalf("couldn't submit: %v", err.Error())
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(n, conf).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v", rec.Code)
+	}
+
+	var parser expfmt.TextParser
+	families, perr := parser.TextToMetricFamilies(rec.Body)
+	if perr != nil {
+		t.Fatalf("couldn't parse the metrics: %v", perr)
+	}
+
+	//the table in the readme
+	documented := []struct {
+		name   string
+		kind   dto.MetricType
+		labels []string
+	}{
+		{"events_received_total", dto.MetricType_COUNTER, []string{"source"}},
+		{"events_delivered_total", dto.MetricType_COUNTER, []string{"peer", "type"}},
+		{"events_dropped_total", dto.MetricType_COUNTER, []string{"peer", "reason", "type"}},
+		{"slow_consumer_disconnects_total", dto.MetricType_COUNTER, []string{"peer", "type"}},
+		{"registrations_total", dto.MetricType_COUNTER, []string{"type"}},
+		{"deregistrations_total", dto.MetricType_COUNTER, []string{"type"}},
+		{"duplicate_events_total", dto.MetricType_COUNTER, []string{}},
+		{"looped_events_total", dto.MetricType_COUNTER, []string{"reason"}},
+		{"malformed_frames_total", dto.MetricType_COUNTER, []string{}},
+		{"websocket_connects_total", dto.MetricType_COUNTER, []string{"type"}},
+		{"websocket_disconnects_total", dto.MetricType_COUNTER, []string{"type"}},
+		{"websocket_rejected_total", dto.MetricType_COUNTER, []string{"type"}},
+		{"websocket_connections", dto.MetricType_GAUGE, []string{"type"}},
+		{"rate_limited_total", dto.MetricType_COUNTER, []string{"action", "limit", "type"}},
+		{"buffer_length", dto.MetricType_GAUGE, []string{"buffer", "id"}},
+		{"buffer_capacity", dto.MetricType_GAUGE, []string{"buffer", "id"}},
+	}
+
+	for _, d := range documented {
+		f, ok := families[namespace+"_"+d.name]
+		if !ok {
+			t.Errorf("%v is missing", d.name)
+			continue
+		}
+		if f.GetType() != d.kind {
+			t.Errorf("%v is a %v, want a %v", d.name, f.GetType(), d.kind)
+		}
+		for _, m := range f.GetMetric() {
+			if got := labelNames(m); !reflect.DeepEqual(got, d.labels) {
+				t.Errorf("%v has labels %v, want %v", d.name, got, d.labels)
+				break
+			}
+		}
+	}
+
+	//registrations are labeled with their peer, and the ones with the same peer are summed
+	want := []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"events_received_total", map[string]string{"source": base.Repeater}, 1},
+		{"events_delivered_total", map[string]string{"type": base.Messenger, "peer": "panel-user"}, 1},
+		{"events_dropped_total", map[string]string{"type": base.Hub, "peer": "hub-b", "reason": nexus.DropNewest}, 0},
+		{"events_dropped_total", map[string]string{"type": base.Hub, "peer": "hub-b", "reason": nexus.DropOldest}, 0},
+		{"events_dropped_total", map[string]string{"type": base.Hub, "peer": "hub-b", "reason": "timeout"}, 0},
+		{"looped_events_total", map[string]string{"reason": "ttl-exceeded"}, 0},
+		{"buffer_capacity", map[string]string{"buffer": base.Messenger, "id": "panel-user"}, 20},
+		{"buffer_capacity", map[string]string{"buffer": base.Repeater, "id": "10.0.0.1"}, 10},
+		{"buffer_capacity", map[string]string{"buffer": base.Hub, "id": "hub-b"}, 10},
+		{"buffer_length", map[string]string{"buffer": "registration", "id": ""}, 0},
+		{"buffer_length", map[string]string{"buffer": "shard-distribution", "id": "1"}, 0},
+		{"rate_limited_total", map[string]string{"type": base.Messenger, "limit": "max-subscriptions", "action": hubconn.LimitDisconnect}, 0},
+	}
+	for _, w := range want {
+		m, ok := find(families[namespace+"_"+w.name], w.labels)
+		if !ok {
+			t.Errorf("%v%v is missing", w.name, w.labels)
+			continue
+		}
+		if got := value(m); got != w.value {
+			t.Errorf("%v%v is %v, want %v", w.name, w.labels, got, w.value)
+		}
+	}
+}
+
+func labelNames(m *dto.Metric) []string {
+	toReturn := []string{}
+	for _, l := range m.GetLabel() {
+		toReturn = append(toReturn, l.GetName())
+	}
+	sort.Strings(toReturn)
+	return toReturn
+}
+
+//find returns the metric in the family with the labels
+func find(f *dto.MetricFamily, labels map[string]string) (*dto.Metric, bool) {
+	for _, m := range f.GetMetric() {
+		got := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			got[l.GetName()] = l.GetValue()
+		}
+		if reflect.DeepEqual(got, labels) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func value(m *dto.Metric) float64 {
+	if m.GetCounter() != nil {
+		return m.GetCounter().GetValue()
+	}
+	return m.GetGauge().GetValue()
+}
@@ -0,0 +1,125 @@
+package nexus
+
+import (
+	"container/list"
+	"encoding/hex"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//Defaults for the de-duplication cache
+const (
+	DefaultDedupWindow = 10 * time.Second
+	DefaultDedupSize   = 10000
+)
+
+//dedupCache remembers the events routed in the last window, so that an event that reaches the hub more than once (e.g. through several repeaters) is only routed the first time.
+//Only the router touches the cache, the counters are read atomically by GetStatus.
+type dedupCache struct {
+	window  time.Duration
+	maxSize int
+
+	seen  map[string]*list.Element
+	order *list.List
+
+	size   int64
+	hits   uint64
+	misses uint64
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+//DedupStatus represents the state of the de-duplication cache
+type DedupStatus struct {
+	Window     string `json:"window"`
+	MaxEntries int    `json:"max-entries"`
+	Entries    int64  `json:"entries"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+}
+
+func newDedupCache(window time.Duration, maxSize int) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		maxSize: maxSize,
+		seen:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+//isDuplicate returns true if the event has been seen within the window, and records it if it hasn't. Not threadsafe.
+//An event is keyed by its ID. Events from legacy peers come without one (stamped), and are given a new ID by every hub they reach, so they're keyed by a hash of their room and contents instead:
+//two identical legacy events within the window are routed once. An event with an ID is also dropped if its contents match a legacy event, which is the same event after another hub gave it an ID
+func (d *dedupCache) isDuplicate(e base.EventWrapper, stamped bool) bool {
+	if d.window <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	d.expire(now)
+
+	hash := "hash:" + contentHash(e)
+	key := hash
+	if !stamped {
+		key = "id:" + e.Header.ID
+	}
+
+	_, seen := d.seen[key]
+	if !seen && !stamped {
+		_, seen = d.seen[hash]
+	}
+	if seen {
+		atomic.AddUint64(&d.hits, 1)
+		return true
+	}
+
+	atomic.AddUint64(&d.misses, 1)
+	d.seen[key] = d.order.PushBack(dedupEntry{key: key, seen: now})
+
+	for d.order.Len() > d.maxSize && d.maxSize > 0 {
+		d.remove(d.order.Front())
+	}
+
+	atomic.StoreInt64(&d.size, int64(d.order.Len()))
+	return false
+}
+
+//expire removes everything older than the window. Not threadsafe
+func (d *dedupCache) expire(now time.Time) {
+	for {
+		front := d.order.Front()
+		if front == nil || now.Sub(front.Value.(dedupEntry).seen) < d.window {
+			return
+		}
+		d.remove(front)
+	}
+}
+
+func (d *dedupCache) remove(el *list.Element) {
+	delete(d.seen, el.Value.(dedupEntry).key)
+	d.order.Remove(el)
+}
+
+func (d *dedupCache) getStatus() DedupStatus {
+	return DedupStatus{
+		Window:     d.window.String(),
+		MaxEntries: d.maxSize,
+		Entries:    atomic.LoadInt64(&d.size),
+		Hits:       atomic.LoadUint64(&d.hits),
+		Misses:     atomic.LoadUint64(&d.misses),
+	}
+}
+
+func contentHash(e base.EventWrapper) string {
+	h := fnv.New128a()
+	h.Write([]byte(e.Room))
+	h.Write([]byte{'\n'})
+	h.Write(e.Event)
+	return hex.EncodeToString(h.Sum(nil))
+}
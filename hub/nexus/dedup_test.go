@@ -0,0 +1,137 @@
+package nexus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+func dedupEvent(id, room, body string) base.EventWrapper {
+	return base.EventWrapper{
+		Room:   room,
+		Event:  []byte(body),
+		Header: base.Header{ID: id},
+	}
+}
+
+func TestDedup(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   base.EventWrapper
+		stamped bool
+		want    bool
+	}{
+		{"a new event", dedupEvent("a", "ITB-1101", `{"key":"power"}`), false, false},
+		{"the same event again", dedupEvent("a", "ITB-1101", `{"key":"power"}`), false, true},
+		{"the same contents with another ID", dedupEvent("b", "ITB-1101", `{"key":"power"}`), false, false},
+		{"the same ID with other contents", dedupEvent("b", "ITB-1101", `{"key":"input"}`), false, true},
+		{"a legacy event", dedupEvent("c", "ITB-1101", `{"key":"volume"}`), true, false},
+		{"the same legacy event, given another ID", dedupEvent("d", "ITB-1101", `{"key":"volume"}`), true, true},
+		{"the legacy event's contents in another room", dedupEvent("e", "ITB-1102", `{"key":"volume"}`), true, false},
+		{"the legacy event after another hub gave it an ID", dedupEvent("f", "ITB-1101", `{"key":"volume"}`), false, true},
+		{"a legacy event with the contents of an event with an ID", dedupEvent("g", "ITB-1101", `{"key":"power"}`), true, false},
+	}
+
+	d := newDedupCache(time.Minute, 100)
+	for _, tt := range tests {
+		if got := d.isDuplicate(tt.event, tt.stamped); got != tt.want {
+			t.Errorf("%v: got duplicate %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	status := d.getStatus()
+	if status.Hits != 4 || status.Misses != 5 || status.Entries != 5 {
+		t.Fatalf("got status %+v, want 4 hits, 5 misses and 5 entries", status)
+	}
+}
+
+func TestDedupLimits(t *testing.T) {
+	//each event takes one entry, so the cache holds as many events as its size
+	d := newDedupCache(time.Minute, 10)
+	for i := 0; i < 10; i++ {
+		if d.isDuplicate(dedupEvent(fmt.Sprint(i), "ITB-1101", fmt.Sprint(i)), i%2 == 0) {
+			t.Fatalf("event %v is a duplicate", i)
+		}
+	}
+	if entries := d.getStatus().Entries; entries != 10 {
+		t.Fatalf("got %v entries for 10 events, want 10", entries)
+	}
+	for i := 0; i < 10; i++ {
+		if !d.isDuplicate(dedupEvent(fmt.Sprint(i), "ITB-1101", fmt.Sprint(i)), i%2 == 0) {
+			t.Fatalf("event %v was forgotten", i)
+		}
+	}
+
+	//the oldest is forgotten to make room
+	d.isDuplicate(dedupEvent("10", "ITB-1101", "10"), false)
+	if d.isDuplicate(dedupEvent("0", "ITB-1101", "0"), true) {
+		t.Fatalf("the oldest event wasn't forgotten")
+	}
+
+	//and everything is forgotten after the window
+	d = newDedupCache(20*time.Millisecond, 10)
+	d.isDuplicate(dedupEvent("a", "ITB-1101", "a"), false)
+	time.Sleep(30 * time.Millisecond)
+	if d.isDuplicate(dedupEvent("a", "ITB-1101", "a"), false) {
+		t.Fatalf("the event was remembered after the window")
+	}
+
+	//a window of 0 turns it off
+	d = newDedupCache(0, 10)
+	for i := 0; i < 2; i++ {
+		if d.isDuplicate(dedupEvent("a", "ITB-1101", "a"), false) {
+			t.Fatalf("an event was a duplicate with de-duplication off")
+		}
+	}
+}
+
+//TestDedupIdenticalEvents checks that two identical events sent with the messenger library are both routed, and that a legacy event that reaches the hub twice is routed once
+func TestDedupIdenticalEvents(t *testing.T) {
+	o := DefaultOptions()
+	o.Shards = 1
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	got := make(chan base.EventWrapper, 10)
+	subscribe(t, n, "sub", []string{"ITB-1101"}, func(e base.EventWrapper) {
+		got <- e
+	})
+
+	submit := func(e base.EventWrapper) DeliveryReport {
+		report, err := n.SubmitAndWait(e, base.Messenger, "producer", 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+		return report
+	}
+
+	for i := 0; i < 2; i++ {
+		//the messenger library stamps each event it sends with a new ID
+		e := dedupEvent("", "ITB-1101", `{"key":"power","value":"on"}`)
+		e.Header.Stamp()
+		if report := submit(e); len(report.Dropped) > 0 {
+			t.Fatalf("identical event %v was dropped as %v", i, report.Dropped)
+		}
+	}
+
+	if report := submit(dedupEvent("", "ITB-1101", `{"key":"input"}`)); len(report.Dropped) > 0 {
+		t.Fatalf("the legacy event was dropped as %v", report.Dropped)
+	}
+	if report := submit(dedupEvent("", "ITB-1101", `{"key":"input"}`)); report.Dropped != DroppedDuplicate {
+		t.Fatalf("the legacy event was dropped as %q the second time, want %q", report.Dropped, DroppedDuplicate)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v of 3 events", i)
+		}
+	}
+}
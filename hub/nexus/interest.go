@@ -0,0 +1,254 @@
+package nexus
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//InterestStatus represents the rooms this hub advertises to other hubs, and how many events weren't forwarded to a hub because it didn't want them
+type InterestStatus struct {
+	Rooms   []string `json:"rooms"`
+	Skipped uint64   `json:"skipped"`
+}
+
+//interestTracker counts the messengers subscribed to each room, which is the interest the hub sends the other hubs (see base.Interest). The subscriptions are only changed by the nexus' run goroutine, lock guards the counts and the watchers
+type interestTracker struct {
+	//all is set if the hub always advertises "*", because the routing rules send events from hubs somewhere other than messengers
+	all bool
+
+	subscriptions map[string]map[string]bool //messenger ID to its rooms
+
+	lock     sync.Mutex
+	counts   map[string]int
+	watchers map[*InterestWatcher]bool
+
+	//skipped counts the events not forwarded to a hub because it didn't want them, it's accessed atomically
+	skipped uint64
+}
+
+//InterestWatcher collects the changes to the nexus' interest for a hub connection. Ready gets a value when there are changes to send, and Next returns them
+type InterestWatcher struct {
+	Ready chan struct{}
+
+	lock   sync.Mutex
+	reset  bool
+	add    map[string]bool
+	remove map[string]bool
+}
+
+func newInterestTracker(all bool) *interestTracker {
+	return &interestTracker{
+		all:           all,
+		subscriptions: make(map[string]map[string]bool),
+		counts:        make(map[string]int),
+		watchers:      make(map[*InterestWatcher]bool),
+	}
+}
+
+//wantsEverything returns true if the rules route events from hubs to more than messengers, in which case the hub needs every event its peers have
+func wantsEverything(rules []compiledRule) bool {
+	for i := range rules {
+		r := rules[i]
+		if len(r.Source) > 0 && r.Source != "*" && r.Source != base.Hub {
+			continue
+		}
+		if r.hubs != DeliverNone || r.repeaters != DeliverNone {
+			return true
+		}
+	}
+	return false
+}
+
+//WatchInterest starts collecting the changes to the nexus' interest for a hub connection. The first call to Next returns the whole interest, and the later ones the rooms that gained their first messenger or lost their last one
+func (n *Nexus) WatchInterest() *InterestWatcher {
+	t := n.interest
+	w := &InterestWatcher{
+		Ready:  make(chan struct{}, 1),
+		reset:  true,
+		add:    make(map[string]bool),
+		remove: make(map[string]bool),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.all {
+		w.add["*"] = true
+	} else {
+		for room := range t.counts {
+			w.add[room] = true
+		}
+	}
+
+	t.watchers[w] = true
+	w.Ready <- struct{}{}
+	return w
+}
+
+//UnwatchInterest stops collecting the changes to the nexus' interest for the watcher
+func (n *Nexus) UnwatchInterest(w *InterestWatcher) {
+	n.interest.lock.Lock()
+	defer n.interest.lock.Unlock()
+
+	delete(n.interest.watchers, w)
+}
+
+//Next returns the changes to the interest since it was last called, and false if there aren't any
+func (w *InterestWatcher) Next() (base.Interest, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.reset && len(w.add) == 0 && len(w.remove) == 0 {
+		return base.Interest{}, false
+	}
+
+	toReturn := base.Interest{
+		Control: base.ControlInterest,
+		Reset:   w.reset,
+		Add:     sortedKeys(w.add),
+		Remove:  sortedKeys(w.remove),
+	}
+
+	w.reset = false
+	w.add = make(map[string]bool)
+	w.remove = make(map[string]bool)
+	return toReturn, true
+}
+
+//changed records that the room was added to or removed from the interest
+func (w *InterestWatcher) changed(room string, added bool) {
+	w.lock.Lock()
+	if added {
+		delete(w.remove, room)
+		w.add[room] = true
+	} else {
+		delete(w.add, room)
+		if !w.reset {
+			w.remove[room] = true
+		}
+	}
+	w.lock.Unlock()
+
+	select {
+	case w.Ready <- struct{}{}:
+	default:
+	}
+}
+
+//subscribe adds the rooms to the messenger's subscriptions. Invalid patterns are left out, since the shards won't register them. Only call from the nexus' run goroutine
+func (t *interestTracker) subscribe(id string, rooms []string) {
+	subs, ok := t.subscriptions[id]
+	if !ok {
+		subs = make(map[string]bool)
+		t.subscriptions[id] = subs
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, room := range rooms {
+		if subs[room] || (IsRoomPattern(room) && validatePattern(room) != nil) {
+			continue
+		}
+
+		subs[room] = true
+		t.counts[room]++
+		if t.counts[room] == 1 {
+			t.notify(room, true)
+		}
+	}
+}
+
+//unsubscribe removes the rooms from the messenger's subscriptions, or all of them if rooms is empty. Only call from the nexus' run goroutine
+func (t *interestTracker) unsubscribe(id string, rooms []string) {
+	subs, ok := t.subscriptions[id]
+	if !ok {
+		return
+	}
+
+	if len(rooms) == 0 {
+		rooms = make([]string, 0, len(subs))
+		for room := range subs {
+			rooms = append(rooms, room)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, room := range rooms {
+		if !subs[room] {
+			continue
+		}
+
+		delete(subs, room)
+		t.counts[room]--
+		if t.counts[room] <= 0 {
+			delete(t.counts, room)
+			t.notify(room, false)
+		}
+	}
+
+	if len(subs) == 0 {
+		delete(t.subscriptions, id)
+	}
+}
+
+//notify tells the watchers about the change. Hold lock to call it
+func (t *interestTracker) notify(room string, added bool) {
+	if t.all {
+		return
+	}
+
+	for w := range t.watchers {
+		w.changed(room, added)
+	}
+}
+
+//getStatus returns the interest the hub advertises
+func (t *interestTracker) getStatus() InterestStatus {
+	toReturn := InterestStatus{
+		Skipped: atomic.LoadUint64(&t.skipped),
+	}
+
+	if t.all {
+		toReturn.Rooms = []string{"*"}
+		return toReturn
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	toReturn.Rooms = make([]string, 0, len(t.counts))
+	for room := range t.counts {
+		toReturn.Rooms = append(toReturn.Rooms, room)
+	}
+	sort.Strings(toReturn.Rooms)
+	return toReturn
+}
+
+//wants returns true if the hub on the other end of the registration wants the event's room, and counts it if it doesn't
+func (t *interestTracker) wants(r base.Registration, room string) bool {
+	if r.Interest.Matches(room) {
+		return true
+	}
+
+	atomic.AddUint64(&t.skipped, 1)
+	return false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	toReturn := make([]string, 0, len(m))
+	for k := range m {
+		toReturn = append(toReturn, k)
+	}
+	sort.Strings(toReturn)
+	return toReturn
+}
@@ -0,0 +1,150 @@
+package nexus
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//change subscribes the messenger to the rooms, or unsubscribes it from them. Unsubscribing from no rooms unregisters it
+func change(t *testing.T, n *Nexus, id string, create bool, rooms ...string) {
+	_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:               base.Messenger,
+		SubscriptionChange: base.SubscriptionChange{Create: create, Rooms: rooms},
+		Registration:       base.Registration{ID: id, Channel: make(chan base.EventWrapper, 10)},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't change %v's rooms: %v", id, err.Error())
+	}
+}
+
+//next checks the watcher is ready, and that its changes are want
+func next(t *testing.T, w *InterestWatcher, want base.Interest) {
+	t.Helper()
+
+	select {
+	case <-w.Ready:
+	default:
+		t.Fatalf("the watcher isn't ready, want %+v", want)
+	}
+
+	got, ok := w.Next()
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got, ok := w.Next(); ok {
+		t.Fatalf("got %+v after the changes were returned", got)
+	}
+}
+
+//TestInterestWatcher checks a watcher starts with the whole interest, and then gets the rooms that gained their first messenger or lost their last one
+func TestInterestWatcher(t *testing.T) {
+	n := reportNexus(t, func(*Options) {})
+
+	change(t, n, "panel-1", true, "ITB-1101", "ITB-*", "ITB*1101")
+	w := n.WatchInterest()
+	defer n.UnwatchInterest(w)
+
+	//the invalid pattern isn't part of the interest
+	next(t, w, base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"ITB-*", "ITB-1101"}})
+
+	//a room another messenger already has doesn't change it
+	change(t, n, "panel-2", true, "ITB-1101", "ITB-1102")
+	next(t, w, base.Interest{Control: base.ControlInterest, Add: []string{"ITB-1102"}})
+
+	change(t, n, "panel-1", false, "ITB-1101", "ITB-*")
+	next(t, w, base.Interest{Control: base.ControlInterest, Remove: []string{"ITB-*"}})
+
+	//unregistering removes every room the messenger was the last one in
+	change(t, n, "panel-2", false)
+	next(t, w, base.Interest{Control: base.ControlInterest, Remove: []string{"ITB-1101", "ITB-1102"}})
+
+	//the last change to a room between calls to Next wins. Removing a room the peer never got is harmless
+	change(t, n, "panel-1", true, "ITB-1103", "ITB-1104")
+	change(t, n, "panel-1", false, "ITB-1103")
+	next(t, w, base.Interest{Control: base.ControlInterest, Add: []string{"ITB-1104"}, Remove: []string{"ITB-1103"}})
+
+	change(t, n, "panel-1", false, "ITB-1104")
+	change(t, n, "panel-1", true, "ITB-1104")
+	next(t, w, base.Interest{Control: base.ControlInterest, Add: []string{"ITB-1104"}})
+
+	if got := n.GetStatus().Interest.Rooms; !reflect.DeepEqual(got, []string{"ITB-1104"}) {
+		t.Fatalf("the status has rooms %v", got)
+	}
+}
+
+//TestInterestWatcherBeforeReset checks a room removed before the first call to Next is just left out of the reset
+func TestInterestWatcherBeforeReset(t *testing.T) {
+	n := reportNexus(t, func(*Options) {})
+
+	change(t, n, "panel-1", true, "ITB-1101", "ITB-1102")
+	w := n.WatchInterest()
+	defer n.UnwatchInterest(w)
+
+	change(t, n, "panel-1", false, "ITB-1101")
+	change(t, n, "panel-1", true, "ITB-1103")
+	next(t, w, base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"ITB-1102", "ITB-1103"}})
+}
+
+//TestInterestAll checks a hub whose rules send events from hubs on to other hubs advertises every room, whatever its messengers are subscribed to
+func TestInterestAll(t *testing.T) {
+	n := reportNexus(t, func(o *Options) {
+		o.Rules = append([]Rule{{
+			Name:         "forward",
+			Source:       base.Hub,
+			Destinations: map[string]string{base.Messenger: DeliverAll, base.Hub: DeliverAll},
+		}}, o.Rules...)
+	})
+
+	w := n.WatchInterest()
+	defer n.UnwatchInterest(w)
+	next(t, w, base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"*"}})
+
+	change(t, n, "panel-1", true, "ITB-1101")
+	if got, ok := w.Next(); ok {
+		t.Fatalf("got %+v, want no changes", got)
+	}
+}
+
+//TestInterestSkipped checks an event is only forwarded to the hubs whose interest covers its room, and that the others are counted
+func TestInterestSkipped(t *testing.T) {
+	n := reportNexus(t, func(*Options) {})
+
+	everything := base.NewInterestSet()
+	some := base.NewInterestSet()
+	some.Apply(base.Interest{Control: base.ControlInterest, Reset: true, Add: []string{"ITB-1101", "JFSB-*"}})
+	none := base.NewInterestSet()
+	none.Apply(base.Interest{Control: base.ControlInterest, Reset: true})
+
+	for id, interest := range map[string]*base.InterestSet{"everything": everything, "some": some, "none": none, "nil": nil} {
+		_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+			Type:               base.Hub,
+			SubscriptionChange: base.SubscriptionChange{Create: true},
+			Registration:       base.Registration{ID: id, Channel: make(chan base.EventWrapper, 10), Interest: interest},
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't register %v: %v", id, err.Error())
+		}
+	}
+
+	want := map[string][]string{
+		"ITB-1101":  {"everything", "nil", "some"},
+		"ITB-1102":  {"everything", "nil"},
+		"JFSB-B192": {"everything", "nil", "some"},
+	}
+	for room, hubs := range want {
+		report := submitAndWait(t, n, base.EventWrapper{Room: room, Event: []byte(`{}`)}, base.Messenger)
+		sort.Strings(report.Hubs)
+		if !reflect.DeepEqual(report.Hubs, hubs) {
+			t.Errorf("%v: forwarded to %v, want %v", room, report.Hubs, hubs)
+		}
+	}
+
+	//none skips all three, and some skips ITB-1102
+	if got := n.GetStatus().Interest.Skipped; got != 4 {
+		t.Fatalf("%v events were skipped, want 4", got)
+	}
+}
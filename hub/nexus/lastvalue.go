@@ -0,0 +1,155 @@
+package nexus
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+)
+
+const (
+	//DefaultLastValueSize is the most events the last-value cache holds. The cache is off by default, since every event has to be unmarshaled to be cached
+	DefaultLastValueSize = 0
+
+	//SnapshotTimeout is the longest a shard waits for a messenger to take its snapshot, before the rest of the snapshot is left out
+	SnapshotTimeout = 5 * time.Second
+)
+
+//lastValueCache holds the last event for each (room, device, key), so that a new subscription can be sent the current state of its rooms before any new events. The least recently updated values are dropped once it's full.
+//Only the shard's router touches the cache, the size is read atomically by GetStatus.
+type lastValueCache struct {
+	maxSize int
+
+	values map[lastValueKey]*list.Element
+	order  *list.List
+
+	size int64
+}
+
+type lastValueKey struct {
+	room   string
+	device string
+	key    string
+}
+
+type lastValue struct {
+	key   lastValueKey
+	event base.EventWrapper
+}
+
+//LastValueStatus represents the state of the last-value cache
+type LastValueStatus struct {
+	MaxEntries int   `json:"max-entries"`
+	Entries    int64 `json:"entries"`
+}
+
+func newLastValueCache(maxSize int) *lastValueCache {
+	return &lastValueCache{
+		maxSize: maxSize,
+		values:  make(map[lastValueKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+//update records the event as the last value of its device and key. Events without a key aren't recorded. Not threadsafe
+func (c *lastValueCache) update(e base.EventWrapper) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	ev, err := base.UnwrapEvent(e)
+	if err != nil {
+		log.L.Debugf("Not caching event %v: %v", e.Header.ID, err.Error())
+		return
+	}
+
+	if len(ev.Key) == 0 {
+		return
+	}
+
+	k := lastValueKey{
+		room:   e.Room,
+		device: ev.TargetDevice.DeviceID,
+		key:    ev.Key,
+	}
+
+	if el, ok := c.values[k]; ok {
+		el.Value = lastValue{key: k, event: e}
+		c.order.MoveToBack(el)
+		return
+	}
+
+	c.values[k] = c.order.PushBack(lastValue{key: k, event: e})
+	for c.order.Len() > c.maxSize {
+		front := c.order.Front()
+		delete(c.values, front.Value.(lastValue).key)
+		c.order.Remove(front)
+	}
+
+	atomic.StoreInt64(&c.size, int64(c.order.Len()))
+}
+
+//each calls fn with every cached event whose room matches, from the least to the most recently updated. Not threadsafe
+func (c *lastValueCache) each(match func(room string) bool, fn func(base.EventWrapper)) {
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		v := el.Value.(lastValue)
+		if match(v.key.room) {
+			fn(v.event)
+		}
+	}
+}
+
+func (c *lastValueCache) getStatus() LastValueStatus {
+	return LastValueStatus{
+		MaxEntries: c.maxSize,
+		Entries:    atomic.LoadInt64(&c.size),
+	}
+}
+
+//sendSnapshot sends the registration the cached events for the rooms, marked with the snapshot header. The snapshot doesn't go through the overflow policy, so nothing in it is dropped and the messenger isn't disconnected for it:
+//each event waits for room in the messenger's buffer, for up to SnapshotTimeout for the whole snapshot. The events that don't make it in time are left out, and counted on the result so the messenger can be told. Not threadsafe
+func (s *shard) sendSnapshot(r base.Registration, rooms []string, result *changeResult) {
+	if len(rooms) == 0 || s.lastValues.order.Len() == 0 {
+		return
+	}
+
+	match := func(room string) bool {
+		return subscribedTo(rooms, room)
+	}
+
+	c := s.counters(base.Messenger, r.ID)
+	t := time.NewTimer(SnapshotTimeout)
+	defer t.Stop()
+
+	sent, truncated := 0, 0
+	s.lastValues.each(match, func(e base.EventWrapper) {
+		if r.ContentFilter != nil {
+			ev, err := base.UnwrapEvent(e)
+			if err != nil || !r.ContentFilter.Match(ev) {
+				return
+			}
+		}
+
+		if truncated > 0 {
+			truncated++
+			return
+		}
+
+		e.Header.Set(base.HeaderSnapshot, "true")
+		select {
+		case r.ChannelFor(e) <- e:
+			atomic.AddUint64(&c.delivered, 1)
+			sent++
+		case <-t.C:
+			truncated++
+		}
+	})
+
+	if truncated > 0 {
+		log.L.Warnf("Messenger %v didn't take its snapshot of %v in time, left out %v of %v cached events", r.ID, rooms, truncated, sent+truncated)
+		result.truncateSnapshot(truncated)
+	}
+	log.L.Debugf("Sent %v cached events for %v to messenger %v", sent, rooms, r.ID)
+}
@@ -0,0 +1,122 @@
+package nexus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/v2/events"
+)
+
+func TestLastValueSizeAndShards(t *testing.T) {
+	tests := []struct {
+		size, shards int
+		err          bool
+	}{
+		{0, 4, false},
+		{4, 4, false},
+		{100, 4, false},
+		{3, 4, true},
+		{1, 2, true},
+	}
+
+	for _, tt := range tests {
+		o := DefaultOptions()
+		o.Shards = tt.shards
+		o.LastValueSize = tt.size
+
+		n, err := New(o)
+		if (err != nil) != tt.err {
+			t.Errorf("a cache of %v with %v shards: got error %v, want an error %v", tt.size, tt.shards, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		//every shard gets a share of the cache, or none of them do
+		for i, s := range n.shards {
+			if enabled := s.lastValues != nil && s.lastValues.maxSize > 0; enabled != (tt.size > 0) {
+				t.Errorf("a cache of %v with %v shards: shard %v has its cache on %v", tt.size, tt.shards, i, enabled)
+			}
+		}
+	}
+}
+
+//TestSnapshotSkipsOverflowPolicy sends a snapshot bigger than the messenger's buffer with an overflow policy that drops events, and checks none of it is dropped
+func TestSnapshotSkipsOverflowPolicy(t *testing.T) {
+	o := DefaultOptions()
+	o.Shards = 1
+	o.DedupWindow = 0
+	o.LastValueSize = 100
+	o.Overflow[base.Messenger] = OverflowPolicy{Action: DropNewest}
+
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	const count = 20
+	routed := make(chan base.EventWrapper, count)
+	subscribe(t, n, "live", []string{"ITB-1101"}, func(e base.EventWrapper) {
+		routed <- e
+	})
+
+	for i := 0; i < count; i++ {
+		e := base.WrapEvent(events.Event{Key: fmt.Sprintf("key-%v", i), Value: "on"})
+		e.Room = "ITB-1101"
+		if err := n.Submit(e, base.Messenger, "producer"); err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-routed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the events to be routed")
+		}
+	}
+
+	//the buffer only holds one event, and it's read slowly
+	c := make(chan base.EventWrapper, 1)
+	got := make(chan base.EventWrapper, count)
+	go func() {
+		for e := range c {
+			time.Sleep(time.Millisecond)
+			got <- e
+		}
+	}()
+
+	report, err := n.SubmitRegistrationChangeAndReport(base.RegistrationChange{
+		Type: base.Messenger,
+		SubscriptionChange: base.SubscriptionChange{
+			Create:   true,
+			Rooms:    []string{"ITB-1101"},
+			Snapshot: true,
+		},
+		Registration: base.Registration{
+			ID:      "snapshot",
+			Channel: c,
+		},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't register: %v", err.Error())
+	}
+	if report.SnapshotTruncated != 0 {
+		t.Fatalf("the snapshot was truncated by %v events", report.SnapshotTruncated)
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case e := <-got:
+			if e.Header.Get(base.HeaderSnapshot) != "true" {
+				t.Fatalf("event %v doesn't have the snapshot header", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v of %v snapshot events", i, count)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package nexus
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//testHub is a nexus in a mesh, with a messenger that counts the events it gets
+type testHub struct {
+	*Nexus
+	received int64
+}
+
+//newMesh starts a nexus for each ID, each forwarding the events from hubs to its other hubs, and links them in the direction of each pair.
+//If peerIDs is set the hubs know who's on the other end of each link, like hubs that exchange a hello
+func newMesh(t *testing.T, ids []string, links [][2]string, peerIDs, dedup bool, maxHops int) map[string]*testHub {
+	done := make(chan struct{})
+	hubs := make(map[string]*testHub, len(ids))
+	for _, id := range ids {
+		o := DefaultOptions()
+		o.ID = id
+		o.Shards = 2
+		o.MaxHops = maxHops
+		o.Rules = append([]Rule{{
+			Name:         "forward",
+			Source:       base.Hub,
+			Destinations: map[string]string{base.Messenger: DeliverAll, base.Hub: DeliverAll},
+		}}, DefaultRules(false)...)
+		if !dedup {
+			o.DedupWindow = 0
+		}
+
+		n, err := New(o)
+		if err != nil {
+			t.Fatalf("couldn't build %v: %v", id, err.Error())
+		}
+		n.Start()
+
+		h := &testHub{Nexus: n}
+		subscribe(t, n, "panel", []string{"ITB-1101"}, func(base.EventWrapper) {
+			atomic.AddInt64(&h.received, 1)
+		})
+		hubs[id] = h
+	}
+
+	t.Cleanup(func() {
+		close(done)
+		for _, h := range hubs {
+			h.Stop(100 * time.Millisecond)
+		}
+	})
+
+	for _, link := range links {
+		from, to := hubs[link[0]], hubs[link[1]]
+		c := make(chan base.EventWrapper, 100)
+
+		r := base.Registration{ID: "to-" + link[1], Channel: c}
+		if peerIDs {
+			r.PeerID = link[1]
+		}
+		_, err := from.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+			Type:               base.Hub,
+			SubscriptionChange: base.SubscriptionChange{Create: true},
+			Registration:       r,
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't link %v to %v: %v", link[0], link[1], err.Error())
+		}
+
+		go func(source string) {
+			for {
+				select {
+				case e := <-c:
+					to.Submit(e, base.Hub, source)
+				case <-done:
+					return
+				}
+			}
+		}("from-" + link[0])
+	}
+
+	return hubs
+}
+
+//settle waits until the counts stop changing
+func settle(t *testing.T, counts func() []uint64) {
+	last := counts()
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+
+		cur := counts()
+		if reflect.DeepEqual(cur, last) && i > 5 {
+			return
+		}
+		last = cur
+	}
+	t.Fatalf("the mesh didn't settle")
+}
+
+func (h *testHub) counts() []uint64 {
+	s := h.GetStatus().Loops
+	return []uint64{uint64(atomic.LoadInt64(&h.received)), s.Returned, s.Prevented, s.TTLExceeded}
+}
+
+func meshCounts(hubs map[string]*testHub, ids ...string) func() []uint64 {
+	return func() []uint64 {
+		toReturn := []uint64{}
+		for _, id := range ids {
+			toReturn = append(toReturn, hubs[id].counts()...)
+		}
+		return toReturn
+	}
+}
+
+func submitTo(t *testing.T, h *testHub) {
+	e := base.EventWrapper{Room: "ITB-1101", Event: []byte(`{"key":"power"}`)}
+	if _, err := h.SubmitAndWait(e, base.Messenger, "producer", 5*time.Second); err != nil {
+		t.Fatalf("couldn't submit: %v", err.Error())
+	}
+}
+
+//TestLoopReturned sends an event around a ring of hubs that don't know who they're connected to, and checks it's dropped when it gets back to the first one
+func TestLoopReturned(t *testing.T) {
+	hubs := newMesh(t, []string{"a", "b", "c"}, [][2]string{{"a", "b"}, {"b", "c"}, {"c", "a"}}, false, false, 0)
+
+	submitTo(t, hubs["a"])
+	settle(t, meshCounts(hubs, "a", "b", "c"))
+
+	//received, returned, prevented, ttl exceeded
+	want := map[string][]uint64{
+		"a": {1, 1, 0, 0},
+		"b": {1, 0, 0, 0},
+		"c": {1, 0, 0, 0},
+	}
+	for id, h := range hubs {
+		if got := h.counts(); !reflect.DeepEqual(got, want[id]) {
+			t.Errorf("%v: got %v, want %v", id, got, want[id])
+		}
+	}
+}
+
+//TestLoopPrevented sends an event into a triangle of hubs that know who they're connected to, and checks no hub sends it to one that has already routed it
+func TestLoopPrevented(t *testing.T) {
+	links := [][2]string{{"a", "b"}, {"b", "a"}, {"b", "c"}, {"c", "b"}, {"c", "a"}, {"a", "c"}}
+	hubs := newMesh(t, []string{"a", "b", "c"}, links, true, true, 0)
+
+	submitTo(t, hubs["a"])
+	settle(t, meshCounts(hubs, "a", "b", "c"))
+
+	//every hub gets it once, and it never gets back to a
+	for id, h := range hubs {
+		if got := h.counts(); got[0] != 1 || got[1] != 0 {
+			t.Errorf("%v: got it %v times, and %v back, want it once", id, got[0], got[1])
+		}
+	}
+	if got := hubs["a"].counts(); got[2] != 0 {
+		t.Errorf("a skipped %v hubs, want 0", got[2])
+	}
+
+	//b and c each skip sending it back to a, and either both send it to the other and drop that copy as a duplicate,
+	//or one gets the other's copy first and skips sending it to both, and drops a's copy
+	prevented := hubs["b"].counts()[2] + hubs["c"].counts()[2]
+	dups := hubs["b"].GetStatus().Dedup.Hits + hubs["c"].GetStatus().Dedup.Hits
+	if prevented < 2 || prevented+dups != 4 {
+		t.Errorf("%v forwards were skipped and %v duplicates dropped, want 4 between them with at least 2 skipped", prevented, dups)
+	}
+}
+
+//TestMaxHops sends an event down a line of hubs, and checks it's dropped once it has gone through more than the max hops
+func TestMaxHops(t *testing.T) {
+	hubs := newMesh(t, []string{"a", "b", "c", "d"}, [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}}, false, false, 2)
+
+	submitTo(t, hubs["a"])
+	settle(t, meshCounts(hubs, "a", "b", "c", "d"))
+
+	want := map[string][]uint64{
+		"a": {1, 0, 0, 0},
+		"b": {1, 0, 0, 0},
+		"c": {0, 0, 0, 1},
+		"d": {0, 0, 0, 0},
+	}
+	for id, h := range hubs {
+		if got := h.counts(); !reflect.DeepEqual(got, want[id]) {
+			t.Errorf("%v: got %v, want %v", id, got, want[id])
+		}
+	}
+}
@@ -1,60 +1,135 @@
 package nexus
 
 import (
-	"os"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/eventlog"
+	"github.com/byuoitav/central-event-system/hub/filter"
 	"github.com/byuoitav/common/log"
 	"github.com/byuoitav/common/nerr"
 )
 
-//N is the default Nexus
-//Do this in server.go?
-var N *Nexus
+//DefaultMaxHops is the number of hubs an event may be routed through before it's dropped
+const DefaultMaxHops = 16
 
-//StartNexus .
-func StartNexus() {
+//Nexus handles the actuall routing of events around.
+//Rooms are hashed to one of several shards, each with its own router and registries, so events are routed in parallel while the events for any one room stay in order.
+//Registration changes go through the nexus, which hands each shard the part it cares about.
+type Nexus struct {
+	shards []*shard
 
-	log.L.Infof("Warping in nexus...")
-	N = &Nexus{
-		registrationChannel: make(chan base.RegistrationChange, 100),
-		incomingChannel:     make(chan base.HubEventWrapper, 5000),
+	registrationChannel chan registrationRequest
+	disconnectChannel   chan base.RegistrationChange
 
-		messengerRegistry:  make(map[string][]base.Registration),
-		roomMessengerIndex: make(map[string][]string),
-		roomNexus:          len(os.Getenv("ROOM_SYSTEM")) > 0,
-	}
-	//start the router
-	go N.start()
-	log.L.Infof("Done.")
+	//disconnected holds the connections whose channel the nexus has closed
+	disconnected map[string]bool
+
+	//rules decide where each event goes, priority decides which events skip ahead of the rest
+	rules        []compiledRule
+	priority     PriorityRules
+	highPriority uint64
+
+	//eventLog is nil unless the event log is turned on. replays tracks the replays to each connection, so they can be stopped when it goes away
+	eventLog *eventlog.Log
+	replays  map[string]*replayTracker
+
+	//id identifies this hub to other hubs, maxHops is the TTL of an event. A maxHops of 0 means unlimited
+	id      string
+	maxHops int
+
+	loops loopCounters
+
+	//received counts the events submitted by each source type, registrations and deregistrations count the registration changes for each connection type
+	received        typeCounters
+	registrations   typeCounters
+	deregistrations typeCounters
+
+	//overflow is the overflow policy for each connection type
+	overflow map[string]OverflowPolicy
+
+	//repeaterStrategy picks the repeater each event from a messenger goes to, repeaterWeights are used by the weighted strategy and are keyed on the repeater's address
+	repeaterStrategy string
+	repeaterWeights  map[string]float64
+	currentRepeater  atomic.Value
+
+	//interest is the rooms the hub asks the other hubs for
+	interest *interestTracker
+
+	//draining is set once the nexus stops accepting events, pending counts the events submitted but not yet routed. idle is signaled when the last pending event is routed while draining
+	draining int32
+	pending  int64
+	idle     chan struct{}
+
+	//buffers are the registrations with a channel, keyed on type and ID, so Drain can see what's left in them without asking the shards
+	buffers     map[string]base.Registration
+	buffersLock sync.Mutex
+
+	//started is set once the routers are running, it's accessed atomically
+	started int32
+
+	//stop is closed when the nexus is stopped
+	stop     chan struct{}
+	once     sync.Once
+	stopOnce sync.Once
 }
 
-//Nexus handles the actuall routing of events around
-type Nexus struct {
-	messengerRegistry  map[string][]base.Registration
-	roomMessengerIndex map[string][]string
+//loopCounters are updated by the routers and read by GetStatus, so they're accessed atomically
+type loopCounters struct {
+	returned    uint64 //events that came back to a hub they had already been routed through
+	prevented   uint64 //forwards skipped because the receiving hub had already seen the event
+	ttlExceeded uint64 //events dropped for going through too many hubs
+}
 
-	hubRegistry      []base.Registration
-	repeaterRegistry []base.Registration
+//typeCounters count something for each connection type. The map is never written after it's built, the counters are accessed atomically
+type typeCounters map[string]*uint64
 
-	registrationChannel chan base.RegistrationChange
-	incomingChannel     chan base.HubEventWrapper
+func newTypeCounters() typeCounters {
+	return typeCounters{
+		base.Messenger: new(uint64),
+		base.Repeater:  new(uint64),
+		base.Hub:       new(uint64),
+	}
+}
+
+func (t typeCounters) inc(connType string) {
+	if c, ok := t[connType]; ok {
+		atomic.AddUint64(c, 1)
+	}
+}
 
-	roomNexus bool
+func (t typeCounters) get() map[string]uint64 {
+	toReturn := make(map[string]uint64, len(t))
+	for k, v := range t {
+		toReturn[k] = atomic.LoadUint64(v)
+	}
+	return toReturn
+}
 
-	once sync.Once
+//ID returns the ID this hub uses to identify itself to other hubs
+func (n *Nexus) ID() string {
+	return n.id
 }
 
 //SubmitRegistrationChange .
 func (n *Nexus) SubmitRegistrationChange(r base.RegistrationChange) {
-	n.registrationChannel <- r
+	n.submitRegistration(registrationRequest{RegistrationChange: r})
+}
+
+func (n *Nexus) submitRegistration(r registrationRequest) {
+	select {
+	case n.registrationChannel <- r:
+	case <-n.stop:
+	}
 }
 
 //RegisterConnection in cases of spokes is called with a set of rooms, and the channel to send events for that room down. in cases of dispatchers and hubs the rooms array is ignored.
 func (n *Nexus) RegisterConnection(rooms []string, channel chan base.EventWrapper, connID, connType string) *nerr.E {
 	log.L.Debugf("Registring connection %v of type %v for rooms %v", connID, connType, rooms)
-	n.registrationChannel <- base.RegistrationChange{
+	n.SubmitRegistrationChange(base.RegistrationChange{
 		Type: connType,
 		SubscriptionChange: base.SubscriptionChange{
 			Create: true,
@@ -64,14 +139,48 @@ func (n *Nexus) RegisterConnection(rooms []string, channel chan base.EventWrappe
 			Channel: channel,
 			ID:      connID,
 		},
-	}
+	})
+	return nil
+}
+
+//RegisterHubConnection registers a connection to another hub. peerID is the ID of the hub on the other end, and is used to avoid sending an event to a hub that has already seen it.
+func (n *Nexus) RegisterHubConnection(channel chan base.EventWrapper, connID, peerID string) *nerr.E {
+	log.L.Debugf("Registring hub connection %v to hub %v", connID, peerID)
+	n.SubmitRegistrationChange(base.RegistrationChange{
+		Type: base.Hub,
+		SubscriptionChange: base.SubscriptionChange{
+			Create: true,
+		},
+		Registration: base.Registration{
+			Channel: channel,
+			ID:      connID,
+			PeerID:  peerID,
+		},
+	})
+	return nil
+}
+
+//RegisterRepeaterConnection registers a connection from a repeater. addr is the host the repeater connected from, it's used to send a room's events to the same repeater after it reconnects, and to look up its weight.
+func (n *Nexus) RegisterRepeaterConnection(channel chan base.EventWrapper, connID, addr string) *nerr.E {
+	log.L.Debugf("Registring repeater connection %v from %v", connID, addr)
+	n.SubmitRegistrationChange(base.RegistrationChange{
+		Type: base.Repeater,
+		SubscriptionChange: base.SubscriptionChange{
+			Create: true,
+		},
+		Registration: base.Registration{
+			Channel: channel,
+			ID:      connID,
+			Addr:    addr,
+		},
+	})
 	return nil
 }
 
 //DeregisterConnection will deregsiter the provided connection (type + ID) fro all rooms provided. In cases of dispatchers and hubs the rooms parameter is ignored
 func (n *Nexus) DeregisterConnection(rooms []string, connType, connID string) *nerr.E {
 
-	n.registrationChannel <- base.RegistrationChange{
+	n.SubmitRegistrationChange(base.RegistrationChange{
 		Type: connType,
 		Registration: base.Registration{
 			ID: connID,
@@ -80,229 +189,319 @@ func (n *Nexus) DeregisterConnection(rooms []string, connType, connID string) *n
 			Create: false,
 			Rooms:  rooms,
 		},
-	}
+	})
 	return nil
 }
 
 //Submit sends an event to the hub for routing
 func (n *Nexus) Submit(e base.EventWrapper, Source, SourceID string) *nerr.E {
+	return n.submit(e, Source, SourceID, nil)
+}
+
+//submit hands the event to the shard for its room. If report isn't nil, the event's delivery report is sent on it once it's been routed
+func (n *Nexus) submit(e base.EventWrapper, Source, SourceID string, report chan DeliveryReport) *nerr.E {
 	if len(Source) == 0 || len(SourceID) == 0 {
 		return nerr.Create("Can't submit blank source or sourceID", "invalid")
 	}
 
-	n.incomingChannel <- base.HubEventWrapper{
-		Source:       Source,
-		SourceID:     SourceID,
-		EventWrapper: e,
+	//the event is counted as pending before draining is checked, so Drain either sees it or it's turned away
+	atomic.AddInt64(&n.pending, 1)
+	if n.Draining() {
+		n.routed()
+		return nerr.Create("the hub is shutting down", "draining")
+	}
+
+	//events from legacy peers show up without an ID, this is the first place they get one
+	stamped := len(e.Header.ID) == 0
+	e.Header.Stamp()
+
+	n.received.inc(Source)
+
+	//every event for a room goes through the same shard, which keeps the events of each priority in order
+	s := n.shardFor(e.Room)
+	lane := s.incomingChannel
+	if n.prioritize(&e) {
+		lane = s.priorityChannel
+	}
+
+	select {
+	case lane <- shardEvent{
+		HubEventWrapper: base.HubEventWrapper{
+			Source:       Source,
+			SourceID:     SourceID,
+			EventWrapper: e,
+		},
+		report:  report,
+		stamped: stamped,
+	}:
+	case <-n.stop:
+		n.routed()
+		return nerr.Create("the hub has stopped", "stopped")
 	}
 
 	return nil
 }
 
-func (n *Nexus) start() {
-	curRepeater := 0
+//Drain stops the nexus from accepting events, and waits for the events it already has to be routed and written out of the registrations' buffers. Returns false if that didn't happen before the timeout
+func (n *Nexus) Drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&n.draining, 1)
+	log.L.Infof("Draining nexus...")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	//the routers signal idle when they route the last event
+	for atomic.LoadInt64(&n.pending) > 0 {
+		select {
+		case <-n.idle:
+		case <-deadline.C:
+			log.L.Warnf("Timed out draining nexus, %v events were left", n.queued())
+			return false
+		}
+	}
+
+	//the connections empty their buffers on their own, so they're checked until they're empty
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		queued := n.queued()
+		if queued == 0 {
+			log.L.Infof("Nexus drained")
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.L.Warnf("Timed out draining nexus, %v events were left", queued)
+			return false
+		}
+	}
+}
+
+//Draining returns true once the nexus has stopped accepting events
+func (n *Nexus) Draining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+//routed marks a pending event as routed (or turned away), and signals idle if it was the last one while draining
+func (n *Nexus) routed() {
+	if atomic.AddInt64(&n.pending, -1) == 0 && n.Draining() {
+		select {
+		case n.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//queued returns the number of events that are waiting to be routed, or waiting in a registration's buffer
+func (n *Nexus) queued() int {
+	toReturn := int(atomic.LoadInt64(&n.pending))
+
+	n.buffersLock.Lock()
+	defer n.buffersLock.Unlock()
+
+	for _, r := range n.buffers {
+		toReturn += len(r.Channel) + len(r.PriorityChannel)
+	}
+	return toReturn
+}
+
+//trackBuffers keeps buffers up to date with the registration change. Called before the change is handed to the shards
+func (n *Nexus) trackBuffers(r base.RegistrationChange) {
+	n.buffersLock.Lock()
+	defer n.buffersLock.Unlock()
+
+	switch {
+	case r.Create && r.Channel != nil:
+		n.buffers[counterKey(r.Type, r.ID)] = r.Registration
+	case !r.Create && len(r.Rooms) == 0:
+		delete(n.buffers, counterKey(r.Type, r.ID))
+	}
+}
+
+//Start starts routing events. Calling it more than once does nothing
+func (n *Nexus) Start() {
 	n.once.Do(func() {
-		for {
-			select {
-			case e := <-n.incomingChannel:
-				log.L.Debugf("Sending Event from %v of type %v for room %v", e.SourceID, e.Source, e.Room)
-				if v, ok := n.messengerRegistry[e.Room]; ok {
-					//we ALWAYS send to messengers
-					for i := range v {
-						if e.Source != base.Messenger || v[i].ID != e.SourceID {
-							log.L.Debugf("%v", v[i].ID)
-							if cap(v[i].Channel) > len(v[i].Channel) {
-								v[i].Channel <- e.EventWrapper
-							}
-						}
-					}
-				}
-
-				//check the star case
-				if v, ok := n.messengerRegistry["*"]; ok {
-					//we ALWAYS send to messengers
-					for i := range v {
-						if e.Source != base.Messenger || v[i].ID != e.SourceID {
-							log.L.Debugf("%v", v[i].ID)
-							if cap(v[i].Channel) > len(v[i].Channel) {
-								v[i].Channel <- e.EventWrapper
-							}
-						}
-					}
-				}
-
-				//where else do we send it?
-				switch e.Source {
-				case base.Repeater:
-
-					//local nexus don't propagate through the hubs, as the assumption is outside events come to every repeater in a local system.
-					if n.roomNexus {
-						continue
-					}
-
-					//we send to other hubs and spokes
-					for i := range n.hubRegistry {
-						n.hubRegistry[i].Channel <- e.EventWrapper
-						if cap(n.hubRegistry[i].Channel) > len(n.hubRegistry[i].Channel) {
-							n.hubRegistry[i].Channel <- e.EventWrapper
-						}
-					}
-				case base.Messenger:
-					//we send to hubs, spokes and dispatchers
-					for i := range n.hubRegistry {
-						if cap(n.hubRegistry[i].Channel) > len(n.hubRegistry[i].Channel) {
-							n.hubRegistry[i].Channel <- e.EventWrapper
-						}
-					}
-
-					//we only send to one repeater
-					if len(n.repeaterRegistry) > 0 {
-						curRepeater = (curRepeater + 1) % len(n.repeaterRegistry)
-						log.L.Debugf("sending to repeater: %v", curRepeater)
-						if cap(n.repeaterRegistry[curRepeater].Channel) > len(n.repeaterRegistry[curRepeater].Channel) {
-							n.repeaterRegistry[curRepeater].Channel <- e.EventWrapper
-						}
-					} else {
-						log.L.Infof("No repeaters registered")
-					}
-
-				default:
-					//discard
-					continue
-				}
-
-				//end case incomingchannel
-			case r := <-n.registrationChannel:
-				switch r.Type {
-				case base.Messenger:
-					if r.Create {
-						n.registerMessenger(r)
-					} else {
-						n.deregisterMessenger(r)
-					}
-				case base.Repeater:
-					if r.Create {
-						n.repeaterRegistry = addToRegistration(r, n.repeaterRegistry)
-					} else {
-						n.repeaterRegistry = removeFromRegistration(r, n.repeaterRegistry)
-					}
-				case base.Hub:
-					if r.Create {
-						n.hubRegistry = addToRegistration(r, n.hubRegistry)
-					} else {
-						n.hubRegistry = removeFromRegistration(r, n.hubRegistry)
-					}
-				default:
-					log.L.Errorf("Attempt to register an unknown type: %v", r.Type)
-				}
-				//end case registrationChannel
-			}
+		log.L.Infof("Warping in nexus...")
+		for i := range n.shards {
+			go n.shards[i].start()
 		}
+
+		go n.run()
+		atomic.StoreInt32(&n.started, 1)
+		log.L.Infof("Done. Routing with %v shards", len(n.shards))
 	})
 }
 
-//not threadsafe
-func (n *Nexus) registerMessenger(r base.RegistrationChange) {
-	log.L.Infof("Registering messenger %v for rooms %v", r.ID, r.Rooms)
-	//add
-	for _, cur := range r.Rooms {
-		v, ok := n.messengerRegistry[cur]
-		if !ok {
-			//it doesn't exist
-			n.messengerRegistry[cur] = []base.Registration{r.Registration}
-			n.roomMessengerIndex[r.ID] = append(n.roomMessengerIndex[r.ID], cur)
-			continue
-		}
-		//it does exist, go through and make sure that the registration(s) don't have duplicate(s)
-		for i := range v {
-			if v[i].ID == r.ID {
-				//duplicate, abort
-				log.L.Infof("attempt to create duplicate registration: %v:%v", cur, r.ID)
-				continue
+//Stop drains the nexus (see Drain), stops routing, and closes the event log. Returns false if it couldn't be drained before the timeout
+func (n *Nexus) Stop(timeout time.Duration) bool {
+	drained := n.Drain(timeout)
+	n.stopOnce.Do(func() {
+		close(n.stop)
+
+		if n.eventLog != nil {
+			if err := n.eventLog.Close(); err != nil {
+				log.L.Warnf("Couldn't close the event log: %v", err.Error())
 			}
 		}
-		//it doesn't exist just create
-		n.messengerRegistry[cur] = append(v, r.Registration)
-		n.roomMessengerIndex[r.ID] = append(n.roomMessengerIndex[r.ID], cur)
-		continue
+	})
+	return drained
+}
+
+func (n *Nexus) run() {
+	for {
+		select {
+		case r := <-n.registrationChannel:
+			n.dispatchRegistration(r.RegistrationChange, r.result)
+			r.result.done()
+		case r := <-n.disconnectChannel:
+			n.disconnect(r)
+		case <-n.stop:
+			return
+		}
 	}
-	log.L.Infof("Successfully registered messenger %v for rooms %v", r.ID, r.Rooms)
 }
 
-//not threadsafe
-func (n *Nexus) deregisterMessenger(r base.RegistrationChange) {
-	if len(r.Rooms) == 0 {
-		//unregister all for this messenger
-		r.Rooms = n.roomMessengerIndex[r.ID]
+//shardFor returns the shard that routes the events for the room
+func (n *Nexus) shardFor(room string) *shard {
+	if len(n.shards) == 1 {
+		return n.shards[0]
 	}
 
-	for _, cur := range r.Rooms {
-		log.L.Infof("Unregistering messenger %v for rooms %v", r.ID, r.Rooms)
-		v, ok := n.messengerRegistry[cur]
-		if !ok {
-			//it doesn't exist
-			log.L.Infof("Trying to remove unknown registration: %v:%v", cur, r.ID)
-			continue
+	h := fnv.New32a()
+	h.Write([]byte(room))
+	return n.shards[h.Sum32()%uint32(len(n.shards))]
+}
+
+//dispatchRegistration hands the registration change to the shards it affects. Messenger rooms only go to the shard that owns the room, everything else goes to every shard.
+//Anything the nexus or the shards do with the change is recorded in the result. Not threadsafe
+func (n *Nexus) dispatchRegistration(r base.RegistrationChange, result *changeResult) {
+	if r.Control == base.ControlQuery {
+		n.broadcast(shardChange{RegistrationChange: r, result: result})
+		return
+	}
+
+	if n.disconnected[counterKey(r.Type, r.ID)] {
+		//we closed this connection's channel, so the only change we accept is it going away
+		if r.Create || len(r.Rooms) > 0 {
+			log.L.Debugf("Ignoring registration change from disconnected %v %v", r.Type, r.ID)
+			result.rejectAll(r.Rooms, "the connection has been disconnected")
+			return
 		}
-		//it does exist, find it to be removed
-		for i := range v {
-			if v[i].ID == r.ID {
-				log.L.Infof("Removing messenger registration %v:%v", cur, r.ID)
-				//remove it
-				v[i] = v[len(v)-1]
-				n.messengerRegistry[cur] = v[:len(v)-1]
-
-				//remove from the index
-				index := n.roomMessengerIndex[r.ID]
-				if len(index) <= 1 {
-					n.roomMessengerIndex[r.ID] = []string{}
-				}
-
-				for j := range index {
-					if index[j] == cur {
-						index[j] = index[len(index)-1]
-						n.roomMessengerIndex[r.ID] = index[:len(index)-1]
-						break
-					}
-				}
-				break
-			}
+		delete(n.disconnected, counterKey(r.Type, r.ID))
+	}
+
+	n.trackBuffers(r)
+
+	if r.Create {
+		n.registrations.inc(r.Type)
+	} else {
+		n.deregistrations.inc(r.Type)
+
+		if len(r.Rooms) == 0 {
+			n.stopReplays(r.Type, r.ID)
+		}
+
+		if r.Type == base.Messenger {
+			n.interest.unsubscribe(r.ID, r.Rooms)
 		}
-		//it doesn't exist
-		log.L.Infof("Removed registration %v:%v", cur, r.ID)
 	}
-}
 
-//don't call outside of the start function. Not threadsafe
-func addToRegistration(r base.RegistrationChange, registry []base.Registration) []base.Registration {
-	log.L.Infof("Registering %v %v", r.Type, r.ID)
-	for i := range registry {
-		if registry[i].ID == r.ID {
-			log.L.Infof("Attempting to register duplicate %v: %v", r.Type, r.ID)
-			return registry
+	if r.Type != base.Messenger || len(r.Rooms) == 0 {
+		n.broadcast(shardChange{RegistrationChange: r, result: result})
+		return
+	}
+
+	//the filter is compiled once, and shared by every shard
+	if r.Create && len(r.Filter) > 0 {
+		f, err := filter.Compile(r.Filter)
+		if err != nil {
+			log.L.Warnf("Not registering messenger %v for rooms %v: %v", r.ID, r.Rooms, err.Error())
+			result.rejectAll(r.Rooms, err.Error())
+			return
 		}
+		r.ContentFilter = f
 	}
-	//not there, add it
-	return append(registry, r.Registration)
-}
 
-//don't call outside of the start function. Not threadsafe
-func removeFromRegistration(r base.RegistrationChange, registry []base.Registration) []base.Registration {
+	if r.Create {
+		n.interest.subscribe(r.ID, r.Rooms)
+	}
 
-	//we're deleting
-	log.L.Infof("unregistering %v %v", r.Type, r.ID)
-	for i := range registry {
-		if registry[i].ID == r.ID {
-			log.L.Infof("Removing %v registration %v ", r.Type, r.ID)
+	shared := []string{}
+	rooms := make(map[*shard][]string)
+	for _, room := range r.Rooms {
+		if room == "*" || IsRoomPattern(room) {
+			shared = append(shared, room)
+			continue
+		}
 
-			//remove it
-			registry[i] = registry[len(registry)-1]
-			registry = registry[:len(registry)-1]
+		s := n.shardFor(room)
+		rooms[s] = append(rooms[s], room)
+	}
 
-			return registry
+	for _, s := range n.shards {
+		if len(shared) == 0 && len(rooms[s]) == 0 {
+			continue
 		}
+
+		c := r
+		c.Rooms = append(append([]string{}, shared...), rooms[s]...)
+		s.submit(shardChange{RegistrationChange: c, result: result})
+	}
+
+	if r.Create && r.Replay != nil {
+		n.startReplay(r)
+	}
+}
+
+//broadcast sends the change to every shard
+func (n *Nexus) broadcast(c shardChange) {
+	for _, s := range n.shards {
+		s.submit(c)
+	}
+}
+
+//disconnect removes a slow consumer from every shard, and then closes its channel, which closes the connection. Not threadsafe
+func (n *Nexus) disconnect(r base.RegistrationChange) {
+	k := counterKey(r.Type, r.ID)
+	if n.disconnected[k] {
+		return
+	}
+
+	//any registration change still on its way from this connection is ignored, so the closed channel is never registered again
+	n.disconnected[k] = true
+	replays := n.stopReplays(r.Type, r.ID)
+
+	if r.Type == base.Messenger {
+		n.interest.unsubscribe(r.ID, nil)
 	}
-	log.L.Infof("Attempting to delete non-existent %v: %v", r.Type, r.ID)
-	return registry
 
+	var wg sync.WaitGroup
+	wg.Add(len(n.shards))
+	n.broadcast(shardChange{
+		RegistrationChange: base.RegistrationChange{
+			Type: r.Type,
+			Registration: base.Registration{
+				ID: r.ID,
+			},
+		},
+		disconnect: true,
+		done:       &wg,
+	})
+
+	//no shard will send to the channel once they've all removed it
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		replays.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		close(r.Channel)
+	case <-n.stop:
+	}
 }
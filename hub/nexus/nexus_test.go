@@ -0,0 +1,296 @@
+package nexus
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/v2/events"
+)
+
+//newTestNexus starts a nexus with the number of shards, that blocks instead of dropping events for messengers so every event is delivered
+func newTestNexus(tb testing.TB, shards int) *Nexus {
+	o := DefaultOptions()
+	o.Shards = shards
+	o.DedupWindow = 0
+	o.LastValueSize = 0
+	o.Overflow[base.Messenger] = OverflowPolicy{Action: Block, Timeout: MaxBlockTimeout}
+
+	n, err := New(o)
+	if err != nil {
+		tb.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+
+	n.Start()
+	tb.Cleanup(func() {
+		n.Stop(time.Second)
+	})
+	return n
+}
+
+//subscribe registers a messenger for the rooms, and waits for the registration to reach the shards. Every event it gets is passed to fn
+func subscribe(tb testing.TB, n *Nexus, id string, rooms []string, fn func(base.EventWrapper)) {
+	c := make(chan base.EventWrapper, 1000)
+
+	_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type: base.Messenger,
+		SubscriptionChange: base.SubscriptionChange{
+			Create: true,
+			Rooms:  rooms,
+		},
+		Registration: base.Registration{
+			ID:      id,
+			Channel: c,
+		},
+	}, 5*time.Second)
+	if err != nil {
+		tb.Fatalf("couldn't register %v: %v", id, err.Error())
+	}
+
+	go func() {
+		for e := range c {
+			fn(e)
+		}
+	}()
+}
+
+func testRooms(count int) []string {
+	toReturn := make([]string, count)
+	for i := range toReturn {
+		toReturn[i] = fmt.Sprintf("BLDG-%04d", i)
+	}
+	return toReturn
+}
+
+func TestRoute(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		t.Run(fmt.Sprintf("shards=%v", shards), func(t *testing.T) {
+			n := newTestNexus(t, shards)
+			rooms := testRooms(20)
+
+			var lock sync.Mutex
+			got := make(map[string]map[string]int)
+			record := func(id string) func(base.EventWrapper) {
+				got[id] = make(map[string]int)
+				return func(e base.EventWrapper) {
+					lock.Lock()
+					got[id][e.Room]++
+					lock.Unlock()
+				}
+			}
+
+			subscribe(t, n, "one-room", rooms[:1], record("one-room"))
+			subscribe(t, n, "pattern", []string{"BLDG-001*"}, record("pattern"))
+			subscribe(t, n, "everything", []string{"*"}, record("everything"))
+
+			e := base.WrapEvent(events.Event{Key: "power", Value: "on"})
+			for _, room := range rooms {
+				e.Room = room
+				if err := n.Submit(e, base.Messenger, "producer"); err != nil {
+					t.Fatalf("couldn't submit: %v", err.Error())
+				}
+			}
+
+			want := map[string]int{"one-room": 1, "pattern": 10, "everything": 20}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				lock.Lock()
+				done := true
+				for id, count := range want {
+					if len(got[id]) != count {
+						done = false
+					}
+				}
+				lock.Unlock()
+
+				if done {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for the events, got %v", got)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+//TestGetStatusWhileRouting reads the status while the shards change their registries, run it with -race
+func TestGetStatusWhileRouting(t *testing.T) {
+	n := newTestNexus(t, 4)
+	rooms := testRooms(50)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			id := fmt.Sprintf("messenger-%v", i%10)
+			n.RegisterConnection([]string{rooms[i%len(rooms)], "BLDG-1*"}, make(chan base.EventWrapper, 10), id, base.Messenger)
+			n.RegisterRepeaterConnection(make(chan base.EventWrapper, 10), fmt.Sprintf("repeater-%v", i%3), "addr")
+			if i%3 == 0 {
+				n.DeregisterConnection(nil, base.Messenger, id)
+			}
+		}
+	}()
+
+	for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+		n.GetStatus()
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+//BenchmarkRoute routes events for 100 rooms, each with its own subscriber and one subscriber for every room, through a nexus with one shard, four shards, and a shard for each CPU.
+//shards=1 stands for the nexus before it was sharded: every event goes through one routing goroutine, like the single router loop, so the other cases show what sharding gains over it
+func BenchmarkRoute(b *testing.B) {
+	counts := []int{1, 4}
+	if runtime.NumCPU() != 1 && runtime.NumCPU() != 4 {
+		counts = append(counts, runtime.NumCPU())
+	}
+
+	for _, shards := range counts {
+		b.Run(fmt.Sprintf("shards=%v", shards), func(b *testing.B) {
+			benchmarkRoute(b, shards, 100)
+		})
+	}
+}
+
+func benchmarkRoute(b *testing.B, shards, numRooms int) {
+	n := newTestNexus(b, shards)
+	rooms := testRooms(numRooms)
+
+	var delivered int64
+	var wg sync.WaitGroup
+	count := func(base.EventWrapper) {
+		atomic.AddInt64(&delivered, 1)
+		wg.Done()
+	}
+
+	for i := range rooms {
+		subscribe(b, n, fmt.Sprintf("sub-%v", i), rooms[i:i+1], count)
+	}
+	subscribe(b, n, "sub-all", []string{"*"}, count)
+
+	e := base.WrapEvent(events.Event{Key: "power", Value: "on"})
+	var next uint64
+
+	wg.Add(2 * b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		cur := e
+		for pb.Next() {
+			cur.Room = rooms[atomic.AddUint64(&next, 1)%uint64(numRooms)]
+			n.Submit(cur, base.Messenger, "producer")
+		}
+	})
+	wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&delivered))/time.Since(start).Seconds(), "deliveries/s")
+}
+
+//TestDrain checks Drain waits for the events to be routed and read out of the buffers, and turns away new events
+func TestDrain(t *testing.T) {
+	o := DefaultOptions()
+	o.Shards = 2
+	o.DedupWindow = 0
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+
+	//nothing reads the buffer at first
+	c := make(chan base.EventWrapper, 100)
+	n.Start()
+	_, err = n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:               base.Messenger,
+		SubscriptionChange: base.SubscriptionChange{Create: true, Rooms: []string{"*"}},
+		Registration:       base.Registration{ID: "slow", Channel: c},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't register: %v", err.Error())
+	}
+
+	rooms := testRooms(50)
+	for i := range rooms {
+		if err := n.Submit(base.EventWrapper{Room: rooms[i], Event: []byte(`{}`)}, base.Messenger, "producer"); err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+	}
+
+	//it isn't drained while the events are in the buffer
+	if n.Drain(50 * time.Millisecond) {
+		t.Fatalf("drained with %v events in the buffer", len(c))
+	}
+	if err := n.Submit(base.EventWrapper{Room: rooms[0], Event: []byte(`{}`)}, base.Messenger, "producer"); err == nil || err.Type != "draining" {
+		t.Fatalf("got %v submitting while draining, want it turned away", err)
+	}
+
+	//and it is once they're read
+	go func() {
+		for range c {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if !n.Drain(5 * time.Second) {
+		t.Fatalf("didn't drain once the buffer was read")
+	}
+	if queued := n.queued(); queued != 0 {
+		t.Fatalf("drained with %v events queued", queued)
+	}
+
+	//the registration is forgotten once it goes away
+	n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:         base.Messenger,
+		Registration: base.Registration{ID: "slow"},
+	}, 5*time.Second)
+	n.buffersLock.Lock()
+	left := len(n.buffers)
+	n.buffersLock.Unlock()
+	if left != 0 {
+		t.Fatalf("%v buffers are still tracked", left)
+	}
+
+	if !n.Stop(time.Second) {
+		t.Fatalf("couldn't stop")
+	}
+}
+
+//TestDrainPending checks Drain waits for events that haven't been routed yet
+func TestDrainPending(t *testing.T) {
+	n, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	defer n.Stop(time.Second)
+
+	for i := 0; i < 10; i++ {
+		n.Submit(base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`)}, base.Messenger, "producer")
+	}
+
+	//nothing routes them until the nexus starts
+	if n.Drain(20 * time.Millisecond) {
+		t.Fatalf("drained before the events were routed")
+	}
+
+	n.Start()
+	if !n.Drain(5 * time.Second) {
+		t.Fatalf("didn't drain once the events were routed, %v are pending", atomic.LoadInt64(&n.pending))
+	}
+}
@@ -0,0 +1,286 @@
+package nexus
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/eventlog"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Defaults for the buffer sizes
+const (
+	DefaultRegistrationBufferSize = 100
+	DefaultIncomingBufferSize     = 5000
+)
+
+//Options configure a nexus
+type Options struct {
+	//ID identifies the hub to other hubs. Defaults to the hostname
+	ID string
+
+	//RoomSystem is set if the hub is running in a room, and picks the default routing rules (see DefaultRules)
+	RoomSystem bool
+
+	//Rules are the routing rules. Defaults to DefaultRules
+	Rules []Rule
+
+	//Shards is the number of routers. Defaults to the number of CPUs
+	Shards int
+
+	//RegistrationBufferSize is the size of the registration buffer, and of each shard's registration buffer
+	RegistrationBufferSize int
+
+	//IncomingBufferSize is the size of each shard's event buffer
+	IncomingBufferSize int
+
+	//MaxHops is the number of hubs an event may be routed through before it's dropped. 0 means unlimited
+	MaxHops int
+
+	//DedupWindow is how long an event is remembered by the de-duplication cache, and DedupSize is the most events it holds. A window of 0 turns de-duplication off.
+	//The cache is split between the shards, so DedupSize has to be at least Shards
+	DedupWindow time.Duration
+	DedupSize   int
+
+	//LastValueSize is the most events the last-value cache holds, which is used to send new subscriptions a snapshot of their rooms. 0 turns it off.
+	//Like the de-duplication cache it's split between the shards, so it has to be at least Shards
+	LastValueSize int
+
+	//EventLog configures the event log every routed event is appended to. The log is off unless EventLog.Dir is set
+	EventLog eventlog.Options
+
+	//Priority picks the events that go through the nexus and out to the connections ahead of the rest, on top of the events that arrive with the Priority header set
+	Priority PriorityRules
+
+	//Overflow is the overflow policy for each connection type. Types without one use DefaultOverflowPolicy
+	Overflow map[string]OverflowPolicy
+
+	//RepeaterStrategy picks the repeater each event from a messenger is sent to. RepeaterWeights are used by the weighted strategy, and are keyed on the repeater's address
+	RepeaterStrategy string
+	RepeaterWeights  map[string]float64
+
+	//AdvertiseAll makes the hub ask the hubs it's connected to for every event, instead of just the rooms its messengers are subscribed to (see interest.go)
+	AdvertiseAll bool
+}
+
+//DefaultOptions returns the options the hub runs with when nothing is configured
+func DefaultOptions() Options {
+	id, _ := os.Hostname()
+
+	return Options{
+		ID:                     id,
+		Shards:                 runtime.NumCPU(),
+		RegistrationBufferSize: DefaultRegistrationBufferSize,
+		IncomingBufferSize:     DefaultIncomingBufferSize,
+		MaxHops:                DefaultMaxHops,
+		DedupWindow:            DefaultDedupWindow,
+		DedupSize:              DefaultDedupSize,
+		LastValueSize:          DefaultLastValueSize,
+		EventLog:               eventlog.DefaultOptions(),
+		Overflow:               make(map[string]OverflowPolicy),
+		RepeaterStrategy:       DefaultRepeaterStrategy,
+		RepeaterWeights:        make(map[string]float64),
+	}
+}
+
+//OptionsFromEnv returns the default options, overridden by the environment variables listed in the hub's readme
+func OptionsFromEnv() (Options, *nerr.E) {
+	o := DefaultOptions()
+
+	if v := os.Getenv("SYSTEM_ID"); len(v) > 0 {
+		o.ID = v
+	}
+
+	o.RoomSystem = len(os.Getenv("ROOM_SYSTEM")) > 0
+	o.AdvertiseAll = len(os.Getenv("HUB_ADVERTISE_ALL")) > 0
+
+	if v, err := strconv.Atoi(os.Getenv("HUB_SHARDS")); err == nil && v > 0 {
+		o.Shards = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("HUB_MAX_HOPS")); err == nil {
+		o.MaxHops = v
+	}
+
+	if v, err := time.ParseDuration(os.Getenv("HUB_DEDUP_WINDOW")); err == nil {
+		o.DedupWindow = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("HUB_DEDUP_SIZE")); err == nil {
+		o.DedupSize = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("HUB_LAST_VALUE_SIZE")); err == nil {
+		o.LastValueSize = v
+	}
+
+	o.EventLog.Dir = os.Getenv("HUB_LOG_DIR")
+	if v, err := strconv.ParseInt(os.Getenv("HUB_LOG_SEGMENT_SIZE"), 10, 64); err == nil {
+		o.EventLog.SegmentSize = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("HUB_LOG_SEGMENT_AGE")); err == nil {
+		o.EventLog.SegmentAge = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("HUB_LOG_RETENTION")); err == nil {
+		o.EventLog.Retention = v
+	}
+	if v, err := strconv.ParseInt(os.Getenv("HUB_LOG_MAX_SIZE"), 10, 64); err == nil {
+		o.EventLog.MaxSize = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("HUB_LOG_QUEUE_SIZE")); err == nil && v > 0 {
+		o.EventLog.QueueSize = v
+	}
+
+	o.Priority = priorityRulesFromEnv()
+
+	for _, t := range []string{base.Messenger, base.Repeater, base.Hub} {
+		v := os.Getenv("HUB_OVERFLOW_" + strings.ToUpper(t))
+		if len(v) == 0 {
+			continue
+		}
+
+		p, err := ParseOverflowPolicy(v)
+		if err != nil {
+			return o, err.Addf("invalid overflow policy for %v", t)
+		}
+		o.Overflow[t] = p
+	}
+
+	if v := os.Getenv("HUB_REPEATER_STRATEGY"); len(v) > 0 {
+		s, err := ParseRepeaterStrategy(v)
+		if err != nil {
+			return o, err
+		}
+		o.RepeaterStrategy = s
+	}
+
+	if path := os.Getenv("HUB_ROUTING_RULES"); len(path) > 0 {
+		rules, err := LoadRules(path)
+		if err != nil {
+			return o, err
+		}
+		o.Rules = rules
+	}
+
+	w, err := ParseRepeaterWeights(os.Getenv("HUB_REPEATER_WEIGHTS"))
+	if err != nil {
+		return o, err
+	}
+	o.RepeaterWeights = w
+
+	return o, nil
+}
+
+//New builds a nexus from the options, and opens its event log. Zero sizes, shard counts, and strategies are replaced with their defaults. The nexus doesn't route anything until it's started
+func New(o Options) (*Nexus, *nerr.E) {
+	d := DefaultOptions()
+	if len(o.ID) == 0 {
+		o.ID = d.ID
+	}
+	if o.Shards <= 0 {
+		o.Shards = d.Shards
+	}
+	if o.DedupSize <= 0 {
+		o.DedupSize = d.DedupSize
+	}
+	if o.RegistrationBufferSize <= 0 {
+		o.RegistrationBufferSize = d.RegistrationBufferSize
+	}
+	if o.IncomingBufferSize <= 0 {
+		o.IncomingBufferSize = d.IncomingBufferSize
+	}
+	if len(o.RepeaterStrategy) == 0 {
+		o.RepeaterStrategy = d.RepeaterStrategy
+	}
+	if o.Overflow == nil {
+		o.Overflow = d.Overflow
+	}
+	if o.RepeaterWeights == nil {
+		o.RepeaterWeights = d.RepeaterWeights
+	}
+
+	if _, err := ParseRepeaterStrategy(o.RepeaterStrategy); err != nil {
+		return nil, err
+	}
+
+	if o.DedupWindow > 0 && o.DedupSize < o.Shards {
+		return nil, nerr.Create(fmt.Sprintf("the de-duplication cache size %v is smaller than the number of shards %v", o.DedupSize, o.Shards), "invalid")
+	}
+
+	if o.LastValueSize > 0 && o.LastValueSize < o.Shards {
+		return nil, nerr.Create(fmt.Sprintf("the last-value cache size %v is smaller than the number of shards %v", o.LastValueSize, o.Shards), "invalid")
+	}
+
+	if err := o.Priority.validate(); err != nil {
+		return nil, err
+	}
+
+	for t, p := range o.Overflow {
+		if _, err := ParseOverflowPolicy(p.String()); err != nil {
+			return nil, err.Addf("invalid overflow policy for %v", t)
+		}
+	}
+
+	if o.Rules == nil {
+		o.Rules = DefaultRules(o.RoomSystem)
+	}
+
+	rules, err := compileRules(o.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Nexus{
+		id:       o.ID,
+		maxHops:  o.MaxHops,
+		overflow: o.Overflow,
+
+		received:        newTypeCounters(),
+		registrations:   newTypeCounters(),
+		deregistrations: newTypeCounters(),
+
+		repeaterStrategy: o.RepeaterStrategy,
+		repeaterWeights:  o.RepeaterWeights,
+
+		registrationChannel: make(chan registrationRequest, o.RegistrationBufferSize),
+		disconnectChannel:   make(chan base.RegistrationChange, o.RegistrationBufferSize),
+		disconnected:        make(map[string]bool),
+		stop:                make(chan struct{}),
+		idle:                make(chan struct{}, 1),
+		buffers:             make(map[string]base.Registration),
+
+		rules:    rules,
+		priority: o.Priority,
+
+		replays: make(map[string]*replayTracker),
+
+		interest: newInterestTracker(o.AdvertiseAll || wantsEverything(rules)),
+	}
+
+	if len(o.EventLog.Dir) > 0 {
+		n.eventLog, err = eventlog.Open(o.EventLog)
+		if err != nil {
+			return nil, err.Addf("couldn't open the event log")
+		}
+	}
+
+	//the caches are split between the shards, since the events for a room (and any duplicates of them) always go to the same shard.
+	//a dedup cache size of 0 means unbounded, so each shard gets at least 1
+	dedupSize := o.DedupSize / o.Shards
+	if dedupSize < 1 {
+		dedupSize = 1
+	}
+
+	for i := 0; i < o.Shards; i++ {
+		n.shards = append(n.shards, newShard(n, i, o.RegistrationBufferSize, o.IncomingBufferSize,
+			newDedupCache(o.DedupWindow, dedupSize),
+			newLastValueCache(o.LastValueSize/o.Shards)))
+	}
+
+	return n, nil
+}
@@ -0,0 +1,219 @@
+package nexus
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Outcomes of sending an event to a registration
+const (
+	delivered      = "delivered"
+	droppedNewest  = "dropped-newest"
+	droppedTimeout = "dropped-timeout"
+	disconnected   = "disconnected"
+)
+
+//Overflow actions, what the nexus does when a connection's buffer is full
+const (
+	//DropNewest drops the event that doesn't fit
+	DropNewest = "drop-newest"
+
+	//DropOldest drops the oldest event in the buffer to make room
+	DropOldest = "drop-oldest"
+
+	//Block waits up to the policy's timeout for room in the buffer, then drops the event. The shard's router does the waiting,
+	//so every other room on the shard waits along with it; the timeout can't be more than MaxBlockTimeout
+	Block = "block"
+
+	//Disconnect drops the event and disconnects the slow consumer
+	Disconnect = "disconnect"
+)
+
+//OverflowPolicy decides what happens to an event when a connection's buffer is full
+type OverflowPolicy struct {
+	Action  string        `json:"action"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+//DefaultOverflowPolicy is the policy used for a connection type that doesn't have one configured
+var DefaultOverflowPolicy = OverflowPolicy{Action: DropNewest}
+
+//MaxBlockTimeout is the longest a block policy may hold up a shard for each event
+const MaxBlockTimeout = time.Second
+
+//ParseOverflowPolicy parses a policy in the form of action[:timeout], e.g. drop-oldest or block:250ms
+func ParseOverflowPolicy(s string) (OverflowPolicy, *nerr.E) {
+	split := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	p := OverflowPolicy{Action: split[0]}
+
+	switch p.Action {
+	case DropNewest, DropOldest, Disconnect:
+		if len(split) > 1 {
+			return p, nerr.Create(fmt.Sprintf("overflow action %v doesn't take a timeout", p.Action), "invalid")
+		}
+	case Block:
+		if len(split) < 2 {
+			return p, nerr.Create("block overflow policy requires a timeout, e.g. block:250ms", "invalid")
+		}
+
+		t, err := time.ParseDuration(split[1])
+		if err != nil || t <= 0 {
+			return p, nerr.Create(fmt.Sprintf("invalid block timeout %v", split[1]), "invalid")
+		}
+		if t > MaxBlockTimeout {
+			return p, nerr.Create(fmt.Sprintf("block timeout %v is longer than %v", t, MaxBlockTimeout), "invalid")
+		}
+		p.Timeout = t
+	default:
+		return p, nerr.Create(fmt.Sprintf("unknown overflow action %v", p.Action), "invalid")
+	}
+
+	return p, nil
+}
+
+func (p OverflowPolicy) String() string {
+	if p.Action == Block {
+		return fmt.Sprintf("%v:%v", p.Action, p.Timeout)
+	}
+	return p.Action
+}
+
+//deliveryCounters track what happened to the events a shard sent to a single registration. They're updated by the shard's router and read by GetStatus, so they're accessed atomically
+type deliveryCounters struct {
+	delivered     uint64
+	droppedNewest uint64
+	droppedOldest uint64
+	timedOut      uint64
+	disconnects   uint64
+}
+
+//DeliveryStatus represents what has happened to the events sent to a registration
+type DeliveryStatus struct {
+	Delivered     uint64 `json:"delivered"`
+	DroppedNewest uint64 `json:"dropped-newest"`
+	DroppedOldest uint64 `json:"dropped-oldest"`
+	TimedOut      uint64 `json:"dropped-timeout"`
+	Disconnects   uint64 `json:"disconnects"`
+}
+
+//addTo adds the counters to the status, so that the counters of each shard can be summed up
+func (d *deliveryCounters) addTo(status *DeliveryStatus) {
+	if d == nil {
+		return
+	}
+
+	status.Delivered += atomic.LoadUint64(&d.delivered)
+	status.DroppedNewest += atomic.LoadUint64(&d.droppedNewest)
+	status.DroppedOldest += atomic.LoadUint64(&d.droppedOldest)
+	status.TimedOut += atomic.LoadUint64(&d.timedOut)
+	status.Disconnects += atomic.LoadUint64(&d.disconnects)
+}
+
+func counterKey(connType, id string) string {
+	return connType + ":" + id
+}
+
+//counters returns the delivery counters for a registration, creating them if needed. Only the shard's router writes to the map, so it only needs the lock to do so. Not threadsafe
+func (s *shard) counters(connType, id string) *deliveryCounters {
+	k := counterKey(connType, id)
+	c, ok := s.delivery[k]
+	if !ok {
+		c = &deliveryCounters{}
+		s.deliveryLock.Lock()
+		s.delivery[k] = c
+		s.deliveryLock.Unlock()
+	}
+	return c
+}
+
+//removeCounters drops the delivery counters of a registration that has gone away. Not threadsafe
+func (s *shard) removeCounters(connType, id string) {
+	s.deliveryLock.Lock()
+	delete(s.delivery, counterKey(connType, id))
+	s.deliveryLock.Unlock()
+}
+
+//send delivers the event to the registration, applying the overflow policy of its connection type if the buffer is full. Returns what happened to the event. Not threadsafe
+func (s *shard) send(connType string, r base.Registration, e base.EventWrapper) string {
+	c := s.counters(connType, r.ID)
+	ch := r.ChannelFor(e)
+
+	//fast path
+	select {
+	case ch <- e:
+		atomic.AddUint64(&c.delivered, 1)
+		return delivered
+	default:
+	}
+
+	policy, ok := s.nexus.overflow[connType]
+	if !ok {
+		policy = DefaultOverflowPolicy
+	}
+
+	switch policy.Action {
+	case DropOldest:
+		//the write pump may empty the buffer underneath us, so neither of these block
+		select {
+		case <-ch:
+			atomic.AddUint64(&c.droppedOldest, 1)
+		default:
+		}
+
+		select {
+		case ch <- e:
+			atomic.AddUint64(&c.delivered, 1)
+			return delivered
+		default:
+			atomic.AddUint64(&c.droppedNewest, 1)
+			return droppedNewest
+		}
+
+	case Block:
+		t := time.NewTimer(policy.Timeout)
+		defer t.Stop()
+
+		select {
+		case ch <- e:
+			atomic.AddUint64(&c.delivered, 1)
+			return delivered
+		case <-t.C:
+			log.L.Debugf("Timed out sending event to %v %v", connType, r.ID)
+			atomic.AddUint64(&c.timedOut, 1)
+			return droppedTimeout
+		}
+
+	case Disconnect:
+		atomic.AddUint64(&c.droppedNewest, 1)
+
+		//other shards may still be sending to the channel, so the nexus takes care of removing the registration everywhere before closing it
+		k := counterKey(connType, r.ID)
+		if !s.disconnecting[k] {
+			log.L.Warnf("Buffer for %v %v is full, disconnecting it", connType, r.ID)
+			atomic.AddUint64(&c.disconnects, 1)
+			s.disconnecting[k] = true
+
+			change := base.RegistrationChange{
+				Type:         connType,
+				Registration: r,
+			}
+			go func() {
+				select {
+				case s.nexus.disconnectChannel <- change:
+				case <-s.nexus.stop:
+				}
+			}()
+		}
+		return disconnected
+
+	default:
+		atomic.AddUint64(&c.droppedNewest, 1)
+		return droppedNewest
+	}
+}
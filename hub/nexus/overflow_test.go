@@ -0,0 +1,208 @@
+package nexus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want OverflowPolicy
+		err  bool
+	}{
+		{"drop-newest", OverflowPolicy{Action: DropNewest}, false},
+		{" drop-oldest ", OverflowPolicy{Action: DropOldest}, false},
+		{"disconnect", OverflowPolicy{Action: Disconnect}, false},
+		{"block:250ms", OverflowPolicy{Action: Block, Timeout: 250 * time.Millisecond}, false},
+		{"block:1s", OverflowPolicy{Action: Block, Timeout: time.Second}, false},
+		{"block", OverflowPolicy{}, true},
+		{"block:0s", OverflowPolicy{}, true},
+		{"block:soon", OverflowPolicy{}, true},
+		{"block:2s", OverflowPolicy{}, true},
+		{"block:24h", OverflowPolicy{}, true},
+		{"drop-newest:1s", OverflowPolicy{}, true},
+		{"drop-everything", OverflowPolicy{}, true},
+		{"", OverflowPolicy{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOverflowPolicy(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want an error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOverflowPolicyInOptions(t *testing.T) {
+	o := DefaultOptions()
+	o.Overflow[base.Messenger] = OverflowPolicy{Action: Block, Timeout: time.Minute}
+	if _, err := New(o); err == nil {
+		t.Fatalf("a block timeout of a minute was accepted")
+	}
+
+	o.Overflow[base.Messenger] = OverflowPolicy{Action: "drop-everything"}
+	if _, err := New(o); err == nil {
+		t.Fatalf("an unknown overflow action was accepted")
+	}
+}
+
+//overflowShard returns the shard of a nexus that isn't routing, with the overflow policy for messengers, so its send can be called directly
+func overflowShard(t *testing.T, policy OverflowPolicy) (*Nexus, *shard) {
+	o := DefaultOptions()
+	o.Shards = 1
+	o.Overflow[base.Messenger] = policy
+
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	return n, n.shards[0]
+}
+
+//fullRegistration returns a messenger registration with a buffer of one, that already holds an event
+func fullRegistration(s *shard) (base.Registration, chan base.EventWrapper) {
+	c := make(chan base.EventWrapper, 1)
+	r := base.Registration{ID: "slow", Channel: c}
+	s.send(base.Messenger, r, base.EventWrapper{Room: "first"})
+	return r, c
+}
+
+func deliveryStatus(s *shard) DeliveryStatus {
+	var toReturn DeliveryStatus
+	s.counters(base.Messenger, "slow").addTo(&toReturn)
+	return toReturn
+}
+
+func TestDropNewest(t *testing.T) {
+	_, s := overflowShard(t, OverflowPolicy{Action: DropNewest})
+	r, c := fullRegistration(s)
+
+	if got := s.send(base.Messenger, r, base.EventWrapper{Room: "second"}); got != droppedNewest {
+		t.Fatalf("got %v, want %v", got, droppedNewest)
+	}
+	if e := <-c; e.Room != "first" {
+		t.Fatalf("the buffer has %v, want the first event", e.Room)
+	}
+	if got, want := deliveryStatus(s), (DeliveryStatus{Delivered: 1, DroppedNewest: 1}); got != want {
+		t.Fatalf("got counters %+v, want %+v", got, want)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	_, s := overflowShard(t, OverflowPolicy{Action: DropOldest})
+	r, c := fullRegistration(s)
+
+	if got := s.send(base.Messenger, r, base.EventWrapper{Room: "second"}); got != delivered {
+		t.Fatalf("got %v, want %v", got, delivered)
+	}
+	if e := <-c; e.Room != "second" {
+		t.Fatalf("the buffer has %v, want the second event", e.Room)
+	}
+	if got, want := deliveryStatus(s), (DeliveryStatus{Delivered: 2, DroppedOldest: 1}); got != want {
+		t.Fatalf("got counters %+v, want %+v", got, want)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	_, s := overflowShard(t, OverflowPolicy{Action: Block, Timeout: timeout})
+	r, c := fullRegistration(s)
+
+	//nothing reads the buffer, so it gives up after the timeout
+	start := time.Now()
+	if got := s.send(base.Messenger, r, base.EventWrapper{Room: "second"}); got != droppedTimeout {
+		t.Fatalf("got %v, want %v", got, droppedTimeout)
+	}
+	if waited := time.Since(start); waited < timeout {
+		t.Fatalf("only waited %v, want at least %v", waited, timeout)
+	}
+
+	//it's delivered once the buffer is read within the timeout
+	go func() {
+		time.Sleep(timeout / 5)
+		<-c
+	}()
+	if got := s.send(base.Messenger, r, base.EventWrapper{Room: "third"}); got != delivered {
+		t.Fatalf("got %v, want %v", got, delivered)
+	}
+	if e := <-c; e.Room != "third" {
+		t.Fatalf("the buffer has %v, want the third event", e.Room)
+	}
+	if got, want := deliveryStatus(s), (DeliveryStatus{Delivered: 2, TimedOut: 1}); got != want {
+		t.Fatalf("got counters %+v, want %+v", got, want)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	n, s := overflowShard(t, OverflowPolicy{Action: Disconnect})
+	r, _ := fullRegistration(s)
+
+	for i := 0; i < 3; i++ {
+		if got := s.send(base.Messenger, r, base.EventWrapper{Room: "more"}); got != disconnected {
+			t.Fatalf("got %v, want %v", got, disconnected)
+		}
+	}
+
+	//the nexus is asked to disconnect it once
+	select {
+	case change := <-n.disconnectChannel:
+		if change.Type != base.Messenger || change.ID != "slow" {
+			t.Fatalf("got a disconnect for %v %v, want the slow messenger", change.Type, change.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the nexus wasn't asked to disconnect the messenger")
+	}
+	select {
+	case change := <-n.disconnectChannel:
+		t.Fatalf("got another disconnect for %v", change.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got, want := deliveryStatus(s), (DeliveryStatus{Delivered: 1, DroppedNewest: 3, Disconnects: 1}); got != want {
+		t.Fatalf("got counters %+v, want %+v", got, want)
+	}
+}
+
+//TestOverflowReport checks the delivery report says which connection an event was dropped for
+func TestOverflowReport(t *testing.T) {
+	o := DefaultOptions()
+	o.Shards = 1
+	o.DedupWindow = 0
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	//nothing reads this one's buffer
+	_, err = n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:               base.Messenger,
+		SubscriptionChange: base.SubscriptionChange{Create: true, Rooms: []string{"ITB-1101"}},
+		Registration:       base.Registration{ID: "slow", Channel: make(chan base.EventWrapper, 1)},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't register: %v", err.Error())
+	}
+
+	want := []DeliveryReport{
+		{Messengers: []string{"slow"}},
+		{Drops: []DeliveryDrop{{Type: base.Messenger, ID: "slow", Reason: droppedNewest}}},
+	}
+	for i := range want {
+		report, err := n.SubmitAndWait(base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`)}, base.Messenger, "producer", 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+		if len(report.Messengers) != len(want[i].Messengers) || len(report.Drops) != len(want[i].Drops) || (len(report.Drops) > 0 && report.Drops[0] != want[i].Drops[0]) {
+			t.Fatalf("event %v: got report %+v, want %+v", i, report, want[i])
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package nexus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//roomSeparator splits a room ID into its building and room
+const roomSeparator = "-"
+
+//IsRoomPattern returns true if the room is a subscription pattern rather than a single room. A pattern ends in '*' and matches every room that starts with the rest of it, e.g. ITB-* or ITB-11*. "*" on its own is every room, and isn't a pattern
+func IsRoomPattern(room string) bool {
+	return room != "*" && strings.Contains(room, "*")
+}
+
+//validatePattern makes sure the only wildcard in a pattern is at the end of it
+func validatePattern(pattern string) *nerr.E {
+	if strings.Index(pattern, "*") != len(pattern)-1 {
+		return nerr.Create(fmt.Sprintf("invalid room pattern %v: '*' is only allowed at the end", pattern), "invalid")
+	}
+	return nil
+}
+
+//subscribedTo returns true if a subscription to the rooms (which may be patterns, or "*") covers the room. It matches the same way the registries do, for the few places that check a room without them
+func subscribedTo(rooms []string, room string) bool {
+	for _, cur := range rooms {
+		if cur == "*" || cur == room || (IsRoomPattern(cur) && matchPattern(cur, room)) {
+			return true
+		}
+	}
+	return false
+}
+
+//patternTrie holds the pattern subscriptions, keyed on the segments of the room ID (BLDG-ROOM), so matching a room is a walk down its segments rather than a check of every pattern
+type patternTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+
+	//all holds the registrations that match every room below this node (e.g. ITB-*)
+	all []base.Registration
+
+	//partial holds the registrations for patterns ending partway through the next segment, keyed on the part of the segment (e.g. 11 for ITB-11*)
+	partial map[string][]base.Registration
+}
+
+func newPatternTrie() *patternTrie {
+	return &patternTrie{
+		root: newTrieNode(),
+	}
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children: make(map[string]*trieNode),
+		partial:  make(map[string][]base.Registration),
+	}
+}
+
+//splitPattern returns the full segments of the pattern, and the part of the last segment before the '*'
+func splitPattern(pattern string) ([]string, string) {
+	segments := strings.Split(strings.TrimSuffix(pattern, "*"), roomSeparator)
+	return segments[:len(segments)-1], segments[len(segments)-1]
+}
+
+//add adds the registration to the pattern, returning false if it was already there. An existing registration is replaced, so that its filter is updated
+func (t *patternTrie) add(pattern string, r base.Registration) bool {
+	full, part := splitPattern(pattern)
+
+	cur := t.root
+	for _, seg := range full {
+		next, ok := cur.children[seg]
+		if !ok {
+			next = newTrieNode()
+			cur.children[seg] = next
+		}
+		cur = next
+	}
+
+	added := false
+	if len(part) == 0 {
+		cur.all, added = upsertRegistration(cur.all, r)
+		return added
+	}
+
+	cur.partial[part], added = upsertRegistration(cur.partial[part], r)
+	return added
+}
+
+//remove removes the registration from the pattern, returning false if it wasn't there. Empty nodes are pruned.
+func (t *patternTrie) remove(pattern, id string) bool {
+	full, part := splitPattern(pattern)
+
+	path := []*trieNode{t.root}
+	cur := t.root
+	for _, seg := range full {
+		next, ok := cur.children[seg]
+		if !ok {
+			return false
+		}
+		path = append(path, next)
+		cur = next
+	}
+
+	removed := false
+	if len(part) == 0 {
+		cur.all, removed = removeRegistration(cur.all, id)
+	} else {
+		cur.partial[part], removed = removeRegistration(cur.partial[part], id)
+		if len(cur.partial[part]) == 0 {
+			delete(cur.partial, part)
+		}
+	}
+
+	//prune
+	for i := len(path) - 1; i > 0; i-- {
+		if !path[i].empty() {
+			break
+		}
+		delete(path[i-1].children, full[i-1])
+	}
+
+	return removed
+}
+
+//get returns the registration with the ID on the pattern
+func (t *patternTrie) get(pattern, id string) (base.Registration, bool) {
+	full, part := splitPattern(pattern)
+
+	cur := t.root
+	for _, seg := range full {
+		next, ok := cur.children[seg]
+		if !ok {
+			return base.Registration{}, false
+		}
+		cur = next
+	}
+
+	if len(part) == 0 {
+		return findRegistration(cur.all, id)
+	}
+	return findRegistration(cur.partial[part], id)
+}
+
+//match calls fn with every registration whose pattern matches the room
+func (t *patternTrie) match(room string, fn func(base.Registration)) {
+	cur := t.root
+	for _, seg := range strings.Split(room, roomSeparator) {
+		for i := range cur.all {
+			fn(cur.all[i])
+		}
+
+		if len(cur.partial) > 0 {
+			for l := 0; l <= len(seg); l++ {
+				v := cur.partial[seg[:l]]
+				for i := range v {
+					fn(v[i])
+				}
+			}
+		}
+
+		next, ok := cur.children[seg]
+		if !ok {
+			return
+		}
+		cur = next
+	}
+}
+
+//walk calls fn with every pattern in the trie and its registrations
+func (t *patternTrie) walk(fn func(pattern string, regs []base.Registration)) {
+	t.root.walk([]string{}, fn)
+}
+
+func (n *trieNode) walk(prefix []string, fn func(string, []base.Registration)) {
+	if len(n.all) > 0 {
+		fn(strings.Join(append(append([]string{}, prefix...), "*"), roomSeparator), n.all)
+	}
+
+	for part, regs := range n.partial {
+		fn(strings.Join(append(append([]string{}, prefix...), part), roomSeparator)+"*", regs)
+	}
+
+	for seg, child := range n.children {
+		child.walk(append(append([]string{}, prefix...), seg), fn)
+	}
+}
+
+func (n *trieNode) empty() bool {
+	return len(n.all) == 0 && len(n.partial) == 0 && len(n.children) == 0
+}
+
+//upsertRegistration replaces the registration with the same ID, or adds it if there isn't one. Returns true if it was added
+func upsertRegistration(v []base.Registration, r base.Registration) ([]base.Registration, bool) {
+	for i := range v {
+		if v[i].ID == r.ID {
+			v[i] = r
+			return v, false
+		}
+	}
+	return append(v, r), true
+}
+
+func removeRegistration(v []base.Registration, id string) ([]base.Registration, bool) {
+	for i := range v {
+		if v[i].ID == id {
+			v[i] = v[len(v)-1]
+			return v[:len(v)-1], true
+		}
+	}
+	return v, false
+}
@@ -0,0 +1,161 @@
+package nexus
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//matched returns the IDs of the registrations in the trie that match the room, sorted
+func matched(t *patternTrie, room string) []string {
+	toReturn := []string{}
+	t.match(room, func(r base.Registration) {
+		toReturn = append(toReturn, r.ID)
+	})
+	sort.Strings(toReturn)
+	return toReturn
+}
+
+func TestPatternTrieMatch(t *testing.T) {
+	trie := newPatternTrie()
+	for id, pattern := range map[string]string{
+		"building":     "ITB-*",
+		"floor":        "ITB-11*",
+		"room":         "ITB-1101-*",
+		"prefix":       "IT*",
+		"other":        "JFSB-*",
+		"empty-prefix": "ITB-1*",
+	} {
+		if !trie.add(pattern, base.Registration{ID: id}) {
+			t.Fatalf("add(%v) returned false", pattern)
+		}
+	}
+
+	tests := []struct {
+		room string
+		want []string
+	}{
+		{"ITB-1101", []string{"building", "empty-prefix", "floor", "prefix"}},
+		{"ITB-1101-CP1", []string{"building", "empty-prefix", "floor", "prefix", "room"}},
+		{"ITB-1201", []string{"building", "empty-prefix", "prefix"}},
+		{"ITB-2201", []string{"building", "prefix"}},
+		{"ITB", []string{"prefix"}},
+		{"ITC-1101", []string{"prefix"}},
+		{"JFSB-B100", []string{"other"}},
+		{"JFSB", []string{}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := matched(trie, tt.room); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("match(%q) = %v, want %v", tt.room, got, tt.want)
+		}
+	}
+}
+
+func TestPatternTrieAddRemove(t *testing.T) {
+	trie := newPatternTrie()
+
+	if !trie.add("ITB-11*", base.Registration{ID: "a"}) {
+		t.Fatalf("first add returned false")
+	}
+	if trie.add("ITB-11*", base.Registration{ID: "a", Addr: "updated"}) {
+		t.Fatalf("second add of the same registration returned true")
+	}
+	if r, ok := trie.get("ITB-11*", "a"); !ok || r.Addr != "updated" {
+		t.Fatalf("get returned %+v, %v; want the updated registration", r, ok)
+	}
+
+	trie.add("ITB-1101-*", base.Registration{ID: "b"})
+
+	if trie.remove("ITB-12*", "a") {
+		t.Fatalf("removed a registration from a pattern it wasn't on")
+	}
+	if trie.remove("JFSB-*", "a") {
+		t.Fatalf("removed a registration from a pattern that isn't in the trie")
+	}
+	if !trie.remove("ITB-11*", "a") {
+		t.Fatalf("remove returned false")
+	}
+	if trie.remove("ITB-11*", "a") {
+		t.Fatalf("second remove returned true")
+	}
+	if _, ok := trie.get("ITB-11*", "a"); ok {
+		t.Fatalf("get found a removed registration")
+	}
+
+	if got := matched(trie, "ITB-1101-CP1"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("match after remove = %v, want [b]", got)
+	}
+
+	trie.remove("ITB-1101-*", "b")
+	if !trie.root.empty() {
+		t.Fatalf("the trie wasn't pruned after everything was removed")
+	}
+}
+
+func TestPatternTrieWalk(t *testing.T) {
+	trie := newPatternTrie()
+	patterns := []string{"ITB-*", "ITB-11*", "ITB-1101-*", "IT*"}
+	for i, p := range patterns {
+		trie.add(p, base.Registration{ID: string(rune('a' + i))})
+	}
+
+	got := []string{}
+	trie.walk(func(pattern string, regs []base.Registration) {
+		got = append(got, pattern)
+	})
+	sort.Strings(got)
+	sort.Strings(patterns)
+
+	if !reflect.DeepEqual(got, patterns) {
+		t.Fatalf("walk = %v, want %v", got, patterns)
+	}
+}
+
+func TestSubscribedTo(t *testing.T) {
+	tests := []struct {
+		rooms []string
+		room  string
+		want  bool
+	}{
+		{[]string{"*"}, "ITB-1101", true},
+		{[]string{"ITB-1101"}, "ITB-1101", true},
+		{[]string{"ITB-1102"}, "ITB-1101", false},
+		{[]string{"ITB-*"}, "ITB-1101", true},
+		{[]string{"ITB-*"}, "ITB", false},
+		{[]string{"ITB-11*"}, "ITB-1101", true},
+		{[]string{"ITB-12*"}, "ITB-1101", false},
+		{[]string{"ITB-1101-*"}, "ITB-1101", false},
+		{[]string{"JFSB-*", "ITB-1101"}, "ITB-1101", true},
+		{nil, "ITB-1101", false},
+	}
+
+	for _, tt := range tests {
+		if got := subscribedTo(tt.rooms, tt.room); got != tt.want {
+			t.Errorf("subscribedTo(%v, %q) = %v, want %v", tt.rooms, tt.room, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"ITB-*", true},
+		{"ITB-11*", true},
+		{"*", true},
+		{"ITB-*-CP1", false},
+		{"*-1101", false},
+		{"ITB-**", false},
+	}
+
+	for _, tt := range tests {
+		if err := validatePattern(tt.pattern); (err == nil) != tt.valid {
+			t.Errorf("validatePattern(%q) valid = %v, want %v", tt.pattern, err == nil, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nexus
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//PriorityRules pick the events that are high priority, on top of the ones that arrive with the Priority header set. An event is high priority if its key matches one of Keys (which may end in '*'), or it has one of Tags
+type PriorityRules struct {
+	Keys []string `json:"keys,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+//priorityRulesFromEnv reads the priority rules from HUB_PRIORITY_KEYS and HUB_PRIORITY_TAGS, which are comma separated lists
+func priorityRulesFromEnv() PriorityRules {
+	split := func(v string) []string {
+		toReturn := []string{}
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				toReturn = append(toReturn, s)
+			}
+		}
+		return toReturn
+	}
+
+	return PriorityRules{
+		Keys: split(os.Getenv("HUB_PRIORITY_KEYS")),
+		Tags: split(os.Getenv("HUB_PRIORITY_TAGS")),
+	}
+}
+
+func (p PriorityRules) validate() *nerr.E {
+	for _, k := range p.Keys {
+		if IsRoomPattern(k) {
+			if err := validatePattern(k); err != nil {
+				return err.Addf("invalid priority key")
+			}
+		}
+	}
+	return nil
+}
+
+func (p PriorityRules) empty() bool {
+	return len(p.Keys) == 0 && len(p.Tags) == 0
+}
+
+//matches returns true if the event's key or tags match the rules
+func (p PriorityRules) matches(e base.EventWrapper) bool {
+	var tmp struct {
+		Key  string   `json:"key"`
+		Tags []string `json:"event-tags"`
+	}
+	if err := json.Unmarshal(e.Event, &tmp); err != nil {
+		return false
+	}
+
+	for _, k := range p.Keys {
+		if matchPattern(k, tmp.Key) {
+			return true
+		}
+	}
+
+	for _, t := range p.Tags {
+		for i := range tmp.Tags {
+			if tmp.Tags[i] == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//prioritize marks the event as high priority if it matches the priority rules, so that it stays high priority on its way through other hubs and connections. Returns true if the event is high priority
+func (n *Nexus) prioritize(e *base.EventWrapper) bool {
+	if !e.Header.HighPriority() {
+		if n.priority.empty() || !n.priority.matches(*e) {
+			return false
+		}
+		e.Header.Set(base.HeaderPriority, base.PriorityHigh)
+	}
+
+	atomic.AddUint64(&n.highPriority, 1)
+	return true
+}
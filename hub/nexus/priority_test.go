@@ -0,0 +1,77 @@
+package nexus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//TestPriorityRouting holds up the router while a flood of normal events and then a high priority event are submitted, and checks the high priority event is routed first
+func TestPriorityRouting(t *testing.T) {
+	const count = 500
+
+	o := DefaultOptions()
+	o.Shards = 1
+	o.DedupWindow = 0
+	o.Priority = PriorityRules{Keys: []string{"fire-*"}}
+	o.Overflow[base.Messenger] = OverflowPolicy{Action: Block, Timeout: 200 * time.Millisecond}
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	//the router waits on the blocker's full buffer for the second event in its room, and the flood queues up behind it
+	panel := make(chan base.EventWrapper, count+1)
+	for _, r := range []struct {
+		id      string
+		room    string
+		channel chan base.EventWrapper
+	}{
+		{"blocker", "BLOCK", make(chan base.EventWrapper, 1)},
+		{"panel", "ITB-1101", panel},
+	} {
+		_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+			Type:               base.Messenger,
+			SubscriptionChange: base.SubscriptionChange{Create: true, Rooms: []string{r.room}},
+			Registration:       base.Registration{ID: r.id, Channel: r.channel},
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't register %v: %v", r.id, err.Error())
+		}
+	}
+
+	submit := func(room, key string) {
+		e := base.EventWrapper{Room: room, Event: []byte(fmt.Sprintf(`{"key":%q}`, key))}
+		if err := n.Submit(e, base.Messenger, "producer"); err != nil {
+			t.Fatalf("couldn't submit: %v", err.Error())
+		}
+	}
+	submit("BLOCK", "first")
+	submit("BLOCK", "second")
+	for i := 0; i < count; i++ {
+		submit("ITB-1101", fmt.Sprintf("heartbeat-%v", i))
+	}
+	submit("ITB-1101", "fire-alarm")
+
+	for i := 0; i <= count; i++ {
+		select {
+		case e := <-panel:
+			switch {
+			case i == 0 && !e.Header.HighPriority():
+				t.Fatalf("the first event was %s, want the high priority one", e.Event)
+			case i > 0 && string(e.Event) != fmt.Sprintf(`{"key":"heartbeat-%v"}`, i-1):
+				t.Fatalf("event %v was %s, want the normal events in order after the high priority one", i, e.Event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v events", i)
+		}
+	}
+
+	if got := n.GetStatus().HighPriorityEvents; got != 1 {
+		t.Fatalf("got %v high priority events, want 1", got)
+	}
+}
@@ -0,0 +1,174 @@
+package nexus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Repeater strategies, how the nexus picks the one repeater an event from a messenger is sent to
+const (
+	//RoundRobin sends each event to the next repeater
+	RoundRobin = "round-robin"
+
+	//Sticky hashes the room to a repeater, so every event for a room goes through the same one
+	Sticky = "sticky"
+
+	//LeastLoaded sends each event to the repeater with the emptiest buffer, preferring the sticky choice when they're tied
+	LeastLoaded = "least-loaded"
+
+	//Weighted hashes the room to a repeater like Sticky, but gives each repeater a share of the rooms proportional to its weight
+	Weighted = "weighted"
+)
+
+//DefaultRepeaterStrategy is the strategy used when one isn't configured
+const DefaultRepeaterStrategy = RoundRobin
+
+//ParseRepeaterStrategy validates the name of a repeater strategy
+func ParseRepeaterStrategy(s string) (string, *nerr.E) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case RoundRobin, Sticky, LeastLoaded, Weighted:
+		return s, nil
+	}
+	return s, nerr.Create(fmt.Sprintf("unknown repeater strategy %v", s), "invalid")
+}
+
+//ParseRepeaterWeights parses weights in the form of addr=weight[,addr=weight...], e.g. 10.5.34.12=3,10.5.34.13=1
+func ParseRepeaterWeights(s string) (map[string]float64, *nerr.E) {
+	toReturn := make(map[string]float64)
+	for _, cur := range strings.Split(s, ",") {
+		cur = strings.TrimSpace(cur)
+		if len(cur) == 0 {
+			continue
+		}
+
+		split := strings.SplitN(cur, "=", 2)
+		if len(split) != 2 {
+			return toReturn, nerr.Create(fmt.Sprintf("invalid repeater weight %v, expected addr=weight", cur), "invalid")
+		}
+
+		w, err := strconv.ParseFloat(split[1], 64)
+		if err != nil || w <= 0 {
+			return toReturn, nerr.Create(fmt.Sprintf("invalid repeater weight %v", split[1]), "invalid")
+		}
+		toReturn[strings.TrimSpace(split[0])] = w
+	}
+	return toReturn, nil
+}
+
+//RepeaterSelectionStatus represents how the nexus is picking repeaters
+type RepeaterSelectionStatus struct {
+	Strategy string             `json:"strategy"`
+	Current  string             `json:"current,omitempty"` //the repeater the last event was sent to
+	Weights  map[string]float64 `json:"weights,omitempty"`
+}
+
+//chooseRepeater returns the index of the repeater the event for the room should go to. The hashing strategies only depend on the room and the repeaters, so adding or removing a repeater only moves the rooms that hashed to it. Not threadsafe
+func (s *shard) chooseRepeater(room string) int {
+	v := s.repeaterRegistry
+	if len(v) == 1 {
+		return 0
+	}
+
+	switch s.nexus.repeaterStrategy {
+	case Sticky:
+		return s.highestScore(room, v, func(base.Registration) float64 { return 1 })
+	case Weighted:
+		return s.highestScore(room, v, s.nexus.repeaterWeight)
+	case LeastLoaded:
+		best := -1
+		bestLoad := 0.0
+		bestScore := 0.0
+		for i := range v {
+			load := utilization(v[i])
+			score := rendezvousScore(room, v[i], 1)
+			if best == -1 || load < bestLoad || (load == bestLoad && score > bestScore) {
+				best, bestLoad, bestScore = i, load, score
+			}
+		}
+		return best
+	default:
+		s.curRepeater = (s.curRepeater + 1) % len(v)
+		return s.curRepeater
+	}
+}
+
+//highestScore picks the repeater with the highest weighted rendezvous score for the room
+func (s *shard) highestScore(room string, v []base.Registration, weight func(base.Registration) float64) int {
+	best := 0
+	bestScore := rendezvousScore(room, v[0], weight(v[0]))
+	for i := 1; i < len(v); i++ {
+		score := rendezvousScore(room, v[i], weight(v[i]))
+		if score > bestScore || (score == bestScore && v[i].ID < v[best].ID) {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+//rendezvousScore hashes the room and the repeater into a score, weighted so that a repeater with twice the weight has the highest score for twice as many rooms
+func rendezvousScore(room string, r base.Registration, weight float64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(room))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(repeaterKey(r)))
+
+	//fnv doesn't spread the last few bytes into the high bits, so they get mixed before mapping the hash into (0, 1)
+	u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+//mix is the splitmix64 finalizer
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+//repeaterKey identifies a repeater for hashing. The address stays the same when a repeater reconnects, so its rooms come back to it
+func repeaterKey(r base.Registration) string {
+	if len(r.Addr) > 0 {
+		return r.Addr
+	}
+	return r.ID
+}
+
+func utilization(r base.Registration) float64 {
+	if cap(r.Channel) == 0 {
+		return float64(len(r.Channel))
+	}
+	return float64(len(r.Channel)) / float64(cap(r.Channel))
+}
+
+//repeaterWeight returns the configured weight of the repeater, or 1 if it doesn't have one
+func (n *Nexus) repeaterWeight(r base.Registration) float64 {
+	if w, ok := n.repeaterWeights[r.Addr]; ok {
+		return w
+	}
+	return 1
+}
+
+//setCurrentRepeater records the repeater the last event was sent to, for the status
+func (n *Nexus) setCurrentRepeater(id string) {
+	n.currentRepeater.Store(id)
+}
+
+func (n *Nexus) getRepeaterSelectionStatus() RepeaterSelectionStatus {
+	toReturn := RepeaterSelectionStatus{
+		Strategy: n.repeaterStrategy,
+		Weights:  n.repeaterWeights,
+	}
+	if v, ok := n.currentRepeater.Load().(string); ok {
+		toReturn.Current = v
+	}
+	return toReturn
+}
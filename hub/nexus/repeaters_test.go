@@ -0,0 +1,276 @@
+package nexus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//repeaterShard returns a shard that picks repeaters with the strategy, outside of a running nexus
+func repeaterShard(strategy string, weights map[string]float64) *shard {
+	return &shard{
+		nexus: &Nexus{
+			repeaterStrategy: strategy,
+			repeaterWeights:  weights,
+		},
+	}
+}
+
+func (s *shard) addRepeater(id, addr string, buffer int) {
+	s.repeaterRegistry = addToRegistration(base.RegistrationChange{
+		Type:         base.Repeater,
+		Registration: base.Registration{ID: id, Addr: addr, Channel: make(chan base.EventWrapper, buffer)},
+	}, s.repeaterRegistry)
+}
+
+func (s *shard) removeRepeater(id string) {
+	s.repeaterRegistry = removeFromRegistration(base.RegistrationChange{
+		Type:         base.Repeater,
+		Registration: base.Registration{ID: id},
+	}, s.repeaterRegistry)
+}
+
+//assignments returns the address of the repeater each room goes to
+func (s *shard) assignments(rooms []string) map[string]string {
+	toReturn := make(map[string]string, len(rooms))
+	for _, room := range rooms {
+		toReturn[room] = s.repeaterRegistry[s.chooseRepeater(room)].Addr
+	}
+	return toReturn
+}
+
+//TestHashingStrategiesAreStable registers and deregisters repeaters, and checks that only the rooms of the repeater that came or went move
+func TestHashingStrategiesAreStable(t *testing.T) {
+	rooms := testRooms(1000)
+	weights := map[string]float64{"10.0.0.1": 3, "10.0.0.2": 0.5}
+
+	for _, strategy := range []string{Sticky, Weighted} {
+		t.Run(strategy, func(t *testing.T) {
+			s := repeaterShard(strategy, weights)
+			for i := 1; i <= 5; i++ {
+				s.addRepeater(fmt.Sprintf("repeater-%v", i), fmt.Sprintf("10.0.0.%v", i), 10)
+			}
+			before := s.assignments(rooms)
+
+			//each repeater gets some rooms
+			counts := make(map[string]int)
+			for _, addr := range before {
+				counts[addr]++
+			}
+			if len(counts) != 5 {
+				t.Fatalf("only %v repeaters got rooms: %v", len(counts), counts)
+			}
+
+			//picking again doesn't change anything
+			for room, addr := range s.assignments(rooms) {
+				if before[room] != addr {
+					t.Fatalf("%v moved from %v to %v without any change", room, before[room], addr)
+				}
+			}
+
+			//removing a repeater only moves its rooms, even though it reorders the registry
+			s.removeRepeater("repeater-2")
+			after := s.assignments(rooms)
+			moved := 0
+			for room, addr := range after {
+				switch {
+				case before[room] == "10.0.0.2":
+					moved++
+					if addr == "10.0.0.2" {
+						t.Fatalf("%v is still on the removed repeater", room)
+					}
+				case addr != before[room]:
+					t.Fatalf("%v moved from %v to %v when another repeater was removed", room, before[room], addr)
+				}
+			}
+			if moved != counts["10.0.0.2"] {
+				t.Fatalf("%v rooms moved, want the %v on the removed repeater", moved, counts["10.0.0.2"])
+			}
+
+			//adding a repeater only takes rooms, it doesn't shuffle the others
+			s.addRepeater("repeater-6", "10.0.0.6", 10)
+			added := s.assignments(rooms)
+			for room, addr := range added {
+				if addr != after[room] && addr != "10.0.0.6" {
+					t.Fatalf("%v moved from %v to %v when a repeater was added", room, after[room], addr)
+				}
+			}
+
+			//a repeater that reconnects from the same address gets its rooms back, with a new ID
+			s.removeRepeater("repeater-6")
+			s.addRepeater("repeater-2-again", "10.0.0.2", 10)
+			for room, addr := range s.assignments(rooms) {
+				if addr != before[room] {
+					t.Fatalf("%v is on %v after the repeater came back, want %v", room, addr, before[room])
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedShares(t *testing.T) {
+	rooms := testRooms(4000)
+	s := repeaterShard(Weighted, map[string]float64{"10.0.0.1": 3})
+	s.addRepeater("repeater-1", "10.0.0.1", 10)
+	s.addRepeater("repeater-2", "10.0.0.2", 10)
+
+	counts := make(map[string]int)
+	for _, addr := range s.assignments(rooms) {
+		counts[addr]++
+	}
+
+	//a weight of 3 against 1 should get about three quarters of the rooms
+	share := float64(counts["10.0.0.1"]) / float64(len(rooms))
+	if share < 0.70 || share > 0.80 {
+		t.Fatalf("the repeater with weight 3 got %.2f of the rooms, want about 0.75 (%v)", share, counts)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s := repeaterShard(RoundRobin, nil)
+	for i := 1; i <= 3; i++ {
+		s.addRepeater(fmt.Sprintf("repeater-%v", i), fmt.Sprintf("10.0.0.%v", i), 10)
+	}
+
+	counts := make(map[string]int)
+	last := ""
+	for i := 0; i < 9; i++ {
+		addr := s.repeaterRegistry[s.chooseRepeater("ITB-1101")].Addr
+		if addr == last {
+			t.Fatalf("%v was picked twice in a row", addr)
+		}
+		counts[addr]++
+		last = addr
+	}
+	for addr, count := range counts {
+		if count != 3 {
+			t.Fatalf("%v was picked %v times out of 9, want 3 (%v)", addr, count, counts)
+		}
+	}
+
+	//removing one keeps going through the others
+	s.removeRepeater("repeater-1")
+	counts = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		counts[s.repeaterRegistry[s.chooseRepeater("ITB-1101")].Addr]++
+	}
+	if counts["10.0.0.2"] != 2 || counts["10.0.0.3"] != 2 {
+		t.Fatalf("got %v after removing a repeater, want 2 each for the other two", counts)
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	s := repeaterShard(LeastLoaded, nil)
+	for i := 1; i <= 3; i++ {
+		s.addRepeater(fmt.Sprintf("repeater-%v", i), fmt.Sprintf("10.0.0.%v", i), 10)
+	}
+
+	//with nothing buffered it's the sticky choice for each room
+	sticky := repeaterShard(Sticky, nil)
+	sticky.repeaterRegistry = s.repeaterRegistry
+	rooms := testRooms(100)
+	for room, addr := range s.assignments(rooms) {
+		if want := sticky.assignments([]string{room})[room]; addr != want {
+			t.Fatalf("%v went to %v with empty buffers, want the sticky choice %v", room, addr, want)
+		}
+	}
+
+	//the emptiest buffer wins
+	fill := func(id string, count int) {
+		for i := range s.repeaterRegistry {
+			if s.repeaterRegistry[i].ID == id {
+				for j := 0; j < count; j++ {
+					s.repeaterRegistry[i].Channel <- base.EventWrapper{}
+				}
+			}
+		}
+	}
+	fill("repeater-1", 5)
+	fill("repeater-2", 2)
+	fill("repeater-3", 8)
+	for room, addr := range s.assignments(rooms) {
+		if addr != "10.0.0.2" {
+			t.Fatalf("%v went to %v, want the emptiest repeater 10.0.0.2", room, addr)
+		}
+	}
+
+	//load is compared as a share of the buffer, not the number of events
+	s.addRepeater("repeater-big", "10.0.0.4", 100)
+	fill("repeater-big", 10)
+	for room, addr := range s.assignments(rooms) {
+		if addr != "10.0.0.4" {
+			t.Fatalf("%v went to %v, want the repeater with the emptiest buffer 10.0.0.4", room, addr)
+		}
+	}
+}
+
+//TestStickyRouting routes events through a nexus with the sticky strategy, and checks each room's events keep going to the same repeater while another one disconnects
+func TestStickyRouting(t *testing.T) {
+	o := DefaultOptions()
+	o.Shards = 2
+	o.DedupWindow = 0
+	o.RepeaterStrategy = Sticky
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	defer n.Stop(time.Second)
+
+	register := func(id, addr string) {
+		_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+			Type:               base.Repeater,
+			SubscriptionChange: base.SubscriptionChange{Create: true},
+			Registration:       base.Registration{ID: id, Addr: addr, Channel: make(chan base.EventWrapper, 1000)},
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("couldn't register %v: %v", id, err.Error())
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		register(fmt.Sprintf("repeater-%v", i), fmt.Sprintf("10.0.0.%v", i))
+	}
+
+	rooms := testRooms(60)
+	route := func() map[string]string {
+		toReturn := make(map[string]string)
+		for _, room := range rooms {
+			e := base.EventWrapper{Room: room, Event: []byte(`{}`)}
+			report, err := n.SubmitAndWait(e, base.Messenger, "producer", 5*time.Second)
+			if err != nil {
+				t.Fatalf("couldn't submit: %v", err.Error())
+			}
+			if len(report.Repeaters) != 1 {
+				t.Fatalf("the event for %v went to %v repeaters, want 1", room, report.Repeaters)
+			}
+			toReturn[room] = report.Repeaters[0]
+		}
+		return toReturn
+	}
+
+	before := route()
+	for room, id := range route() {
+		if id != before[room] {
+			t.Fatalf("%v moved from %v to %v", room, before[room], id)
+		}
+	}
+
+	_, err = n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:         base.Repeater,
+		Registration: base.Registration{ID: "repeater-3"},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't deregister: %v", err.Error())
+	}
+
+	for room, id := range route() {
+		if before[room] != "repeater-3" && id != before[room] {
+			t.Fatalf("%v moved from %v to %v when repeater-3 disconnected", room, before[room], id)
+		}
+		if id == "repeater-3" {
+			t.Fatalf("%v still went to the disconnected repeater", room)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package nexus
+
+import (
+	"sync"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/eventlog"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//replayTracker tracks the replays to a connection. cancel is closed when the connection goes away
+type replayTracker struct {
+	sync.WaitGroup
+	cancel chan struct{}
+}
+
+//HasEventLog returns true if the event log is turned on
+func (n *Nexus) HasEventLog() bool {
+	return n.eventLog != nil
+}
+
+//Replay calls fn with each event in the event log that matches the query, oldest first, until fn returns false
+func (n *Nexus) Replay(q eventlog.Query, fn func(eventlog.Record) bool) *nerr.E {
+	if n.eventLog == nil {
+		return nerr.Create("the event log is turned off", "unavailable")
+	}
+	return n.eventLog.Replay(q, fn)
+}
+
+//startReplay sends a messenger the events for its new rooms from the event log. The replay runs alongside the live events, so they may be interleaved; replayed events have the Offset header set. Not threadsafe
+func (n *Nexus) startReplay(r base.RegistrationChange) {
+	if r.Type != base.Messenger {
+		return
+	}
+
+	if n.eventLog == nil {
+		log.L.Warnf("Messenger %v asked for a replay of %v, but the event log is turned off", r.ID, r.Rooms)
+		return
+	}
+
+	k := counterKey(r.Type, r.ID)
+	t, ok := n.replays[k]
+	if !ok {
+		t = &replayTracker{cancel: make(chan struct{})}
+		n.replays[k] = t
+	}
+
+	q := eventlog.Query{
+		From:  r.Replay.From,
+		Since: r.Replay.Since,
+	}
+
+	t.Add(1)
+	go func() {
+		defer t.Done()
+
+		count := 0
+		err := n.eventLog.Replay(q, func(rec eventlog.Record) bool {
+			if !subscribedTo(r.Rooms, rec.Room) {
+				return true
+			}
+
+			e := rec.EventWrapper()
+			if r.ContentFilter != nil {
+				ev, err := base.UnwrapEvent(e)
+				if err != nil || !r.ContentFilter.Match(ev) {
+					return true
+				}
+			}
+
+			//the replay waits on the connection instead of dropping events, it's stopped if the connection goes away
+			select {
+			case r.Channel <- e:
+				count++
+				return true
+			case <-t.cancel:
+				return false
+			case <-n.stop:
+				return false
+			}
+		})
+		if err != nil {
+			log.L.Warnf("Replay of %v to messenger %v failed: %v", r.Rooms, r.ID, err.Error())
+		}
+
+		log.L.Infof("Replayed %v events for %v to messenger %v", count, r.Rooms, r.ID)
+	}()
+}
+
+//stopReplays stops the replays to the connection, and returns their tracker so the caller can wait for them to finish. Not threadsafe
+func (n *Nexus) stopReplays(connType, connID string) *replayTracker {
+	k := counterKey(connType, connID)
+	t, ok := n.replays[k]
+	if !ok {
+		return &replayTracker{}
+	}
+
+	close(t.cancel)
+	delete(n.replays, k)
+	return t
+}
@@ -0,0 +1,116 @@
+package nexus
+
+import (
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Reasons an event isn't routed at all
+const (
+	DroppedLoop      = "loop"
+	DroppedMaxHops   = "max-hops"
+	DroppedDuplicate = "duplicate"
+	DroppedNoRule    = "no-rule"
+)
+
+//DeliveryReport is what happened to a single event, see SubmitAndWait
+type DeliveryReport struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+
+	//Rule is the name of the routing rule that matched the event
+	Rule string `json:"rule,omitempty"`
+
+	//Dropped is set if the event wasn't routed at all, to one of the Dropped reasons
+	Dropped string `json:"dropped,omitempty"`
+
+	//Messengers, Repeaters and Hubs are the IDs of the connections the event was delivered to. With the default rules there's only ever one repeater
+	Messengers []string `json:"messengers"`
+	Repeaters  []string `json:"repeaters"`
+	Hubs       []string `json:"hubs"`
+
+	//Drops are the connections the event was meant for, but that it couldn't be delivered to because their buffer was full
+	Drops []DeliveryDrop `json:"drops"`
+}
+
+//DeliveryDrop is a connection an event couldn't be delivered to, and what the overflow policy did about it
+type DeliveryDrop struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+//shardEvent is an event on its way to a shard. report is set if someone is waiting on the delivery report
+type shardEvent struct {
+	base.HubEventWrapper
+	report chan DeliveryReport
+
+	//stamped is true if the event came without an ID, and was given one by this hub
+	stamped bool
+}
+
+func newDeliveryReport(e base.HubEventWrapper) *DeliveryReport {
+	return &DeliveryReport{
+		ID:         e.Header.ID,
+		Room:       e.Room,
+		Messengers: []string{},
+		Repeaters:  []string{},
+		Hubs:       []string{},
+		Drops:      []DeliveryDrop{},
+	}
+}
+
+//drop records why the event wasn't routed. A nil report is ignored, so the router doesn't have to check if anyone is waiting
+func (r *DeliveryReport) drop(reason string) {
+	if r == nil {
+		return
+	}
+	r.Dropped = reason
+}
+
+//add records what happened when the event was sent to a connection
+func (r *DeliveryReport) add(connType, id, outcome string) {
+	if r == nil {
+		return
+	}
+
+	if outcome != delivered {
+		r.Drops = append(r.Drops, DeliveryDrop{
+			Type:   connType,
+			ID:     id,
+			Reason: outcome,
+		})
+		return
+	}
+
+	switch connType {
+	case base.Messenger:
+		r.Messengers = append(r.Messengers, id)
+	case base.Repeater:
+		r.Repeaters = append(r.Repeaters, id)
+	case base.Hub:
+		r.Hubs = append(r.Hubs, id)
+	}
+}
+
+//SubmitAndWait submits an event like Submit, and then waits up to the timeout for it to be routed. Returns where the event was delivered, and where it couldn't be
+func (n *Nexus) SubmitAndWait(e base.EventWrapper, Source, SourceID string, timeout time.Duration) (DeliveryReport, *nerr.E) {
+	report := make(chan DeliveryReport, 1)
+	if err := n.submit(e, Source, SourceID, report); err != nil {
+		return DeliveryReport{}, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case r := <-report:
+		return r, nil
+	case <-t.C:
+		return DeliveryReport{}, nerr.Create("timed out waiting for the event to be routed", "timeout")
+	case <-n.stop:
+		return DeliveryReport{}, nerr.Create("the hub has stopped", "stopped")
+	}
+}
@@ -0,0 +1,174 @@
+package nexus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+)
+
+//reportNexus returns a started nexus with the options changed by fn
+func reportNexus(t *testing.T, fn func(*Options)) *Nexus {
+	o := DefaultOptions()
+	o.ID = "hub-a"
+	o.Shards = 2
+	o.LastValueSize = 0
+	fn(&o)
+
+	n, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	n.Start()
+	t.Cleanup(func() {
+		n.Stop(time.Second)
+	})
+	return n
+}
+
+//register registers a connection with a buffer of size, for the rooms if it's a messenger
+func register(t *testing.T, n *Nexus, connType, id string, size int, rooms ...string) {
+	_, err := n.SubmitRegistrationChangeAndWait(base.RegistrationChange{
+		Type:               connType,
+		SubscriptionChange: base.SubscriptionChange{Create: true, Rooms: rooms},
+		Registration:       base.Registration{ID: id, Channel: make(chan base.EventWrapper, size)},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't register %v: %v", id, err.Error())
+	}
+}
+
+func submitAndWait(t *testing.T, n *Nexus, e base.EventWrapper, source string) DeliveryReport {
+	report, err := n.SubmitAndWait(e, source, "producer", 5*time.Second)
+	if err != nil {
+		t.Fatalf("couldn't submit: %v", err.Error())
+	}
+	return report
+}
+
+func TestDeliveryReport(t *testing.T) {
+	n := reportNexus(t, func(o *Options) {})
+	register(t, n, base.Messenger, "panel", 10, "ITB-1101")
+	register(t, n, base.Messenger, "other-room", 10, "ITB-1102")
+	register(t, n, base.Repeater, "repeater", 10)
+	register(t, n, base.Hub, "hub-b", 10)
+
+	e := base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`), Header: base.Header{ID: "event-1"}}
+	report := submitAndWait(t, n, e, base.Messenger)
+
+	want := DeliveryReport{
+		ID:         "event-1",
+		Room:       "ITB-1101",
+		Rule:       "from-messengers",
+		Messengers: []string{"panel"},
+		Repeaters:  []string{"repeater"},
+		Hubs:       []string{"hub-b"},
+		Drops:      []DeliveryDrop{},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got report %+v, want %+v", report, want)
+	}
+
+	//an event from a hub only goes to messengers
+	e.Header.ID = "event-2"
+	report = submitAndWait(t, n, e, base.Hub)
+	if report.Rule != "from-hubs" || !reflect.DeepEqual(report.Messengers, []string{"panel"}) || len(report.Hubs) != 0 || len(report.Repeaters) != 0 {
+		t.Fatalf("got report %+v for an event from a hub", report)
+	}
+}
+
+func TestDeliveryReportDrops(t *testing.T) {
+	n := reportNexus(t, func(o *Options) {})
+
+	//the first event fills each buffer
+	register(t, n, base.Messenger, "panel", 1, "ITB-1101")
+	register(t, n, base.Repeater, "repeater", 1)
+	register(t, n, base.Hub, "hub-b", 1)
+
+	e := base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`), Header: base.Header{ID: "event-1"}}
+	if report := submitAndWait(t, n, e, base.Messenger); len(report.Drops) != 0 {
+		t.Fatalf("the first event was dropped for %+v", report.Drops)
+	}
+
+	e.Header.ID = "event-2"
+	report := submitAndWait(t, n, e, base.Messenger)
+	want := []DeliveryDrop{
+		{Type: base.Messenger, ID: "panel", Reason: droppedNewest},
+		{Type: base.Hub, ID: "hub-b", Reason: droppedNewest},
+		{Type: base.Repeater, ID: "repeater", Reason: droppedNewest},
+	}
+	if !reflect.DeepEqual(report.Drops, want) {
+		t.Fatalf("got drops %+v, want %+v", report.Drops, want)
+	}
+	if len(report.Messengers) != 0 || len(report.Repeaters) != 0 || len(report.Hubs) != 0 || len(report.Dropped) != 0 {
+		t.Fatalf("got report %+v, want it delivered nowhere", report)
+	}
+}
+
+func TestDeliveryReportDropped(t *testing.T) {
+	n := reportNexus(t, func(o *Options) {
+		o.MaxHops = 2
+		o.Rules = []Rule{{
+			Name:         "from-messengers",
+			Source:       base.Messenger,
+			Destinations: map[string]string{base.Messenger: DeliverAll},
+		}}
+	})
+	register(t, n, base.Messenger, "panel", 10, "ITB-1101")
+
+	event := func(id string) base.EventWrapper {
+		return base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`), Header: base.Header{ID: id}}
+	}
+
+	looped := event("looped")
+	looped.Header.Visit("hub-b")
+	looped.Header.Visit("hub-a")
+
+	tooFar := event("too-far")
+	tooFar.Header.Hops = 2
+
+	tests := []struct {
+		name   string
+		event  base.EventWrapper
+		source string
+		want   string
+	}{
+		{"a new event", event("event-1"), base.Messenger, ""},
+		{"the same event again", event("event-1"), base.Messenger, DroppedDuplicate},
+		{"an event that has been through this hub", looped, base.Hub, DroppedLoop},
+		{"an event that has been through too many hubs", tooFar, base.Messenger, DroppedMaxHops},
+		{"an event no rule matches", event("event-2"), base.Repeater, DroppedNoRule},
+	}
+
+	for _, tt := range tests {
+		report := submitAndWait(t, n, tt.event, tt.source)
+		if report.Dropped != tt.want {
+			t.Errorf("%v: got dropped %q, want %q", tt.name, report.Dropped, tt.want)
+		}
+		if len(tt.want) > 0 && len(report.Messengers) != 0 {
+			t.Errorf("%v: was delivered to %v", tt.name, report.Messengers)
+		}
+	}
+}
+
+func TestSubmitAndWaitTimeout(t *testing.T) {
+	//a nexus that isn't started never routes the event
+	n, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+
+	start := time.Now()
+	_, err = n.SubmitAndWait(base.EventWrapper{Room: "ITB-1101", Event: []byte(`{}`)}, base.Messenger, "producer", 50*time.Millisecond)
+	if err == nil || err.Type != "timeout" {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("only waited %v", waited)
+	}
+
+	if _, err = n.SubmitAndWait(base.EventWrapper{Room: "ITB-1101"}, base.Messenger, "", time.Second); err == nil {
+		t.Fatalf("an event without a source ID was accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package nexus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//Delivery modes, how a rule sends an event to a class of destination (messenger, hub, repeater)
+const (
+	//DeliverAll sends it to every destination of the class. Messengers only get the events for rooms they've subscribed to
+	DeliverAll = "all"
+
+	//DeliverOne sends it to one of them. Repeaters are picked with the repeater strategy, the others are picked by hashing the room
+	DeliverOne = "one"
+
+	//DeliverNone doesn't send it to the class, and neither does leaving the class out of the rule
+	DeliverNone = "none"
+)
+
+//Rule is a single routing rule. The rules are checked in order, and the first one that matches the event decides where it goes; an event that doesn't match any rule is dropped.
+//Source, Room and Key match the type of connection the event came from, its room and its key. Rooms and keys may be patterns ending in '*', and an empty field matches everything
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source,omitempty"`
+	Room   string `json:"room,omitempty"`
+	Key    string `json:"key,omitempty"`
+
+	//Destinations maps a destination class (messenger, hub, repeater) to its delivery mode
+	Destinations map[string]string `json:"destinations"`
+}
+
+//RuleSet is the format of a routing rules file
+type RuleSet struct {
+	Rules []Rule `json:"rules"`
+}
+
+//DefaultRules returns the rules the hub has always routed with. Hubs in a room don't send events from repeaters to the other hubs, since every hub in the room gets them from its own repeater
+func DefaultRules(roomSystem bool) []Rule {
+	repeaterToHubs := DeliverAll
+	if roomSystem {
+		repeaterToHubs = DeliverNone
+	}
+
+	return []Rule{
+		{
+			Name:   "from-hubs",
+			Source: base.Hub,
+			Destinations: map[string]string{
+				base.Messenger: DeliverAll,
+			},
+		},
+		{
+			Name:   "from-messengers",
+			Source: base.Messenger,
+			Destinations: map[string]string{
+				base.Messenger: DeliverAll,
+				base.Hub:       DeliverAll,
+				base.Repeater:  DeliverOne,
+			},
+		},
+		{
+			Name:   "from-repeaters",
+			Source: base.Repeater,
+			Destinations: map[string]string{
+				base.Messenger: DeliverAll,
+				base.Hub:       repeaterToHubs,
+			},
+		},
+	}
+}
+
+//LoadRules reads a rule set from a json file
+func LoadRules(path string) ([]Rule, *nerr.E) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't read routing rules from %v", path)
+	}
+
+	var set RuleSet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't parse routing rules in %v", path)
+	}
+
+	if _, err := compileRules(set.Rules); err != nil {
+		return nil, err.Addf("invalid routing rules in %v", path)
+	}
+
+	return set.Rules, nil
+}
+
+//compiledRule is a rule with its delivery modes pulled out, so matching an event doesn't need any map lookups
+type compiledRule struct {
+	Rule
+
+	messengers string
+	hubs       string
+	repeaters  string
+}
+
+func compileRules(rules []Rule) ([]compiledRule, *nerr.E) {
+	toReturn := []compiledRule{}
+	for i, r := range rules {
+		name := r.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%v", i)
+		}
+
+		switch r.Source {
+		case "", "*", base.Messenger, base.Repeater, base.Hub:
+		default:
+			return nil, nerr.Create(fmt.Sprintf("rule %v: unknown source %v", name, r.Source), "invalid")
+		}
+
+		for _, p := range []string{r.Room, r.Key} {
+			if IsRoomPattern(p) {
+				if err := validatePattern(p); err != nil {
+					return nil, err.Addf("rule %v", name)
+				}
+			}
+		}
+
+		c := compiledRule{
+			Rule:       r,
+			messengers: DeliverNone,
+			hubs:       DeliverNone,
+			repeaters:  DeliverNone,
+		}
+
+		for class, mode := range r.Destinations {
+			switch mode {
+			case DeliverAll, DeliverOne, DeliverNone:
+			default:
+				return nil, nerr.Create(fmt.Sprintf("rule %v: unknown delivery mode %v for %v", name, mode, class), "invalid")
+			}
+
+			switch class {
+			case base.Messenger:
+				c.messengers = mode
+			case base.Hub:
+				c.hubs = mode
+			case base.Repeater:
+				c.repeaters = mode
+			default:
+				return nil, nerr.Create(fmt.Sprintf("rule %v: unknown destination %v", name, class), "invalid")
+			}
+		}
+
+		toReturn = append(toReturn, c)
+	}
+
+	return toReturn, nil
+}
+
+//matches returns true if the rule matches the event. key is only called if the rule checks the key
+func (r *compiledRule) matches(e base.HubEventWrapper, key func() string) bool {
+	if len(r.Source) > 0 && r.Source != "*" && r.Source != e.Source {
+		return false
+	}
+	if !matchPattern(r.Room, e.Room) {
+		return false
+	}
+	if len(r.Key) > 0 && r.Key != "*" && !matchPattern(r.Key, key()) {
+		return false
+	}
+	return true
+}
+
+//matchPattern matches a value against a pattern ending in '*', an exact value, or an empty pattern, which matches everything
+func matchPattern(pattern, v string) bool {
+	switch {
+	case len(pattern) == 0 || pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(v, strings.TrimSuffix(pattern, "*"))
+	default:
+		return pattern == v
+	}
+}
+
+//matchRule returns the first rule that matches the event, or nil if none do
+func (n *Nexus) matchRule(e base.HubEventWrapper) *compiledRule {
+	//the key is only unmarshaled if a rule needs it
+	var key *string
+	getKey := func() string {
+		if key == nil {
+			var tmp struct {
+				Key string `json:"key"`
+			}
+			json.Unmarshal(e.Event, &tmp)
+			key = &tmp.Key
+		}
+		return *key
+	}
+
+	for i := range n.rules {
+		if n.rules[i].matches(e, getKey) {
+			return &n.rules[i]
+		}
+	}
+	return nil
+}
+
+//Rules returns the routing rules the nexus is using
+func (n *Nexus) Rules() []Rule {
+	toReturn := make([]Rule, len(n.rules))
+	for i := range n.rules {
+		toReturn[i] = n.rules[i].Rule
+	}
+	return toReturn
+}
@@ -0,0 +1,29 @@
+package nexus
+
+import (
+	"reflect"
+	"testing"
+)
+
+//TestShippedRules checks the rule files shipped with the hub are the rules it uses when HUB_ROUTING_RULES isn't set
+func TestShippedRules(t *testing.T) {
+	tests := []struct {
+		path       string
+		roomSystem bool
+	}{
+		{"../rules.json", false},
+		{"../rules-room.json", true},
+	}
+
+	for _, tt := range tests {
+		rules, err := LoadRules(tt.path)
+		if err != nil {
+			t.Errorf("couldn't load %v: %v", tt.path, err.Error())
+			continue
+		}
+
+		if want := DefaultRules(tt.roomSystem); !reflect.DeepEqual(rules, want) {
+			t.Errorf("%v = %+v, want %+v", tt.path, rules, want)
+		}
+	}
+}
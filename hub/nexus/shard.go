@@ -0,0 +1,464 @@
+package nexus
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/v2/events"
+)
+
+//shardChange is a registration change handed to a shard by the nexus
+type shardChange struct {
+	base.RegistrationChange
+
+	//disconnect is set when the nexus is removing a slow consumer. The shard keeps its delivery counters, and marks done once the registration is gone
+	disconnect bool
+	done       *sync.WaitGroup
+
+	//result is set if someone is waiting to hear what happened to the change
+	result *changeResult
+}
+
+//shard routes the events for the rooms that hash to it. Each shard has its own copy of the hub and repeater registries, and the messenger registrations for its rooms, so that it never has to wait on another shard
+type shard struct {
+	nexus *Nexus
+	index int
+
+	messengerRegistry  map[string][]base.Registration
+	roomMessengerIndex map[string][]string
+	patterns           *patternTrie
+
+	hubRegistry      []base.Registration
+	repeaterRegistry []base.Registration
+
+	registrationChannel chan shardChange
+	incomingChannel     chan shardEvent
+	priorityChannel     chan shardEvent
+
+	//statusRequests asks the shard for a copy of its registries, see getSnapshot
+	statusRequests chan chan shardSnapshot
+
+	dedup      *dedupCache
+	lastValues *lastValueCache
+
+	//curRepeater is the last repeater picked by the round-robin strategy
+	curRepeater int
+
+	//delivery holds the delivery counters for each registration, disconnecting holds the registrations this shard has asked the nexus to disconnect
+	delivery      map[string]*deliveryCounters
+	deliveryLock  sync.RWMutex
+	disconnecting map[string]bool
+}
+
+func newShard(n *Nexus, index, registrationBufferSize, incomingBufferSize int, dedup *dedupCache, lastValues *lastValueCache) *shard {
+	return &shard{
+		nexus: n,
+		index: index,
+
+		messengerRegistry:  make(map[string][]base.Registration),
+		roomMessengerIndex: make(map[string][]string),
+		patterns:           newPatternTrie(),
+
+		registrationChannel: make(chan shardChange, registrationBufferSize),
+		incomingChannel:     make(chan shardEvent, incomingBufferSize),
+		priorityChannel:     make(chan shardEvent, incomingBufferSize),
+		statusRequests:      make(chan chan shardSnapshot),
+
+		dedup:      dedup,
+		lastValues: lastValues,
+
+		delivery:      make(map[string]*deliveryCounters),
+		disconnecting: make(map[string]bool),
+	}
+}
+
+func (s *shard) start() {
+	for {
+		//high priority events always go first
+		select {
+		case e := <-s.priorityChannel:
+			s.routeEvent(e)
+			continue
+		default:
+		}
+
+		select {
+		case e := <-s.priorityChannel:
+			s.routeEvent(e)
+
+		case e := <-s.incomingChannel:
+			s.routeEvent(e)
+			//end case incomingchannel
+
+		case r := <-s.registrationChannel:
+			s.applyChange(r)
+			//end case registrationChannel
+
+		case c := <-s.statusRequests:
+			c <- s.snapshot()
+
+		case <-s.nexus.stop:
+			return
+		}
+	}
+}
+
+//routeEvent routes an event off of one of the shard's lanes, and sends its delivery report if someone is waiting on it. Not threadsafe
+func (s *shard) routeEvent(e shardEvent) {
+	if e.report == nil {
+		s.route(e.HubEventWrapper, e.stamped, nil)
+	} else {
+		report := newDeliveryReport(e.HubEventWrapper)
+		s.route(e.HubEventWrapper, e.stamped, report)
+		e.report <- *report
+	}
+	s.nexus.routed()
+}
+
+//submit hands the shard a registration change
+func (s *shard) submit(c shardChange) {
+	c.result.add()
+	select {
+	case s.registrationChannel <- c:
+	case <-s.nexus.stop:
+	}
+}
+
+//applyChange updates the shard's registries. Not threadsafe
+func (s *shard) applyChange(r shardChange) {
+	defer r.result.done()
+
+	if r.Control == base.ControlQuery {
+		s.querySubscriptions(r.ID, r.result)
+		return
+	}
+
+	switch r.Type {
+	case base.Messenger:
+		if r.Create {
+			s.registerMessenger(r.RegistrationChange, r.result)
+		} else {
+			s.deregisterMessenger(r.RegistrationChange)
+		}
+	case base.Repeater:
+		if r.Create {
+			s.repeaterRegistry = addToRegistration(r.RegistrationChange, s.repeaterRegistry)
+		} else {
+			s.repeaterRegistry = removeFromRegistration(r.RegistrationChange, s.repeaterRegistry)
+		}
+	case base.Hub:
+		if r.Create {
+			s.hubRegistry = addToRegistration(r.RegistrationChange, s.hubRegistry)
+		} else {
+			s.hubRegistry = removeFromRegistration(r.RegistrationChange, s.hubRegistry)
+		}
+	default:
+		log.L.Errorf("Attempt to register an unknown type: %v", r.Type)
+	}
+
+	switch {
+	case r.disconnect:
+		//the counters stay around so the drops and the disconnect show up in the status until the connection deregisters
+		delete(s.disconnecting, counterKey(r.Type, r.ID))
+		r.done.Done()
+	case !r.Create && len(r.Rooms) == 0:
+		//the connection is going away entirely
+		s.removeCounters(r.Type, r.ID)
+	}
+}
+
+//route sends the event everywhere it needs to go, and records where it went in the report if there is one. stamped is true if the event came without an ID. Not threadsafe
+func (s *shard) route(e base.HubEventWrapper, stamped bool, report *DeliveryReport) {
+	log.L.Debugf("Sending Event from %v of type %v for room %v", e.SourceID, e.Source, e.Room)
+	if reason := s.checkHops(&e); len(reason) > 0 {
+		report.drop(reason)
+		return
+	}
+
+	if s.dedup.isDuplicate(e.EventWrapper, stamped) {
+		log.L.Debugf("Dropping duplicate event %v from %v", e.Header.ID, e.SourceID)
+		report.drop(DroppedDuplicate)
+		return
+	}
+
+	//the log's writer appends it, so routing never waits on the disk
+	if s.nexus.eventLog != nil && !s.nexus.eventLog.Submit(e) {
+		log.L.Debugf("Event %v didn't make it into the event log's queue", e.Header.ID)
+	}
+
+	rule := s.nexus.matchRule(e)
+	if rule == nil {
+		log.L.Debugf("No routing rule for event %v from %v of type %v, dropping it", e.Header.ID, e.SourceID, e.Source)
+		report.drop(DroppedNoRule)
+		return
+	}
+
+	if report != nil {
+		report.Rule = rule.Name
+	}
+
+	//messengers never get their own events back
+	if rule.messengers != DeliverNone {
+		s.lastValues.update(e.EventWrapper)
+
+		v := s.matchMessengers(e.EventWrapper)
+		if e.Source == base.Messenger {
+			v, _ = removeRegistration(v, e.SourceID)
+		}
+
+		s.deliver(base.Messenger, rule.messengers, e, v, report)
+	}
+
+	//hubs that have already seen the event, or that don't want its room, are skipped
+	if rule.hubs != DeliverNone {
+		v := []base.Registration{}
+		for i := range s.hubRegistry {
+			if !s.hasSeen(s.hubRegistry[i], e) && s.nexus.interest.wants(s.hubRegistry[i], e.Room) {
+				v = append(v, s.hubRegistry[i])
+			}
+		}
+
+		s.deliver(base.Hub, rule.hubs, e, v, report)
+	}
+
+	if rule.repeaters != DeliverNone {
+		if len(s.repeaterRegistry) == 0 {
+			log.L.Infof("No repeaters registered")
+		}
+
+		s.deliver(base.Repeater, rule.repeaters, e, s.repeaterRegistry, report)
+	}
+}
+
+//deliver sends the event to the registrations using the delivery mode. Not threadsafe
+func (s *shard) deliver(connType, mode string, e base.HubEventWrapper, v []base.Registration, report *DeliveryReport) {
+	if len(v) == 0 {
+		return
+	}
+
+	if mode == DeliverAll {
+		for i := range v {
+			log.L.Debugf("%v", v[i].ID)
+			report.add(connType, v[i].ID, s.send(connType, v[i], e.EventWrapper))
+		}
+		return
+	}
+
+	//we only send to one
+	var r base.Registration
+	if connType == base.Repeater {
+		r = v[s.chooseRepeater(e.Room)]
+		s.nexus.setCurrentRepeater(r.ID)
+	} else {
+		r = v[s.highestScore(e.Room, v, func(base.Registration) float64 { return 1 })]
+	}
+
+	log.L.Debugf("sending to %v: %v", connType, r.ID)
+	report.add(connType, r.ID, s.send(connType, r, e.EventWrapper))
+}
+
+//checkHops marks the event as routed through this hub, and returns why it should be dropped if it has looped back here or gone through too many hubs. Not threadsafe
+func (s *shard) checkHops(e *base.HubEventWrapper) string {
+	if e.Header.HasVisited(s.nexus.id) {
+		log.L.Debugf("Dropping event %v from %v, it has already been routed through this hub (%v)", e.Header.ID, e.SourceID, e.Header.Visited())
+		atomic.AddUint64(&s.nexus.loops.returned, 1)
+		return DroppedLoop
+	}
+
+	e.Header.Hops++
+	if s.nexus.maxHops > 0 && e.Header.Hops > s.nexus.maxHops {
+		log.L.Warnf("Dropping event %v from %v, it has been routed through %v hubs (%v)", e.Header.ID, e.SourceID, e.Header.Hops, e.Header.Visited())
+		atomic.AddUint64(&s.nexus.loops.ttlExceeded, 1)
+		return DroppedMaxHops
+	}
+
+	e.Header.Visit(s.nexus.id)
+	return ""
+}
+
+//hasSeen returns true if the hub on the other end of the registration has already routed the event. Not threadsafe
+func (s *shard) hasSeen(r base.Registration, e base.HubEventWrapper) bool {
+	if len(r.PeerID) == 0 || !e.Header.HasVisited(r.PeerID) {
+		return false
+	}
+
+	log.L.Debugf("Not sending event %v to hub %v, it's already been there", e.Header.ID, r.PeerID)
+	atomic.AddUint64(&s.nexus.loops.prevented, 1)
+	return true
+}
+
+//registerMessenger subscribes the messenger to the rooms. Subscribing to a room again replaces the registration, so its filter is updated. Not threadsafe
+func (s *shard) registerMessenger(r base.RegistrationChange, result *changeResult) {
+	log.L.Infof("Registering messenger %v for rooms %v", r.ID, r.Rooms)
+
+	//add
+	for _, cur := range r.Rooms {
+		if IsRoomPattern(cur) {
+			if err := validatePattern(cur); err != nil {
+				log.L.Warnf("Not registering messenger %v: %v", r.ID, err.Error())
+				result.reject(cur, err.Error())
+				continue
+			}
+
+			if !s.patterns.add(cur, r.Registration) {
+				log.L.Infof("attempt to create duplicate registration: %v:%v", cur, r.ID)
+				continue
+			}
+			s.roomMessengerIndex[r.ID] = append(s.roomMessengerIndex[r.ID], cur)
+			continue
+		}
+
+		v, added := upsertRegistration(s.messengerRegistry[cur], r.Registration)
+		s.messengerRegistry[cur] = v
+		if !added {
+			log.L.Infof("attempt to create duplicate registration: %v:%v", cur, r.ID)
+			continue
+		}
+		s.roomMessengerIndex[r.ID] = append(s.roomMessengerIndex[r.ID], cur)
+	}
+	log.L.Infof("Successfully registered messenger %v for rooms %v", r.ID, r.Rooms)
+
+	//the snapshot goes out before this shard routes anything else, so it's always ahead of the live events
+	if r.Snapshot {
+		s.sendSnapshot(r.Registration, r.Rooms, result)
+	}
+}
+
+//not threadsafe
+func (s *shard) deregisterMessenger(r base.RegistrationChange) {
+	if len(r.Rooms) == 0 {
+		//unregister all for this messenger, the index is modified as we go so we need a copy
+		r.Rooms = append([]string{}, s.roomMessengerIndex[r.ID]...)
+	}
+
+	for _, cur := range r.Rooms {
+		log.L.Infof("Unregistering messenger %v for rooms %v", r.ID, r.Rooms)
+		if IsRoomPattern(cur) {
+			if !s.patterns.remove(cur, r.ID) {
+				log.L.Infof("Trying to remove unknown registration: %v:%v", cur, r.ID)
+				continue
+			}
+			s.removeFromIndex(r.ID, cur)
+			log.L.Infof("Removed registration %v:%v", cur, r.ID)
+			continue
+		}
+
+		v, ok := s.messengerRegistry[cur]
+		if !ok {
+			//it doesn't exist
+			log.L.Infof("Trying to remove unknown registration: %v:%v", cur, r.ID)
+			continue
+		}
+		//it does exist, find it to be removed
+		for i := range v {
+			if v[i].ID == r.ID {
+				log.L.Infof("Removing messenger registration %v:%v", cur, r.ID)
+				//remove it
+				v[i] = v[len(v)-1]
+				s.messengerRegistry[cur] = v[:len(v)-1]
+
+				//remove from the index
+				s.removeFromIndex(r.ID, cur)
+				break
+			}
+		}
+		//it doesn't exist
+		log.L.Infof("Removed registration %v:%v", cur, r.ID)
+	}
+}
+
+//removeFromIndex removes the room from the messenger's entry in the room index. Not threadsafe
+func (s *shard) removeFromIndex(id, room string) {
+	index := s.roomMessengerIndex[id]
+	for j := range index {
+		if index[j] == room {
+			index[j] = index[len(index)-1]
+			s.roomMessengerIndex[id] = index[:len(index)-1]
+			return
+		}
+	}
+}
+
+//matchMessengers returns every messenger registered for the event's room, either directly, through a pattern, or through '*', whose filter (if any) matches the event. Each messenger is only returned once. Not threadsafe
+func (s *shard) matchMessengers(e base.EventWrapper) []base.Registration {
+	toReturn := []base.Registration{}
+	seen := make(map[string]bool)
+
+	//the event is only unmarshaled if there is a filter to check
+	var ev *events.Event
+	decoded := false
+
+	add := func(r base.Registration) {
+		if seen[r.ID] {
+			return
+		}
+
+		if r.ContentFilter != nil {
+			if !decoded {
+				decoded = true
+				tmp, err := base.UnwrapEvent(e)
+				if err != nil {
+					log.L.Debugf("Couldn't unwrap event %v to check filters: %v", e.Header.ID, err.Error())
+				} else {
+					ev = &tmp
+				}
+			}
+
+			if ev == nil || !r.ContentFilter.Match(*ev) {
+				return
+			}
+		}
+
+		seen[r.ID] = true
+		toReturn = append(toReturn, r)
+	}
+
+	for _, r := range s.messengerRegistry[e.Room] {
+		add(r)
+	}
+
+	s.patterns.match(e.Room, add)
+
+	//check the star case
+	for _, r := range s.messengerRegistry["*"] {
+		add(r)
+	}
+
+	return toReturn
+}
+
+//don't call outside of the start function. Not threadsafe
+func addToRegistration(r base.RegistrationChange, registry []base.Registration) []base.Registration {
+	log.L.Infof("Registering %v %v", r.Type, r.ID)
+	for i := range registry {
+		if registry[i].ID == r.ID {
+			log.L.Infof("Attempting to register duplicate %v: %v", r.Type, r.ID)
+			return registry
+		}
+	}
+	//not there, add it
+	return append(registry, r.Registration)
+}
+
+//don't call outside of the start function. Not threadsafe
+func removeFromRegistration(r base.RegistrationChange, registry []base.Registration) []base.Registration {
+
+	//we're deleting
+	log.L.Infof("unregistering %v %v", r.Type, r.ID)
+	for i := range registry {
+		if registry[i].ID == r.ID {
+			log.L.Infof("Removing %v registration %v ", r.Type, r.ID)
+
+			//remove it
+			registry[i] = registry[len(registry)-1]
+			registry = registry[:len(registry)-1]
+
+			return registry
+		}
+	}
+	log.L.Infof("Attempting to delete non-existent %v: %v", r.Type, r.ID)
+	return registry
+
+}
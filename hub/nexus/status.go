@@ -1,12 +1,42 @@
 package nexus
 
-import "github.com/byuoitav/central-event-system/hub/base"
+import (
+	"sync/atomic"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/eventlog"
+)
 
 //RegStatus represents the status of a registration
 type RegStatus struct {
 	ID         string `json:"id"`
+	PeerID     string `json:"peer-id,omitempty"`
+	Addr       string `json:"address,omitempty"`
+	Identity   string `json:"identity,omitempty"`
 	BufferCap  int    `json:"buffer-capacity"`
 	BufferUtil int    `json:"buffer-utilization"`
+
+	//PriorityBufferUtil is the number of high priority events waiting, for the connections that have a separate buffer for them
+	PriorityBufferUtil int `json:"priority-buffer-utilization,omitempty"`
+
+	//Peer is who the hub on the other end of a hub connection is, and Direction is whether it dialed this hub (inbound) or this hub dialed it (outbound)
+	Peer      *base.Hello `json:"peer,omitempty"`
+	Direction string      `json:"direction,omitempty"`
+
+	//Interest is the rooms the hub on the other end of a hub connection has asked for, it's left out until the hub sends them
+	Interest []string `json:"interest,omitempty"`
+
+	Overflow string          `json:"overflow-policy,omitempty"`
+	Delivery *DeliveryStatus `json:"delivery,omitempty"`
+}
+
+//LoopStatus represents the state of loop prevention between hubs
+type LoopStatus struct {
+	HubID       string `json:"hub-id"`
+	MaxHops     int    `json:"max-hops"`
+	Returned    uint64 `json:"returned"`
+	Prevented   uint64 `json:"prevented"`
+	TTLExceeded uint64 `json:"ttl-exceeded"`
 }
 
 //Status returns the state of the nexus, including the states of the registries, and the utilization of the buffers.
@@ -17,6 +47,74 @@ type Status struct {
 	MessengerMappings map[string][]RegStatus `json:"messenger-mapping"`
 	Registration      RegStatus              `json:"registration-buffer"`
 	Distribution      RegStatus              `json:"distribution-buffer"`
+	Loops             LoopStatus             `json:"loops"`
+	Dedup             DedupStatus            `json:"dedup"`
+	LastValues        LastValueStatus        `json:"last-values"`
+	Interest          InterestStatus         `json:"interest"`
+	EventLog          *eventlog.Status       `json:"event-log,omitempty"`
+	Shards            []ShardStatus          `json:"shards"`
+
+	RepeaterSelection RepeaterSelectionStatus `json:"repeater-selection"`
+
+	EventsReceived     map[string]uint64 `json:"events-received"`
+	HighPriorityEvents uint64            `json:"high-priority-events"`
+	Registrations      map[string]uint64 `json:"registrations"`
+	Deregistrations    map[string]uint64 `json:"deregistrations"`
+}
+
+//ShardStatus represents the state of one of the nexus' routers
+type ShardStatus struct {
+	Index        int       `json:"index"`
+	Distribution RegStatus `json:"distribution-buffer"`
+	Registration RegStatus `json:"registration-buffer"`
+	Rooms        int       `json:"rooms"`
+}
+
+//shardSnapshot is a copy of a shard's registries. The shard takes it, so the registries aren't read while they're changing
+type shardSnapshot struct {
+	messengers map[string][]base.Registration
+	patterns   map[string][]base.Registration
+	hubs       []base.Registration
+	repeaters  []base.Registration
+}
+
+//snapshot copies the shard's registries. Not threadsafe
+func (s *shard) snapshot() shardSnapshot {
+	toReturn := shardSnapshot{
+		messengers: make(map[string][]base.Registration, len(s.messengerRegistry)),
+		patterns:   make(map[string][]base.Registration),
+		hubs:       append([]base.Registration{}, s.hubRegistry...),
+		repeaters:  append([]base.Registration{}, s.repeaterRegistry...),
+	}
+
+	for k, v := range s.messengerRegistry {
+		toReturn.messengers[k] = append([]base.Registration{}, v...)
+	}
+	s.patterns.walk(func(pattern string, v []base.Registration) {
+		toReturn.patterns[pattern] = append([]base.Registration{}, v...)
+	})
+	return toReturn
+}
+
+//getSnapshot asks the shard's goroutine for a copy of its registries. Before the nexus is started nothing else touches them, so they're copied directly
+func (s *shard) getSnapshot() shardSnapshot {
+	if atomic.LoadInt32(&s.nexus.started) == 0 {
+		return s.snapshot()
+	}
+
+	c := make(chan shardSnapshot, 1)
+	select {
+	case s.statusRequests <- c:
+	case <-s.nexus.stop:
+		return shardSnapshot{}
+	}
+
+	select {
+	case snap := <-c:
+		return snap
+	case <-s.nexus.stop:
+		return shardSnapshot{}
+	}
 }
 
 //GetStatus returns the state of the device
@@ -26,6 +124,7 @@ func (n *Nexus) GetStatus() Status {
 		Hubs:              []RegStatus{},
 		Repeaters:         []RegStatus{},
 		Messengers:        []string{},
+		Shards:            []ShardStatus{},
 	}
 
 	tmpmessengers := make(map[string]bool)
@@ -37,38 +136,145 @@ func (n *Nexus) GetStatus() Status {
 		BufferUtil: len(n.registrationChannel),
 	}
 	toReturn.Distribution = RegStatus{
-		ID:         "distribution",
-		BufferCap:  cap(n.incomingChannel),
-		BufferUtil: len(n.incomingChannel),
-	}
-
-	for k, v := range n.messengerRegistry {
-		cur := []RegStatus{}
-		for i := range v {
-			cur = append(cur, RegStatus{
-				ID:         v[i].ID,
-				BufferCap:  cap(v[i].Channel),
-				BufferUtil: len(v[i].Channel),
-			})
-			tmpmessengers[v[i].ID] = true
+		ID: "distribution",
+	}
+	toReturn.Dedup = DedupStatus{}
+
+	for _, s := range n.shards {
+		snap := s.getSnapshot()
+
+		toReturn.Distribution.BufferCap += cap(s.incomingChannel)
+		toReturn.Distribution.BufferUtil += len(s.incomingChannel)
+		toReturn.Distribution.PriorityBufferUtil += len(s.priorityChannel)
+
+		dedup := s.dedup.getStatus()
+		toReturn.Dedup.Window = dedup.Window
+		toReturn.Dedup.MaxEntries += dedup.MaxEntries
+		toReturn.Dedup.Entries += dedup.Entries
+		toReturn.Dedup.Hits += dedup.Hits
+		toReturn.Dedup.Misses += dedup.Misses
+
+		lastValues := s.lastValues.getStatus()
+		toReturn.LastValues.MaxEntries += lastValues.MaxEntries
+		toReturn.LastValues.Entries += lastValues.Entries
+
+		toReturn.Shards = append(toReturn.Shards, ShardStatus{
+			Index: s.index,
+			Distribution: RegStatus{
+				ID:                 "distribution",
+				BufferCap:          cap(s.incomingChannel),
+				BufferUtil:         len(s.incomingChannel),
+				PriorityBufferUtil: len(s.priorityChannel),
+			},
+			Registration: RegStatus{
+				ID:         "registration",
+				BufferCap:  cap(s.registrationChannel),
+				BufferUtil: len(s.registrationChannel),
+			},
+			Rooms: len(snap.messengers),
+		})
+
+		//each shard has the rooms that hash to it, and a copy of the '*' registrations
+		for k, v := range snap.messengers {
+			if k == "*" && s.index != 0 {
+				continue
+			}
+
+			cur := []RegStatus{}
+			for i := range v {
+				cur = append(cur, n.getRegStatus(base.Messenger, v[i]))
+				tmpmessengers[v[i].ID] = true
+			}
+			toReturn.MessengerMappings[k] = cur
+		}
+
+		//every shard has a copy of the patterns, hubs, and repeaters
+		if s.index != 0 {
+			continue
 		}
-		toReturn.MessengerMappings[k] = cur
+
+		for pattern, v := range snap.patterns {
+			cur := []RegStatus{}
+			for i := range v {
+				cur = append(cur, n.getRegStatus(base.Messenger, v[i]))
+				tmpmessengers[v[i].ID] = true
+			}
+			toReturn.MessengerMappings[pattern] = cur
+		}
+
+		toReturn.Hubs = n.getRegistryStatus(base.Hub, snap.hubs)
+		toReturn.Repeaters = n.getRegistryStatus(base.Repeater, snap.repeaters)
 	}
 
-	toReturn.Hubs = getRegistryStatus(n.hubRegistry)
-	toReturn.Repeaters = getRegistryStatus(n.repeaterRegistry)
+	toReturn.RepeaterSelection = n.getRepeaterSelectionStatus()
+	toReturn.Interest = n.interest.getStatus()
+
+	toReturn.EventsReceived = n.received.get()
+	toReturn.HighPriorityEvents = atomic.LoadUint64(&n.highPriority)
+	toReturn.Registrations = n.registrations.get()
+	toReturn.Deregistrations = n.deregistrations.get()
+
+	toReturn.Loops = LoopStatus{
+		HubID:       n.id,
+		MaxHops:     n.maxHops,
+		Returned:    atomic.LoadUint64(&n.loops.returned),
+		Prevented:   atomic.LoadUint64(&n.loops.prevented),
+		TTLExceeded: atomic.LoadUint64(&n.loops.ttlExceeded),
+	}
+
+	if n.eventLog != nil {
+		l := n.eventLog.GetStatus()
+		toReturn.EventLog = &l
+	}
 
 	return toReturn
 }
 
-func getRegistryStatus(v []base.Registration) []RegStatus {
+func (n *Nexus) getRegistryStatus(connType string, v []base.Registration) []RegStatus {
 	toReturn := []RegStatus{}
 	for i := range v {
-		toReturn = append(toReturn, RegStatus{
-			ID:         v[i].ID,
-			BufferCap:  cap(v[i].Channel),
-			BufferUtil: len(v[i].Channel),
-		})
+		toReturn = append(toReturn, n.getRegStatus(connType, v[i]))
 	}
 	return toReturn
 }
+
+//getRegStatus returns the status of a registration, with its delivery counters summed across the shards
+func (n *Nexus) getRegStatus(connType string, r base.Registration) RegStatus {
+	policy, ok := n.overflow[connType]
+	if !ok {
+		policy = DefaultOverflowPolicy
+	}
+
+	delivery := DeliveryStatus{}
+	for _, s := range n.shards {
+		s.deliveryLock.RLock()
+		s.delivery[counterKey(connType, r.ID)].addTo(&delivery)
+		s.deliveryLock.RUnlock()
+	}
+
+	interest, _ := r.Interest.Rooms()
+
+	direction := ""
+	if connType == base.Hub {
+		direction = "inbound"
+		if r.Outbound {
+			direction = "outbound"
+		}
+	}
+
+	return RegStatus{
+		ID:         r.ID,
+		PeerID:     r.PeerID,
+		Addr:       r.Addr,
+		Identity:   r.Identity,
+		BufferCap:  cap(r.Channel),
+		BufferUtil: len(r.Channel),
+		Overflow:   policy.String(),
+		Delivery:   &delivery,
+		Interest:   interest,
+		Peer:       r.Peer,
+		Direction:  direction,
+
+		PriorityBufferUtil: len(r.PriorityChannel),
+	}
+}
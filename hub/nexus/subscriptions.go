@@ -0,0 +1,215 @@
+package nexus
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/nerr"
+)
+
+//registrationRequest is a registration change on its way to the nexus. result is set if someone is waiting to hear what happened to it
+type registrationRequest struct {
+	base.RegistrationChange
+	result *changeResult
+}
+
+//changeResult collects what the shards did with a registration change. A nil result is ignored, so the nexus and the shards don't have to check if anyone is waiting
+type changeResult struct {
+	wg sync.WaitGroup
+
+	lock              sync.Mutex
+	rejected          map[string]string
+	subscriptions     []base.Subscription
+	snapshotTruncated int
+}
+
+//ChangeReport is what the nexus did with a registration change
+type ChangeReport struct {
+	//Rejected holds the rooms that couldn't be subscribed to, and why
+	Rejected map[string]string
+
+	//SnapshotTruncated is how many cached events were left out of the snapshot the change asked for, because the messenger didn't take them within SnapshotTimeout
+	SnapshotTruncated int
+}
+
+//newChangeResult returns a result that's done once the nexus, and every shard it hands the change to, have called done
+func newChangeResult() *changeResult {
+	c := &changeResult{
+		rejected: make(map[string]string),
+	}
+	c.wg.Add(1)
+	return c
+}
+
+//add is called before the change is handed to a shard
+func (c *changeResult) add() {
+	if c == nil {
+		return
+	}
+	c.wg.Add(1)
+}
+
+func (c *changeResult) done() {
+	if c == nil {
+		return
+	}
+	c.wg.Done()
+}
+
+//reject records why the room wasn't subscribed to
+func (c *changeResult) reject(room, reason string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rejected[room] = reason
+}
+
+//rejectAll rejects every room in the change
+func (c *changeResult) rejectAll(rooms []string, reason string) {
+	for _, room := range rooms {
+		c.reject(room, reason)
+	}
+}
+
+//truncateSnapshot records the cached events left out of the snapshot
+func (c *changeResult) truncateSnapshot(count int) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.snapshotTruncated += count
+}
+
+func (c *changeResult) addSubscriptions(subs ...base.Subscription) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscriptions = append(c.subscriptions, subs...)
+}
+
+//wait waits up to the timeout for the change to be applied
+func (c *changeResult) wait(timeout time.Duration, stop chan struct{}) *nerr.E {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+		return nerr.Create("timed out waiting for the registration change to be applied", "timeout")
+	case <-stop:
+		return nerr.Create("the hub has stopped", "stopped")
+	}
+}
+
+//SubmitRegistrationChangeAndWait submits the change like SubmitRegistrationChange, and then waits up to the timeout for it to be applied. Returns the rooms that couldn't be subscribed to, and why
+func (n *Nexus) SubmitRegistrationChangeAndWait(r base.RegistrationChange, timeout time.Duration) (map[string]string, *nerr.E) {
+	report, err := n.SubmitRegistrationChangeAndReport(r, timeout)
+	return report.Rejected, err
+}
+
+//SubmitRegistrationChangeAndReport is SubmitRegistrationChangeAndWait, but returns everything the nexus did with the change
+func (n *Nexus) SubmitRegistrationChangeAndReport(r base.RegistrationChange, timeout time.Duration) (ChangeReport, *nerr.E) {
+	result := newChangeResult()
+	n.submitRegistration(registrationRequest{
+		RegistrationChange: r,
+		result:             result,
+	})
+
+	if err := result.wait(timeout, n.stop); err != nil {
+		return ChangeReport{}, err
+	}
+
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	return ChangeReport{
+		Rejected:          result.rejected,
+		SnapshotTruncated: result.snapshotTruncated,
+	}, nil
+}
+
+//Subscriptions returns the rooms (and patterns) the messenger is subscribed to, sorted by room. It goes through the same queue as the registration changes, so every change submitted before it has been applied
+func (n *Nexus) Subscriptions(id string, timeout time.Duration) ([]base.Subscription, *nerr.E) {
+	result := newChangeResult()
+	n.submitRegistration(registrationRequest{
+		RegistrationChange: base.RegistrationChange{
+			Type: base.Messenger,
+			Registration: base.Registration{
+				ID: id,
+			},
+			SubscriptionChange: base.SubscriptionChange{
+				Control: base.ControlQuery,
+			},
+		},
+		result: result,
+	})
+
+	if err := result.wait(timeout, n.stop); err != nil {
+		return nil, err
+	}
+
+	result.lock.Lock()
+	defer result.lock.Unlock()
+
+	toReturn := append([]base.Subscription{}, result.subscriptions...)
+	sort.Slice(toReturn, func(i, j int) bool {
+		return toReturn[i].Room < toReturn[j].Room
+	})
+	return toReturn, nil
+}
+
+//querySubscriptions adds the messenger's subscriptions in this shard to the result. Every shard has a copy of the patterns and '*', so only the first shard adds them. Not threadsafe
+func (s *shard) querySubscriptions(id string, result *changeResult) {
+	subs := []base.Subscription{}
+	for _, room := range s.roomMessengerIndex[id] {
+		var r base.Registration
+		var ok bool
+
+		if room == "*" || IsRoomPattern(room) {
+			if s.index != 0 {
+				continue
+			}
+		}
+
+		if IsRoomPattern(room) {
+			r, ok = s.patterns.get(room, id)
+		} else {
+			r, ok = findRegistration(s.messengerRegistry[room], id)
+		}
+		if !ok {
+			continue
+		}
+
+		subs = append(subs, base.Subscription{
+			Room:   room,
+			Filter: r.ContentFilter.String(),
+		})
+	}
+
+	result.addSubscriptions(subs...)
+}
+
+func findRegistration(v []base.Registration, id string) (base.Registration, bool) {
+	for i := range v {
+		if v[i].ID == id {
+			return v[i], true
+		}
+	}
+	return base.Registration{}, false
+}
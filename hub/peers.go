@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//defaultPeerCheckInterval is how often the peer file is checked for changes, unless HUB_PEERS_RELOAD_INTERVAL says otherwise
+const defaultPeerCheckInterval = 10 * time.Second
+
+//Peer is a hub this hub keeps an interconnection with
+type Peer struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+
+	//Retry is how long to wait between attempts to connect, the durations are strings like 2s or 1m
+	Retry *struct {
+		Initial string `json:"initial,omitempty"`
+		Max     string `json:"max,omitempty"`
+	} `json:"retry,omitempty"`
+}
+
+//PeerSet is the format of the peer file
+type PeerSet struct {
+	Peers []Peer `json:"peers"`
+}
+
+//managedPeer is a peer in the peer file, whether or not the manager added its link
+type managedPeer struct {
+	Peer
+	retry hubconn.RetryPolicy
+}
+
+//PeerManager keeps a hub link (see hubconn.AddLink) to each of the peers in the peer file, and follows the changes to the file
+type PeerManager struct {
+	path string
+	n    *nexus.Nexus
+	conf *hubconn.Config
+
+	lock    sync.Mutex
+	peers   map[string]*managedPeer //keyed on link address
+	modTime time.Time
+}
+
+//NewPeerManager returns a manager for the peers in the file at path
+func NewPeerManager(path string, n *nexus.Nexus, conf *hubconn.Config) *PeerManager {
+	return &PeerManager{
+		path:  path,
+		n:     n,
+		conf:  conf,
+		peers: make(map[string]*managedPeer),
+	}
+}
+
+//LoadPeers reads and checks a peer file
+func LoadPeers(path string) ([]Peer, *nerr.E) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't read peers from %v", path)
+	}
+
+	var set PeerSet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, nerr.Translate(err).Addf("couldn't parse peers in %v", path)
+	}
+
+	for i := range set.Peers {
+		if len(set.Peers[i].Address) == 0 {
+			return nil, nerr.Create(fmt.Sprintf("peer #%v in %v has no address", i, path), "invalid")
+		}
+		if _, err := set.Peers[i].policy(); err != nil {
+			return nil, err.Addf("invalid peers in %v", path)
+		}
+	}
+
+	return set.Peers, nil
+}
+
+//policy returns the peer's retry policy, filling in the defaults
+func (p Peer) policy() (hubconn.RetryPolicy, *nerr.E) {
+	toReturn := hubconn.DefaultRetryPolicy
+	if p.Retry == nil {
+		return toReturn, nil
+	}
+
+	for _, v := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{p.Retry.Initial, &toReturn.Initial},
+		{p.Retry.Max, &toReturn.Max},
+	} {
+		if len(v.s) == 0 {
+			continue
+		}
+
+		d, err := time.ParseDuration(v.s)
+		if err != nil || d <= 0 {
+			return toReturn, nerr.Create(fmt.Sprintf("peer %v: invalid retry duration %v", p, v.s), "invalid")
+		}
+		*v.d = d
+	}
+
+	if toReturn.Max < toReturn.Initial {
+		toReturn.Max = toReturn.Initial
+	}
+	return toReturn, nil
+}
+
+func (p Peer) String() string {
+	if len(p.Name) > 0 {
+		return fmt.Sprintf("%v (%v)", p.Name, p.Address)
+	}
+	return p.Address
+}
+
+//Watch loads the peer file, then reloads it when it changes (checking every interval) or when reload is signaled. It doesn't return
+func (m *PeerManager) Watch(interval time.Duration, reload <-chan struct{}) {
+	if err := m.Reload(true); err != nil {
+		log.L.Errorf("Couldn't load the hub peers: %v", err.Error())
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ticker.C:
+		case <-reload:
+			force = true
+		}
+
+		if err := m.Reload(force); err != nil {
+			log.L.Warnf("Couldn't reload the hub peers, keeping the current ones: %v", err.Error())
+		}
+	}
+}
+
+//Reload reads the peer file if it has changed since it was last read (or always, if force is set), and removes the links to the peers that were removed.
+//A peer whose retry policy changed is reconnected. A peer without a link gets one on every reload, so a peer that shares its address with a link added some other way (e.g. through the API) is linked once that link is removed.
+//Links added some other way are otherwise left alone. If the file can't be read the current peers are kept
+func (m *PeerManager) Reload(force bool) *nerr.E {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return nerr.Translate(err).Addf("couldn't read peers from %v", m.path)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if force || !info.ModTime().Equal(m.modTime) {
+		peers, lerr := LoadPeers(m.path)
+		if lerr != nil {
+			return lerr
+		}
+		m.modTime = info.ModTime()
+
+		m.update(peers)
+		log.L.Infof("Loaded %v hub peers from %v", len(m.peers), m.path)
+	}
+
+	for addr, p := range m.peers {
+		if _, ok := hubconn.GetLink(addr, m.conf); ok {
+			continue
+		}
+
+		log.L.Infof("Opening hub interconnection with %v", p)
+		if _, _, err := hubconn.AddLink(addr, p.Name, hubconn.LinkSourceFile, p.retry, m.n, m.conf); err != nil {
+			log.L.Warnf("Couldn't add a link to %v: %v", p, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//update replaces the peers with the ones from the file, removing the links the manager added for the peers that were removed or whose retry policy changed. Hold lock to call it
+func (m *PeerManager) update(peers []Peer) {
+	wanted := make(map[string]*managedPeer, len(peers))
+	for i := range peers {
+		addr, aerr := hubconn.LinkAddress(peers[i].Address, m.conf)
+		if aerr != nil {
+			log.L.Warnf("Skipping peer %v: %v", peers[i], aerr.Error())
+			continue
+		}
+		if _, ok := wanted[addr]; ok {
+			log.L.Warnf("Peer %v is listed more than once, using the first one", peers[i])
+			continue
+		}
+
+		p := &managedPeer{
+			Peer: peers[i],
+		}
+		p.retry, _ = p.policy()
+		wanted[addr] = p
+	}
+
+	for addr, cur := range m.peers {
+		if p, ok := wanted[addr]; ok && p.retry == cur.retry {
+			continue
+		}
+
+		if status, ok := hubconn.GetLink(addr, m.conf); ok && status.Source == hubconn.LinkSourceFile {
+			log.L.Infof("Closing hub interconnection with %v", cur)
+			if _, err := hubconn.RemoveLink(addr, m.conf); err != nil {
+				log.L.Warnf("Couldn't remove the link to %v: %v", cur, err.Error())
+			}
+		}
+	}
+
+	for addr, p := range wanted {
+		if _, ok := hubconn.GetLink(addr, m.conf); ok {
+			if _, tracked := m.peers[addr]; !tracked {
+				log.L.Infof("There's already a link to %v, it's linked by the peer file once that link is removed", p)
+			}
+		}
+	}
+
+	m.peers = wanted
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/nexus"
+)
+
+//nobody listens on these, so the links keep retrying
+const (
+	peerA = "ws://127.0.0.1:1"
+	peerB = "ws://127.0.0.1:2"
+	peerC = "ws://127.0.0.1:3"
+)
+
+//testPeerManager returns a manager for a peer file in a temporary directory, and a function that writes the file
+func testPeerManager(t *testing.T) (*PeerManager, func(string)) {
+	n, err := nexus.New(nexus.DefaultOptions())
+	if err != nil {
+		t.Fatalf("couldn't build the nexus: %v", err.Error())
+	}
+	conf, err := hubconn.NewConfig(hubconn.Options{})
+	if err != nil {
+		t.Fatalf("couldn't build the config: %v", err.Error())
+	}
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	t.Cleanup(func() {
+		for _, l := range hubconn.GetLinks() {
+			hubconn.RemoveLink(l.Address, conf)
+		}
+	})
+
+	//each write gets a newer modification time, even if the file system only keeps whole seconds
+	modTime := time.Now()
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatalf("couldn't write the peer file: %v", err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("couldn't set the peer file's time: %v", err)
+		}
+	}
+
+	return NewPeerManager(path, n, conf), write
+}
+
+//links returns the source of each link, keyed on address
+func links() map[string]string {
+	toReturn := make(map[string]string)
+	for _, l := range hubconn.GetLinks() {
+		toReturn[l.Address] = l.Source
+	}
+	return toReturn
+}
+
+func reload(t *testing.T, m *PeerManager) {
+	if err := m.Reload(false); err != nil {
+		t.Fatalf("couldn't reload: %v", err.Error())
+	}
+}
+
+func TestPeerReload(t *testing.T) {
+	m, write := testPeerManager(t)
+	file := hubconn.LinkSourceFile
+
+	//a peer listed twice, once in another form, only gets one link
+	write(`{"peers": [
+		{"name": "a", "address": "127.0.0.1:1"},
+		{"name": "b", "address": "ws://127.0.0.1:2"},
+		{"name": "a-again", "address": "ws://127.0.0.1:1/"}
+	]}`)
+	reload(t, m)
+	if got, want := links(), map[string]string{peerA: file, peerB: file}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got links %v, want %v", got, want)
+	}
+	if status, _ := hubconn.GetLink(peerA, m.conf); status.Name != "a" {
+		t.Fatalf("got the link named %q, want the first one listed", status.Name)
+	}
+
+	//a removed peer's link is removed
+	write(`{"peers": [{"name": "b", "address": "127.0.0.1:2"}]}`)
+	reload(t, m)
+	if got, want := links(), map[string]string{peerB: file}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got links %v after removing a peer, want %v", got, want)
+	}
+
+	//a changed retry policy reconnects the peer with the new policy
+	write(`{"peers": [{"name": "b", "address": "127.0.0.1:2", "retry": {"initial": "5s", "max": "1m"}}]}`)
+	reload(t, m)
+	if status, ok := hubconn.GetLink(peerB, m.conf); !ok || status.Retry.Initial != "5s" || status.Retry.Max != "1m0s" {
+		t.Fatalf("got link %+v, want it retried with the new policy", status)
+	}
+
+	//a file that can't be read keeps the peers it has
+	for _, bad := range []string{
+		`{"peers": [`,
+		`{"peers": [{"name": "no-address"}]}`,
+		`{"peers": [{"address": "127.0.0.1:3", "retry": {"initial": "soon"}}]}`,
+	} {
+		write(bad)
+		if err := m.Reload(false); err == nil {
+			t.Fatalf("%v was loaded", bad)
+		}
+		if got, want := links(), map[string]string{peerB: file}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got links %v after a bad file, want %v", got, want)
+		}
+	}
+}
+
+//TestPeerWithAnotherLink checks a peer whose address already has a link is linked once that link is removed, and that the other link is left alone
+func TestPeerWithAnotherLink(t *testing.T) {
+	m, write := testPeerManager(t)
+
+	if _, _, err := hubconn.AddLink(peerC, "", hubconn.LinkSourceAPI, hubconn.DefaultRetryPolicy, m.n, m.conf); err != nil {
+		t.Fatalf("couldn't add the link: %v", err.Error())
+	}
+
+	write(`{"peers": [{"address": "127.0.0.1:3"}]}`)
+	reload(t, m)
+	if got := links()[peerC]; got != hubconn.LinkSourceAPI {
+		t.Fatalf("the link is from %q, want it left alone", got)
+	}
+
+	//the file hasn't changed, but the peer is linked once the other link is gone
+	hubconn.RemoveLink(peerC, m.conf)
+	reload(t, m)
+	if got := links()[peerC]; got != hubconn.LinkSourceFile {
+		t.Fatalf("the link is from %q after the other link was removed, want %q", got, hubconn.LinkSourceFile)
+	}
+
+	//removing a peer doesn't remove a link that the file didn't add
+	hubconn.RemoveLink(peerC, m.conf)
+	hubconn.AddLink(peerC, "", hubconn.LinkSourceAPI, hubconn.DefaultRetryPolicy, m.n, m.conf)
+	write(`{"peers": []}`)
+	reload(t, m)
+	if got := links()[peerC]; got != hubconn.LinkSourceAPI {
+		t.Fatalf("the link is from %q after the peer was removed, want it left alone", got)
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/byuoitav/central-event-system/hub/auth"
 	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/certs"
+	"github.com/byuoitav/central-event-system/hub/discovery"
+	"github.com/byuoitav/central-event-system/hub/eventlog"
 	"github.com/byuoitav/central-event-system/hub/hubconn"
+	"github.com/byuoitav/central-event-system/hub/metrics"
 	"github.com/byuoitav/central-event-system/hub/nexus"
 	"github.com/byuoitav/common"
 	"github.com/byuoitav/common/log"
@@ -17,24 +27,187 @@ import (
 )
 
 func main() {
-	port := ":7100"
+	port := 7100
+	if v, err := strconv.Atoi(os.Getenv("HUB_PORT")); err == nil && v > 0 {
+		port = v
+	}
+
+	opts, nerr := nexus.OptionsFromEnv()
+	if nerr != nil {
+		log.L.Fatalf("Invalid nexus configuration: %v", nerr.Error())
+	}
+
+	n, nerr := nexus.New(opts)
+	if nerr != nil {
+		log.L.Fatalf("Couldn't build the nexus: %v", nerr.Error())
+	}
+	n.Start()
+
+	limits, nerr := hubconn.LimitsFromEnv()
+	if nerr != nil {
+		log.L.Fatalf("Invalid connection limits: %v", nerr.Error())
+	}
+
+	authenticator, nerr := auth.FromEnv()
+	if nerr != nil {
+		log.L.Fatalf("Invalid authentication configuration: %v", nerr.Error())
+	}
+
+	certStore, nerr := certs.FromEnv()
+	if nerr != nil {
+		log.L.Fatalf("Invalid TLS configuration: %v", nerr.Error())
+	}
+
+	//the version is sent to the other hubs in the hello
+	version, err := status.GetMicroserviceVersion()
+	if err != nil {
+		log.L.Warnf("Couldn't read the hub's version: %v", err.Error())
+	}
 
-	nexus.StartNexus()
+	conf, nerr := hubconn.NewConfig(hubconn.Options{
+		Limits:        limits,
+		Authenticator: authenticator,
+		Credentials:   auth.CredentialsFromEnv(n.ID()),
+		Certificates:  certStore,
+		Version:       version,
+	})
+	if nerr != nil {
+		log.L.Fatalf("Invalid connection limits: %v", nerr.Error())
+	}
 
 	// if this hub is in a room, create an interconnection with the rest of the hubs in the room
-	if len(os.Getenv("ROOM_SYSTEM")) > 0 {
-		addresses := GetHubAddresses()
+	var discoverer *discovery.Discoverer
+	if opts.RoomSystem {
+		fromDB, multicast := discoveryModes()
+
+		linkRoomHubs := func() {
+			addresses := GetHubAddresses(certStore.Scheme())
 
-		for i := range addresses {
-			log.L.Infof("Opening hub interconnection with %v", addresses[i])
-			go hubconn.OpenConnectionWithRetry(addresses[i], "/connect/hub", base.Hub, nexus.N)
+			for i := range addresses {
+				log.L.Infof("Opening hub interconnection with %v", addresses[i])
+				if _, _, err := hubconn.AddLink(addresses[i], "", hubconn.LinkSourceRoom, hubconn.DefaultRetryPolicy, n, conf); err != nil {
+					log.L.Warnf("Couldn't add a link to %v: %v", addresses[i], err.Error())
+				}
+			}
+		}
+
+		if multicast {
+			o, nerr := discovery.OptionsFromEnv()
+			if nerr == nil {
+				discoverer, nerr = DiscoverHubs(o, port, certStore.Scheme(), n, conf)
+			}
+			if nerr != nil {
+				log.L.Fatalf("Couldn't start discovering hubs: %v", nerr.Error())
+			}
+		}
+
+		switch {
+		case fromDB && multicast:
+			//the database may not have replicated, so don't wait on it to start serving
+			go linkRoomHubs()
+		case fromDB:
+			linkRoomHubs()
 		}
 	}
 
+	//hubs listed in the peer file are kept connected, and the file is reloaded when it changes or on SIGHUP
+	reload := make(chan struct{}, 1)
+	if path := os.Getenv("HUB_PEERS_FILE"); len(path) > 0 {
+		interval := defaultPeerCheckInterval
+		if v := os.Getenv("HUB_PEERS_RELOAD_INTERVAL"); len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.L.Fatalf("Invalid HUB_PEERS_RELOAD_INTERVAL %v", v)
+			}
+			interval = d
+		}
+
+		go NewPeerManager(path, n, conf).Watch(interval, reload)
+	}
+	go reloadOnHangup(certStore, reload)
+
 	router := common.NewRouter()
 
-	router.GET("/status", Status)
-	router.GET("/connect/:type", func(context echo.Context) error {
+	router.GET("/status", Status(n, conf, certStore, discoverer))
+	router.GET("/metrics", echo.WrapHandler(metrics.Handler(n, conf)))
+	router.GET("/rules", Rules(n))
+	router.GET("/log", Log(n, conf))
+	router.GET("/connect/:type", Connect(n, conf))
+
+	//changing the links needs the credentials of a hub
+	requireHub := RequireHub(conf)
+	router.GET("/links", GetLinks())
+	router.POST("/links", AddLink(n, conf), requireHub)
+	router.DELETE("/links/:address", RemoveLink(conf), requireHub)
+	router.POST("/interconnect/:address", func(context echo.Context) error {
+		return CreateInterconnection(context, n, conf)
+	}, requireHub)
+
+	router.POST("/event", Event(n, conf))
+
+	go func() {
+		err := certs.Start(router, ":"+strconv.Itoa(port), certStore)
+		if err != nil && err != http.ErrServerClosed {
+			log.L.Fatalf("Couldn't start the hub: %v", err.Error())
+		}
+	}()
+
+	shutdown(router, n)
+}
+
+//reloadOnHangup reloads the TLS certificates and the peer file each time the hub gets a SIGHUP
+func reloadOnHangup(certStore *certs.Store, reload chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.L.Infof("Received SIGHUP, reloading")
+		if certStore != nil {
+			if err := certStore.Reload(); err != nil {
+				log.L.Warnf("Couldn't reload the TLS certificates, still using the old ones: %v", err.Error())
+			}
+		}
+
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//shutdown waits for SIGTERM (or an interrupt), and then shuts the hub down: new connections and events are turned away, the nexus is drained, and every connection is closed with a going away close frame so the peers reconnect right away.
+func shutdown(router *echo.Echo, n *nexus.Nexus) {
+	timeout := 10 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("HUB_DRAIN_TIMEOUT")); err == nil {
+		timeout = v
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+
+	log.L.Infof("Received %v, shutting down...", s)
+
+	n.Stop(timeout)
+	hubconn.CloseAll(hubconn.GoingAwayReason, hubconn.WriteWait)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hubconn.WriteWait)
+	defer cancel()
+
+	if err := router.Shutdown(ctx); err != nil {
+		log.L.Warnf("Couldn't shut down the http server: %v", err.Error())
+	}
+
+	log.L.Infof("Done.")
+}
+
+// Connect upgrades the request to a websocket, and registers it with the nexus
+func Connect(n *nexus.Nexus, conf *hubconn.Config) echo.HandlerFunc {
+	return func(context echo.Context) error {
+		if n.Draining() {
+			return context.String(http.StatusServiceUnavailable, "the hub is shutting down")
+		}
+
 		t := context.Param("type")
 		switch t {
 		case base.Messenger, base.Repeater, base.Hub:
@@ -43,79 +216,216 @@ func main() {
 			return context.String(http.StatusBadRequest, "invalid connection type")
 		}
 
-		err := hubconn.CreateConnection(context.Response().Writer, context.Request(), t, nexus.N)
+		err := hubconn.CreateConnection(context.Response(), context.Request(), t, n, conf)
 		if err != nil {
+			//the connection was turned away, or the upgrade already failed
+			if context.Response().Committed {
+				return nil
+			}
 			return context.JSON(http.StatusInternalServerError, err.Error())
 		}
 
 		return nil
-	})
+	}
+}
 
-	router.POST("/interconnect/:address", func(context echo.Context) error {
-		return CreateInterconnection(context, nexus.N)
-	})
+// Status returns the status of the hub
+func Status(n *nexus.Nexus, conf *hubconn.Config, certStore *certs.Store, discoverer *discovery.Discoverer) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		log.L.Debugf("Status request from %v", ctx.Request().RemoteAddr)
 
-	router.POST("/event", Event)
+		var s status.Status
+		var err error
 
-	router.Start(port)
-}
+		s.Info = map[string]interface{}{}
+		s.Bin = os.Args[0]
+		s.Info = make(map[string]interface{})
+		s.Uptime = status.GetProgramUptime().String()
 
-// Status returns the status of the hub
-func Status(ctx echo.Context) error {
-	log.L.Debugf("Status request from %v", ctx.Request().RemoteAddr)
+		s.Version, err = status.GetMicroserviceVersion()
+		if err != nil {
+			s.Info["error"] = "failed to open version.txt"
+			s.StatusCode = status.Sick
 
-	var s status.Status
-	var err error
+			return ctx.JSON(http.StatusInternalServerError, s)
+		}
 
-	s.Info = map[string]interface{}{}
-	s.Bin = os.Args[0]
-	s.Info = make(map[string]interface{})
-	s.Uptime = status.GetProgramUptime().String()
+		s.Info["nexus"] = n.GetStatus()
+		s.Info["connections"] = hubconn.GetConnectionCounts()
+		s.Info["limits"] = conf.GetLimitStatus()
+		if certStore != nil {
+			s.Info["tls"] = certStore.GetStatus()
+		}
+		if discoverer != nil {
+			s.Info["discovery"] = discoverer.GetStatus()
+		}
+		s.StatusCode = status.Healthy
 
-	s.Version, err = status.GetMicroserviceVersion()
-	if err != nil {
-		s.Info["error"] = "failed to open version.txt"
-		s.StatusCode = status.Sick
+		return ctx.JSON(http.StatusOK, s)
+	}
+}
 
-		return ctx.JSON(http.StatusInternalServerError, s)
+// Rules returns the routing rules the hub is using
+func Rules(n *nexus.Nexus) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, nexus.RuleSet{
+			Rules: n.Rules(),
+		})
 	}
+}
 
-	s.Info["nexus"] = nexus.N.GetStatus()
-	s.StatusCode = status.Healthy
+// Log streams the records in the event log that match the query, one json record per line, to a client with a messenger's credentials. The query parameters are
+//	room   the room to replay, or a pattern ending in '*'. Defaults to every room
+//	from   the first offset to replay
+//	since  an RFC3339 time, records from before it are skipped
+//	limit  the most records to send
+func Log(n *nexus.Nexus, conf *hubconn.Config) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		//the log is the same events a messenger could subscribe to, so reading it needs the same credentials
+		if _, nerr := conf.Authenticate(ctx.Request(), base.Messenger); nerr != nil {
+			return unauthorized(ctx)
+		}
 
-	return ctx.JSON(http.StatusOK, s)
-}
+		q := eventlog.Query{
+			Room: ctx.QueryParam("room"),
+		}
 
-// Event sends an event to the hub using an http endpoint instead of a messenger
-func Event(c echo.Context) error {
-	var e events.Event
-	req := c.Request()
+		var err error
+		if v := ctx.QueryParam("from"); len(v) > 0 {
+			if q.From, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return ctx.String(http.StatusBadRequest, "invalid offset: "+err.Error())
+			}
+		}
+		if v := ctx.QueryParam("since"); len(v) > 0 {
+			if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				return ctx.String(http.StatusBadRequest, "invalid time: "+err.Error())
+			}
+		}
 
-	eventBytes, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		log.L.Warnf("unable to read body: " + err.Error())
-		return c.String(http.StatusBadRequest, "unable to read body: "+err.Error())
-	}
+		limit := -1
+		if v := ctx.QueryParam("limit"); len(v) > 0 {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+				return ctx.String(http.StatusBadRequest, "invalid limit")
+			}
+		}
+
+		if !n.HasEventLog() {
+			return ctx.String(http.StatusNotFound, "the event log is turned off")
+		}
 
-	log.L.Debugf("Submitting event from %s: %s", c.Request().RemoteAddr, eventBytes)
+		log.L.Infof("Replaying the event log for %v from %v", ctx.Request().RemoteAddr, ctx.QueryString())
 
-	err = json.Unmarshal(eventBytes, &e)
-	if err != nil {
-		log.L.Warnf("unable to unmarshal body: " + err.Error())
-		return c.String(http.StatusBadRequest, "unable to unmarshal body: "+err.Error())
+		resp := ctx.Response()
+		resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		resp.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(resp)
+		count := 0
+		nerr := n.Replay(q, func(rec eventlog.Record) bool {
+			if limit >= 0 && count >= limit {
+				return false
+			}
+			if err := enc.Encode(rec); err != nil {
+				//the client went away
+				return false
+			}
+
+			count++
+			if count%100 == 0 {
+				resp.Flush()
+			}
+			return true
+		})
+		if nerr != nil {
+			log.L.Warnf("Replay of the event log failed: %v", nerr.Error())
+		}
+
+		resp.Flush()
+		return nil
 	}
+}
+
+// defaultWaitTimeout is how long a synchronous POST /event waits for the event to be routed, unless the request asks for something else
+const defaultWaitTimeout = 5 * time.Second
+
+// maxWaitTimeout is the longest a synchronous POST /event waits, so a request can't hold a handler for longer than this no matter what timeout it asks for
+const maxWaitTimeout = 30 * time.Second
+
+// Event sends an event to the hub using an http endpoint instead of a messenger.
+// If the wait query parameter or the X-Event-Wait header is true, it waits up to timeout (a duration, e.g. 2s, at most maxWaitTimeout) for the event to be routed, and returns its delivery report.
+func Event(n *nexus.Nexus, conf *hubconn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if n.Draining() {
+			return c.String(http.StatusServiceUnavailable, "the hub is shutting down")
+		}
+
+		var e events.Event
+		req := c.Request()
 
-	nerr := nexus.N.Submit(
-		base.EventWrapper{
+		//events posted here are treated like they came from a messenger, so they need the same credentials
+		if _, err := conf.Authenticate(req, base.Messenger); err != nil {
+			return unauthorized(c)
+		}
+
+		eventBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.L.Warnf("unable to read body: " + err.Error())
+			return c.String(http.StatusBadRequest, "unable to read body: "+err.Error())
+		}
+
+		log.L.Debugf("Submitting event from %s: %s", c.Request().RemoteAddr, eventBytes)
+
+		err = json.Unmarshal(eventBytes, &e)
+		if err != nil {
+			log.L.Warnf("unable to unmarshal body: " + err.Error())
+			return c.String(http.StatusBadRequest, "unable to unmarshal body: "+err.Error())
+		}
+
+		wrapper := base.EventWrapper{
 			Room:  e.AffectedRoom.RoomID,
 			Event: eventBytes,
-		},
-		base.Messenger,
-		req.RemoteAddr+base.Messenger)
-	if nerr != nil {
-		log.L.Warnf("unable to submit event: " + nerr.Error())
-		return c.String(http.StatusInternalServerError, "unable to submit event: "+nerr.Error())
+		}
+
+		wait, _ := strconv.ParseBool(c.QueryParam("wait"))
+		if v := req.Header.Get("X-Event-Wait"); len(v) > 0 {
+			wait, _ = strconv.ParseBool(v)
+		}
+
+		if wait {
+			timeout := defaultWaitTimeout
+			if v := c.QueryParam("timeout"); len(v) > 0 {
+				timeout, err = time.ParseDuration(v)
+				if err != nil || timeout <= 0 {
+					return c.String(http.StatusBadRequest, "invalid timeout")
+				}
+				if timeout > maxWaitTimeout {
+					timeout = maxWaitTimeout
+				}
+			}
+
+			report, err := n.SubmitAndWait(wrapper, base.Messenger, req.RemoteAddr+base.Messenger, timeout)
+			switch {
+			case err != nil && err.Type == "timeout":
+				return c.String(http.StatusGatewayTimeout, err.Error())
+			case err != nil:
+				log.L.Warnf("unable to submit event: " + err.Error())
+				return c.String(http.StatusInternalServerError, "unable to submit event: "+err.Error())
+			}
+
+			return c.JSON(http.StatusOK, report)
+		}
+
+		if err := n.Submit(wrapper, base.Messenger, req.RemoteAddr+base.Messenger); err != nil {
+			log.L.Warnf("unable to submit event: " + err.Error())
+			return c.String(http.StatusInternalServerError, "unable to submit event: "+err.Error())
+		}
+
+		return c.String(http.StatusOK, "Processing event")
 	}
+}
 
-	return c.String(http.StatusOK, "Processing event")
+// unauthorized turns away a request that didn't have the credentials it needed
+func unauthorized(ctx echo.Context) error {
+	ctx.Response().Header().Set("WWW-Authenticate", auth.SchemeBearer+", "+auth.SchemeHMAC)
+	return ctx.String(http.StatusUnauthorized, "unauthorized")
 }
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/byuoitav/central-event-system/hub/auth"
 	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/certs"
 	"github.com/byuoitav/central-event-system/hub/hubconn"
 	"github.com/byuoitav/common/log"
 	"github.com/byuoitav/common/nerr"
@@ -21,17 +25,36 @@ const (
 	retryInterval = 3 * time.Second
 )
 
+//subscription is how a room was subscribed to, so it can be subscribed to the same way after a reconnect
+type subscription struct {
+	filter   string
+	snapshot bool
+}
+
 //Messenger is the connection from this receiver to a hub
 type Messenger struct {
 	HubAddr        string
 	ConnectionType string
 
-	subscriptionList    map[string]bool
+	subscriptionList    map[string]subscription //map of rooms to how they were subscribed
+	subLock             sync.Mutex
 	writeChannel        chan base.EventWrapper
 	subscriptionChannel chan base.SubscriptionChange
 	readChannel         chan base.EventWrapper
 
-	conn *websocket.Conn
+	conn        *websocket.Conn
+	credentials auth.Credentials
+	certs       *certs.Store //certs has the CA bundle and client certificate for wss:// hubs, nil uses the system roots
+
+	//frameVersion is the frame version we write to the hub, accessed atomically
+	frameVersion int32
+
+	//answers is set if the hub answers subscription changes. pending holds the channels waiting on the answers, keyed on request ID, for up to timeout
+	answers     int32
+	requests    uint64
+	pending     map[string]chan base.ControlReply
+	pendingLock sync.Mutex
+	timeout     time.Duration
 
 	readDone     chan bool
 	writeDone    chan bool
@@ -72,44 +95,106 @@ func (h *Messenger) SetReceiveChannel(c chan base.EventWrapper) {
 	h.readChannel = c
 }
 
-//SubscribeToRooms .
-func (h *Messenger) SubscribeToRooms(r ...string) {
+//SubscribeToRooms subscribes to the rooms, and waits for the hub to acknowledge it. See subscribe for what happens when it fails
+func (h *Messenger) SubscribeToRooms(r ...string) *nerr.E {
+	return h.SubscribeToRoomsWithFilter("", r...)
+}
+
+//SubscribeToRoomsWithFilter subscribes to the rooms, but the hub will only send the events that match the filter. See the hub's filter package for the syntax.
+//Subscribing to a room again replaces its filter.
+func (h *Messenger) SubscribeToRoomsWithFilter(filter string, r ...string) *nerr.E {
+	return h.subscribe(subscription{filter: filter}, nil, r...)
+}
+
+//SubscribeToRoomsWithSnapshot subscribes to the rooms like SubscribeToRoomsWithFilter, and asks the hub to first send the last value of each device and key it has seen in the rooms.
+//The cached events have the Snapshot header set. Rooms subscribed to this way get a new snapshot whenever the messenger reconnects.
+func (h *Messenger) SubscribeToRoomsWithSnapshot(filter string, r ...string) *nerr.E {
+	return h.subscribe(subscription{filter: filter, snapshot: true}, nil, r...)
+}
+
+//SubscribeToRoomsWithReplay subscribes to the rooms like SubscribeToRoomsWithFilter, and asks the hub to send the events for them from its event log, starting at the offset and time in from.
+//The replayed events have the Offset header set, and may be interleaved with new events. The replay isn't repeated when the messenger reconnects.
+func (h *Messenger) SubscribeToRoomsWithReplay(from base.Replay, filter string, r ...string) *nerr.E {
+	return h.subscribe(subscription{filter: filter}, &from, r...)
+}
+
+//subscribe adds the rooms to the subscription list, and sends the subscription to the hub. If the hub answers subscription changes, it waits for the answer:
+//rooms the hub rejects are taken back out of the list, while rooms that failed for any other reason (e.g. a timeout, or the hub being unreachable) are kept, and subscribed to on the next reconcile
+func (h *Messenger) subscribe(sub subscription, replay *base.Replay, r ...string) *nerr.E {
 	if len(r) == 0 {
-		return
+		return nil
 	}
 
+	h.subLock.Lock()
 	for i := range r {
-		h.subscriptionList[r[i]] = true
+		h.subscriptionList[r[i]] = sub
 	}
+	h.subLock.Unlock()
+
+	reply, err := h.request(base.SubscriptionChange{
+		Rooms:    r,
+		Create:   true,
+		Filter:   sub.filter,
+		Snapshot: sub.snapshot,
+		Replay:   replay,
+	})
+	if err != nil {
+		if len(reply.Rejected) > 0 {
+			h.subLock.Lock()
+			for room := range reply.Rejected {
+				delete(h.subscriptionList, room)
+			}
+			h.subLock.Unlock()
+		}
 
-	h.subscriptionChannel <- base.SubscriptionChange{
-		Rooms:  r,
-		Create: true,
+		return err.Addf("couldn't subscribe to %v", r)
 	}
 
+	if reply.SnapshotTruncated > 0 {
+		log.L.Warnf("The hub left %v cached events out of the snapshot of %v", reply.SnapshotTruncated, r)
+	}
+	return nil
 }
 
-//UnsubscribeFromRooms .
-func (h *Messenger) UnsubscribeFromRooms(r ...string) {
+//UnsubscribeFromRooms removes the rooms from the subscription list, and waits for the hub to acknowledge it
+func (h *Messenger) UnsubscribeFromRooms(r ...string) *nerr.E {
 	if len(r) < 1 {
-		return
+		return nil
 	}
+
+	h.subLock.Lock()
 	for i := range r {
 		delete(h.subscriptionList, r[i])
 	}
+	h.subLock.Unlock()
 
-	h.subscriptionChannel <- base.SubscriptionChange{
+	if _, err := h.request(base.SubscriptionChange{
 		Rooms:  r,
 		Create: false,
+	}); err != nil {
+		return err.Addf("couldn't unsubscribe from %v", r)
 	}
+
+	return nil
 }
 
-//BuildMessenger starts a connection to the hub provided, and then returns the connection (messenger)
+//BuildMessenger starts a connection to the hub provided, and then returns the connection (messenger). The credentials for the hub are read from the environment, see auth.CredentialsFromEnv
 func BuildMessenger(HubAddress, connectionType string, bufferSize int) (*Messenger, *nerr.E) {
+	return BuildMessengerWithCredentials(HubAddress, connectionType, bufferSize, auth.CredentialsFromEnv(""))
+}
+
+//BuildMessengerWithCredentials starts a connection to the hub like BuildMessenger, sending the credentials each time it connects. nil credentials sends none.
+//A wss:// hub is verified with the CA bundle from the environment, and sent the client certificate from it, see certs.FromEnv
+func BuildMessengerWithCredentials(HubAddress, connectionType string, bufferSize int, credentials auth.Credentials) (*Messenger, *nerr.E) {
 	if len(HubAddress) == 0 {
 		return nil, nerr.Createf("error", "unable to build messenger - invalid hub address '%s'", HubAddress)
 	}
 
+	certStore, cerr := certs.FromEnv()
+	if cerr != nil {
+		return nil, cerr.Addf("unable to build messenger - invalid TLS configuration")
+	}
+
 	log.L.Infof("starting messenger with %v, connection type %v, buffer size %v", HubAddress, connectionType, bufferSize)
 	h := &Messenger{
 		HubAddr:             HubAddress,
@@ -119,7 +204,11 @@ func BuildMessenger(HubAddress, connectionType string, bufferSize int) (*Messeng
 		readChannel:         make(chan base.EventWrapper, bufferSize),
 		readDone:            make(chan bool, 1),
 		writeDone:           make(chan bool, 1),
-		subscriptionList:    map[string]bool{},
+		subscriptionList:    map[string]subscription{},
+		pending:             make(map[string]chan base.ControlReply),
+		timeout:             SubscriptionTimeout,
+		credentials:         credentials,
+		certs:               certStore,
 		killChan:            make(chan struct{}),
 	}
 
@@ -151,13 +240,31 @@ func (h *Messenger) openConnection() error {
 	dialer := &websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
 	}
+	if h.certs != nil {
+		dialer.TLSClientConfig = h.certs.ClientConfig()
+	}
 
-	conn, _, err := dialer.Dial(fmt.Sprintf("%s/connect/%s", h.HubAddr, h.ConnectionType), nil)
+	headers := base.FrameVersionHeaders()
+	if err := auth.SetCredentials(headers, h.credentials, h.ConnectionType); err != nil {
+		return err.Addf("couldn't set the credentials for %v", h.HubAddr)
+	}
+
+	conn, resp, err := dialer.Dial(fmt.Sprintf("%s/connect/%s", h.HubAddr, h.ConnectionType), headers)
 	if err != nil {
+		if resp != nil {
+			return nerr.Create(fmt.Sprintf("failed opening websocket with %v: %s (%v)", h.HubAddr, err, resp.Status), "connection-error")
+		}
 		return nerr.Create(fmt.Sprintf("failed opening websocket with %v: %s", h.HubAddr, err), "connection-error")
 	}
 
 	h.conn = conn
+	atomic.StoreInt32(&h.frameVersion, int32(base.NegotiateFrameVersion(resp.Header)))
+
+	answers := int32(0)
+	if len(resp.Header.Get(base.ControlHeader)) > 0 {
+		answers = 1
+	}
+	atomic.StoreInt32(&h.answers, answers)
 	return nil
 }
 
@@ -191,8 +298,10 @@ func (h *Messenger) retryConnection() {
 	go h.startReadPump()
 	go h.startWritePump()
 
-	//we need to resubscribe
-	h.SubscribeToRooms(h.getSubList()...)
+	//the hub doesn't know about us anymore, so we need to resubscribe
+	if err := h.Reconcile(); err != nil {
+		log.L.Warnf("[retry] Couldn't resubscribe to every room: %v", err.Error())
+	}
 }
 
 func (h *Messenger) startReadPump() {
@@ -248,6 +357,11 @@ func (h *Messenger) startReadPump() {
 				return
 			}
 
+			if t == websocket.TextMessage {
+				h.answer(b)
+				continue
+			}
+
 			if t != websocket.BinaryMessage {
 				log.L.Warnf("Unknown message type %v", t)
 				continue
@@ -260,6 +374,10 @@ func (h *Messenger) startReadPump() {
 				continue
 			}
 
+			if m.Header.Version > int(atomic.LoadInt32(&h.frameVersion)) {
+				atomic.StoreInt32(&h.frameVersion, int32(m.Header.Version))
+			}
+
 			h.readChannel <- m
 		}
 	}
@@ -293,7 +411,7 @@ func (h *Messenger) startWritePump() {
 				return
 			}
 
-			err := h.conn.WriteMessage(websocket.BinaryMessage, base.PrepareMessage(message))
+			err := h.conn.WriteMessage(websocket.BinaryMessage, base.EncodeMessage(message, int(atomic.LoadInt32(&h.frameVersion))))
 			if err != nil {
 				log.L.Errorf("Problem writing message to socket: %v", err.Error())
 				return
@@ -345,11 +463,15 @@ func (h *Messenger) GetState() interface{} {
 
 	values["subscription-list"] = h.getSubList()
 	values["state"] = h.state
+	values["frame-version"] = atomic.LoadInt32(&h.frameVersion)
 	values["last-ping-time"] = h.lastPingTime.Format(time.RFC3339)
 	return values
 }
 
 func (h *Messenger) getSubList() []string {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+
 	toReturn := []string{}
 	for k := range h.subscriptionList {
 		toReturn = append(toReturn, k)
@@ -0,0 +1,150 @@
+package messenger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/common/nerr"
+)
+
+//SubscriptionTimeout is how long the messenger waits for the hub to answer a subscription change
+const SubscriptionTimeout = 15 * time.Second
+
+//request sends a subscription change (or query) to the hub, and waits for the hub to answer it.
+//Hubs that don't answer subscription changes are sent it without a request ID, and it's treated as acknowledged right away
+func (h *Messenger) request(s base.SubscriptionChange) (base.ControlReply, *nerr.E) {
+	if atomic.LoadInt32(&h.answers) == 0 {
+		h.subscriptionChannel <- s
+		return base.ControlReply{Control: base.ControlAck}, nil
+	}
+
+	s.RequestID = strconv.FormatUint(atomic.AddUint64(&h.requests, 1), 10)
+	answer := make(chan base.ControlReply, 1)
+
+	h.pendingLock.Lock()
+	h.pending[s.RequestID] = answer
+	h.pendingLock.Unlock()
+
+	defer func() {
+		h.pendingLock.Lock()
+		delete(h.pending, s.RequestID)
+		h.pendingLock.Unlock()
+	}()
+
+	h.subscriptionChannel <- s
+
+	t := time.NewTimer(h.timeout)
+	defer t.Stop()
+
+	select {
+	case reply := <-answer:
+		return reply, reply.Err()
+	case <-t.C:
+		return base.ControlReply{}, nerr.Create(fmt.Sprintf("timed out waiting for the hub to answer request %v", s.RequestID), "timeout")
+	case <-h.killChan:
+		return base.ControlReply{}, nerr.Create("the messenger has been killed", "killed")
+	}
+}
+
+//answer hands a reply from the hub to the request waiting on it
+func (h *Messenger) answer(b []byte) {
+	var reply base.ControlReply
+	if err := json.Unmarshal(b, &reply); err != nil {
+		log.L.Warnf("Invalid control message received %s: %v", b, err.Error())
+		return
+	}
+
+	h.pendingLock.Lock()
+	answer, ok := h.pending[reply.RequestID]
+	h.pendingLock.Unlock()
+
+	if !ok {
+		log.L.Debugf("Nothing is waiting on the answer to request %v anymore", reply.RequestID)
+		return
+	}
+
+	select {
+	case answer <- reply:
+	default:
+	}
+}
+
+//HubSubscriptions asks the hub which rooms (and patterns) the messenger is subscribed to, and the filter on each
+func (h *Messenger) HubSubscriptions() ([]base.Subscription, *nerr.E) {
+	//to a hub that doesn't know about queries, a query looks like unsubscribing from everything
+	if atomic.LoadInt32(&h.answers) == 0 {
+		return nil, nerr.Create(fmt.Sprintf("hub %v doesn't answer subscription queries", h.HubAddr), "unsupported")
+	}
+
+	reply, err := h.request(base.SubscriptionChange{
+		Control: base.ControlQuery,
+	})
+	if err != nil {
+		return nil, err.Addf("couldn't get the subscriptions from hub %v", h.HubAddr)
+	}
+
+	return reply.Subscriptions, nil
+}
+
+//Reconcile makes the hub's subscriptions match the messenger's: it subscribes to the rooms the hub is missing (or has with a different filter), and unsubscribes from the ones the messenger no longer wants.
+//If the hub doesn't answer subscription queries, every room is subscribed to again instead. It's called whenever the messenger reconnects
+func (h *Messenger) Reconcile() *nerr.E {
+	h.subLock.Lock()
+	want := make(map[string]subscription, len(h.subscriptionList))
+	for room, sub := range h.subscriptionList {
+		want[room] = sub
+	}
+	h.subLock.Unlock()
+
+	have := make(map[string]string)
+	if atomic.LoadInt32(&h.answers) == 1 {
+		subs, err := h.HubSubscriptions()
+		if err != nil {
+			return err.Addf("couldn't reconcile subscriptions")
+		}
+
+		for _, sub := range subs {
+			have[sub.Room] = sub.Filter
+		}
+	}
+
+	//one subscription per filter
+	missing := make(map[subscription][]string)
+	count := 0
+	for room, sub := range want {
+		if filter, ok := have[room]; ok && filter == sub.filter {
+			continue
+		}
+		missing[sub] = append(missing[sub], room)
+		count++
+	}
+
+	extra := []string{}
+	for room := range have {
+		if _, ok := want[room]; !ok {
+			extra = append(extra, room)
+		}
+	}
+
+	if count > 0 || len(extra) > 0 {
+		log.L.Infof("Reconciling subscriptions with hub %v: subscribing to %v rooms, unsubscribing from %v", h.HubAddr, count, len(extra))
+	}
+
+	var toReturn *nerr.E
+	for sub, rooms := range missing {
+		if err := h.subscribe(sub, nil, rooms...); err != nil {
+			toReturn = err
+		}
+	}
+
+	if err := h.UnsubscribeFromRooms(extra...); err != nil {
+		toReturn = err
+	}
+
+	return toReturn
+}
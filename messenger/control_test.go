@@ -0,0 +1,277 @@
+package messenger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/gorilla/websocket"
+)
+
+//fakeHub keeps the subscriptions of the messengers connected to it, and answers their subscription changes
+type fakeHub struct {
+	*httptest.Server
+
+	//legacy hubs don't send ControlHeader, or answer anything
+	legacy bool
+
+	lock  sync.Mutex
+	subs  map[string]string //room to filter
+	conns []*websocket.Conn
+
+	//reject is the rooms the hub rejects, and why. silent makes it never answer
+	reject map[string]string
+	silent bool
+}
+
+func newFakeHub(t *testing.T, legacy bool) *fakeHub {
+	f := &fakeHub{
+		legacy: legacy,
+		subs:   make(map[string]string),
+		reject: make(map[string]string),
+	}
+
+	upgrader := websocket.Upgrader{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := http.Header{}
+		if !f.legacy {
+			header.Set(base.ControlHeader, base.ControlVersion)
+		}
+
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			t.Errorf("couldn't upgrade: %v", err)
+			return
+		}
+
+		f.lock.Lock()
+		f.conns = append(f.conns, conn)
+		f.lock.Unlock()
+
+		for {
+			msgType, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msgType != websocket.TextMessage {
+				continue
+			}
+
+			var s base.SubscriptionChange
+			if err := json.Unmarshal(b, &s); err != nil {
+				t.Errorf("couldn't parse the subscription change %s: %v", b, err)
+				return
+			}
+
+			reply, answer := f.apply(s)
+			if !answer {
+				continue
+			}
+
+			b, _ = json.Marshal(reply)
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+	}))
+
+	t.Cleanup(f.Close)
+	return f
+}
+
+//apply makes the change to the hub's subscriptions, and returns the answer to it if there is one
+func (f *fakeHub) apply(s base.SubscriptionChange) (base.ControlReply, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	reply := base.ControlReply{RequestID: s.RequestID, Control: base.ControlAck}
+	switch {
+	case s.Control == base.ControlQuery:
+		for room, filter := range f.subs {
+			reply.Subscriptions = append(reply.Subscriptions, base.Subscription{Room: room, Filter: filter})
+		}
+	case s.Create:
+		for _, room := range s.Rooms {
+			if why, ok := f.reject[room]; ok {
+				if reply.Rejected == nil {
+					reply.Rejected = make(map[string]string)
+				}
+				reply.Rejected[room] = why
+				reply.Control = base.ControlNack
+				continue
+			}
+			f.subs[room] = s.Filter
+		}
+	default:
+		for _, room := range s.Rooms {
+			delete(f.subs, room)
+		}
+	}
+
+	return reply, len(s.RequestID) > 0 && !f.silent && !f.legacy
+}
+
+func (f *fakeHub) subscriptions() map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	toReturn := make(map[string]string, len(f.subs))
+	for k, v := range f.subs {
+		toReturn[k] = v
+	}
+	return toReturn
+}
+
+//waitFor waits for the hub's subscriptions to be want
+func (f *fakeHub) waitFor(t *testing.T, want map[string]string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !reflect.DeepEqual(f.subscriptions(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the hub has %v, want %v", f.subscriptions(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestMessenger(t *testing.T, f *fakeHub) *Messenger {
+	m, err := BuildMessengerWithCredentials("ws://"+f.Listener.Addr().String(), "messenger", 10, nil)
+	if err != nil {
+		t.Fatalf("couldn't build the messenger: %v", err.Error())
+	}
+	t.Cleanup(m.Kill)
+	return m
+}
+
+func subList(m *Messenger) []string {
+	toReturn := m.getSubList()
+	sort.Strings(toReturn)
+	return toReturn
+}
+
+func TestSubscribeAck(t *testing.T) {
+	f := newFakeHub(t, false)
+	m := newTestMessenger(t, f)
+
+	if err := m.SubscribeToRoomsWithFilter(`key == "power"`, "ITB-1101", "ITB-*"); err != nil {
+		t.Fatalf("couldn't subscribe: %v", err.Error())
+	}
+	//the answer comes after the hub has applied the change
+	if got, want := f.subscriptions(), map[string]string{"ITB-1101": `key == "power"`, "ITB-*": `key == "power"`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the hub has %v, want %v", got, want)
+	}
+
+	if err := m.UnsubscribeFromRooms("ITB-*"); err != nil {
+		t.Fatalf("couldn't unsubscribe: %v", err.Error())
+	}
+	if got, want := f.subscriptions(), map[string]string{"ITB-1101": `key == "power"`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("the hub has %v, want %v", got, want)
+	}
+	if got := subList(m); !reflect.DeepEqual(got, []string{"ITB-1101"}) {
+		t.Fatalf("the messenger has %v", got)
+	}
+
+	subs, err := m.HubSubscriptions()
+	if err != nil {
+		t.Fatalf("couldn't query the subscriptions: %v", err.Error())
+	}
+	if want := []base.Subscription{{Room: "ITB-1101", Filter: `key == "power"`}}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("got subscriptions %+v, want %+v", subs, want)
+	}
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	f := newFakeHub(t, false)
+	f.reject["ITB*1101"] = "'*' is only allowed at the end"
+	m := newTestMessenger(t, f)
+
+	err := m.SubscribeToRooms("ITB-1101", "ITB*1101")
+	if err == nil || err.Type != base.ControlNack {
+		t.Fatalf("got error %v, want a nack", err)
+	}
+
+	//the rejected room is taken back out of the list, the other one stays
+	if got := subList(m); !reflect.DeepEqual(got, []string{"ITB-1101"}) {
+		t.Fatalf("the messenger has %v, want just the room the hub accepted", got)
+	}
+}
+
+func TestSubscribeTimeout(t *testing.T) {
+	f := newFakeHub(t, false)
+	f.silent = true
+	m := newTestMessenger(t, f)
+	m.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := m.SubscribeToRooms("ITB-1101")
+	if err == nil || err.Type != "timeout" {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited < m.timeout {
+		t.Fatalf("only waited %v", waited)
+	}
+
+	//the room is kept, so the next reconcile subscribes to it
+	if got := subList(m); !reflect.DeepEqual(got, []string{"ITB-1101"}) {
+		t.Fatalf("the messenger has %v, want the room kept", got)
+	}
+}
+
+//TestReconcile gives the hub subscriptions that don't match the messenger's, and checks reconciling fixes them
+func TestReconcile(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		f := newFakeHub(t, legacy)
+		m := newTestMessenger(t, f)
+
+		if err := m.SubscribeToRooms("ITB-1101"); err != nil {
+			t.Fatalf("couldn't subscribe: %v", err.Error())
+		}
+		if err := m.SubscribeToRoomsWithFilter(`key == "power"`, "ITB-1102"); err != nil {
+			t.Fatalf("couldn't subscribe: %v", err.Error())
+		}
+		want := map[string]string{"ITB-1101": "", "ITB-1102": `key == "power"`}
+		f.waitFor(t, want)
+
+		//the hub lost a room, has another with the wrong filter, and has one the messenger doesn't want
+		f.lock.Lock()
+		f.subs = map[string]string{"ITB-1102": "", "ITB-1103": ""}
+		f.lock.Unlock()
+
+		if err := m.Reconcile(); err != nil {
+			t.Fatalf("couldn't reconcile: %v", err.Error())
+		}
+		if !legacy {
+			f.waitFor(t, want)
+			continue
+		}
+
+		//a legacy hub can't be asked what it has, so the rooms are subscribed to again, and nothing is unsubscribed
+		want["ITB-1103"] = ""
+		f.waitFor(t, want)
+	}
+}
+
+//TestReconcileAfterReconnect drops the messenger's connection, and checks it subscribes to its rooms again on the new one
+func TestReconcileAfterReconnect(t *testing.T) {
+	f := newFakeHub(t, false)
+	m := newTestMessenger(t, f)
+
+	if err := m.SubscribeToRoomsWithFilter(`key == "power"`, "ITB-1101", "ITB-1102"); err != nil {
+		t.Fatalf("couldn't subscribe: %v", err.Error())
+	}
+
+	//a new connection is a new registration on the hub, so it starts without any rooms
+	f.lock.Lock()
+	f.subs = make(map[string]string)
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.lock.Unlock()
+
+	f.waitFor(t, map[string]string{"ITB-1101": `key == "power"`, "ITB-1102": `key == "power"`})
+}
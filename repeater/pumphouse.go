@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/byuoitav/central-event-system/hub/auth"
 	"github.com/byuoitav/central-event-system/hub/base"
 	"github.com/byuoitav/common/db"
 	"github.com/byuoitav/common/log"
@@ -45,6 +48,9 @@ type PumpingStation struct {
 	remoteaddr string
 	starttime  time.Time
 
+	//peer is the subject of the other repeater's verified certificate, if the connection is over TLS
+	peer string
+
 	//internal channels
 	readChannel  chan base.EventWrapper
 	writeChannel chan base.EventWrapper
@@ -64,6 +70,9 @@ type PumpingStation struct {
 	ReceiveChannel chan base.EventWrapper
 	SendChannel    chan base.EventWrapper
 
+	//frameVersion is the frame version we write to the peer, accessed atomically
+	frameVersion int32
+
 	dbDevConn bool
 	tick      bool //if we initialized the connection or not. Only those who initialize start a ticker
 
@@ -88,6 +97,10 @@ type PumpingStationStatus struct {
 
 	ReadTimeout  time.Time `json:"read-timeout"`
 	WriteTimeout time.Time `json:"write-timeout"`
+
+	FrameVersion int `json:"frame-version"`
+
+	Peer string `json:"peer,omitempty"`
 }
 
 //GetStatus .
@@ -105,6 +118,8 @@ func (c *PumpingStation) GetStatus() PumpingStationStatus {
 		WriteBufferPrivateUtil: len(c.writeChannel),
 		ReadTimeout:            c.readTimeout,
 		WriteTimeout:           c.writeTimeout,
+		FrameVersion:           int(atomic.LoadInt32(&c.frameVersion)),
+		Peer:                   c.peer,
 	}
 }
 
@@ -135,7 +150,7 @@ func StartConnection(proc, room string, r *Repeater, dbDevConn bool) (*PumpingSt
 	return toreturn, nil
 }
 
-func buildFromConnection(proc, room string, r *Repeater, conn *websocket.Conn) (*PumpingStation, *nerr.E) {
+func buildFromConnection(proc, room, peer string, r *Repeater, conn *websocket.Conn, frameVersion int) (*PumpingStation, *nerr.E) {
 
 	toreturn := &PumpingStation{
 		readChannel:    make(chan base.EventWrapper, readBufferSize),
@@ -153,6 +168,8 @@ func buildFromConnection(proc, room string, r *Repeater, conn *websocket.Conn) (
 		r:              r,
 		conn:           conn,
 		remoteaddr:     conn.RemoteAddr().String(),
+		peer:           peer,
+		frameVersion:   int32(frameVersion),
 		tick:           false,
 		starttime:      time.Now(),
 	}
@@ -175,7 +192,7 @@ func (c *PumpingStation) start() {
 			c.r.UnregisterConnection(c.ID)
 			return
 		}
-		addr = "ws://" + dev.Address
+		addr = c.r.certs.Scheme() + dev.Address
 	} else {
 		addr = c.ID
 	}
@@ -215,16 +232,25 @@ func (c *PumpingStation) openConn(addr string) *nerr.E {
 	dialer := &websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
 	}
+	if c.r.certs != nil {
+		dialer.TLSClientConfig = c.r.certs.ClientConfig()
+	}
 	fulladdr := fmt.Sprintf("%s/connect/%s/%s", addr, c.Room, c.r.RepeaterID)
 	log.L.Debugf("Connecting to: %v", fulladdr)
 
-	conn, _, err := dialer.Dial(fulladdr, nil)
+	conn, resp, err := dialer.Dial(fulladdr, base.FrameVersionHeaders())
 	if err != nil {
 		return nerr.Create(fmt.Sprintf("failed opening websocket with %v: %s", addr, err), "connection-error")
 	}
 	log.L.Debugf("Connection started with %v", addr)
 
 	c.conn = conn
+	atomic.StoreInt32(&c.frameVersion, int32(base.NegotiateFrameVersion(resp.Header)))
+
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		c.peer, _ = auth.ConnectionSubject(&state)
+	}
 	return nil
 }
 
@@ -258,6 +284,10 @@ func (c *PumpingStation) startReadPump() {
 		if er != nil {
 			log.L.Errorf("Couldn't parse message %s.", er)
 		}
+
+		if msg.Header.Version > int(atomic.LoadInt32(&c.frameVersion)) {
+			atomic.StoreInt32(&c.frameVersion, int32(msg.Header.Version))
+		}
 		c.readChannel <- msg
 	}
 }
@@ -274,7 +304,7 @@ func (c *PumpingStation) startWritePump() {
 		case msg = <-c.writeChannel:
 			c.conn.SetWriteDeadline(time.Now().Add(WriteWait))
 			//in the case of the write channel we just write it down the socket
-			err := c.conn.WriteMessage(websocket.BinaryMessage, base.PrepareMessage(msg))
+			err := c.conn.WriteMessage(websocket.BinaryMessage, base.EncodeMessage(msg, int(atomic.LoadInt32(&c.frameVersion))))
 			if err != nil {
 				log.L.Debugf("[%v} Problem writing message: %v", c.ID, err.Error())
 				c.errorChan <- err
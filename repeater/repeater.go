@@ -8,7 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/byuoitav/central-event-system/hub/auth"
 	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/certs"
 	"github.com/byuoitav/central-event-system/messenger"
 	"github.com/byuoitav/central-event-system/repeater/httpbuffer"
 	"github.com/byuoitav/common/log"
@@ -33,6 +35,9 @@ type Repeater struct {
 
 	HubSendBuffer chan base.EventWrapper
 	RepeaterID    string
+
+	//certs has the certificates for wss:// connections to other repeaters, nil connects with ws://
+	certs *certs.Store
 }
 
 var (
@@ -68,7 +73,7 @@ func init() {
 }
 
 // GetRepeater .
-func GetRepeater(s map[string][]string, m *messenger.Messenger, id string) *Repeater {
+func GetRepeater(s map[string][]string, m *messenger.Messenger, id string, certStore *certs.Store) *Repeater {
 	v := &Repeater{
 		sendMap:        s,
 		HubSendBuffer:  make(chan base.EventWrapper, 1000),
@@ -77,6 +82,7 @@ func GetRepeater(s map[string][]string, m *messenger.Messenger, id string) *Repe
 		connections:    make(map[string]*PumpingStation),
 		messenger:      m,
 		RepeaterID:     id,
+		certs:          certStore,
 		httpBuffer:     httpbuffer.New(2*time.Second, 1000),
 	}
 
@@ -193,12 +199,17 @@ func (r *Repeater) handleConnection(context echo.Context) error {
 	id := context.Param("id")
 	room := context.Param("room")
 
-	conn, err := upgrader.Upgrade(context.Response().Writer, context.Request(), nil)
+	conn, err := upgrader.Upgrade(context.Response().Writer, context.Request(), base.FrameVersionHeaders())
 	if err != nil {
 		log.L.Errorf("Couldn't upgrade	Connection to a websocket: %v", err.Error())
 		return err
 	}
-	p, er := buildFromConnection(id, room, r, conn)
+	peer, _ := auth.PeerSubject(context.Request())
+	if len(peer) > 0 {
+		log.L.Infof("Repeater %v connected with the certificate for %v", id, peer)
+	}
+
+	p, er := buildFromConnection(id, room, peer, r, conn, base.NegotiateFrameVersion(context.Request().Header))
 	if er != nil {
 		return context.JSON(http.StatusBadRequest, er.Error())
 	}
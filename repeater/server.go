@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/byuoitav/central-event-system/hub/base"
+	"github.com/byuoitav/central-event-system/hub/certs"
 	"github.com/byuoitav/central-event-system/messenger"
 	"github.com/byuoitav/common"
 	"github.com/byuoitav/common/log"
@@ -21,8 +22,13 @@ func main() {
 		}
 	}
 
+	certStore, err := certs.FromEnv()
+	if err != nil {
+		log.L.Fatalf("Invalid TLS configuration: %v", err.Error())
+	}
+
 	//do we want some sort of config here?
-	r := GetRepeater(SendMap, m, os.Getenv("SYSTEM_ID"))
+	r := GetRepeater(SendMap, m, os.Getenv("SYSTEM_ID"), certStore)
 
 	router := common.NewRouter()
 
@@ -30,5 +36,5 @@ func main() {
 	router.GET("/connect/:room/:id", r.handleConnection)
 	router.POST("send", r.fireEvent)
 
-	router.Start(port)
+	certs.Start(router, port, certStore)
 }